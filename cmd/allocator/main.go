@@ -16,9 +16,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"purelb.io/internal/allocator"
 	"purelb.io/internal/k8s"
@@ -29,8 +32,19 @@ func main() {
 	logger := logging.Init()
 
 	var (
-		port       = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
-		kubeconfig = flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "absolute path to the kubeconfig file (only needed when running outside of k8s)")
+		port          = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
+		kubeconfig    = flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "absolute path to the kubeconfig file (only needed when running outside of k8s)")
+		ledger        = flag.String("ledger", "", "name of the ConfigMap in which to record address allocations (if empty then allocations aren't recorded)")
+		namespace     = flag.String("namespace", os.Getenv("PURELB_NAMESPACE"), "namespace of the ledger ConfigMap, the leader election Lease, and the Secrets that hold Netbox credentials")
+		leaderElect   = flag.Bool("leader-elect", false, "run as one of several replicas, only one of which (the leader) allocates addresses")
+		leaseName     = flag.String("lease-name", "purelb-allocator", "name of the Lease that replicas use to elect a leader")
+		leaseDuration = flag.Duration("lease-duration", 15*time.Second, "how long standbys wait before they take over from a leader that stops renewing its lease")
+		renewDeadline = flag.Duration("renew-deadline", 10*time.Second, "how long the leader keeps trying to renew its lease before it gives up leadership")
+		retryPeriod   = flag.Duration("retry-period", 2*time.Second, "how long replicas wait between attempts to acquire or renew the lease")
+		webhookPort   = flag.Int("webhook-port", 9443, "HTTPS listening port for the validating admission webhook")
+		webhookCert   = flag.String("webhook-cert", "", "path to the webhook's TLS certificate (if empty then the webhook is disabled)")
+		webhookKey    = flag.String("webhook-key", "", "path to the webhook's TLS private key")
+		ipamCheck     = flag.Duration("ipam-reconcile-interval", 10*time.Minute, "how often the replicas refresh the networks of their Netbox and webhook pools, and the leader checks the pools for orphaned addresses, in addition to when they start (0 disables the periodic refreshes and checks)")
 	)
 	flag.Parse()
 
@@ -46,13 +60,17 @@ func main() {
 	defer logger.Log("op", "shutdown", "msg", "done")
 
 	// Set up controller
-	c, _ := allocator.NewController(logger, allocator.New(logger))
+	alloc := allocator.New(logger)
+	c, _ := allocator.NewController(logger, alloc)
 
 	client, err := k8s.New(&k8s.Config{
 		ProcessName: "purelb-allocator",
 		Logger:      logger,
 		Kubeconfig:  *kubeconfig,
 
+		ReadSecrets:     true,
+		SecretNamespace: *namespace,
+
 		ServiceChanged: c.SetBalancer,
 		ServiceDeleted: c.DeleteBalancer,
 		ConfigChanged:  c.SetConfig,
@@ -66,6 +84,54 @@ func main() {
 
 	c.SetClient(client)
 
+	if *ledger != "" {
+		if err := alloc.SetLedger(allocator.NewConfigMapLedger(logger, client.Clientset(), *namespace, *ledger)); err != nil {
+			logger.Log("op", "startup", "error", err, "msg", "failed to load allocation ledger")
+			os.Exit(1)
+		}
+	}
+
+	if *leaderElect {
+		identity, err := os.Hostname()
+		if err != nil {
+			logger.Log("op", "startup", "error", err, "msg", "failed to get hostname for leader election identity")
+			os.Exit(1)
+		}
+
+		// We're a standby until we win the election
+		c.SetLeader(false)
+		go func() {
+			if err := client.RunLeaderElection(k8s.LeaderConfig{
+				Namespace:      *namespace,
+				Name:           *leaseName,
+				Identity:       identity,
+				LeaseDuration:  *leaseDuration,
+				RenewDeadline:  *renewDeadline,
+				RetryPeriod:    *retryPeriod,
+				StartedLeading: func() { c.SetLeader(true) },
+				StoppedLeading: func() { c.SetLeader(false) },
+			}, stopCh); err != nil {
+				logger.Log("op", "leaderElection", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if *webhookCert != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/validate", allocator.NewWebhook(logger, client.ServiceGroups, c.ValidateService))
+		go func() {
+			if err := http.ListenAndServeTLS(fmt.Sprintf(":%d", *webhookPort), *webhookCert, *webhookKey, mux); err != nil {
+				logger.Log("op", "webhook", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if *ipamCheck > 0 {
+		go c.ReconcileIPAMEvery(*ipamCheck, stopCh)
+	}
+
 	go k8s.RunMetrics("", *port)
 
 	// the k8s client doesn't return until it's time to shut down
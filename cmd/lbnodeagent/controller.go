@@ -16,6 +16,11 @@
 package main
 
 import (
+	"reflect"
+	"sync"
+	"time"
+
+	"purelb.io/internal/bgp"
 	"purelb.io/internal/election"
 	"purelb.io/internal/k8s"
 	"purelb.io/internal/lbnodeagent"
@@ -24,6 +29,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type controller struct {
@@ -31,6 +37,14 @@ type controller struct {
 	logger     log.Logger
 	myNode     string
 	announcers []lbnodeagent.Announcer
+
+	// agent is the LBNodeAgent to which we report our status, and
+	// reported is the status that we most recently reported. lock
+	// protects them since the status reporter runs in its own
+	// goroutine.
+	agent    *purelbv1.LBNodeAgent
+	reported *purelbv1.LBNodeAgentNodeStatus
+	lock     sync.Mutex
 }
 
 // NewController configures a new controller. If error is non-nil then
@@ -41,6 +55,7 @@ func NewController(l log.Logger, myNode string) (*controller, error) {
 		myNode: myNode,
 		announcers: []lbnodeagent.Announcer{
 			local.NewAnnouncer(l, myNode),
+			bgp.NewAnnouncer(l, myNode, local.IsLocal),
 		},
 	}
 
@@ -129,6 +144,15 @@ func (c *controller) DeleteBalancer(nsName string) k8s.SyncState {
 func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 	retval := k8s.SyncStateReprocessAll
 
+	// Report our status to the first agent config, which is the one
+	// that the announcers use
+	c.lock.Lock()
+	c.agent = nil
+	if len(cfg.Agents) > 0 {
+		c.agent = cfg.Agents[0]
+	}
+	c.lock.Unlock()
+
 	for _, announcer := range c.announcers {
 		if err := announcer.SetConfig(cfg); err != nil {
 			c.logger.Log("op", "setConfig", "error", err)
@@ -149,4 +173,62 @@ func (c *controller) Shutdown() {
 	for _, announcer := range c.announcers {
 		announcer.Shutdown()
 	}
+
+	// Remove our entry from the LBNodeAgent status since we're not
+	// announcing anything anymore
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.agent != nil && c.reported != nil {
+		if err := c.client.UpdateAgentNodeStatus(c.agent, nil); err != nil {
+			c.logger.Log("op", "reportStatus", "error", err)
+		}
+	}
+}
+
+// RunStatusReporter reports this node's status to the LBNodeAgent
+// every interval. It writes only if the status has changed since the
+// last time it was written. It returns when stopCh is closed.
+func (c *controller) RunStatusReporter(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.reportStatus()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// reportStatus asks each announcer for its view of this node and
+// writes the result to the LBNodeAgent if it has changed.
+func (c *controller) reportStatus() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.agent == nil || c.client == nil {
+		return
+	}
+
+	status := purelbv1.LBNodeAgentNodeStatus{Node: c.myNode}
+	for _, announcer := range c.announcers {
+		announcer.ReportStatus(&status)
+	}
+
+	// Ignore the timestamp when deciding whether anything changed
+	if c.reported != nil {
+		status.LastUpdateTime = c.reported.LastUpdateTime
+		if reflect.DeepEqual(status, *c.reported) {
+			return
+		}
+	}
+
+	status.LastUpdateTime = metav1.Now()
+	if err := c.client.UpdateAgentNodeStatus(c.agent, &status); err != nil {
+		c.logger.Log("op", "reportStatus", "error", err)
+		return
+	}
+	c.reported = &status
 }
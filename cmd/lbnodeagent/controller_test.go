@@ -0,0 +1,87 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"purelb.io/internal/election"
+	"purelb.io/internal/k8s"
+	"purelb.io/internal/lbnodeagent"
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// testAnnouncer reports a fixed set of announcements.
+type testAnnouncer struct {
+	announcements []purelbv1.LBNodeAgentAnnouncement
+}
+
+func (a *testAnnouncer) SetConfig(*purelbv1.Config) error             { return nil }
+func (a *testAnnouncer) SetClient(*k8s.Client)                        {}
+func (a *testAnnouncer) SetBalancer(*v1.Service, *v1.Endpoints) error { return nil }
+func (a *testAnnouncer) DeleteBalancer(string, string, net.IP) error  { return nil }
+func (a *testAnnouncer) SetElection(*election.Election)               {}
+func (a *testAnnouncer) Shutdown()                                    {}
+func (a *testAnnouncer) ReportStatus(s *purelbv1.LBNodeAgentNodeStatus) {
+	s.Announcements = append(s.Announcements, a.announcements...)
+}
+
+// testK8S records the statuses that the controller writes.
+type testK8S struct {
+	written []*purelbv1.LBNodeAgentNodeStatus
+}
+
+func (s *testK8S) Infof(runtime.Object, string, string, ...interface{})  {}
+func (s *testK8S) Errorf(runtime.Object, string, string, ...interface{}) {}
+func (s *testK8S) ForceSync()                                            {}
+func (s *testK8S) UpdateGroupStatus(*purelbv1.ServiceGroup) error        { return nil }
+func (s *testK8S) UpdateAgentNodeStatus(agent *purelbv1.LBNodeAgent, status *purelbv1.LBNodeAgentNodeStatus) error {
+	s.written = append(s.written, status)
+	return nil
+}
+
+func TestReportStatus(t *testing.T) {
+	local := &testAnnouncer{announcements: []purelbv1.LBNodeAgentAnnouncement{{Address: "192.0.2.10", Services: []string{"ns/a"}}}}
+	bgp := &testAnnouncer{announcements: []purelbv1.LBNodeAgentAnnouncement{{Address: "198.51.100.10", Services: []string{"ns/b"}}}}
+	client := &testK8S{}
+	c := &controller{logger: log.NewNopLogger(), myNode: "test-node", announcers: []lbnodeagent.Announcer{local, bgp}, client: client}
+
+	// Nothing to report to until we've been configured
+	c.reportStatus()
+	assert.Empty(t, client.written)
+
+	c.agent = &purelbv1.LBNodeAgent{}
+	c.reportStatus()
+	assert.Equal(t, 1, len(client.written))
+	assert.Equal(t, "test-node", client.written[0].Node)
+	assert.Equal(t, append(local.announcements, bgp.announcements...), client.written[0].Announcements, "every announcer reports")
+
+	// Nothing has changed so we don't write
+	c.reportStatus()
+	assert.Equal(t, 1, len(client.written))
+
+	// Removing the last service means an empty report
+	local.announcements = nil
+	bgp.announcements = nil
+	c.reportStatus()
+	assert.Equal(t, 2, len(client.written))
+	assert.Empty(t, client.written[1].Announcements)
+}
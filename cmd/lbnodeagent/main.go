@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"purelb.io/internal/election"
 	"purelb.io/internal/k8s"
@@ -30,12 +31,14 @@ func main() {
 	logger := logging.Init()
 
 	var (
-		memberlistNS     = flag.String("memberlist-ns", os.Getenv("PURELB_ML_NAMESPACE"), "memberlist namespace (only needed when running outside of k8s)")
-		memberlistLabels = flag.String("memberlist-labels", os.Getenv("PURELB_ML_LABELS"), "Labels to match the lbnodeagent pods (for MemberList / fast dead node detection)")
-		kubeconfig       = flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "absolute path to the kubeconfig file (only needed when running outside of k8s)")
-		host             = flag.String("host", os.Getenv("PURELB_HOST"), "HTTP host address for Prometheus metrics")
-		myNode           = flag.String("node-name", os.Getenv("PURELB_NODE_NAME"), "name of this Kubernetes node (spec.nodeName)")
-		port             = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
+		memberlistNS      = flag.String("memberlist-ns", os.Getenv("PURELB_ML_NAMESPACE"), "memberlist namespace (only needed when running outside of k8s)")
+		memberlistLabels  = flag.String("memberlist-labels", os.Getenv("PURELB_ML_LABELS"), "Labels to match the lbnodeagent pods (for MemberList / fast dead node detection)")
+		memberlistKeyring = flag.String("memberlist-keyring", os.Getenv("PURELB_ML_KEYRING"), "name of the Secret in the memberlist namespace that holds the memberlist keyring (overrides ML_GROUP)")
+		kubeconfig        = flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "absolute path to the kubeconfig file (only needed when running outside of k8s)")
+		host              = flag.String("host", os.Getenv("PURELB_HOST"), "HTTP host address for Prometheus metrics")
+		myNode            = flag.String("node-name", os.Getenv("PURELB_NODE_NAME"), "name of this Kubernetes node (spec.nodeName)")
+		port              = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
+		statusInterval    = flag.Duration("status-interval", 10*time.Second, "how often to report this node's status to the LBNodeAgent resource")
 	)
 	flag.Parse()
 
@@ -72,6 +75,9 @@ func main() {
 		Kubeconfig:    *kubeconfig,
 		ReadEndpoints: true,
 
+		MemberNamespace: *memberlistNS,
+		MemberLabels:    *memberlistLabels,
+
 		ServiceChanged: ctrl.ServiceChanged,
 		ServiceDeleted: ctrl.DeleteBalancer,
 		ConfigChanged:  ctrl.SetConfig,
@@ -85,15 +91,16 @@ func main() {
 	ctrl.SetClient(client)
 
 	election, err := election.New(&election.Config{
-		Namespace: *memberlistNS,
-		Labels:    *memberlistLabels,
-		NodeName:  *myNode,
-		BindAddr:  os.Getenv("PURELB_HOST"),
-		BindPort:  7934,
-		Secret:    []byte(os.Getenv("ML_GROUP")),
-		Logger:    &logger,
-		StopCh:    stopCh,
-		Client:    client,
+		NodeName: *myNode,
+		BindAddr: os.Getenv("PURELB_HOST"),
+		BindPort: 7934,
+		Secret:   []byte(os.Getenv("ML_GROUP")),
+		Logger:   &logger,
+		StopCh:   stopCh,
+		Client:   client,
+
+		KeyringNamespace: *memberlistNS,
+		KeyringSecret:    *memberlistKeyring,
 	})
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to create election client")
@@ -115,6 +122,8 @@ func main() {
 
 	go k8s.RunMetrics(*host, *port)
 
+	go ctrl.RunStatusReporter(*statusInterval, stopCh)
+
 	// the k8s client doesn't return until it's time to shut down
 	if err := client.Run(stopCh); err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to run k8s client")
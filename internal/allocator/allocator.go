@@ -17,11 +17,18 @@ package allocator
 import (
 	"fmt"
 	"net"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/vishvananda/netlink/nl"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"purelb.io/internal/k8s"
+	"purelb.io/internal/local"
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
@@ -34,13 +41,59 @@ type Allocator struct {
 	client k8s.ServiceEvent
 	logger log.Logger
 	pools  map[string]Pool
+
+	// groups holds our copies of the ServiceGroups from the most recent
+	// call to SetPools, keyed by namespaced name. Each copy's Status is
+	// the most recent status that we wrote to the cluster, so we can
+	// avoid writing updates that don't change anything.
+	groups map[string]*purelbv1.ServiceGroup
+
+	// poolGroups maps each pool name to the namespaced name of the
+	// ServiceGroup that defined it.
+	poolGroups map[string]string
+
+	// parsed holds the result of parsing each ServiceGroup, keyed by
+	// namespaced name.
+	parsed map[string]metav1.Condition
+
+	// ledger is the durable record of our assignments. It's nil if the
+	// user didn't configure one.
+	ledger Ledger
+
+	// ledgerEntries is our copy of the ledger's contents, keyed by
+	// service namespaced name. We replay it into new pools so they know
+	// about our assignments before the services sync, and we use it to
+	// avoid rewriting entries that haven't changed.
+	ledgerEntries map[string]LedgerEntry
+
+	// standby is true if another replica is the leader. Standbys keep
+	// their pools up to date but don't write anything to the cluster.
+	standby bool
+
+	// secrets holds the Secrets that the ServiceGroups reference,
+	// keyed by namespaced name.
+	secrets map[string]*v1.Secret
+
+	// ipamOrphans records when ReconcileIPAM first saw each orphaned
+	// IPAM address, keyed by pool name and address. It outlives the
+	// pools, which SetPools rebuilds.
+	ipamOrphans map[string]time.Time
+
+	// releases returns our IPAM pools' addresses to their backends in
+	// the background. It outlives the pools so releases that are still
+	// queued when SetPools rebuilds them still block re-claims.
+	releases *ipamReleases
 }
 
 // New returns an Allocator managing no pools.
 func New(log log.Logger) *Allocator {
 	return &Allocator{
-		logger: log,
-		pools:  map[string]Pool{},
+		logger:     log,
+		pools:      map[string]Pool{},
+		groups:     map[string]*purelbv1.ServiceGroup{},
+		poolGroups: map[string]string{},
+		parsed:     map[string]metav1.Condition{},
+		releases:   newIPAMReleases(),
 	}
 }
 
@@ -49,15 +102,85 @@ func (a *Allocator) SetClient(client k8s.ServiceEvent) {
 	a.client = client
 }
 
+// SetLedger loads the contents of ledger and replays them into our
+// pools, and then keeps ledger in sync with our assignments.
+func (a *Allocator) SetLedger(ledger Ledger) error {
+	entries, err := ledger.Load()
+	if err != nil {
+		return err
+	}
+
+	a.ledger = ledger
+	a.ledgerEntries = entries
+	a.replayLedger()
+
+	return nil
+}
+
+// SetStandby tells the allocator whether it's a standby. When a
+// standby becomes the leader it reloads the ledger, which the old
+// leader might have changed, and reports the status of its groups.
+func (a *Allocator) SetStandby(standby bool) {
+	wasStandby := a.standby
+	a.standby = standby
+	if standby || !wasStandby {
+		return
+	}
+
+	if a.ledger != nil {
+		if entries, err := a.ledger.Load(); err != nil {
+			a.logger.Log("op", "reloadLedger", "error", err)
+		} else {
+			a.ledgerEntries = entries
+			a.replayLedger()
+		}
+	}
+
+	for _, group := range a.groups {
+		a.updateGroupStatus(group)
+	}
+}
+
+// SetSecrets updates the set of Secrets that the ServiceGroups
+// reference. The pools that use them pick them up when SetPools
+// rebuilds the pools.
+func (a *Allocator) SetSecrets(secrets []*v1.Secret) {
+	a.secrets = map[string]*v1.Secret{}
+	for _, secret := range secrets {
+		a.secrets[secret.Namespace+"/"+secret.Name] = secret
+	}
+}
+
 // SetPools updates the set of address pools that the allocator owns.
 func (a *Allocator) SetPools(groups []*purelbv1.ServiceGroup) error {
-	pools := a.parseGroups(groups)
+	a.parsed = map[string]metav1.Condition{}
+	pools, poolGroups := a.parseGroups(groups)
 
-	// If we have groups but they're all bogus then let the user know.
+	// If we have groups but they're all bogus then let the user know,
+	// in each group's status too. We keep the pools that we have.
 	if len(groups) > 0 && len(pools) == 0 {
+		a.reportGroups(groups)
 		return fmt.Errorf("No valid pools found")
 	}
 
+	// Carry the local pools' release history forward so the new pools
+	// honor the old pools' cooldowns, and have the IPAM pools release
+	// addresses in the background. We're called with the controller's
+	// lock held so the IPAM pools ask their backends for their networks
+	// in the background too.
+	for n, p := range pools {
+		if newPool, isLocal := p.(LocalPool); isLocal {
+			if oldPool, wasLocal := a.pools[n].(LocalPool); wasLocal {
+				newPool.inheritReleases(oldPool)
+			}
+		}
+		if ipamPool, isIPAM := p.(IPAMPool); isIPAM {
+			ipamPool.releases = a.releases
+			pools[n] = ipamPool
+			go ipamPool.RefreshNetworks()
+		}
+	}
+
 	for n := range a.pools {
 		if pools[n] == nil {
 			poolCapacity.DeleteLabelValues(n)
@@ -66,6 +189,11 @@ func (a *Allocator) SetPools(groups []*purelbv1.ServiceGroup) error {
 	}
 
 	a.pools = pools
+	a.poolGroups = poolGroups
+
+	// Tell the new pools about the assignments that we've recorded in
+	// the ledger
+	a.replayLedger()
 
 	// Refresh or initiate stats
 	for n, p := range a.pools {
@@ -73,9 +201,31 @@ func (a *Allocator) SetPools(groups []*purelbv1.ServiceGroup) error {
 		poolActive.WithLabelValues(n).Set(float64(p.InUse()))
 	}
 
+	a.reportGroups(groups)
+
 	return nil
 }
 
+// reportGroups remembers groups so we can report their status, and
+// then reports it.
+func (a *Allocator) reportGroups(groups []*purelbv1.ServiceGroup) {
+	oldGroups := a.groups
+	a.groups = map[string]*purelbv1.ServiceGroup{}
+	for _, group := range groups {
+		ours := group.DeepCopy()
+
+		// If we've already written this group's status then start from
+		// that instead of the informer's copy which might not have caught
+		// up yet
+		if old, known := oldGroups[groupName(group)]; known && old.Generation == group.Generation {
+			old.Status.DeepCopyInto(&ours.Status)
+		}
+
+		a.groups[groupName(group)] = ours
+		a.updateGroupStatus(ours)
+	}
+}
+
 // updateStats unconditionally updates internal state to reflect svc's
 // allocation of alloc. Caller must ensure that this call is safe.
 func (a *Allocator) updateStats(service *v1.Service, poolName string) error {
@@ -83,9 +233,55 @@ func (a *Allocator) updateStats(service *v1.Service, poolName string) error {
 	poolCapacity.WithLabelValues(poolName).Set(float64(pool.Size()))
 	poolActive.WithLabelValues(poolName).Set(float64(pool.InUse()))
 
+	if group, known := a.groups[a.poolGroups[poolName]]; known {
+		a.updateGroupStatus(group)
+	}
+
 	return nil
 }
 
+// updateGroupStatus writes group's status to the cluster if it has
+// changed since the last time we wrote it. group must be one of our
+// copies, i.e., from a.groups, since we update it to cache the status
+// that we wrote.
+func (a *Allocator) updateGroupStatus(group *purelbv1.ServiceGroup) {
+	// The leader reports status, not the standbys
+	if a.standby {
+		return
+	}
+
+	name := groupName(group)
+	status := purelbv1.ServiceGroupStatus{}
+
+	// If the group defined a pool then the pool can tell us how it's
+	// being used
+	if a.poolGroups[group.Name] == name {
+		if pool, havePool := a.pools[group.Name]; havePool {
+			status = pool.Status()
+		}
+	}
+
+	// Start with the conditions that we wrote last time so
+	// SetStatusCondition can tell whether a condition has transitioned
+	status.Conditions = group.Status.Conditions
+	if cond, parsed := a.parsed[name]; parsed {
+		cond.ObservedGeneration = group.Generation
+		meta.SetStatusCondition(&status.Conditions, cond)
+	}
+
+	if reflect.DeepEqual(status, group.Status) {
+		return
+	}
+
+	group.Status = status
+	if err := a.client.UpdateGroupStatus(group); err != nil {
+		a.logger.Log("op", "updateGroupStatus", "service-group", name, "error", err)
+
+		// Forget what we wrote so we'll try again next time
+		group.Status = purelbv1.ServiceGroupStatus{Conditions: status.Conditions}
+	}
+}
+
 // NotifyExisting notifies the allocator of an existing IP assignment,
 // for example, at startup time.
 func (a *Allocator) NotifyExisting(svc *v1.Service) error {
@@ -99,16 +295,35 @@ func (a *Allocator) NotifyExisting(svc *v1.Service) error {
 	if pool, havePool := a.pools[poolName]; !havePool {
 		return nil
 	} else {
+		// If the ledger disagrees with the service then the service
+		// wins, but first we need to release whatever the ledger told
+		// the pool about
+		nsName := namespacedName(svc)
+		if entry, recorded := a.ledgerEntries[nsName]; recorded {
+			if current := newLedgerEntry(svc, poolName); entry.Pool != current.Pool || !reflect.DeepEqual(entry.Addresses, current.Addresses) {
+				a.logger.Log("op", "notifyExisting", "service", nsName, "msg", "service differs from ledger", "ledger", fmt.Sprint(entry.Addresses), "service-addresses", fmt.Sprint(current.Addresses))
+				if !a.standby {
+					a.client.Errorf(svc, "LedgerDrift", "Ledger recorded %v from pool %s but service has %v from pool %s, updating ledger", entry.Addresses, entry.Pool, current.Addresses, current.Pool)
+				}
+				if recordedPool, known := a.pools[entry.Pool]; known {
+					a.release(recordedPool, nsName)
+				}
+			}
+		}
+
 		if err := pool.Notify(svc); err != nil {
 			return err
 		}
+		a.record(svc, poolName)
 		return a.updateStats(svc, poolName)
 	}
 }
 
 // AllocateAnyIP allocates an IP address for svc based on svc's
-// annotations and current configuration. If the user asks for a
-// specific IP then we'll attempt to use that, and if not we'll use
+// annotations and current configuration. If the user asks for
+// specific IPs, either in the purelbv1.AddressesAnnotation annotation
+// or in spec.loadBalancerIP, then we'll attempt to use those, and if
+// not we'll use
 // the pool specified in the purelbv1.DesiredGroupAnnotation
 // annotation. If neither is specified then we will attempt to
 // allocate from a pool named "default", if it exists.
@@ -118,7 +333,12 @@ func (a *Allocator) AllocateAnyIP(svc *v1.Service) (string, error) {
 		err      error
 	)
 
-	if svc.Spec.LoadBalancerIP != "" {
+	if addresses, exists := svc.Annotations[purelbv1.AddressesAnnotation]; exists {
+		// The user asked for specific IPs, so try those.
+		if poolName, err = a.allocateSpecificIPs(svc, addresses); err != nil {
+			return "", err
+		}
+	} else if svc.Spec.LoadBalancerIP != "" {
 		// The user asked for a specific IP, so try that.
 		if poolName, err = a.allocateSpecificIP(svc); err != nil {
 			return "", err
@@ -141,6 +361,7 @@ func (a *Allocator) AllocateAnyIP(svc *v1.Service) (string, error) {
 	if err = a.updateStats(svc, poolName); err != nil {
 		return "", err
 	}
+	a.record(svc, poolName)
 
 	return poolName, nil
 }
@@ -148,21 +369,13 @@ func (a *Allocator) AllocateAnyIP(svc *v1.Service) (string, error) {
 // allocateSpecificIP assigns the requested ip to svc, if the assignment is
 // permissible by sharingKey.
 func (a *Allocator) allocateSpecificIP(svc *v1.Service) (string, error) {
-	ip := net.ParseIP(svc.Spec.LoadBalancerIP)
-	if ip == nil {
-		return "", fmt.Errorf("invalid spec.loadBalancerIP %q", svc.Spec.LoadBalancerIP)
-	}
-
-	// Check that the address belongs to a pool
-	pool := poolFor(a.pools, ip)
-	if pool == "" {
-		return "", fmt.Errorf("%q does not belong to any group", ip)
+	ip, pool, err := a.specificIPPool(svc)
+	if err != nil {
+		return "", err
 	}
 
-	// Check that the address belongs to the requested pool
-	desiredGroup, exists := svc.Annotations[purelbv1.DesiredGroupAnnotation]
-	if exists && desiredGroup != pool {
-		return "", fmt.Errorf("%q belongs to group %s but desired group is %s", ip, pool, desiredGroup)
+	if a.reassign(svc, pool, []net.IP{ip}, false) {
+		return pool, nil
 	}
 
 	// If the service had an IP before, release it
@@ -173,14 +386,234 @@ func (a *Allocator) allocateSpecificIP(svc *v1.Service) (string, error) {
 	// Does the IP already have allocs? If so, needs to be the same
 	// sharing key, and have non-overlapping ports. If not, the proposed
 	// IP needs to be allowed by configuration.
-	err := a.pools[pool].Assign(ip, svc)
+	err = a.pools[pool].Assign(ip, svc)
+	if err != nil {
+		return "", err
+	}
+
+	return pool, nil
+}
+
+// reassign restores svc's ingress if pool is an external pool that
+// has already assigned ips to svc, e.g., because svc's status update
+// was lost. Releasing and re-assigning the addresses would make the
+// external system delete and recreate its records of them. If fill
+// is true then the pool may also have assigned svc addresses in
+// families that aren't in ips.
+func (a *Allocator) reassign(svc *v1.Service, pool string, ips []net.IP, fill bool) bool {
+	external, isExternal := a.pools[pool].(externalPool)
+	if !isExternal {
+		return false
+	}
+	assigned := external.Assigned(namespacedName(svc))
+	if len(assigned) == 0 {
+		return false
+	}
+
+	requested := map[int]bool{}
+	for _, ip := range ips {
+		requested[local.AddrFamily(ip)] = true
+	}
+	for _, ip := range assigned {
+		if requested[local.AddrFamily(ip)] || !fill {
+			if !containsIP(ips, ip) {
+				return false
+			}
+		}
+	}
+	for _, ip := range ips {
+		if !containsIP(assigned, ip) {
+			return false
+		}
+	}
+
+	svc.Status.LoadBalancer.Ingress = nil
+	for _, ip := range assigned {
+		addIngress(a.logger, svc, ip)
+	}
+	return true
+}
+
+// containsIP indicates whether ips contains ip.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateSpecificIPs assigns the addresses in addresses, which is
+// the value of svc's purelbv1.AddressesAnnotation annotation, to
+// svc. If svc needs an address in a family that isn't in addresses
+// then we allocate one from the same pool.
+func (a *Allocator) allocateSpecificIPs(svc *v1.Service, addresses string) (string, error) {
+	ips, err := parseAddresses(addresses)
+	if err != nil {
+		return "", err
+	}
+	pool, err := a.requestedPool(svc, ips)
 	if err != nil {
 		return "", err
 	}
 
+	// The addresses need to be in families that the service uses
+	families := map[int]bool{}
+	for _, family := range svc.Spec.IPFamilies {
+		if family == v1.IPv4Protocol {
+			families[nl.FAMILY_V4] = true
+		} else if family == v1.IPv6Protocol {
+			families[nl.FAMILY_V6] = true
+		}
+	}
+	for _, ip := range ips {
+		if len(families) > 0 && !families[local.AddrFamily(ip)] {
+			return "", fmt.Errorf("%q is not in any of the service's IP families %v", ip, svc.Spec.IPFamilies)
+		}
+	}
+
+	if a.reassign(svc, pool, ips, true) {
+		return pool, nil
+	}
+
+	// If the service had IPs before, release them
+	nsName := namespacedName(svc)
+	if err := a.Unassign(nsName); err != nil {
+		return "", err
+	}
+
+	// Assign the addresses that the user asked for, and then let the
+	// pool fill in the families that the user didn't pin. If
+	// something goes wrong then we release whatever we assigned so
+	// we don't leak addresses.
+	for _, ip := range ips {
+		if err = a.pools[pool].Assign(ip, svc); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = a.pools[pool].AssignNext(svc)
+	}
+	if err != nil {
+		a.pools[pool].Release(nsName)
+		svc.Status.LoadBalancer.Ingress = nil
+		return "", err
+	}
+
 	return pool, nil
 }
 
+// specificIPPool parses svc's spec.loadBalancerIP and returns it
+// along with the name of the pool that contains it.
+func (a *Allocator) specificIPPool(svc *v1.Service) (net.IP, string, error) {
+	ip := net.ParseIP(svc.Spec.LoadBalancerIP)
+	if ip == nil {
+		return nil, "", fmt.Errorf("invalid spec.loadBalancerIP %q", svc.Spec.LoadBalancerIP)
+	}
+
+	pool, err := a.requestedPool(svc, []net.IP{ip})
+	return ip, pool, err
+}
+
+// requestedPool returns the name of the pool that contains ips, which
+// are addresses that the user asked for. It returns an error if an
+// address doesn't belong to any pool, if the addresses belong to
+// different pools, or if they belong to a pool other than the one
+// that the user asked for.
+func (a *Allocator) requestedPool(svc *v1.Service, ips []net.IP) (string, error) {
+	pool := ""
+	for _, ip := range ips {
+		// Check that the address belongs to a pool
+		ipPool := poolFor(a.pools, ip)
+		if ipPool == "" {
+			return "", fmt.Errorf("%q does not belong to any group", ip)
+		}
+
+		// Check that the addresses all belong to the same pool
+		if pool != "" && ipPool != pool {
+			return "", fmt.Errorf("%q belongs to group %s but %q belongs to group %s", ips[0], pool, ip, ipPool)
+		}
+		pool = ipPool
+	}
+
+	// Check that the addresses belong to the requested pool
+	desiredGroup, exists := svc.Annotations[purelbv1.DesiredGroupAnnotation]
+	if exists && desiredGroup != pool {
+		return "", fmt.Errorf("%q belongs to group %s but desired group is %s", ips[0], pool, desiredGroup)
+	}
+
+	return pool, nil
+}
+
+// parseAddresses parses the value of the purelbv1.AddressesAnnotation
+// annotation. It returns an error if the value is malformed or if it
+// contains more than one address from the same family.
+func parseAddresses(addresses string) ([]net.IP, error) {
+	ips := []net.IP{}
+	families := map[int]net.IP{}
+	for _, raw := range strings.Split(addresses, ",") {
+		ip := net.ParseIP(strings.TrimSpace(raw))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q in annotation %s", raw, purelbv1.AddressesAnnotation)
+		}
+		family := local.AddrFamily(ip)
+		if other, exists := families[family]; exists {
+			return nil, fmt.Errorf("annotation %s has more than one address in the same family: %q and %q", purelbv1.AddressesAnnotation, other, ip)
+		}
+		families[family] = ip
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// CheckService returns an error if AllocateAnyIP would be unable to
+// allocate an address to svc because of the way that svc is
+// configured, e.g., it asks for an address that doesn't belong to any
+// pool or that another service is using in an incompatible way. It
+// runs the same checks as AllocateAnyIP against the current state of
+// the pools but it doesn't change anything.
+func (a *Allocator) CheckService(svc *v1.Service) error {
+	var (
+		ips  []net.IP
+		pool string
+		err  error
+	)
+
+	if addresses, exists := svc.Annotations[purelbv1.AddressesAnnotation]; exists {
+		if ips, err = parseAddresses(addresses); err != nil {
+			return err
+		}
+		if pool, err = a.requestedPool(svc, ips); err != nil {
+			return err
+		}
+	} else if svc.Spec.LoadBalancerIP != "" {
+		var ip net.IP
+		if ip, pool, err = a.specificIPPool(svc); err != nil {
+			return err
+		}
+		ips = []net.IP{ip}
+	} else {
+		// The user asked for a pool so it needs to exist
+		if desiredGroup, exists := svc.Annotations[purelbv1.DesiredGroupAnnotation]; exists && a.pools[desiredGroup] == nil {
+			return fmt.Errorf("unknown pool %q", desiredGroup)
+		}
+		return nil
+	}
+
+	// Local pools can tell us whether the addresses are available to
+	// svc. Remote pools can't know until they try.
+	if localPool, isLocal := a.pools[pool].(LocalPool); isLocal {
+		for _, ip := range ips {
+			if err := localPool.available(ip, svc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // AllocateFromPool assigns an available IP from pool to service.
 func (a *Allocator) allocateFromPool(svc *v1.Service, poolName string) error {
 	pool := a.pools[poolName]
@@ -209,15 +642,30 @@ func (a *Allocator) Unassign(svc string) error {
 	// not be a pool, e.g., in the case of a config change that moves
 	// addresses from one pool to another
 	for pname, p := range a.pools {
-		if err = p.Release(svc); err == nil {
+		if err = a.release(p, svc); err == nil {
 			// This pool released the address
 			poolActive.WithLabelValues(pname).Set(float64(p.InUse()))
+			if group, known := a.groups[a.poolGroups[pname]]; known {
+				a.updateGroupStatus(group)
+			}
 		}
 	}
 
+	a.forget(svc)
+
 	return nil
 }
 
+// release tells pool that svc has released its addresses. Standbys
+// only update the pool's own state since the leader updates any
+// external system from which the pool allocates.
+func (a *Allocator) release(pool Pool, svc string) error {
+	if external, isExternal := pool.(externalPool); isExternal && a.standby {
+		return external.Forget(svc)
+	}
+	return pool.Release(svc)
+}
+
 // poolFor returns the pool that owns the requested IP, or "" if none.
 func poolFor(pools map[string]Pool, ip net.IP) string {
 	for pname, p := range pools {
@@ -232,16 +680,23 @@ func poolFor(pools map[string]Pool, ip net.IP) string {
 // the pools specified by those groups. We try to return any good
 // pools so if a pool fails our validation it won't be in the output,
 // but other valid pools will be. Therefore there might be fewer pools
-// in the output than there are groups in the input.
-func (a *Allocator) parseGroups(groups []*purelbv1.ServiceGroup) map[string]Pool {
+// in the output than there are groups in the input. It also returns
+// the namespaced name of the group that defined each pool.
+func (a *Allocator) parseGroups(groups []*purelbv1.ServiceGroup) (map[string]Pool, map[string]string) {
 	pools := map[string]Pool{}
+	poolGroups := map[string]string{}
 
 Group:
 	for _, group := range groups {
-		pool, err := parsePool(a.logger, group.Name, group.Spec)
+		credentials, err := poolCredentials(group, a.secrets)
+		var pool Pool
+		if err == nil {
+			pool, err = parsePool(a.logger, group.Name, group.Spec, credentials)
+		}
 		if err != nil {
 			a.client.Errorf(group, "ParseFailed", "Failed to parse: %s", err)
 			a.logger.Log("failure", "parsing ServiceGroup address pool", "service-group", group.Name, "message", err)
+			a.setParsed(group, metav1.ConditionFalse, "ParseFailed", fmt.Sprintf("Failed to parse: %s", err))
 			continue Group
 		}
 
@@ -249,6 +704,7 @@ Group:
 		if pools[group.Name] != nil {
 			a.client.Errorf(group, "ParseFailed", "Duplicate definition of pool %s", group.Name)
 			a.logger.Log("failure", "duplicate definition of ServiceGroup address pool", "service-group", group.Name)
+			a.setParsed(group, metav1.ConditionFalse, "ParseFailed", fmt.Sprintf("Duplicate definition of pool %s", group.Name))
 			continue Group
 		}
 
@@ -258,13 +714,32 @@ Group:
 			if pool.Overlaps(r) {
 				a.client.Errorf(group, "ParseFailed", "Pool overlaps with already defined pool \"%s\"", name)
 				a.logger.Log("failure", "ServiceGroup address pool overlaps with already defined pool", "service-group", group.Name, "overlaps-with", name)
+				a.setParsed(group, metav1.ConditionFalse, "ParseFailed", fmt.Sprintf("Pool overlaps with already defined pool \"%s\"", name))
 				continue Group
 			}
 		}
 
 		pools[group.Name] = pool
+		poolGroups[group.Name] = groupName(group)
 		a.client.Infof(group, "Parsed", "ServiceGroup parsed successfully")
+		a.setParsed(group, metav1.ConditionTrue, "Parsed", "ServiceGroup parsed successfully")
 	}
 
-	return pools
+	return pools, poolGroups
+}
+
+// setParsed records the result of parsing group so we can report it
+// in the group's status.
+func (a *Allocator) setParsed(group *purelbv1.ServiceGroup, status metav1.ConditionStatus, reason string, message string) {
+	a.parsed[groupName(group)] = metav1.Condition{
+		Type:    purelbv1.ServiceGroupParsed,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+// groupName returns group's namespaced name.
+func groupName(group *purelbv1.ServiceGroup) string {
+	return group.Namespace + "/" + group.Name
 }
@@ -26,6 +26,7 @@ import (
 	ptu "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	purelbv1 "purelb.io/pkg/apis/v1"
@@ -727,6 +728,68 @@ func TestPoolMetrics(t *testing.T) {
 	}
 }
 
+func TestGroupStatus(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("test", "1.2.3.4/30"),
+		localServiceGroup("bogus", "1.2.3.0/33"),
+	}))
+
+	// The valid group reports its capacity and the bogus one reports
+	// why it's bogus
+	status := k.groupStatus["test"]
+	assert.Equal(t, &purelbv1.ServiceGroupFamilyStatus{Capacity: 4, InUse: 0}, status.V4)
+	assert.Nil(t, status.V6)
+	assert.Empty(t, status.Allocations)
+	assert.True(t, meta.IsStatusConditionTrue(status.Conditions, purelbv1.ServiceGroupParsed))
+	status = k.groupStatus["bogus"]
+	assert.Nil(t, status.V4)
+	assert.True(t, meta.IsStatusConditionFalse(status.Conditions, purelbv1.ServiceGroupParsed))
+
+	// Allocations show up in the status
+	svc1 := service("s1", ports("tcp/80"), "key")
+	svc1.Spec.LoadBalancerIP = "1.2.3.5"
+	_, err := alloc.AllocateAnyIP(&svc1)
+	assert.NoError(t, err)
+	svc2 := service("s2", ports("tcp/443"), "key")
+	svc2.Spec.LoadBalancerIP = "1.2.3.5"
+	_, err = alloc.AllocateAnyIP(&svc2)
+	assert.NoError(t, err)
+	svc3 := service("s3", ports("tcp/80"), "")
+	svc3.Spec.LoadBalancerIP = "1.2.3.4"
+	_, err = alloc.AllocateAnyIP(&svc3)
+	assert.NoError(t, err)
+	status = k.groupStatus["test"]
+	assert.Equal(t, 2, status.V4.InUse)
+	assert.Equal(t, []purelbv1.ServiceGroupAllocation{
+		{Address: "1.2.3.4", Services: []string{"unit/s3"}},
+		{Address: "1.2.3.5", Services: []string{"unit/s1", "unit/s2"}},
+	}, status.Allocations)
+
+	// Releases show up too
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc1)))
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc3)))
+	status = k.groupStatus["test"]
+	assert.Equal(t, 1, status.V4.InUse)
+	assert.Equal(t, []purelbv1.ServiceGroupAllocation{
+		{Address: "1.2.3.5", Services: []string{"unit/s2"}},
+	}, status.Allocations)
+	assert.True(t, meta.IsStatusConditionTrue(status.Conditions, purelbv1.ServiceGroupParsed))
+
+	// If every group is bogus then we keep the pools that we have, and
+	// the groups say why they're bogus
+	broken := localServiceGroup("test", "1.2.3.4/33")
+	broken.Generation = 2
+	assert.Error(t, alloc.SetPools([]*purelbv1.ServiceGroup{broken}))
+	status = k.groupStatus["test"]
+	assert.True(t, meta.IsStatusConditionFalse(status.Conditions, purelbv1.ServiceGroupParsed))
+	assert.Equal(t, 1, status.V4.InUse, "the old pool is still in use")
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc2)))
+	assert.Equal(t, 0, k.groupStatus["test"].V4.InUse)
+}
+
 // TestSpecificAddress tests allocations when a specific address is
 // requested
 func TestSpecificAddress(t *testing.T) {
@@ -781,6 +844,84 @@ func TestSpecificAddress(t *testing.T) {
 
 }
 
+func TestSpecificAddresses(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	groups := []*purelbv1.ServiceGroup{
+		serviceGroup(defaultPoolName, purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+			V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "1.2.3.0/30", Subnet: "1.2.3.0/24"}},
+			V6Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "2001:db8::/126", Subnet: "2001:db8::/64"}},
+		}}),
+		localServiceGroup("alternate", "3.2.1.0/31"),
+	}
+	assert.NoError(t, alloc.SetPools(groups))
+
+	dualStack := func(name string, addresses string) *v1.Service {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+		svc.Annotations[purelbv1.AddressesAnnotation] = addresses
+		return &svc
+	}
+	ingress := func(svc *v1.Service) []string {
+		addrs := []string{}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			addrs = append(addrs, ingress.IP)
+		}
+		return addrs
+	}
+
+	// Pin both families
+	svc := dualStack("both", "1.2.3.2, 2001:db8::2")
+	pool, err := alloc.AllocateAnyIP(svc)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPoolName, pool)
+	assert.Equal(t, []string{"1.2.3.2", "2001:db8::2"}, ingress(svc))
+
+	// Pin one family, the other comes from the same pool
+	svc = dualStack("v6-only", "2001:db8::3")
+	_, err = alloc.AllocateAnyIP(svc)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2001:db8::3", "1.2.3.0"}, ingress(svc))
+
+	// Malformed lists, and addresses in the wrong place, fail without
+	// allocating anything
+	for desc, addresses := range map[string]string{
+		"malformed address":       "1.2.3.1,2001:db8::zz",
+		"two addresses in family": "1.2.3.1,1.2.3.3",
+		"address not in a group":  "1.2.4.1",
+		"addresses in two groups": "3.2.1.0,2001:db8::1",
+		"address in use":          "1.2.3.2",
+	} {
+		svc = dualStack("bad", addresses)
+		_, err = alloc.AllocateAnyIP(svc)
+		assert.Error(t, err, desc)
+		assert.Empty(t, svc.Status.LoadBalancer.Ingress, desc)
+	}
+	assert.Empty(t, alloc.pools[defaultPoolName].(LocalPool).servicesOnIP(net.ParseIP("1.2.3.1")), "failed allocation leaked an address")
+
+	// The pinned address has to be in the desired group
+	svc = dualStack("wrong-group", "1.2.3.1")
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "alternate"
+	_, err = alloc.AllocateAnyIP(svc)
+	assert.Error(t, err)
+
+	// The pinned address has to be in one of the service's families
+	svc = dualStack("wrong-family", "2001:db8::1")
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+	_, err = alloc.AllocateAnyIP(svc)
+	assert.Error(t, err)
+
+	// The annotation takes precedence over spec.loadBalancerIP
+	svc = dualStack("precedence", "1.2.3.1")
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+	svc.Spec.LoadBalancerIP = "3.2.1.0"
+	pool, err = alloc.AllocateAnyIP(svc)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPoolName, pool)
+	assert.Equal(t, []string{"1.2.3.1"}, ingress(svc))
+}
+
 // TestSharingSimple tests address sharing with no address or pool
 // specified. Addresses should come from the "default" pool.
 func TestSharingSimple(t *testing.T) {
@@ -930,7 +1071,7 @@ func TestParseGroups(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			got := alloc.parseGroups(test.raw)
+			got, _ := alloc.parseGroups(test.raw)
 			iprangeComparer := cmp.Comparer(func(x, y IPRange) bool {
 				return reflect.DeepEqual(x.from, y.from) && reflect.DeepEqual(x.to, y.to)
 			})
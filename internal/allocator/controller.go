@@ -16,6 +16,9 @@
 package allocator
 
 import (
+	"sync"
+	"time"
+
 	v1 "k8s.io/api/core/v1"
 
 	"purelb.io/internal/k8s"
@@ -32,16 +35,29 @@ type Controller interface {
 	SetBalancer(*v1.Service, *v1.Endpoints) k8s.SyncState
 	DeleteBalancer(string) k8s.SyncState
 	MarkSynced()
+	SetLeader(bool)
+	ValidateService(*v1.Service) error
+	ReconcileIPAMEvery(time.Duration, <-chan struct{})
 	Shutdown()
 }
 
 type controller struct {
 	client    k8s.ServiceEvent
+	services  func() []*v1.Service
 	synced    bool
 	ips       *Allocator
 	groupURL  *string
 	logger    log.Logger
 	isDefault bool
+
+	// standby is true if another replica of the allocator is the
+	// leader. Standbys don't allocate addresses, they only keep track
+	// of the leader's allocations so they're ready to take over.
+	standby bool
+
+	// lock serializes the callbacks, which come from the k8s client's
+	// service and custom resource workers and from leader election.
+	lock sync.Mutex
 }
 
 // NewController configures a new controller. If error is non-nil then
@@ -57,10 +73,14 @@ func NewController(l log.Logger, ips *Allocator) (Controller, error) {
 
 func (c *controller) SetClient(client *k8s.Client) {
 	c.client = client
+	c.services = client.Services
 	c.ips.SetClient(client)
 }
 
 func (c *controller) DeleteBalancer(name string) k8s.SyncState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if err := c.ips.Unassign(name); err != nil {
 		c.logger.Log("event", "serviceDelete", "error", err)
 		return k8s.SyncStateError
@@ -71,6 +91,9 @@ func (c *controller) DeleteBalancer(name string) k8s.SyncState {
 }
 
 func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	defer c.logger.Log("event", "configUpdated")
 
 	if cfg == nil {
@@ -78,6 +101,7 @@ func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 		return k8s.SyncStateError
 	}
 
+	c.ips.SetSecrets(cfg.Secrets)
 	if err := c.ips.SetPools(cfg.Groups); err != nil {
 		c.logger.Log("op", "setConfig", "error", err)
 		return k8s.SyncStateError
@@ -91,8 +115,133 @@ func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 }
 
 func (c *controller) MarkSynced() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.synced = true
 	c.logger.Log("event", "stateSynced", "msg", "controller synced, can allocate IPs now")
+
+	if !c.standby {
+		// The IPAM check waits for the IPAM systems so it runs in the
+		// background
+		c.reconcileLedger()
+		go c.reconcileIPAM()
+	}
+}
+
+// SetLeader tells the controller whether this replica is the
+// leader. When a standby becomes the leader it picks up any changes
+// that the old leader made to the ledger and then reprocesses every
+// service, so it can allocate addresses to the services that the
+// standby ignored.
+func (c *controller) SetLeader(leader bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.logger.Log("event", "leaderChanged", "leader", leader)
+	c.standby = !leader
+	c.ips.SetStandby(!leader)
+
+	if leader && c.synced {
+		c.reconcileLedger()
+		go c.reconcileIPAM()
+	}
+	if leader && c.client != nil {
+		c.client.ForceSync()
+	}
+}
+
+// ValidateService returns an error if svc is a LoadBalancer service
+// that we're responsible for but to which we would be unable to
+// allocate an address. It's used by the admission webhook so users
+// find out about problems when they create the service instead of by
+// reading its events.
+func (c *controller) ValidateService(svc *v1.Service) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// If we haven't seen every service yet then we don't know which
+	// addresses are in use so we can't judge
+	if !c.synced {
+		return nil
+	}
+
+	// We only check services that SetBalancer would allocate to
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+	if svc.Spec.LoadBalancerClass != nil && *svc.Spec.LoadBalancerClass != purelbv1.ServiceLBClass {
+		return nil
+	}
+	if !c.isDefault && svc.Spec.LoadBalancerClass == nil {
+		return nil
+	}
+	if len(svc.Status.LoadBalancer.Ingress) > 0 {
+		return nil
+	}
+
+	return c.ips.CheckService(svc)
+}
+
+// reconcileLedger checks the services against the ledger, if we have
+// one.
+func (c *controller) reconcileLedger() {
+	// Now that we've seen every service we can check them against the
+	// ledger
+	if c.services != nil && c.ips.ledger != nil {
+		drift := c.ips.ReconcileLedger(c.services())
+		c.logger.Log("event", "ledgerReconciled", "orphaned", drift["orphaned"], "unrecorded", drift["unrecorded"], "mismatched", drift["mismatched"])
+	}
+}
+
+// ReconcileIPAMEvery refreshes our IPAM pools' networks and checks
+// the pools against the services every interval until stopCh is
+// closed. Every replica refreshes, since standbys answer the
+// admission webhook too, but only the leader checks, and only once it
+// has seen every service.
+func (c *controller) ReconcileIPAMEvery(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			// We don't hold the lock while we wait for the IPAM systems
+			c.lock.Lock()
+			pools := c.ips.IPAMPools()
+			c.lock.Unlock()
+			for _, pool := range pools {
+				pool.RefreshNetworks()
+			}
+
+			c.reconcileIPAM()
+		}
+	}
+}
+
+// reconcileIPAM checks the services against our IPAM pools, if we
+// have any and we're the leader. It takes the lock itself since it
+// lets go of it while it asks the IPAM systems what we've allocated.
+func (c *controller) reconcileIPAM() {
+	c.lock.Lock()
+	if !c.synced || c.standby || c.services == nil {
+		c.lock.Unlock()
+		return
+	}
+	pools := c.ips.IPAMPools()
+	c.lock.Unlock()
+
+	listings := ListIPAM(pools)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.synced || c.standby {
+		return
+	}
+	drift := c.ips.ReconcileIPAM(c.services(), listings, time.Now())
+	c.logger.Log("event", "ipamReconciled", "orphaned", drift["orphaned"], "mismatched", drift["mismatched"], "released", drift["released"])
 }
 
 func (c *controller) Shutdown() {
@@ -48,6 +48,8 @@ func statusAssigned(ip string) v1.ServiceStatus {
 // to do to k8s.
 type testK8S struct {
 	loggedWarning bool
+	warnings      []string
+	groupStatus   map[string]purelbv1.ServiceGroupStatus
 	t             *testing.T
 }
 
@@ -58,10 +60,23 @@ func (s *testK8S) Infof(_ runtime.Object, evtType string, msg string, args ...in
 func (s *testK8S) Errorf(_ runtime.Object, evtType string, msg string, args ...interface{}) {
 	s.t.Logf("k8s Warning event %q: %s", evtType, fmt.Sprintf(msg, args...))
 	s.loggedWarning = true
+	s.warnings = append(s.warnings, evtType)
 }
 
 func (s *testK8S) ForceSync() {}
 
+func (s *testK8S) UpdateGroupStatus(group *purelbv1.ServiceGroup) error {
+	if s.groupStatus == nil {
+		s.groupStatus = map[string]purelbv1.ServiceGroupStatus{}
+	}
+	s.groupStatus[group.Name] = *group.Status.DeepCopy()
+	return nil
+}
+
+func (s *testK8S) UpdateAgentNodeStatus(_ *purelbv1.LBNodeAgent, _ *purelbv1.LBNodeAgentNodeStatus) error {
+	return nil
+}
+
 func (s *testK8S) reset() {
 	s.loggedWarning = false
 }
@@ -219,3 +234,75 @@ func TestDeleteRecyclesIP(t *testing.T) {
 	assert.NotEmpty(t, svc2.Status.LoadBalancer.Ingress, "svc2 didn't get an IP")
 	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 got the wrong IP")
 }
+
+func TestStandby(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+	c.SetLeader(false)
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			{ObjectMeta: metav1.ObjectMeta{Name: defaultPoolName},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Subnet: "1.2.3.0/24",
+						Pool:   "1.2.3.0/31",
+					},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+	assert.Empty(t, k.groupStatus, "standby wrote group status")
+
+	// The leader allocated this one
+	allocated := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "allocated",
+			Annotations: map[string]string{
+				purelbv1.BrandAnnotation: purelbv1.Brand,
+				purelbv1.PoolAnnotation:  defaultPoolName,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned("1.2.3.0"),
+	}
+	wantSvc := allocated.DeepCopy()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(allocated, nil), "SetBalancer failed")
+	assert.Empty(t, diffService(wantSvc, allocated), "standby mutated service")
+
+	// The standby doesn't allocate
+	unallocated := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "unallocated",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	wantSvc = unallocated.DeepCopy()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(unallocated, nil), "SetBalancer failed")
+	assert.Empty(t, diffService(wantSvc, unallocated), "standby mutated service")
+
+	// Once it becomes the leader it allocates, and it knows which
+	// address the old leader allocated
+	c.SetLeader(true)
+	assert.NotEmpty(t, k.groupStatus, "new leader didn't write group status")
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(unallocated, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.1", unallocated.Status.LoadBalancer.Ingress[0].IP, "new leader allocated the wrong address")
+}
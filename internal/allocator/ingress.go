@@ -17,7 +17,10 @@ import (
 	"net"
 
 	"github.com/go-kit/kit/log"
+	"github.com/vishvananda/netlink/nl"
 	v1 "k8s.io/api/core/v1"
+
+	"purelb.io/internal/local"
 )
 
 // addIngress adds "address" to the Spec.Ingress field of "svc".
@@ -25,3 +28,32 @@ func addIngress(log log.Logger, svc *v1.Service, address net.IP) {
 	svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: address.String()})
 	log.Log("op", "program ingress address", "dest", "IP", "address", address.String())
 }
+
+// hasIngressFamily indicates whether "svc" has an ingress address
+// that belongs to "family".
+func hasIngressFamily(svc *v1.Service, family int) bool {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ip := net.ParseIP(ingress.IP); ip != nil && local.AddrFamily(ip) == family {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceFamilies returns the IP families (nl.FAMILY_V4 and/or
+// nl.FAMILY_V6) in which service needs addresses. If it's empty then
+// any family is OK.
+func serviceFamilies(logger log.Logger, service *v1.Service) []int {
+	families := []int{}
+	for _, family := range service.Spec.IPFamilies {
+		if family == v1.IPv6Protocol {
+			families = append(families, nl.FAMILY_V6)
+		} else if family == v1.IPv4Protocol {
+			families = append(families, nl.FAMILY_V4)
+		} else {
+			logger.Log("service %s unknown IP family %s", service.Name, family)
+		}
+	}
+
+	return families
+}
@@ -0,0 +1,649 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vishvananda/netlink/nl"
+	v1 "k8s.io/api/core/v1"
+
+	"purelb.io/internal/ipam"
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// IPAMPool is the IP address pool that requests IP addresses from an
+// external IPAM system, e.g., Netbox or a webhook, through an
+// ipam.Backend.
+type IPAMPool struct {
+	logger  log.Logger
+	backend ipam.Backend
+
+	// services caches the addresses that we've allocated to a specific
+	// service. It's used so we can release addresses when we're given
+	// only the service name. The key is the service's namespaced name,
+	// and the value is an array of the addresses assigned to that
+	// service.
+	services map[string][]net.IP
+
+	// Map of the addresses that have been assigned.
+	addressesInUse map[string]map[string]bool // ip.String() -> svc name -> true
+
+	// owners records the service that the backend lists as the owner
+	// of each address, so if the backend is an ipam.Transferer we can
+	// update it when that service releases an address that other
+	// services share.
+	owners map[string]string // ip.String() -> svc name
+
+	// releaseOrphans tells ReconcileIPAM to release addresses that
+	// have been orphaned for orphanGracePeriod.
+	releaseOrphans    bool
+	orphanGracePeriod time.Duration
+
+	// networks caches the networks from which the backend allocates
+	// addresses so Contains doesn't have to ask the backend.
+	networks *ipamNetworks
+
+	// releases, if it's not nil, returns addresses to the backend in
+	// the background. If it's nil then we return them synchronously.
+	releases *ipamReleases
+}
+
+// ipamNetworks is a cache of the networks from which a backend
+// allocates addresses. It has its own lock so we can refresh it
+// without holding the allocator's lock while we wait for the backend.
+type ipamNetworks struct {
+	lock     sync.RWMutex
+	networks []*net.IPNet
+}
+
+// ipamReleases returns addresses to IPAM backends in the background.
+// The controller releases addresses while it holds its lock, so
+// without it a slow IPAM system would hold up every service. It
+// remembers the addresses that it hasn't finished with so pools don't
+// claim them again before the backend has released them. If we exit
+// before the queue drains then ReconcileIPAM reports the addresses
+// that we didn't release as orphans.
+type ipamReleases struct {
+	lock     sync.Mutex
+	queue    []ipamRelease
+	pending  map[string]int // address -> queued releases
+	draining bool
+}
+
+// ipamRelease is one queued call to a backend.
+type ipamRelease struct {
+	address string
+	release func()
+}
+
+func newIPAMReleases() *ipamReleases {
+	return &ipamReleases{pending: map[string]int{}}
+}
+
+// add queues release, which tells a backend about address. If r is
+// nil then we call release before we return.
+func (r *ipamReleases) add(address string, release func()) {
+	if r == nil {
+		release()
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pending[address]++
+	r.queue = append(r.queue, ipamRelease{address: address, release: release})
+	if !r.draining {
+		r.draining = true
+		go r.drain()
+	}
+}
+
+// drain calls the queued releases in order until the queue is empty.
+func (r *ipamReleases) drain() {
+	for {
+		r.lock.Lock()
+		if len(r.queue) == 0 {
+			r.draining = false
+			r.lock.Unlock()
+			return
+		}
+		next := r.queue[0]
+		r.queue = r.queue[1:]
+		r.lock.Unlock()
+
+		next.release()
+
+		r.lock.Lock()
+		if r.pending[next.address]--; r.pending[next.address] == 0 {
+			delete(r.pending, next.address)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// releasing indicates whether we're still waiting to tell a backend
+// about address.
+func (r *ipamReleases) releasing(address string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.pending[address] > 0
+}
+
+// NewIPAMPool initializes a new instance of IPAMPool that allocates
+// addresses from backend. It doesn't talk to the backend, so the
+// pool contains only the addresses that it allocates until
+// RefreshNetworks asks the backend for its networks.
+func NewIPAMPool(log log.Logger, backend ipam.Backend) *IPAMPool {
+	return &IPAMPool{
+		logger:         log,
+		backend:        backend,
+		services:       map[string][]net.IP{},
+		addressesInUse: map[string]map[string]bool{},
+		owners:         map[string]string{},
+		networks:       &ipamNetworks{},
+	}
+}
+
+// RefreshNetworks asks the backend for the networks from which it
+// allocates addresses and caches them for Contains. If the backend
+// fails then we log it and keep the networks that we have. It can
+// block for as long as the backend takes to answer so callers
+// shouldn't hold the allocator's lock.
+func (p IPAMPool) RefreshNetworks() {
+	networks, err := p.backend.Networks()
+	if err != nil {
+		p.logger.Log("op", "ipamNetworks", "error", err)
+		return
+	}
+
+	p.networks.lock.Lock()
+	defer p.networks.lock.Unlock()
+	p.networks.networks = networks
+}
+
+// NewWebhookPool initializes a new instance of IPAMPool that uses
+// credentials to connect to the webhook that spec describes. name is
+// the name of the ServiceGroup. If error is non-nil then the returned
+// IPAMPool should not be used.
+func NewWebhookPool(log log.Logger, name string, spec purelbv1.ServiceGroupWebhookSpec, credentials Credentials) (*IPAMPool, error) {
+	url, err := url.Parse(spec.URL)
+	if err != nil || (url.Scheme != "http" && url.Scheme != "https") || url.Host == "" {
+		return nil, fmt.Errorf("webhook URL %q invalid, it must be an absolute http or https URL", spec.URL)
+	}
+
+	rootCAs, err := credentials.rootCAs()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := spec.Pool
+	if pool == "" {
+		pool = name
+	}
+
+	return NewIPAMPool(log, ipam.NewWebhook(ipam.WebhookConfig{
+		URL:     url.String(),
+		Pool:    pool,
+		Token:   credentials.Token,
+		RootCAs: rootCAs,
+	})), nil
+}
+
+func (p IPAMPool) Notify(service *v1.Service) error {
+	nsName := namespacedName(service)
+
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		ipstr := ingress.IP
+		ip := net.ParseIP(ipstr)
+		if ip == nil {
+			return fmt.Errorf("Service %s has unparseable IP %s", nsName, ipstr)
+		}
+
+		if p.addressesInUse[ipstr] == nil {
+			p.addressesInUse[ipstr] = map[string]bool{}
+		}
+		p.addressesInUse[ipstr][nsName] = true
+		p.services[nsName] = append(p.services[nsName], ip)
+	}
+
+	return nil
+}
+
+// AssignNext assigns a service to the next available IP in each of
+// the service's IP families. If the service already has an address
+// in a family (e.g., one that the user asked for) then we skip that
+// family.
+func (p IPAMPool) AssignNext(service *v1.Service) error {
+	families := serviceFamilies(p.logger, service)
+
+	if len(families) == 0 {
+		// Any address is OK, so if the service already has one then
+		// we're done
+		if len(service.Status.LoadBalancer.Ingress) > 0 {
+			return nil
+		}
+		return p.allocate(0, nil, service)
+	}
+
+	for _, family := range families {
+		if hasIngressFamily(service, family) {
+			continue
+		}
+		if err := p.allocate(family, nil, service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Assign assigns a service to an IP. If no other service is using
+// the address then we allocate it from the backend, which checks
+// that it's in the backend's pool and that it's available.
+func (p IPAMPool) Assign(ip net.IP, service *v1.Service) error {
+	if _, inUse := p.addressesInUse[ip.String()]; inUse {
+		return p.assign(ip, service)
+	}
+	return p.allocate(0, ip, service)
+}
+
+// allocate allocates an address in family (or either family if family
+// is 0) from the backend and assigns it to service. If ip isn't nil
+// then we allocate that address.
+func (p IPAMPool) allocate(family int, ip net.IP, service *v1.Service) error {
+	address := ""
+	if ip != nil {
+		address = ip.String()
+		if p.releases.releasing(address) {
+			return fmt.Errorf("%s is still being released, try again later", address)
+		}
+	}
+
+	allocated, err := p.backend.Allocate(family, address, ipam.Owner{Namespace: service.Namespace, Name: service.Name})
+	if err != nil {
+		return err
+	}
+	ip = net.ParseIP(allocated)
+	if ip == nil {
+		return fmt.Errorf("IPAM returned unparseable IP %s", allocated)
+	}
+	p.owners[ip.String()] = namespacedName(service)
+
+	return p.assign(ip, service)
+}
+
+// assign assigns a service to an IP that we've already allocated
+// from the backend.
+func (p IPAMPool) assign(ip net.IP, service *v1.Service) error {
+	addIngress(p.logger, service, ip)
+	return p.Notify(service)
+}
+
+// Release releases an IP so it can be assigned again. When the last
+// service that uses an address releases it we return the address to
+// the backend, in the background if the pool belongs to an
+// Allocator. If that fails then we log it but still forget the
+// address since the service no longer needs it.
+func (p IPAMPool) Release(service string) error {
+	return p.release(service, true)
+}
+
+// Forget releases service's addresses like Release but doesn't tell
+// the backend. Standbys use it to keep up with the leader, which
+// tells the backend itself.
+func (p IPAMPool) Forget(service string) error {
+	return p.release(service, false)
+}
+
+// Assigned returns the addresses that we've assigned to service.
+func (p IPAMPool) Assigned(service string) []net.IP {
+	return p.services[service]
+}
+
+// release implements Release and Forget. If external is false then
+// it changes only our own state, not the backend's.
+func (p IPAMPool) release(service string, external bool) error {
+	ips, haveIp := p.services[service]
+	if !haveIp {
+		return fmt.Errorf("trying to release an IP from unknown service %s", service)
+	}
+	delete(p.services, service)
+
+	for _, ip := range ips {
+		ipstr := ip.String()
+		if _, inUse := p.addressesInUse[ipstr]; !inUse {
+			// We've already released this one
+			continue
+		}
+		delete(p.addressesInUse[ipstr], service)
+		if len(p.addressesInUse[ipstr]) == 0 {
+			delete(p.addressesInUse, ipstr)
+			delete(p.owners, ipstr)
+			if !external {
+				continue
+			}
+			p.releases.add(ipstr, func() {
+				if err := p.backend.Release(ipstr); err != nil {
+					p.logger.Log("op", "ipamRelease", "address", ipstr, "service", service, "error", err)
+				}
+			})
+			continue
+		}
+
+		// Other services still share the address. If the backend says
+		// that it belongs to the service that released it (or we don't
+		// know to whom it belongs, e.g., after a restart) then we hand
+		// it to one of the others.
+		transferer, canTransfer := p.backend.(ipam.Transferer)
+		if !canTransfer {
+			continue
+		}
+		if owner, known := p.owners[ipstr]; !known || owner == service {
+			remaining := []string{}
+			for nsName := range p.addressesInUse[ipstr] {
+				remaining = append(remaining, nsName)
+			}
+			sort.Strings(remaining)
+			p.owners[ipstr] = remaining[0]
+			if !external {
+				continue
+			}
+			owner := remaining[0]
+			p.releases.add(ipstr, func() {
+				if err := transferer.Transfer(ipstr, ipamOwner(owner)); err != nil {
+					p.logger.Log("op", "ipamTransfer", "address", ipstr, "service", owner, "error", err)
+				}
+			})
+		}
+	}
+	return nil
+}
+
+// ipamOwner converts a service's namespaced name into an ipam.Owner.
+func ipamOwner(nsName string) ipam.Owner {
+	if parts := strings.SplitN(nsName, "/", 2); len(parts) == 2 {
+		return ipam.Owner{Namespace: parts[0], Name: parts[1]}
+	}
+	return ipam.Owner{Name: nsName}
+}
+
+// InUse returns the count of addresses that currently have services
+// assigned.
+func (p IPAMPool) InUse() int {
+	return len(p.addressesInUse)
+}
+
+// Size returns the number of addresses that the backend can
+// allocate, or 0 if it can't tell us.
+func (p IPAMPool) Size() uint64 {
+	sizer, isSizer := p.backend.(ipam.Sizer)
+	if !isSizer {
+		return 0
+	}
+	size, err := sizer.Capacity(0)
+	if err != nil {
+		p.logger.Log("op", "ipamCapacity", "error", err)
+		return 0
+	}
+	return size
+}
+
+// Status returns a report on this pool's utilization. If the backend
+// can tell us its capacity then we report it, otherwise we can report
+// only the addresses that we've allocated from it.
+func (p IPAMPool) Status() purelbv1.ServiceGroupStatus {
+	status := inUseStatus(p.addressesInUse)
+
+	sizer, isSizer := p.backend.(ipam.Sizer)
+	if !isSizer {
+		return status
+	}
+	for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+		capacity, err := sizer.Capacity(family)
+		if err != nil {
+			p.logger.Log("op", "ipamCapacity", "family", family, "error", err)
+			continue
+		}
+		if capacity == 0 {
+			continue
+		}
+		familyStatus := &status.V4
+		if family == nl.FAMILY_V6 {
+			familyStatus = &status.V6
+		}
+		if *familyStatus == nil {
+			*familyStatus = &purelbv1.ServiceGroupFamilyStatus{}
+		}
+		(*familyStatus).Capacity = capacity
+	}
+
+	return status
+}
+
+// Overlaps indicates whether the other Pool overlaps with this one
+// (i.e., has any addresses in common). This implementation always
+// returns false since the pool is managed by a remote system.
+func (p IPAMPool) Overlaps(other Pool) bool {
+	return false
+}
+
+// Contains indicates whether the provided net.IP represents an
+// address within this Pool. In this case the pool is owned by a
+// remote system so "address within this Pool" means that we've
+// already allocated the address, or that it's in one of the networks
+// that the backend told us about when we last asked. We're called
+// while the allocator holds its lock, and by the admission webhook,
+// so we don't ask the backend.
+func (p IPAMPool) Contains(ip net.IP) bool {
+	if _, allocated := p.addressesInUse[ip.String()]; allocated {
+		return true
+	}
+
+	p.networks.lock.RLock()
+	defer p.networks.lock.RUnlock()
+	for _, network := range p.networks.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPAMPools returns the pools that allocate from IPAM systems,
+// indexed by name. Their networks have their own lock so the caller
+// can refresh them without holding the lock that protects the
+// Allocator.
+func (a *Allocator) IPAMPools() map[string]IPAMPool {
+	pools := map[string]IPAMPool{}
+	for name, p := range a.pools {
+		if pool, isIPAM := p.(IPAMPool); isIPAM {
+			pools[name] = pool
+		}
+	}
+	return pools
+}
+
+// IPAMListing is what an IPAM pool's backend said that we'd
+// allocated.
+type IPAMListing struct {
+	pool        IPAMPool
+	allocations []ipam.Allocation
+	err         error
+}
+
+// ListIPAM asks the pools' backends which addresses we've allocated.
+// It can block for as long as the backends take to answer so callers
+// shouldn't hold the allocator's lock.
+func ListIPAM(pools map[string]IPAMPool) map[string]IPAMListing {
+	listings := map[string]IPAMListing{}
+	for name, pool := range pools {
+		allocations, err := pool.backend.List()
+		listings[name] = IPAMListing{pool: pool, allocations: allocations, err: err}
+	}
+	return listings
+}
+
+// ReconcileIPAM compares the addresses that the IPAM pools' backends
+// say we allocated, which ListIPAM fetched, with the addresses that
+// services use, and returns the number of differences of each kind.
+// now is the time of the reconciliation.
+//
+// "orphaned": the backend says that we allocated an address to a
+// service but no service uses it, e.g., because we crashed after we
+// allocated it but before we recorded it in the service. If the
+// pool's ServiceGroup sets ReleaseOrphansAfter then we release
+// addresses that have been orphaned for that long.
+//
+// "mismatched": services use an address but the backend says that we
+// allocated it to a different service.
+//
+// "released": orphans that we queued for release. We release them in
+// the background, like the addresses that services let go of, so we
+// don't wait for the backends while we hold the allocator's lock.
+func (a *Allocator) ReconcileIPAM(services []*v1.Service, listings map[string]IPAMListing, now time.Time) map[string]int {
+	drift := map[string]int{"orphaned": 0, "mismatched": 0, "released": 0}
+
+	users := map[string]map[string]bool{} // ip.String() -> svc name -> true
+	for _, svc := range services {
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(ingress.IP); ip != nil {
+				if users[ip.String()] == nil {
+					users[ip.String()] = map[string]bool{}
+				}
+				users[ip.String()][namespacedName(svc)] = true
+			}
+		}
+	}
+
+	ipamDrift.Reset()
+	orphans := map[string]time.Time{}
+	for name, listing := range listings {
+		// If the pool was rebuilt while we were asking its backend then
+		// the listing might be stale so we wait for the next round, and
+		// remember its orphans until then
+		pool, isIPAM := a.pools[name].(IPAMPool)
+		if !isIPAM {
+			continue
+		}
+		if pool.networks != listing.pool.networks {
+			for key, since := range a.ipamOrphans {
+				if strings.HasPrefix(key, name+" ") {
+					orphans[key] = since
+				}
+			}
+			continue
+		}
+		group := a.groups[a.poolGroups[name]]
+
+		if listing.err != nil {
+			a.logger.Log("op", "reconcileIPAM", "pool", name, "error", listing.err)
+			a.client.Errorf(group, "IPAMReconcileFailed", "Failed to list the IPAM system's addresses: %s", listing.err)
+			continue
+		}
+
+		poolDrift := map[string]int{"orphaned": 0, "mismatched": 0}
+		for _, allocation := range listing.allocations {
+			if allocation.Owner == nil {
+				continue
+			}
+			owner := allocation.Owner.Namespace + "/" + allocation.Owner.Name
+			key := name + " " + allocation.Address
+
+			// We're already giving the address back, either because its
+			// service let go of it or because it was orphaned
+			if a.releases.releasing(allocation.Address) {
+				if since, seen := a.ipamOrphans[key]; seen {
+					orphans[key] = since
+				}
+				continue
+			}
+
+			// Addresses that we've assigned but whose services haven't
+			// caught up yet aren't orphans
+			using := map[string]bool{}
+			for nsName := range users[allocation.Address] {
+				using[nsName] = true
+			}
+			for nsName := range pool.addressesInUse[allocation.Address] {
+				using[nsName] = true
+			}
+
+			if len(using) > 0 {
+				if !using[owner] {
+					poolDrift["mismatched"]++
+					a.logger.Log("op", "reconcileIPAM", "pool", name, "address", allocation.Address, "owner", owner, "msg", "owner doesn't use the address")
+					a.client.Errorf(group, "IPAMDrift", "The IPAM system says %s is allocated to %s but that service doesn't use it", allocation.Address, owner)
+				}
+				continue
+			}
+
+			poolDrift["orphaned"]++
+			since, seen := a.ipamOrphans[key]
+			if !seen {
+				since = now
+			}
+			orphans[key] = since
+
+			if !pool.releaseOrphans || now.Sub(since) < pool.orphanGracePeriod {
+				// The drift metric keeps count, so we report each orphan
+				// only once
+				if !seen {
+					a.logger.Log("op", "reconcileIPAM", "pool", name, "address", allocation.Address, "owner", owner, "msg", "address orphaned")
+					a.client.Errorf(group, "IPAMOrphan", "The IPAM system says %s is allocated to %s but no service uses it", allocation.Address, owner)
+				}
+				continue
+			}
+
+			// If the release fails then the address is still orphaned the
+			// next time that we look so we try again
+			drift["released"]++
+			a.releaseOrphan(name, pool, group, allocation.Address, owner)
+		}
+
+		for kind, count := range poolDrift {
+			drift[kind] += count
+			ipamDrift.WithLabelValues(name, kind).Set(float64(count))
+		}
+	}
+	a.ipamOrphans = orphans
+
+	return drift
+}
+
+// releaseOrphan queues the release of address, which the backend of
+// pool says is allocated to owner but which no service uses.
+func (a *Allocator) releaseOrphan(name string, pool IPAMPool, group *purelbv1.ServiceGroup, address string, owner string) {
+	a.releases.add(address, func() {
+		if err := pool.backend.Release(address); err != nil {
+			a.logger.Log("op", "reconcileIPAM", "pool", name, "address", address, "error", err)
+			a.client.Errorf(group, "IPAMOrphan", "Failed to release orphaned address %s: %s", address, err)
+			return
+		}
+		ipamOrphansReleased.WithLabelValues(name).Inc()
+		a.logger.Log("op", "reconcileIPAM", "pool", name, "address", address, "owner", owner, "msg", "released orphaned address")
+		a.client.Infof(group, "IPAMOrphanReleased", "Released %s, which the IPAM system said was allocated to %s but no service used", address, owner)
+	})
+}
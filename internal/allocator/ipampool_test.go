@@ -0,0 +1,225 @@
+// Copyright 2021 Acnodal Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"purelb.io/internal/ipam"
+	"purelb.io/internal/ipam/fake"
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// webhookServiceGroup returns a ServiceGroup that allocates from the
+// stand-in server's pool.
+func webhookServiceGroup(name string, server *fake.Server, credentials *purelbv1.ServiceGroupCredentials) *purelbv1.ServiceGroup {
+	group := serviceGroup(name, purelbv1.ServiceGroupSpec{Webhook: &purelbv1.ServiceGroupWebhookSpec{
+		URL:         server.URL,
+		Credentials: credentials,
+	}})
+	group.Namespace = "purelb"
+	return group
+}
+
+func TestWebhookPool(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddPool("default", "10.1.2.1", "10.1.2.2", "2001:db8::1", "10.1.2.3")
+
+	alloc := New(log.NewNopLogger())
+	alloc.client = &testK8S{t: t}
+	alloc.SetSecrets([]*v1.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "purelb", Name: "ipam-credentials"},
+		Data:       map[string][]byte{"token": []byte("token")},
+	}})
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{
+		webhookServiceGroup(defaultPoolName, server, &purelbv1.ServiceGroupCredentials{SecretName: "ipam-credentials"}),
+	}))
+	assert.NotNil(t, alloc.pools[defaultPoolName], "webhook pool didn't parse")
+
+	// Dual-stack services get one address per family
+	svc1 := service("svc1", ports("tcp/80"), "key")
+	svc1.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+	_, err := alloc.AllocateAnyIP(&svc1)
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "2001:db8::1"}, {IP: "10.1.2.1"}}, svc1.Status.LoadBalancer.Ingress)
+	assert.Equal(t, &ipam.Owner{Namespace: "unit", Name: "svc1"}, server.Owner("default", "10.1.2.1"))
+
+	// Users can ask for addresses in the backend's pool that are free,
+	// or that they can share
+	svc2 := service("svc2", ports("tcp/81"), "key")
+	svc2.Spec.LoadBalancerIP = "10.1.2.1"
+	_, err = alloc.AllocateAnyIP(&svc2)
+	assert.NoError(t, err)
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc3.Spec.LoadBalancerIP = "10.1.2.3"
+	_, err = alloc.AllocateAnyIP(&svc3)
+	assert.NoError(t, err)
+	assert.Equal(t, &ipam.Owner{Namespace: "unit", Name: "svc3"}, server.Owner("default", "10.1.2.3"))
+
+	// but not addresses that aren't in the pool, or that someone else
+	// allocated
+	server.Allocate("default", "10.1.2.2", ipam.Owner{Namespace: "other", Name: "other"})
+	svc4 := service("svc4", ports("tcp/80"), "")
+	svc4.Spec.LoadBalancerIP = "10.1.2.2"
+	_, err = alloc.AllocateAnyIP(&svc4)
+	assert.Error(t, err)
+	svc4.Spec.LoadBalancerIP = "10.1.9.9"
+	_, err = alloc.AllocateAnyIP(&svc4)
+	assert.Error(t, err)
+
+	pool := alloc.pools[defaultPoolName]
+	assert.True(t, pool.Contains(net.ParseIP("10.1.2.1")), "allocated address")
+	assert.True(t, pool.Contains(net.ParseIP("10.1.2.2")), "address in the backend's pool")
+	assert.False(t, pool.Contains(net.ParseIP("10.1.9.9")), "address not in the backend's pool")
+	assert.Equal(t, 3, pool.InUse())
+	status := pool.Status()
+	assert.Equal(t, 2, status.V4.InUse)
+	assert.Equal(t, 1, status.V6.InUse)
+
+	// The backend gets a shared address back when the last service
+	// lets go of it
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc1)))
+	waitForRelease(t, alloc, "2001:db8::1")
+	assert.NotNil(t, server.Owner("default", "10.1.2.1"))
+	assert.Nil(t, server.Owner("default", "2001:db8::1"))
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc2)))
+	waitForRelease(t, alloc, "10.1.2.1")
+	assert.Nil(t, server.Owner("default", "10.1.2.1"))
+	assert.Equal(t, 1, pool.InUse())
+}
+
+// waitForRelease waits for alloc to return address to its backend.
+func waitForRelease(t *testing.T, alloc *Allocator, address string) {
+	assert.Eventually(t, func() bool { return !alloc.releases.releasing(address) }, 5*time.Second, time.Millisecond, "release of %s", address)
+}
+
+// slowBackend holds up releases until its release channel is closed.
+type slowBackend struct {
+	ipam.Backend
+	release chan struct{}
+}
+
+func (b slowBackend) Release(address string) error {
+	<-b.release
+	return b.Backend.Release(address)
+}
+
+func TestIPAMBackgroundRelease(t *testing.T) {
+	server := fake.NewServer("")
+	defer server.Close()
+	server.AddPool("default", "10.1.2.1")
+
+	backend := slowBackend{Backend: ipam.NewWebhook(ipam.WebhookConfig{URL: server.URL, Pool: "default"}), release: make(chan struct{})}
+	alloc := New(log.NewNopLogger())
+	pool := NewIPAMPool(log.NewNopLogger(), backend)
+	pool.RefreshNetworks()
+	pool.releases = alloc.releases
+	alloc.pools = map[string]Pool{"ipam": *pool}
+
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc1.Spec.LoadBalancerIP = "10.1.2.1"
+	_, err := alloc.allocateSpecificIP(&svc1)
+	assert.NoError(t, err)
+
+	// Unassign doesn't wait for the backend
+	unassigned := make(chan error)
+	go func() { unassigned <- alloc.Unassign(namespacedName(&svc1)) }()
+	select {
+	case err := <-unassigned:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unassign waited for the backend")
+	}
+	assert.Equal(t, 0, pool.InUse())
+
+	// Nobody can claim the address until the backend has it back
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Spec.LoadBalancerIP = "10.1.2.1"
+	_, err = alloc.allocateSpecificIP(&svc2)
+	assert.Error(t, err)
+
+	close(backend.release)
+	waitForRelease(t, alloc, "10.1.2.1")
+	assert.Nil(t, server.Owner("default", "10.1.2.1"))
+	_, err = alloc.allocateSpecificIP(&svc2)
+	assert.NoError(t, err)
+	assert.Equal(t, &ipam.Owner{Namespace: "unit", Name: "svc2"}, server.Owner("default", "10.1.2.1"))
+}
+
+func TestWebhookPoolParse(t *testing.T) {
+	server := fake.NewServer("")
+	defer server.Close()
+	server.AddPool("shared", "10.1.2.1")
+
+	spec := purelbv1.ServiceGroupWebhookSpec{URL: server.URL, Pool: "shared"}
+	pool, err := NewWebhookPool(log.NewNopLogger(), "ipam", spec, Credentials{})
+	assert.NoError(t, err)
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, pool.AssignNext(&svc1), "the spec's pool name overrides the group's name")
+	assert.NotNil(t, server.Owner("shared", "10.1.2.1"))
+
+	for _, url := range []string{"", "ipam.example.com", "ftp://ipam.example.com/", "http://"} {
+		_, err = NewWebhookPool(log.NewNopLogger(), "ipam", purelbv1.ServiceGroupWebhookSpec{URL: url}, Credentials{})
+		assert.Error(t, err, url)
+	}
+	_, err = NewWebhookPool(log.NewNopLogger(), "ipam", spec, Credentials{CABundle: []byte("not PEM")})
+	assert.Error(t, err, "invalid CA bundle")
+
+	// Groups that refer to a missing Secret don't parse
+	_, err = poolCredentials(webhookServiceGroup("ipam", server, &purelbv1.ServiceGroupCredentials{SecretName: "missing"}), nil)
+	assert.Error(t, err)
+	creds, err := poolCredentials(webhookServiceGroup("ipam", server, nil), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{}, creds, "webhooks don't need credentials")
+}
+
+// reconcileIPAM lists alloc's IPAM pools' addresses and checks them
+// against services, like the controller does.
+func reconcileIPAM(alloc *Allocator, services []*v1.Service, now time.Time) map[string]int {
+	return alloc.ReconcileIPAM(services, ListIPAM(alloc.IPAMPools()), now)
+}
+
+func TestWebhookReconcile(t *testing.T) {
+	server := fake.NewServer("")
+	defer server.Close()
+	server.AddPool("default", "10.1.2.1", "10.1.2.2", "10.1.2.3")
+
+	alloc := New(log.NewNopLogger())
+	alloc.client = &testK8S{t: t}
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{webhookServiceGroup(defaultPoolName, server, nil)}))
+
+	// svc1 owns its address, the backend says that svc2's address
+	// belongs to another service, and nobody uses 10.1.2.3
+	svc1 := service("svc1", ports("tcp/80"), "")
+	_, err := alloc.AllocateAnyIP(&svc1)
+	assert.NoError(t, err)
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Status = statusAssigned("10.1.2.2")
+	server.Allocate("default", "10.1.2.2", ipam.Owner{Namespace: "unit", Name: "old"})
+	server.Allocate("default", "10.1.2.3", ipam.Owner{Namespace: "unit", Name: "gone"})
+
+	// Webhook pools report orphans but never release them
+	services := []*v1.Service{&svc1, &svc2}
+	assert.Equal(t, map[string]int{"orphaned": 1, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, time.Now()))
+	assert.Equal(t, map[string]int{"orphaned": 1, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, time.Now().Add(24*time.Hour)))
+	assert.NotNil(t, server.Owner("default", "10.1.2.3"))
+}
@@ -76,6 +76,23 @@ func (p IPRange) ContainedBy(cidr net.IPNet) bool {
 	return cidr.Contains(p.from) && cidr.Contains(p.to)
 }
 
+// Intersection returns the addresses that this range has in common
+// with other. The second return value is false if they have no
+// addresses in common.
+func (r IPRange) Intersection(other IPRange) (IPRange, bool) {
+	from, to := r.from, r.to
+	if bytes.Compare(other.from.To16(), from.To16()) > 0 {
+		from = other.from
+	}
+	if bytes.Compare(other.to.To16(), to.To16()) < 0 {
+		to = other.to
+	}
+	if bytes.Compare(from.To16(), to.To16()) > 0 {
+		return IPRange{}, false
+	}
+	return IPRange{from: from, to: to}, true
+}
+
 // Family returns the IP family of the addresses in this range. The
 // return value will be nl.FAMILY_V6 if this is an IPV6 range,
 // nl.FAMILY_V4 if it's IPV4, or 0 if the family can't be determined.
@@ -100,6 +117,19 @@ func (r IPRange) Next(ip net.IP) net.IP {
 	return next
 }
 
+// Offset returns the net.IP that is n addresses after the first
+// address in this IPRange. n should be less than Size(), otherwise the
+// returned address might not be in the range.
+func (r IPRange) Offset(n uint64) net.IP {
+	ip := dup(r.from)
+	for j := len(ip) - 1; j >= 0 && n > 0; j-- {
+		sum := uint64(ip[j]) + n&0xff
+		ip[j] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	return ip
+}
+
 // Size returns the count of net.IPs contained in this IPRange.  If
 // the count is too large to be represented by a uint64 then the
 // return value will be math.MaxUint64.
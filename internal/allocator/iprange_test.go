@@ -90,6 +90,31 @@ func TestNext(t *testing.T) {
 	assert.Nil(t, ip)
 }
 
+func TestOffset(t *testing.T) {
+	ipr1 := mustIPRange(t, "1.1.0.0/16")
+	assert.Equal(t, "1.1.0.0", ipr1.Offset(0).String())
+	assert.Equal(t, "1.1.0.255", ipr1.Offset(255).String())
+	assert.Equal(t, "1.1.1.0", ipr1.Offset(256).String())
+	assert.Equal(t, "1.1.255.255", ipr1.Offset(65535).String())
+
+	ipr2 := mustIPRange(t, "2001:db8::ff00-2001:db8::1:ff00")
+	assert.Equal(t, "2001:db8::1:0", ipr2.Offset(0x100).String())
+	assert.Equal(t, "2001:db8::1:ff00", ipr2.Offset(0x10000).String())
+}
+
+func TestIntersection(t *testing.T) {
+	common, overlap := mustIPRange(t, "1.1.1.0/24").Intersection(mustIPRange(t, "1.1.1.128-1.1.2.5"))
+	assert.True(t, overlap)
+	assertIPRange(t, common, "1.1.1.128", "1.1.1.255")
+
+	common, overlap = mustIPRange(t, "1.1.1.4-1.1.1.5").Intersection(mustIPRange(t, "1.1.1.0/24"))
+	assert.True(t, overlap)
+	assertIPRange(t, common, "1.1.1.4", "1.1.1.5")
+
+	_, overlap = mustIPRange(t, "1.1.1.0/30").Intersection(mustIPRange(t, "1.1.1.4/30"))
+	assert.False(t, overlap)
+}
+
 func TestFamily(t *testing.T) {
 	iprV4 := mustIPRange(t, "1.1.1.0/31")
 	assert.Equal(t, nl.FAMILY_V4, iprV4.Family(), "wrong family")
@@ -0,0 +1,334 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// LedgerEntry records the addresses that the allocator assigned to
+// one service, along with enough information about the service to
+// replay the assignment into a pool after a restart.
+type LedgerEntry struct {
+	Pool       string   `json:"pool"`
+	Addresses  []string `json:"addresses"`
+	SharingKey string   `json:"sharingKey,omitempty"`
+	Ports      []Port   `json:"ports,omitempty"`
+}
+
+// Ledger is a durable record of the allocator's address
+// assignments. Entries are keyed by the namespaced name of the
+// service that owns them, e.g., "default/echoserver".
+type Ledger interface {
+	// Load returns all of the entries in the ledger.
+	Load() (map[string]LedgerEntry, error)
+
+	// Record adds or replaces service's entry.
+	Record(service string, entry LedgerEntry) error
+
+	// Forget removes service's entry, if it has one.
+	Forget(service string) error
+}
+
+// newLedgerEntry builds a LedgerEntry that describes service's
+// assignment from pool.
+func newLedgerEntry(service *v1.Service, pool string) LedgerEntry {
+	entry := LedgerEntry{
+		Pool:       pool,
+		Addresses:  []string{},
+		SharingKey: SharingKey(service),
+		Ports:      Ports(service),
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		entry.Addresses = append(entry.Addresses, ingress.IP)
+	}
+	return entry
+}
+
+// service builds a stand-in for the service named nsName that has
+// the addresses, ports, and sharing key that are recorded in this
+// entry. It's good enough to pass to Pool.Notify.
+func (e LedgerEntry) service(nsName string) *v1.Service {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				purelbv1.BrandAnnotation: purelbv1.Brand,
+				purelbv1.PoolAnnotation:  e.Pool,
+			},
+		},
+	}
+	if parts := strings.SplitN(nsName, "/", 2); len(parts) == 2 {
+		svc.Namespace, svc.Name = parts[0], parts[1]
+	} else {
+		svc.Name = nsName
+	}
+	if e.SharingKey != "" {
+		svc.Annotations[purelbv1.SharingAnnotation] = e.SharingKey
+	}
+	for _, port := range e.Ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Protocol: port.Proto, Port: int32(port.Port)})
+	}
+	for _, address := range e.Addresses {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: address})
+	}
+	return svc
+}
+
+// configMapLedger stores the ledger in a ConfigMap, with one data
+// item per service. Each item's key is the service's namespaced name
+// with the "/" replaced by a "." (neither namespaces nor service names
+// can contain dots) and its value is the JSON-encoded LedgerEntry.
+type configMapLedger struct {
+	logger    log.Logger
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapLedger returns a Ledger that stores its entries in the
+// ConfigMap namespace/name. The ConfigMap will be created if it
+// doesn't exist.
+func NewConfigMapLedger(logger log.Logger, client kubernetes.Interface, namespace string, name string) Ledger {
+	return &configMapLedger{
+		logger:    logger,
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Load returns all of the entries in the ledger. If the ConfigMap
+// doesn't exist then Load creates it and returns an empty
+// ledger. Entries that can't be parsed are logged and skipped.
+func (l *configMapLedger) Load() (map[string]LedgerEntry, error) {
+	entries := map[string]LedgerEntry{}
+
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(context.TODO(), l.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return entries, l.create(map[string]string{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for key, raw := range cm.Data {
+		entry := LedgerEntry{}
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			l.logger.Log("op", "loadLedger", "entry", key, "error", err)
+			continue
+		}
+		entries[strings.Replace(key, ".", "/", 1)] = entry
+	}
+
+	return entries, nil
+}
+
+// Record adds or replaces service's entry.
+func (l *configMapLedger) Record(service string, entry LedgerEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return l.patch(map[string]interface{}{ledgerKey(service): string(raw)})
+}
+
+// Forget removes service's entry, if it has one.
+func (l *configMapLedger) Forget(service string) error {
+	// A null value in a merge patch deletes the key
+	return l.patch(map[string]interface{}{ledgerKey(service): nil})
+}
+
+// patch applies a JSON merge patch to the ConfigMap's data. We patch
+// instead of updating so we don't need to worry about the ConfigMap's
+// resourceVersion. If the ConfigMap has been deleted then we recreate
+// it.
+func (l *configMapLedger) patch(data map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+
+	_, err = l.client.CoreV1().ConfigMaps(l.namespace).Patch(context.TODO(), l.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if k8serrors.IsNotFound(err) {
+		recreated := map[string]string{}
+		for key, value := range data {
+			if value != nil {
+				recreated[key] = value.(string)
+			}
+		}
+		return l.create(recreated)
+	}
+	return err
+}
+
+// create creates the ConfigMap with the provided data.
+func (l *configMapLedger) create(data map[string]string) error {
+	_, err := l.client.CoreV1().ConfigMaps(l.namespace).Create(context.TODO(), &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: l.namespace,
+			Name:      l.name,
+		},
+		Data: data,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("creating ledger ConfigMap %s/%s: %w", l.namespace, l.name, err)
+	}
+	return nil
+}
+
+// ledgerKey converts a service's namespaced name into a key that we
+// can use in a ConfigMap.
+func ledgerKey(service string) string {
+	return strings.Replace(service, "/", ".", 1)
+}
+
+// replayLedger tells our pools about the assignments that are
+// recorded in the ledger.
+func (a *Allocator) replayLedger() {
+	for nsName, entry := range a.ledgerEntries {
+		pool, havePool := a.pools[entry.Pool]
+		if !havePool {
+			a.logger.Log("op", "replayLedger", "service", nsName, "error", fmt.Sprintf("unknown pool %q", entry.Pool))
+			continue
+		}
+		if err := pool.Notify(entry.service(nsName)); err != nil {
+			a.logger.Log("op", "replayLedger", "service", nsName, "error", err)
+		}
+	}
+}
+
+// record writes service's assignment from pool to the ledger, if we
+// have one and the assignment has changed. Standbys leave the ledger
+// to the leader so they only update their copy.
+func (a *Allocator) record(service *v1.Service, pool string) {
+	if a.ledger == nil {
+		return
+	}
+
+	nsName := namespacedName(service)
+	entry := newLedgerEntry(service, pool)
+	if old, recorded := a.ledgerEntries[nsName]; recorded && reflect.DeepEqual(old, entry) {
+		return
+	}
+
+	if !a.standby {
+		if err := a.ledger.Record(nsName, entry); err != nil {
+			a.logger.Log("op", "recordLedger", "service", nsName, "error", err)
+			return
+		}
+	}
+	a.ledgerEntries[nsName] = entry
+}
+
+// forget removes service's assignment from the ledger, if we have one
+// and it has an entry for service. Standbys leave the ledger to the
+// leader so they only update their copy.
+func (a *Allocator) forget(service string) {
+	if a.ledger == nil {
+		return
+	}
+	if _, recorded := a.ledgerEntries[service]; !recorded {
+		return
+	}
+
+	if !a.standby {
+		if err := a.ledger.Forget(service); err != nil {
+			a.logger.Log("op", "forgetLedger", "service", service, "error", err)
+			return
+		}
+	}
+	delete(a.ledgerEntries, service)
+}
+
+// ReconcileLedger compares the ledger with the ingress addresses of
+// services, which must contain every service in the cluster, and
+// reports and fixes the differences. The services' statuses are what
+// clients use so they win. It returns the count of each kind of
+// difference:
+//
+// "orphaned": the ledger has an entry for a service that doesn't
+// exist. It was probably deleted while we weren't running, so we
+// release its addresses.
+//
+// "unrecorded": a service has addresses from one of our pools but the
+// ledger doesn't know about them, so we record them.
+//
+// "mismatched": the ledger and the service disagree about the
+// service's addresses, so we rewrite the service's entry, or remove
+// it if the service doesn't have addresses from our pools anymore.
+func (a *Allocator) ReconcileLedger(services []*v1.Service) map[string]int {
+	drift := map[string]int{"orphaned": 0, "unrecorded": 0, "mismatched": 0}
+	if a.ledger == nil {
+		return drift
+	}
+
+	seen := map[string]bool{}
+	for _, svc := range services {
+		nsName := namespacedName(svc)
+		seen[nsName] = true
+
+		poolName, ours := svc.Annotations[purelbv1.PoolAnnotation]
+		ours = ours && svc.Annotations[purelbv1.BrandAnnotation] == purelbv1.Brand && len(svc.Status.LoadBalancer.Ingress) > 0
+		entry, recorded := a.ledgerEntries[nsName]
+
+		switch {
+		case ours && !recorded:
+			drift["unrecorded"]++
+			a.logger.Log("op", "reconcileLedger", "service", nsName, "msg", "service addresses not in ledger")
+			a.client.Errorf(svc, "LedgerDrift", "Service has addresses from pool %s that aren't in the ledger", poolName)
+			a.record(svc, poolName)
+		case recorded:
+			current := newLedgerEntry(svc, poolName)
+			if !ours || entry.Pool != current.Pool || !reflect.DeepEqual(entry.Addresses, current.Addresses) {
+				drift["mismatched"]++
+				a.logger.Log("op", "reconcileLedger", "service", nsName, "msg", "service differs from ledger", "ledger", fmt.Sprint(entry.Addresses), "service-addresses", fmt.Sprint(current.Addresses))
+				a.client.Errorf(svc, "LedgerDrift", "Ledger recorded %v from pool %s but service has %v", entry.Addresses, entry.Pool, current.Addresses)
+				if ours {
+					a.record(svc, poolName)
+				} else {
+					a.forget(nsName)
+				}
+			}
+		}
+	}
+
+	for nsName, entry := range a.ledgerEntries {
+		if !seen[nsName] {
+			drift["orphaned"]++
+			a.logger.Log("op", "reconcileLedger", "service", nsName, "msg", "service no longer exists, releasing", "addresses", fmt.Sprint(entry.Addresses))
+			a.Unassign(nsName)
+		}
+	}
+
+	for kind, count := range drift {
+		ledgerDrift.WithLabelValues(kind).Set(float64(count))
+	}
+
+	return drift
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Acnodal Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"purelb.io/internal/k8s"
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// testLedger is an in-memory Ledger.
+type testLedger struct {
+	entries map[string]LedgerEntry
+}
+
+func (l *testLedger) Load() (map[string]LedgerEntry, error) {
+	entries := map[string]LedgerEntry{}
+	for k, v := range l.entries {
+		entries[k] = v
+	}
+	return entries, nil
+}
+
+func (l *testLedger) Record(service string, entry LedgerEntry) error {
+	l.entries[service] = entry
+	return nil
+}
+
+func (l *testLedger) Forget(service string) error {
+	delete(l.entries, service)
+	return nil
+}
+
+func TestConfigMapLedger(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ledger := NewConfigMapLedger(log.NewNopLogger(), client, "purelb", "allocations")
+
+	// Loading a ledger that doesn't exist creates it
+	entries, err := ledger.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = client.CoreV1().ConfigMaps("purelb").Get(context.TODO(), "allocations", metav1.GetOptions{})
+	assert.NoError(t, err, "ledger ConfigMap wasn't created")
+
+	entry1 := LedgerEntry{Pool: "default", Addresses: []string{"192.168.1.1"}, SharingKey: "key", Ports: []Port{{Proto: v1.ProtocolTCP, Port: 80}}}
+	entry2 := LedgerEntry{Pool: "default", Addresses: []string{"192.168.1.2", "2001:db8::2"}}
+	assert.NoError(t, ledger.Record("ns1/svc1", entry1))
+	assert.NoError(t, ledger.Record("ns2/svc2", entry2))
+
+	entries, err = ledger.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]LedgerEntry{"ns1/svc1": entry1, "ns2/svc2": entry2}, entries)
+
+	assert.NoError(t, ledger.Forget("ns1/svc1"))
+	entries, err = ledger.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]LedgerEntry{"ns2/svc2": entry2}, entries)
+
+	// If someone deletes the ConfigMap then it comes back
+	assert.NoError(t, client.CoreV1().ConfigMaps("purelb").Delete(context.TODO(), "allocations", metav1.DeleteOptions{}))
+	assert.NoError(t, ledger.Record("ns1/svc1", entry1))
+	entries, err = ledger.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]LedgerEntry{"ns1/svc1": entry1}, entries)
+}
+
+func TestAllocatorLedger(t *testing.T) {
+	ledger := &testLedger{entries: map[string]LedgerEntry{
+		"unit/recorded": {Pool: "default", Addresses: []string{"1.2.3.0"}, Ports: []Port{{Proto: v1.ProtocolTCP, Port: 80}}},
+		"unit/deleted":  {Pool: "default", Addresses: []string{"1.2.3.1"}},
+	}}
+
+	k := &testK8S{t: t}
+	alloc := New(log.NewNopLogger())
+	alloc.client = k
+	assert.NoError(t, alloc.SetLedger(ledger))
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{localServiceGroup("default", "1.2.3.0/30")}))
+
+	// The ledger's addresses are in use before any service has synced
+	// so the allocator skips them
+	svc := service("new", ports("tcp/80"), "")
+	_, err := alloc.AllocateAnyIP(&svc)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.2", svc.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, []string{"1.2.3.2"}, ledger.entries["unit/new"].Addresses, "allocation wasn't recorded")
+
+	// Releasing an address removes it from the ledger
+	assert.NoError(t, alloc.Unassign("unit/new"))
+	assert.NotContains(t, ledger.entries, "unit/new")
+
+	// A service that has a different address than the ledger says
+	// updates the ledger, and releases the old address
+	moved := service("recorded", ports("tcp/80"), "")
+	moved.Annotations[purelbv1.BrandAnnotation] = purelbv1.Brand
+	moved.Annotations[purelbv1.PoolAnnotation] = "default"
+	moved.Status = statusAssigned("1.2.3.3")
+	assert.NoError(t, alloc.NotifyExisting(&moved))
+	assert.Equal(t, []string{"1.2.3.3"}, ledger.entries["unit/recorded"].Addresses)
+	assert.True(t, k.loggedWarning, "drift wasn't reported")
+	assert.Empty(t, alloc.pools["default"].(LocalPool).servicesOnIP(net.ParseIP("1.2.3.0")))
+
+	// Reconciliation releases the addresses of services that no longer
+	// exist, and records services that the ledger doesn't know about
+	unrecorded := service("unrecorded", ports("tcp/80"), "")
+	unrecorded.Annotations[purelbv1.BrandAnnotation] = purelbv1.Brand
+	unrecorded.Annotations[purelbv1.PoolAnnotation] = "default"
+	unrecorded.Status = statusAssigned("1.2.3.0")
+	drift := alloc.ReconcileLedger([]*v1.Service{&moved, &unrecorded})
+	assert.Equal(t, map[string]int{"orphaned": 1, "unrecorded": 1, "mismatched": 0}, drift)
+	assert.NotContains(t, ledger.entries, "unit/deleted")
+	assert.Empty(t, alloc.pools["default"].(LocalPool).servicesOnIP(net.ParseIP("1.2.3.1")))
+	assert.Equal(t, []string{"1.2.3.0"}, ledger.entries["unit/unrecorded"].Addresses)
+
+	// Entries that disagree with their services are rewritten from the
+	// services, or removed if the services aren't ours anymore
+	moved.Status = statusAssigned("1.2.3.1")
+	delete(unrecorded.Annotations, purelbv1.PoolAnnotation)
+	drift = alloc.ReconcileLedger([]*v1.Service{&moved, &unrecorded})
+	assert.Equal(t, map[string]int{"orphaned": 0, "unrecorded": 0, "mismatched": 2}, drift)
+	assert.Equal(t, []string{"1.2.3.1"}, ledger.entries["unit/recorded"].Addresses)
+	assert.NotContains(t, ledger.entries, "unit/unrecorded")
+	drift = alloc.ReconcileLedger([]*v1.Service{&moved, &unrecorded})
+	assert.Equal(t, map[string]int{"orphaned": 0, "unrecorded": 0, "mismatched": 0}, drift)
+}
+
+func TestControllerLedgerUnsynced(t *testing.T) {
+	ledger := &testLedger{entries: map[string]LedgerEntry{
+		"unit/recorded": {Pool: "default", Addresses: []string{"1.2.3.0"}},
+	}}
+
+	k := &testK8S{t: t}
+	alloc := New(log.NewNopLogger())
+	alloc.client = k
+	assert.NoError(t, alloc.SetLedger(ledger))
+	c := &controller{logger: log.NewNopLogger(), ips: alloc, client: k, isDefault: true}
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{localServiceGroup("default", "1.2.3.0/30")}))
+
+	// The ledger might be stale, e.g., if someone edited it, so we
+	// don't allocate until we've seen every service
+	svc := service("new", ports("tcp/80"), "")
+	svc.Spec.Type = v1.ServiceTypeLoadBalancer
+	svc.Spec.ClusterIP = "10.0.0.1"
+	wantSvc := svc.DeepCopy()
+	assert.Equal(t, k8s.SyncStateError, c.SetBalancer(&svc, nil))
+	assert.Empty(t, diffService(wantSvc, &svc), "unsynced SetBalancer mutated service")
+	assert.Empty(t, ledger.entries["unit/new"].Addresses, "unsynced SetBalancer allocated")
+
+	c.MarkSynced()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(&svc, nil))
+	assert.Equal(t, "1.2.3.1", svc.Status.LoadBalancer.Ingress[0].IP)
+}
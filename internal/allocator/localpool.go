@@ -16,13 +16,19 @@
 package allocator
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/vishvananda/netlink/nl"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"purelb.io/internal/local"
 	purelbv1 "purelb.io/pkg/apis/v1"
@@ -32,15 +38,17 @@ import (
 type LocalPool struct {
 	logger log.Logger
 
-	// v4Range contains the IPV4 addresses that are part of this
-	// pool. config.Parse guarantees that these are non-overlapping,
-	// both within and between pools.
-	v4Range *IPRange
+	// v4Ranges contains the IPV4 addresses that are part of this
+	// pool, sorted by address. NewLocalPool guarantees that they don't
+	// overlap one another, and config.Parse guarantees that they don't
+	// overlap other pools.
+	v4Ranges []IPRange
 
-	// v6Range contains the IPV6 addresses that are part of this
-	// pool. config.Parse guarantees that these are non-overlapping,
-	// both within and between pools.
-	v6Range *IPRange
+	// v6Ranges contains the IPV6 addresses that are part of this
+	// pool, sorted by address. NewLocalPool guarantees that they don't
+	// overlap one another, and config.Parse guarantees that they don't
+	// overlap other pools.
+	v6Ranges []IPRange
 
 	// Map of the addresses that have been assigned.
 	addressesInUse map[string]map[string]bool // ip.String() -> svc name -> true
@@ -49,6 +57,23 @@ type LocalPool struct {
 	sharingKeys map[string]*Key // ip.String() -> pointer to sharing key
 
 	portsInUse map[string]map[Port]string // ip.String() -> Port -> svc
+
+	// excluded contains the addresses within this pool's ranges that
+	// we must never allocate, sorted by address and merged so they
+	// don't overlap one another.
+	excluded []IPRange
+
+	// strategy is the AllocationStrategy that AssignNext uses to
+	// choose addresses.
+	strategy string
+
+	// cooldown is how long AssignNext holds back an address after
+	// it's released.
+	cooldown time.Duration
+
+	// released holds the time at which each address was most recently
+	// released, i.e., when its last service let go of it.
+	released map[string]time.Time // ip.String() -> release time
 }
 
 func NewLocalPool(log log.Logger, spec purelbv1.ServiceGroupLocalSpec) (*LocalPool, error) {
@@ -57,44 +82,46 @@ func NewLocalPool(log log.Logger, spec purelbv1.ServiceGroupLocalSpec) (*LocalPo
 		addressesInUse: map[string]map[string]bool{},
 		sharingKeys:    map[string]*Key{},
 		portsInUse:     map[string]map[Port]string{},
+		strategy:       purelbv1.AllocationSequential,
+		released:       map[string]time.Time{},
 	}
 
-	// See if there's an IPV6 range in the spec
-	if spec.V6Pool != nil {
-		iprange, err := NewIPRange(spec.V6Pool.Pool)
-		if err != nil {
-			return nil, err
-		}
+	switch spec.AllocationStrategy {
+	case "":
+		// Use the default
+	case purelbv1.AllocationSequential, purelbv1.AllocationRandom, purelbv1.AllocationLRU:
+		pool.strategy = spec.AllocationStrategy
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy %q", spec.AllocationStrategy)
+	}
 
-		// Validate that the range is contained by the subnet.
-		_, subnet, err := net.ParseCIDR(spec.V6Pool.Subnet)
-		if err != nil {
-			return nil, err
-		}
-		if !iprange.ContainedBy(*subnet) {
-			return nil, fmt.Errorf("IPV6 range %s not contained by network %s", iprange, subnet)
+	if spec.ReleaseCooldown != nil {
+		if spec.ReleaseCooldown.Duration < 0 {
+			return nil, fmt.Errorf("release cooldown %s is negative", spec.ReleaseCooldown.Duration)
 		}
+		pool.cooldown = spec.ReleaseCooldown.Duration
+	}
 
-		pool.v6Range = &iprange
+	// The allocator doesn't use the node selector but the lbnodeagents
+	// do, so if it's invalid then none of them will announce
+	if spec.NodeSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(spec.NodeSelector); err != nil {
+			return nil, fmt.Errorf("invalid node selector: %w", err)
+		}
 	}
 
-	// See if there's an IPV4 range in the spec
-	if spec.V4Pool != nil {
-		iprange, err := NewIPRange(spec.V4Pool.Pool)
-		if err != nil {
+	// See if there are IPV6 ranges in the spec
+	for _, addrPool := range spec.FamilyPools(nl.FAMILY_V6) {
+		if err := pool.addRange(addrPool, nl.FAMILY_V6); err != nil {
 			return nil, err
 		}
+	}
 
-		// Validate that the range is contained by the subnet.
-		_, subnet, err := net.ParseCIDR(spec.V4Pool.Subnet)
-		if err != nil {
+	// See if there are IPV4 ranges in the spec
+	for _, addrPool := range spec.FamilyPools(nl.FAMILY_V4) {
+		if err := pool.addRange(addrPool, nl.FAMILY_V4); err != nil {
 			return nil, err
 		}
-		if !iprange.ContainedBy(*subnet) {
-			return nil, fmt.Errorf("IPV4 range %s not contained by network %s", iprange, subnet)
-		}
-
-		pool.v4Range = &iprange
 	}
 
 	// See if there's a top-level range in the spec
@@ -110,18 +137,21 @@ func NewLocalPool(log log.Logger, spec purelbv1.ServiceGroupLocalSpec) (*LocalPo
 			if !iprange.ContainedBy(*subnet) {
 				return nil, fmt.Errorf("Legacy range %s not contained by network %s", iprange, subnet)
 			}
+			if err := validateAggregation(spec.Aggregation, iprange.Family()); err != nil {
+				return nil, err
+			}
 
 			// We have a legacy (i.e., top-level) range, let's see where it
 			// goes
 			if iprange.Family() == nl.FAMILY_V6 {
-				if pool.v6Range == nil {
-					pool.v6Range = &iprange
+				if len(pool.v6Ranges) == 0 {
+					pool.v6Ranges = []IPRange{iprange}
 				} else {
 					return nil, fmt.Errorf("Invalid Spec: both legacy Pool and V6Pool are IPV6")
 				}
 			} else if iprange.Family() == nl.FAMILY_V4 {
-				if pool.v4Range == nil {
-					pool.v4Range = &iprange
+				if len(pool.v4Ranges) == 0 {
+					pool.v4Ranges = []IPRange{iprange}
 				} else {
 					return nil, fmt.Errorf("Invalid Spec: both legacy Pool and V4Pool are IPV4")
 				}
@@ -131,13 +161,177 @@ func NewLocalPool(log log.Logger, spec purelbv1.ServiceGroupLocalSpec) (*LocalPo
 
 	// Last check: if we don't have *any* valid range then it's a bad
 	// Spec
-	if pool.v6Range == nil && pool.v4Range == nil {
+	if len(pool.v6Ranges) == 0 && len(pool.v4Ranges) == 0 {
 		return nil, fmt.Errorf("no valid address range found")
 	}
 
+	// Build the exclusion list, which combines the addresses that the
+	// user excluded explicitly with the network and broadcast addresses
+	// if the user asked us to skip them
+	for _, raw := range spec.Exclude {
+		iprange, err := parseExclusion(raw)
+		if err != nil {
+			return nil, err
+		}
+		pool.excluded = append(pool.excluded, iprange)
+	}
+	if spec.SkipNetworkBroadcast {
+		cidrs := []string{}
+		for _, addrPool := range spec.FamilyPools(nl.FAMILY_V4) {
+			cidrs = append(cidrs, addrPool.Pool)
+		}
+		if spec.Pool != "" {
+			cidrs = append(cidrs, spec.Pool)
+		}
+		for _, cidr := range cidrs {
+			pool.excluded = append(pool.excluded, networkBroadcast(cidr)...)
+		}
+	}
+	pool.excluded = mergeRanges(pool.excluded)
+
+	// Keep the ranges in address order so "sequential" allocation
+	// really does choose the lowest available address
+	sortRanges(pool.v4Ranges)
+	sortRanges(pool.v6Ranges)
+
 	return &pool, nil
 }
 
+// addRange validates addrPool and adds its range of addresses to this
+// pool. family is the family that the range must belong to.
+func (p *LocalPool) addRange(addrPool purelbv1.ServiceGroupAddressPool, family int) error {
+	familyName := "IPV4"
+	if family == nl.FAMILY_V6 {
+		familyName = "IPV6"
+	}
+
+	iprange, err := NewIPRange(addrPool.Pool)
+	if err != nil {
+		return err
+	}
+	if iprange.Family() != family {
+		return fmt.Errorf("%s range %s contains addresses of the wrong family", familyName, iprange)
+	}
+
+	// Validate that the range is contained by the subnet.
+	_, subnet, err := net.ParseCIDR(addrPool.Subnet)
+	if err != nil {
+		return err
+	}
+	if !iprange.ContainedBy(*subnet) {
+		return fmt.Errorf("%s range %s not contained by network %s", familyName, iprange, subnet)
+	}
+
+	if err := validateAggregation(addrPool.Aggregation, family); err != nil {
+		return err
+	}
+
+	// Validate that the range doesn't overlap the ones that we already
+	// have.
+	ranges := &p.v4Ranges
+	if family == nl.FAMILY_V6 {
+		ranges = &p.v6Ranges
+	}
+	for _, other := range *ranges {
+		if iprange.Overlaps(other) || other.Overlaps(iprange) {
+			return fmt.Errorf("%s range %s overlaps range %s", familyName, iprange, other)
+		}
+	}
+
+	*ranges = append(*ranges, iprange)
+	return nil
+}
+
+// validateAggregation checks that aggregation is a value that the
+// lbnodeagent can use for addresses of the provided family: either
+// "default" (or empty, which means the same thing) or a mask length
+// like "/24" that fits the family. A "/0" aggregation would make the
+// lbnodeagent's dummy interface a default route for the node, which
+// would send all of its traffic into the dummy interface, so we
+// don't allow it.
+func validateAggregation(aggregation string, family int) error {
+	if aggregation == "" || aggregation == "default" {
+		return nil
+	}
+
+	maxBits := 32
+	if family == nl.FAMILY_V6 {
+		maxBits = 128
+	}
+	if !strings.HasPrefix(aggregation, "/") {
+		return fmt.Errorf("invalid aggregation %q: must be \"default\" or a mask length like \"/24\"", aggregation)
+	}
+	bits, err := strconv.Atoi(aggregation[1:])
+	if err != nil || bits < 1 || bits > maxBits {
+		return fmt.Errorf("invalid aggregation %q: mask length must be between 1 and %d", aggregation, maxBits)
+	}
+
+	return nil
+}
+
+// parseExclusion parses one entry of a ServiceGroup's exclusion
+// list. It can be a single address, a CIDR, or a from-to range.
+func parseExclusion(raw string) (IPRange, error) {
+	if ip := net.ParseIP(strings.TrimSpace(raw)); ip != nil {
+		return IPRange{from: ip, to: ip}, nil
+	}
+
+	iprange, err := NewIPRange(raw)
+	if err != nil {
+		return iprange, fmt.Errorf("invalid exclusion %q: %w", raw, err)
+	}
+	return iprange, nil
+}
+
+// networkBroadcast returns the network and broadcast addresses of
+// pool if it's an IPV4 CIDR with room for both, or an empty slice if
+// not.
+func networkBroadcast(pool string) []IPRange {
+	if strings.Contains(pool, "-") {
+		return []IPRange{}
+	}
+	_, cidr, err := net.ParseCIDR(pool)
+	if err != nil || cidr.IP.To4() == nil {
+		return []IPRange{}
+	}
+	if ones, _ := cidr.Mask.Size(); ones > 30 {
+		return []IPRange{}
+	}
+
+	iprange, _ := NewIPRange(cidr.String())
+	return []IPRange{
+		{from: iprange.from, to: iprange.from},
+		{from: iprange.to, to: iprange.to},
+	}
+}
+
+// mergeRanges sorts ranges and combines the ones that overlap, so no
+// address appears in more than one of the returned ranges.
+func mergeRanges(ranges []IPRange) []IPRange {
+	sortRanges(ranges)
+
+	merged := []IPRange{}
+	for _, iprange := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(iprange.from.To16(), merged[last].to.To16()) <= 0 {
+			if bytes.Compare(iprange.to.To16(), merged[last].to.To16()) > 0 {
+				merged[last].to = iprange.to
+			}
+			continue
+		}
+		merged = append(merged, iprange)
+	}
+
+	return merged
+}
+
+// sortRanges sorts ranges by their first addresses.
+func sortRanges(ranges []IPRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].from.To16(), ranges[j].from.To16()) < 0
+	})
+}
+
 func (p LocalPool) Notify(service *v1.Service) error {
 	nsName := namespacedName(service)
 	sharingKey := &Key{Sharing: SharingKey(service)}
@@ -153,6 +347,7 @@ func (p LocalPool) Notify(service *v1.Service) error {
 		p.logger.Log("localpool", "notify-existing", "service", nsName, "ip", ipstr)
 
 		p.sharingKeys[ipstr] = sharingKey
+		delete(p.released, ipstr)
 		if p.addressesInUse[ipstr] == nil {
 			p.addressesInUse[ipstr] = map[string]bool{}
 		}
@@ -177,6 +372,10 @@ func (p LocalPool) available(ip net.IP, service *v1.Service) error {
 	key := &Key{Sharing: SharingKey(service)}
 	ports := Ports(service)
 
+	if p.isExcluded(ip) {
+		return fmt.Errorf("address %s is excluded from the pool", ip)
+	}
+
 	// No key: no sharing
 	if key == nil {
 		key = &Key{}
@@ -212,7 +411,8 @@ func (p LocalPool) available(ip net.IP, service *v1.Service) error {
 	return nil
 }
 
-// AssignNext assigns the next available IP to service.
+// AssignNext assigns the next available IP to service in each of
+// service's families for which it doesn't already have an address.
 func (p LocalPool) AssignNext(service *v1.Service) error {
 	families, err := p.whichFamilies(service)
 	if err != nil {
@@ -220,8 +420,13 @@ func (p LocalPool) AssignNext(service *v1.Service) error {
 	}
 
 	if len(families) == 0 {
-		// Any address is OK so try V6 first then V4 and assign the first
-		// one that succeeds
+		// Any address is OK, so if the service already has one (e.g.,
+		// one that the user asked for) then we're done
+		if len(service.Status.LoadBalancer.Ingress) > 0 {
+			return nil
+		}
+
+		// Try V6 first then V4 and assign the first one that succeeds
 		if err := p.assignFamily(nl.FAMILY_V6, service); err == nil {
 			return err
 		}
@@ -231,8 +436,13 @@ func (p LocalPool) AssignNext(service *v1.Service) error {
 		return fmt.Errorf("no available addresses in pool")
 	}
 
-	// We have a specific set of families to assign
+	// We have a specific set of families to assign. Skip the ones for
+	// which the service already has an address, e.g., one that the
+	// user asked for.
 	for _, family := range families {
+		if hasIngressFamily(service, family) {
+			continue
+		}
 		if err := p.assignFamily(family, service); err != nil {
 			return err
 		}
@@ -241,14 +451,103 @@ func (p LocalPool) AssignNext(service *v1.Service) error {
 }
 
 func (p LocalPool) assignFamily(family int, service *v1.Service) error {
+	var ip net.IP
+
+	switch p.strategy {
+	case purelbv1.AllocationRandom:
+		ip = p.nextRandom(family, service)
+	case purelbv1.AllocationLRU:
+		ip = p.nextLRU(family, service)
+	default:
+		ip = p.nextSequential(family, service)
+	}
+
+	if ip == nil {
+		return fmt.Errorf("no available addresses for service %s in family %d", namespacedName(service), family)
+	}
+
+	return p.Assign(ip, service)
+}
+
+// assignable determines whether AssignNext can assign ip to
+// service. The address needs to be available and can't be cooling
+// down after a release.
+func (p LocalPool) assignable(ip net.IP, service *v1.Service) bool {
+	if p.available(ip, service) != nil {
+		return false
+	}
+
+	if released, wasReleased := p.released[ip.String()]; wasReleased && time.Since(released) < p.cooldown {
+		return false
+	}
+
+	return true
+}
+
+// nextSequential returns the lowest-valued address in family that
+// can be assigned to service, or nil if there isn't one.
+func (p LocalPool) nextSequential(family int, service *v1.Service) net.IP {
 	for pos := p.first(family); pos != nil; pos = p.next(pos) {
-		if err := p.Assign(pos, service); err == nil {
-			// we found an available address
-			return err
+		if p.assignable(pos, service) {
+			return pos
 		}
 	}
 
-	return fmt.Errorf("no available addresses for service %s in family %d", namespacedName(service), family)
+	return nil
+}
+
+// nextRandom returns a randomly-chosen address in family that can be
+// assigned to service, or nil if there isn't one. It picks a random
+// starting point in the family's ranges and walks forward from there,
+// wrapping around at the end of the last range.
+func (p LocalPool) nextRandom(family int, service *v1.Service) net.IP {
+	size := p.familyRangeSize(family)
+	if size == 0 {
+		return nil
+	}
+
+	start := p.offset(family, rand.Uint64()%size)
+	for pos := start; pos != nil; pos = p.next(pos) {
+		if p.assignable(pos, service) {
+			return pos
+		}
+	}
+	for pos := p.first(family); pos != nil && !pos.Equal(start); pos = p.next(pos) {
+		if p.assignable(pos, service) {
+			return pos
+		}
+	}
+
+	return nil
+}
+
+// nextLRU returns the least-recently-used address in family that can
+// be assigned to service, or nil if there isn't one. Addresses that
+// have never been released are preferred, in sequential order.
+func (p LocalPool) nextLRU(family int, service *v1.Service) net.IP {
+	var (
+		oldest     net.IP
+		oldestTime time.Time
+	)
+
+	for pos := p.first(family); pos != nil; pos = p.next(pos) {
+		if !p.assignable(pos, service) {
+			continue
+		}
+
+		released, wasReleased := p.released[pos.String()]
+		if !wasReleased {
+			// Never used (at least not since we started) so it's the best
+			// that we can do
+			return pos
+		}
+		if oldest == nil || released.Before(oldestTime) {
+			oldest = pos
+			oldestTime = released
+		}
+	}
+
+	return oldest
 }
 
 // Assign assigns a service to an IP.
@@ -267,10 +566,14 @@ func (p LocalPool) Assign(ip net.IP, service *v1.Service) error {
 // Release releases an IP so it can be assigned again.
 func (p LocalPool) Release(service string) error {
 	for ipstr, allocs := range p.addressesInUse {
+		_, hadService := allocs[service]
 		delete(allocs, service)
 		if len(allocs) == 0 {
 			delete(p.addressesInUse, ipstr)
 			delete(p.sharingKeys, ipstr)
+			if hadService {
+				p.released[ipstr] = time.Now()
+			}
 		}
 		for port, svc := range p.portsInUse[ipstr] {
 			if svc == service {
@@ -305,45 +608,138 @@ func (p LocalPool) servicesOnIP(ip net.IP) []string {
 	return []string{}
 }
 
+// isExcluded indicates whether ip is on this pool's exclusion list.
+func (p LocalPool) isExcluded(ip net.IP) bool {
+	for _, iprange := range p.excluded {
+		if iprange.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // SharingKey returns the "sharing key" for the specified address.
 func (p LocalPool) SharingKey(ip net.IP) *Key {
 	return p.sharingKeys[ip.String()]
 }
 
-// first returns the first (i.e., lowest-valued) net.IP within this
-// Pool, or nil if the pool has no addresses.
-func (p LocalPool) first(family int) net.IP {
-	if family == nl.FAMILY_V6 && p.v6Range != nil {
-		return p.v6Range.First()
+// inheritReleases copies old's release history into this pool so a
+// configuration change doesn't end any cooldowns early or make the
+// LRU strategy forget which addresses have been used.
+func (p LocalPool) inheritReleases(old LocalPool) {
+	for ipstr, released := range old.released {
+		if _, known := p.released[ipstr]; !known {
+			p.released[ipstr] = released
+		}
 	}
-	if family == nl.FAMILY_V4 && p.v4Range != nil {
-		return p.v4Range.First()
+}
+
+// familyRanges returns this Pool's ranges of addresses in family.
+func (p LocalPool) familyRanges(family int) []IPRange {
+	if family == nl.FAMILY_V6 {
+		return p.v6Ranges
+	}
+	if family == nl.FAMILY_V4 {
+		return p.v4Ranges
 	}
 	return nil
 }
 
+// familySize returns the number of addresses in this Pool's ranges
+// in family that can be allocated, i.e., that aren't excluded.
+func (p LocalPool) familySize(family int) (size uint64) {
+	for _, iprange := range p.familyRanges(family) {
+		size += iprange.Size()
+		for _, excluded := range p.excluded {
+			if common, overlap := iprange.Intersection(excluded); overlap {
+				size -= common.Size()
+			}
+		}
+	}
+	return
+}
+
+// familyRangeSize returns the number of addresses in this Pool's
+// ranges in family, including the excluded ones.
+func (p LocalPool) familyRangeSize(family int) (size uint64) {
+	for _, iprange := range p.familyRanges(family) {
+		size += iprange.Size()
+	}
+	return
+}
+
+// first returns the first (i.e., lowest-valued) net.IP in family
+// within this Pool, or nil if the pool has no addresses in family.
+func (p LocalPool) first(family int) net.IP {
+	ranges := p.familyRanges(family)
+	if len(ranges) == 0 {
+		return nil
+	}
+	return ranges[0].First()
+}
+
 // next returns the next net.IP within this Pool, or nil if the
-// provided net.IP is the last address in the range.
+// provided net.IP is the last address in the pool. If ip is the last
+// address in one of the pool's ranges then next returns the first
+// address in the following range.
 func (p LocalPool) next(ip net.IP) net.IP {
-	if local.AddrFamily(ip) == nl.FAMILY_V6 {
-		return p.v6Range.Next(ip)
+	ranges := p.familyRanges(local.AddrFamily(ip))
+	for i, iprange := range ranges {
+		if !iprange.Contains(ip) {
+			continue
+		}
+		if next := iprange.Next(ip); next != nil {
+			return next
+		}
+		if i+1 < len(ranges) {
+			return ranges[i+1].First()
+		}
+		return nil
 	}
-	if local.AddrFamily(ip) == nl.FAMILY_V4 {
-		return p.v4Range.Next(ip)
+	return nil
+}
+
+// offset returns the address that is n addresses after the first
+// address in family, counting across all of the family's ranges. n
+// should be less than familyRangeSize(), otherwise the result will be
+// nil.
+func (p LocalPool) offset(family int, n uint64) net.IP {
+	for _, iprange := range p.familyRanges(family) {
+		if n < iprange.Size() {
+			return iprange.Offset(n)
+		}
+		n -= iprange.Size()
 	}
 	return nil
 }
 
 // Size returns the total number of addresses in this pool if it's a
 // local pool, or 0 if it's a remote pool.
-func (p LocalPool) Size() (size uint64) {
-	if p.v6Range != nil {
-		size += p.v6Range.Size()
+func (p LocalPool) Size() uint64 {
+	return p.familySize(nl.FAMILY_V6) + p.familySize(nl.FAMILY_V4)
+}
+
+// Status returns a report on this pool's utilization.
+func (p LocalPool) Status() purelbv1.ServiceGroupStatus {
+	status := purelbv1.ServiceGroupStatus{
+		Allocations: allocationStatus(p.addressesInUse),
 	}
-	if p.v4Range != nil {
-		size += p.v4Range.Size()
+
+	if len(p.v4Ranges) > 0 {
+		status.V4 = &purelbv1.ServiceGroupFamilyStatus{Capacity: p.familySize(nl.FAMILY_V4)}
 	}
-	return
+	if len(p.v6Ranges) > 0 {
+		status.V6 = &purelbv1.ServiceGroupFamilyStatus{Capacity: p.familySize(nl.FAMILY_V6)}
+	}
+	for ipstr := range p.addressesInUse {
+		if family := local.AddrFamily(net.ParseIP(ipstr)); family == nl.FAMILY_V4 && status.V4 != nil {
+			status.V4.InUse++
+		} else if family == nl.FAMILY_V6 && status.V6 != nil {
+			status.V6.InUse++
+		}
+	}
+
+	return status
 }
 
 // Overlaps indicates whether the other Pool overlaps with this one
@@ -355,11 +751,14 @@ func (p LocalPool) Overlaps(other Pool) bool {
 		return false
 	}
 
-	if p.v4Range != nil && lpool.v4Range != nil && p.v4Range.Overlaps(*lpool.v4Range) {
-		return true
-	}
-	if p.v6Range != nil && lpool.v6Range != nil && p.v6Range.Overlaps(*lpool.v6Range) {
-		return true
+	for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+		for _, mine := range p.familyRanges(family) {
+			for _, theirs := range lpool.familyRanges(family) {
+				if mine.Overlaps(theirs) {
+					return true
+				}
+			}
+		}
 	}
 
 	return false
@@ -368,11 +767,10 @@ func (p LocalPool) Overlaps(other Pool) bool {
 // Contains indicates whether the provided net.IP represents an
 // address within this Pool.  It returns true if so, false otherwise.
 func (p LocalPool) Contains(ip net.IP) bool {
-	if p.v4Range != nil && p.v4Range.Contains(ip) {
-		return true
-	}
-	if p.v6Range != nil && p.v6Range.Contains(ip) {
-		return true
+	for _, iprange := range p.familyRanges(local.AddrFamily(ip)) {
+		if iprange.Contains(ip) {
+			return true
+		}
 	}
 	return false
 }
@@ -382,20 +780,5 @@ func (p LocalPool) Contains(ip net.IP) bool {
 // one for each address to assign, in the order that they should be
 // assigned. An empty array means that any family is OK.
 func (p LocalPool) whichFamilies(service *v1.Service) ([]int, error) {
-	if len(service.Spec.IPFamilies) == 0 {
-		return []int{}, nil
-	}
-
-	families := []int{}
-	for _, family := range service.Spec.IPFamilies {
-		if family == v1.IPv6Protocol {
-			families = append(families, nl.FAMILY_V6)
-		} else if family == v1.IPv4Protocol {
-			families = append(families, nl.FAMILY_V4)
-		} else {
-			p.logger.Log("service %s unknown IP family %s", service.Name, family)
-		}
-	}
-
-	return families, nil
+	return serviceFamilies(p.logger, service), nil
 }
@@ -14,14 +14,17 @@
 package allocator
 
 import (
+	"fmt"
 	"net"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/vishvananda/netlink/nl"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
@@ -29,7 +32,7 @@ import (
 var (
 	key1                = Key{Sharing: "sharing1"}
 	key2                = Key{Sharing: "sharing2"}
-	http                = Port{Proto: v1.ProtocolTCP, Port: 80}
+	httpPort            = Port{Proto: v1.ProtocolTCP, Port: 80}
 	smtp                = Port{Proto: v1.ProtocolTCP, Port: 25}
 	localPoolTestLogger = log.NewNopLogger()
 )
@@ -258,6 +261,213 @@ func TestAssignNext(t *testing.T) {
 	assert.NoError(t, p.AssignNext(&svc3))
 }
 
+func TestMultipleRanges(t *testing.T) {
+	spec := purelbv1.ServiceGroupLocalSpec{
+		V4Pool: &purelbv1.ServiceGroupAddressPool{Pool: "192.168.2.0/31", Subnet: "192.168.2.0/24"},
+		V4Pools: []purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.4-192.168.1.5", Subnet: "192.168.1.0/24"},
+			{Pool: "10.0.0.0/32", Subnet: "10.0.0.0/24"},
+		},
+		V6Pools: []purelbv1.ServiceGroupAddressPool{
+			{Pool: "2001:db8::/127", Subnet: "2001:db8::/64"},
+			{Pool: "2001:db9::1/128", Subnet: "2001:db9::/64"},
+		},
+	}
+	p, err := NewLocalPool(localPoolTestLogger, spec)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(8), p.Size())
+	assert.True(t, p.Contains(net.ParseIP("192.168.1.5")))
+	assert.True(t, p.Contains(net.ParseIP("2001:db9::1")))
+	assert.False(t, p.Contains(net.ParseIP("192.168.1.6")))
+	assert.False(t, p.Contains(net.ParseIP("2001:db8::2")))
+
+	status := p.Status()
+	assert.Equal(t, uint64(5), status.V4.Capacity)
+	assert.Equal(t, uint64(3), status.V6.Capacity)
+
+	// Sequential allocation walks the ranges in address order, not in
+	// the order in which they were configured
+	want := []string{"10.0.0.0", "192.168.1.4", "192.168.1.5", "192.168.2.0", "192.168.2.1"}
+	for i, ip := range want {
+		svc := service(fmt.Sprintf("svc%d", i), ports("tcp/80"), "")
+		svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+		assert.NoError(t, p.AssignNext(&svc))
+		assert.Equal(t, ip, svc.Status.LoadBalancer.Ingress[0].IP)
+	}
+	svc := service("full", ports("tcp/80"), "")
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+	assert.Error(t, p.AssignNext(&svc), "pool should be full")
+
+	// Overlaps checks every range
+	assert.True(t, p.Overlaps(mustLocalPool(t, "192.168.1.5/32")))
+	assert.True(t, p.Overlaps(mustLocalPool(t, "2001:db9::1/128")))
+	assert.False(t, p.Overlaps(mustLocalPool(t, "192.168.1.6/32")))
+
+	// Random allocation can reach every range
+	spec.AllocationStrategy = purelbv1.AllocationRandom
+	p, err = NewLocalPool(localPoolTestLogger, spec)
+	assert.NoError(t, err)
+	assigned := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		svc := service(fmt.Sprintf("svc%d", i), ports("tcp/80"), "")
+		svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol}
+		assert.NoError(t, p.AssignNext(&svc))
+		assigned[svc.Status.LoadBalancer.Ingress[0].IP] = true
+	}
+	assert.Equal(t, map[string]bool{"2001:db8::": true, "2001:db8::1": true, "2001:db9::1": true}, assigned)
+
+	// Ranges in a group can't overlap
+	_, err = NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.0/24", Subnet: "192.168.1.0/24"},
+			{Pool: "192.168.1.4-192.168.1.5", Subnet: "192.168.1.0/24"},
+		},
+	})
+	assert.Error(t, err, "overlapping ranges were accepted")
+
+	// Ranges must be in the right family
+	_, err = NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V6Pools: []purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.0/24", Subnet: "192.168.1.0/24"},
+		},
+	})
+	assert.Error(t, err, "IPV4 range in V6Pools was accepted")
+}
+
+func TestExclusions(t *testing.T) {
+	p, err := NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pool: &purelbv1.ServiceGroupAddressPool{Pool: "192.168.1.0/29", Subnet: "192.168.1.0/24"},
+		Exclude: []string{
+			"192.168.1.1",
+			"192.168.1.2-192.168.1.3",
+			"192.168.1.2/31", // overlaps the previous entry
+			"10.0.0.1",       // isn't in the pool
+		},
+		SkipNetworkBroadcast: true,
+	})
+	assert.NoError(t, err)
+
+	// 8 addresses, minus network, broadcast, and 3 excluded
+	assert.Equal(t, uint64(3), p.Size())
+	assert.Equal(t, uint64(3), p.Status().V4.Capacity)
+
+	// AssignNext skips the excluded addresses
+	for i, want := range []string{"192.168.1.4", "192.168.1.5", "192.168.1.6"} {
+		svc := service(fmt.Sprintf("svc%d", i), ports("tcp/80"), "")
+		assert.NoError(t, p.AssignNext(&svc))
+		assert.Equal(t, want, svc.Status.LoadBalancer.Ingress[0].IP)
+	}
+	svc := service("full", ports("tcp/80"), "")
+	assert.Error(t, p.AssignNext(&svc), "pool should be full")
+
+	// Excluded addresses are still part of the pool but can't be
+	// assigned explicitly
+	for _, ip := range []string{"192.168.1.0", "192.168.1.3", "192.168.1.7"} {
+		assert.True(t, p.Contains(net.ParseIP(ip)))
+		svc := service("explicit", ports("tcp/80"), "")
+		assert.Error(t, p.Assign(net.ParseIP(ip), &svc), "excluded address %s was assigned", ip)
+	}
+
+	// Network and broadcast are only skipped if the user asks
+	assert.Equal(t, uint64(4), mustLocalPool(t, "192.168.1.0/30").Size())
+
+	// Bad exclusions are rejected
+	_, err = NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:    "192.168.1.0/30",
+		Subnet:  "192.168.1.0/30",
+		Exclude: []string{"192.168.1.300"},
+	})
+	assert.Error(t, err, "invalid exclusion was accepted")
+}
+
+func TestAllocationStrategy(t *testing.T) {
+	_, err := NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:               "192.168.1.0/30",
+		Subnet:             "192.168.1.0/30",
+		AllocationStrategy: "bogus",
+	})
+	assert.Error(t, err, "pool with unknown strategy was accepted")
+
+	_, err = NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:            "192.168.1.0/30",
+		Subnet:          "192.168.1.0/30",
+		ReleaseCooldown: &metav1.Duration{Duration: -time.Second},
+	})
+	assert.Error(t, err, "pool with negative cooldown was accepted")
+}
+
+func TestAssignNextRandom(t *testing.T) {
+	p := mustStrategyPool(t, "192.168.1.0/28", purelbv1.AllocationRandom, 0)
+
+	// Every address should get used exactly once
+	assigned := map[string]bool{}
+	for i := 0; i < 16; i++ {
+		svc := service(fmt.Sprintf("svc%d", i), ports("tcp/80"), "")
+		assert.NoError(t, p.AssignNext(&svc))
+		ip := svc.Status.LoadBalancer.Ingress[0].IP
+		assert.False(t, assigned[ip], "address %s assigned twice", ip)
+		assigned[ip] = true
+	}
+	assert.Len(t, assigned, 16)
+
+	// The pool is full
+	svc := service("svc16", ports("tcp/80"), "")
+	assert.Error(t, p.AssignNext(&svc))
+}
+
+func TestAssignNextLRU(t *testing.T) {
+	p := mustStrategyPool(t, "192.168.1.0/30", purelbv1.AllocationLRU, 0)
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc4 := service("svc4", ports("tcp/80"), "")
+
+	// svc1 gets the first address and then releases it. svc2 should
+	// get an address that has never been used instead of svc1's
+	assert.NoError(t, p.AssignNext(&svc1))
+	assert.Equal(t, "192.168.1.0", svc1.Status.LoadBalancer.Ingress[0].IP)
+	assert.NoError(t, p.Release(namespacedName(&svc1)))
+	assert.NoError(t, p.AssignNext(&svc2))
+	assert.Equal(t, "192.168.1.1", svc2.Status.LoadBalancer.Ingress[0].IP)
+
+	// Once every address has been used, the one that was released
+	// longest ago wins
+	p.released["192.168.1.2"] = time.Now().Add(-time.Hour)
+	p.released["192.168.1.3"] = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, p.AssignNext(&svc3))
+	assert.Equal(t, "192.168.1.3", svc3.Status.LoadBalancer.Ingress[0].IP)
+	assert.NoError(t, p.AssignNext(&svc4))
+	assert.Equal(t, "192.168.1.2", svc4.Status.LoadBalancer.Ingress[0].IP)
+}
+
+func TestReleaseCooldown(t *testing.T) {
+	p := mustStrategyPool(t, "192.168.1.0/31", purelbv1.AllocationSequential, time.Hour)
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc3 := service("svc3", ports("tcp/80"), "")
+
+	assert.NoError(t, p.AssignNext(&svc1))
+	assert.Equal(t, "192.168.1.0", svc1.Status.LoadBalancer.Ingress[0].IP)
+	assert.NoError(t, p.Release(namespacedName(&svc1)))
+
+	// svc1's address is cooling down so svc2 gets the other one, and
+	// then the pool is effectively empty
+	assert.NoError(t, p.AssignNext(&svc2))
+	assert.Equal(t, "192.168.1.1", svc2.Status.LoadBalancer.Ingress[0].IP)
+	assert.Error(t, p.AssignNext(&svc3))
+
+	// A service can still ask for the address explicitly
+	assert.NoError(t, p.Assign(net.ParseIP("192.168.1.0"), &svc3))
+	assert.NoError(t, p.Release(namespacedName(&svc3)))
+
+	// Once the cooldown is over the address is available again
+	p.released["192.168.1.0"] = time.Now().Add(-2 * time.Hour)
+	svc3 = service("svc3", ports("tcp/80"), "")
+	assert.NoError(t, p.AssignNext(&svc3))
+	assert.Equal(t, "192.168.1.0", svc3.Status.LoadBalancer.Ingress[0].IP)
+}
+
 func TestPoolSize(t *testing.T) {
 	p, err := NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
 		V4Pool: &purelbv1.ServiceGroupAddressPool{
@@ -273,6 +483,25 @@ func TestPoolSize(t *testing.T) {
 	assert.Equal(t, uint64(3), p.Size(), "Pool Size() failed")
 }
 
+func TestLocalPoolStatus(t *testing.T) {
+	p := mustDualStackPool(t, "192.168.1.0/30", "192.168.1.0/24", "fd53:9ef0:8683::/126", "fd53:9ef0:8683::/120")
+	status := p.Status()
+	assert.Equal(t, &purelbv1.ServiceGroupFamilyStatus{Capacity: 4, InUse: 0}, status.V4)
+	assert.Equal(t, &purelbv1.ServiceGroupFamilyStatus{Capacity: 4, InUse: 0}, status.V6)
+	assert.Empty(t, status.Allocations)
+
+	svc := service("svc1", ports("tcp/80"), "")
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	assert.NoError(t, p.AssignNext(&svc))
+	status = p.Status()
+	assert.Equal(t, 1, status.V4.InUse)
+	assert.Equal(t, 1, status.V6.InUse)
+	assert.Equal(t, []purelbv1.ServiceGroupAllocation{
+		{Address: "192.168.1.0", Services: []string{"unit/svc1"}},
+		{Address: "fd53:9ef0:8683::", Services: []string{"unit/svc1"}},
+	}, status.Allocations)
+}
+
 func TestWhichFamilies(t *testing.T) {
 	var (
 		families []int
@@ -329,6 +558,14 @@ func mustLocalPool(t *testing.T, r string) LocalPool {
 	return *p
 }
 
+func mustStrategyPool(t *testing.T, r string, strategy string, cooldown time.Duration) LocalPool {
+	p, err := NewLocalPool(localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{Pool: r, Subnet: r, AllocationStrategy: strategy, ReleaseCooldown: &metav1.Duration{Duration: cooldown}})
+	if err != nil {
+		panic(err)
+	}
+	return *p
+}
+
 func mustDualStackPool(t *testing.T, pool4 string, subnet4 string, pool6 string, subnet6 string) LocalPool {
 	p, err := NewLocalPool(allocatorTestLogger, purelbv1.ServiceGroupLocalSpec{V4Pool: &purelbv1.ServiceGroupAddressPool{Pool: pool4, Subnet: subnet4}, V6Pool: &purelbv1.ServiceGroupAddressPool{Pool: pool6, Subnet: subnet6}})
 	if err != nil {
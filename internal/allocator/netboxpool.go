@@ -19,148 +19,92 @@ import (
 	"fmt"
 	"net"
 	"net/url"
-	"os"
+	"time"
 
 	"github.com/go-kit/kit/log"
-	v1 "k8s.io/api/core/v1"
 
 	"purelb.io/internal/netbox"
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
-// NetboxPool is the IP address pool that requests IP addresses from a
-// Netbox IPAM system.
-type NetboxPool struct {
-	logger log.Logger
-
-	url       string
-	userToken string
-	netbox    netbox.Netbox
-
-	// services caches the addresses that we've allocated to a specific
-	// service. It's used so we can release addresses when we're given
-	// only the service name. The key is the service's namespaced name,
-	// and the value is an array of the addresses assigned to that
-	// service.
-	services map[string][]net.IP
-
-	// Map of the addresses that have been assigned.
-	addressesInUse map[string]map[string]bool // ip.String() -> svc name -> true
-}
-
-// NewNetboxPool initializes a new instance of NetboxPool. If error is
-// non-nil then the returned NetboxPool should not be used.
-func NewNetboxPool(log log.Logger, spec purelbv1.ServiceGroupNetboxSpec) (*NetboxPool, error) {
-	// Make sure that we've got credentials for Netbox
-	userToken, ok := os.LookupEnv("NETBOX_USER_TOKEN")
-	if !ok {
-		return nil, fmt.Errorf("NETBOX_USER_TOKEN not set, can't connect to Netbox")
-	}
-
+// NewNetboxPool initializes a new instance of IPAMPool that uses
+// credentials to connect to the Netbox system that spec describes. If
+// error is non-nil then the returned IPAMPool should not be used.
+func NewNetboxPool(log log.Logger, spec purelbv1.ServiceGroupNetboxSpec, credentials Credentials) (*IPAMPool, error) {
 	// Validate the url from the service group
 	url, err := url.Parse(spec.URL)
 	if err != nil {
 		return nil, fmt.Errorf("Netbox URL invalid")
 	}
 
-	return &NetboxPool{
-		logger:         log,
-		url:            url.String(),
-		userToken:      userToken,
-		netbox:         netbox.NewNetbox(url.String(), spec.Tenant, userToken),
-		services:       map[string][]net.IP{},
-		addressesInUse: map[string]map[string]bool{},
-	}, nil
-}
-
-func (p NetboxPool) Notify(service *v1.Service) error {
-	nsName := namespacedName(service)
-
-	for _, ingress := range service.Status.LoadBalancer.Ingress {
-		ipstr := ingress.IP
-		ip := net.ParseIP(ipstr)
-		if ip == nil {
-			return fmt.Errorf("Service %s has unparseable IP %s", namespacedName(service), ipstr)
-		}
-
-		if p.addressesInUse[ipstr] == nil {
-			p.addressesInUse[ipstr] = map[string]bool{}
-		}
-		p.addressesInUse[ipstr][nsName] = true
-		p.services[nsName] = append(p.services[nsName], ip)
-	}
-
-	return nil
-}
-
-// AssignNext assigns a service to the next available IP.
-func (p NetboxPool) AssignNext(service *v1.Service) error {
-	// fetch from netbox
-	cidr, err := p.netbox.Fetch()
+	prefixes, err := netboxPrefixes(spec.Prefixes)
 	if err != nil {
-		return fmt.Errorf("no available IPs in pool %q", err)
+		return nil, err
 	}
-	ip, _, err := net.ParseCIDR(cidr)
+
+	rootCAs, err := credentials.rootCAs()
 	if err != nil {
-		return fmt.Errorf("error parsing CIDR %s", cidr)
+		return nil, err
 	}
-	if err := p.Assign(ip, service); err != nil {
-		return err
-	}
-
-	return nil
-}
 
-// Assign assigns a service to an IP.
-func (p NetboxPool) Assign(ip net.IP, service *v1.Service) error {
-	// we have an IP selected somehow, so program the data plane
-	addIngress(p.logger, service, ip)
-
-	// Update our internal allocation data structures
-	return p.Notify(service)
-}
-
-// Release releases an IP so it can be assigned again.
-func (p NetboxPool) Release(service string) error {
-	ip, haveIp := p.services[service]
-	if !haveIp {
-		return fmt.Errorf("trying to release an IP from unknown service %s", service)
-	}
-	delete(p.services, service)
-	ipstr := ip[0].String()
-	delete(p.addressesInUse[ipstr], service)
-	if len(p.addressesInUse[ipstr]) == 0 {
-		delete(p.addressesInUse, ipstr)
+	var orphanGracePeriod time.Duration
+	releaseOrphans := spec.ReleaseOrphansAfter != nil
+	if releaseOrphans {
+		if spec.ReleaseOrphansAfter.Duration < 0 {
+			return nil, fmt.Errorf("orphan grace period %s is negative", spec.ReleaseOrphansAfter.Duration)
+		}
+		orphanGracePeriod = spec.ReleaseOrphansAfter.Duration
 	}
-	return nil
-}
 
-// InUse returns the count of addresses that currently have services
-// assigned.
-func (p NetboxPool) InUse() int {
-	return len(p.addressesInUse)
-}
-
-// Size returns the total number of addresses in this pool if it's a
-// local pool, or 0 if it's a remote pool.
-func (p NetboxPool) Size() uint64 {
-	return uint64(0)
-}
+	// The cluster name is what makes our ownership metadata ours.
+	// ServiceGroups from before it existed don't have one so we keep
+	// writing and matching the metadata without it, like we used to,
+	// but then we can't tell when another cluster's allocator claims an
+	// address at the same time as we do, and we'd think that other
+	// clusters' orphans were ours, so we don't release them
+	if spec.Cluster == "" {
+		log.Log("op", "netboxPool", "tenant", spec.Tenant, "msg", "Netbox pools without a cluster are deprecated, set cluster to a name that's unique among the clusters that share the tenant")
+		if releaseOrphans {
+			log.Log("op", "netboxPool", "tenant", spec.Tenant, "msg", "ignoring releaseOrphansAfter since cluster isn't set, orphans will only be reported")
+			releaseOrphans = false
+		}
+	}
 
-// Overlaps indicates whether the other Pool overlaps with this one
-// (i.e., has any addresses in common).  It returns true if there are
-// any common addresses and false if there aren't. This implementation
-// always returns false since the pool is managed by a remote system.
-func (p NetboxPool) Overlaps(other Pool) bool {
-	return false
+	pool := NewIPAMPool(log, netbox.NewBackend(netbox.Config{
+		URL:           url.String(),
+		Tenant:        spec.Tenant,
+		Token:         credentials.Token,
+		RootCAs:       rootCAs,
+		ReleaseStatus: spec.ReleaseStatus,
+		Cluster:       spec.Cluster,
+		CustomFields:  spec.CustomFields,
+		Prefixes:      prefixes,
+	}))
+	pool.releaseOrphans = releaseOrphans
+	pool.orphanGracePeriod = orphanGracePeriod
+	return pool, nil
 }
 
-// Contains indicates whether the provided net.IP represents an
-// address within this Pool.  It returns true if so, false
-// otherwise. In this case the pool is owned by a remote system so
-// "address within this Pool" means that the address has been
-// allocated by a previous call to AssignNext().
-func (p NetboxPool) Contains(ip net.IP) bool {
-	_, allocated := p.addressesInUse[ip.String()]
-	return allocated
+// netboxPrefixes validates the prefix selectors from a ServiceGroup
+// and converts them into their netbox equivalents.
+func netboxPrefixes(specs []purelbv1.ServiceGroupNetboxPrefix) ([]netbox.PrefixSelector, error) {
+	prefixes := []netbox.PrefixSelector{}
+	for _, spec := range specs {
+		set := 0
+		for _, isSet := range []bool{spec.ID != 0, spec.Prefix != "", spec.Role != "", spec.Tag != ""} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("Netbox prefix %+v must have exactly one of id, prefix, role, or tag", spec)
+		}
+		if spec.Prefix != "" {
+			if _, _, err := net.ParseCIDR(spec.Prefix); err != nil {
+				return nil, fmt.Errorf("Netbox prefix %s invalid: %w", spec.Prefix, err)
+			}
+		}
+		prefixes = append(prefixes, netbox.PrefixSelector{ID: spec.ID, Prefix: spec.Prefix, Role: spec.Role, Tag: spec.Tag})
+	}
+	return prefixes, nil
 }
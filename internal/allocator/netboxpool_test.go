@@ -13,12 +13,18 @@
 package allocator
 
 import (
+	"encoding/pem"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"purelb.io/internal/netbox"
 	"purelb.io/internal/netbox/fake"
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
@@ -31,9 +37,16 @@ func TestNetboxContains(t *testing.T) {
 	svc1 := service("svc1", ports("tcp/80"), "sharing1")
 	nsName := namespacedName(&svc1)
 
-	nbp, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: "url", Tenant: "tenant"})
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("10.1.2.3/32", "reserved", "tenant")
+
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", ReleaseStatus: netbox.ReleaseDelete}, Credentials{Token: "token"})
 	assert.Nil(t, err, "NewNetboxPool()")
-	nbp.netbox = fake.NewNetbox("base", "tenant", "token") // patch the pool with a fake Netbox client
+	assert.Empty(t, server.Requests(), "NewNetboxPool() talked to Netbox")
+	assert.False(t, nbp.Contains(net.ParseIP("10.1.2.3")), "pool hasn't asked Netbox for its networks")
+	nbp.RefreshNetworks()
+	assert.True(t, nbp.Contains(net.ParseIP("10.1.2.3")))
 
 	err = nbp.AssignNext(&svc1)
 	assert.Nil(t, err, "Netbox pool AssignNext() failed")
@@ -42,6 +55,387 @@ func TestNetboxContains(t *testing.T) {
 	assert.NotNil(t, assigned, "service was assigned an unparseable IP")
 	assert.True(t, nbp.Contains(assigned), "address should have been contained in pool but wasn't")
 
+	// The pool checks addresses against the networks that it cached,
+	// without asking Netbox, until it refreshes them
 	nbp.Release(nsName)
+	server.AddAddress("10.1.2.4/32", "reserved", "tenant")
+	requests := server.Requests()
+	assert.True(t, nbp.Contains(assigned), "cached address")
+	assert.False(t, nbp.Contains(net.ParseIP("10.1.2.4")), "address that Netbox reserved after we cached its networks")
+	assert.Equal(t, requests, server.Requests(), "Contains asked Netbox")
+
+	nbp.RefreshNetworks()
 	assert.False(t, nbp.Contains(assigned), "address should not have been contained in pool but was")
+	assert.True(t, nbp.Contains(net.ParseIP("10.1.2.4")))
+}
+
+func TestNetboxRelease(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("10.1.2.3/32", "reserved", "tenant")
+
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test"}, Credentials{Token: "token"})
+	assert.Nil(t, err, "NewNetboxPool()")
+	nbp.RefreshNetworks()
+
+	alloc := New(netboxPoolTestLogger)
+	alloc.pools = map[string]Pool{"netbox": *nbp}
+
+	// Two services share the address
+	svc1 := service("svc1", ports("tcp/80"), "sharing1")
+	svc2 := service("svc2", ports("tcp/81"), "sharing1")
+	assert.NoError(t, nbp.AssignNext(&svc1))
+	assert.Equal(t, "active", server.Address("10.1.2.3/32").Status)
+	svc2.Status = svc1.Status
+	assert.NoError(t, nbp.Notify(&svc2))
+
+	assert.Equal(t, "svc1.unit.test", server.Address("10.1.2.3/32").DNSName)
+
+	// When the address's owner lets go of it, Netbox learns that the
+	// other service is using it, and the address goes back to Netbox
+	// when the last service lets go of it
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc1)))
+	assert.Equal(t, "active", server.Address("10.1.2.3/32").Status)
+	assert.Equal(t, "svc2.unit.test", server.Address("10.1.2.3/32").DNSName)
+	assert.NoError(t, alloc.Unassign(namespacedName(&svc2)))
+	assert.Equal(t, "reserved", server.Address("10.1.2.3/32").Status)
+	assert.Empty(t, server.Address("10.1.2.3/32").DNSName)
+	assert.Equal(t, 0, nbp.InUse())
+
+	// The address is reserved for our tenant so the pool can claim it
+	// again
+	assert.True(t, nbp.Contains(net.ParseIP("10.1.2.3")))
+}
+
+func TestNetboxStandbyRelease(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("10.1.2.3/32", "reserved", "tenant")
+
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test"}, Credentials{Token: "token"})
+	assert.Nil(t, err, "NewNetboxPool()")
+
+	// The leader allocated the address
+	svc1 := service("svc1", ports("tcp/80"), "sharing1")
+	assert.NoError(t, nbp.AssignNext(&svc1))
+	svc2 := service("svc2", ports("tcp/81"), "sharing1")
+	svc2.Status = svc1.Status
+
+	standby := New(netboxPoolTestLogger)
+	standby.pools = map[string]Pool{"netbox": *nbp}
+	standby.SetStandby(true)
+	assert.NoError(t, nbp.Notify(&svc2))
+	requests := server.Requests()
+
+	// The standby forgets the services but leaves Netbox to the leader
+	assert.NoError(t, standby.Unassign(namespacedName(&svc1)))
+	assert.NoError(t, standby.Unassign(namespacedName(&svc2)))
+	assert.Equal(t, 0, nbp.InUse())
+	assert.Equal(t, requests, server.Requests(), "standby talked to Netbox")
+	assert.Equal(t, "active", server.Address("10.1.2.3/32").Status)
+	assert.Equal(t, "svc1.unit.test", server.Address("10.1.2.3/32").DNSName)
+}
+
+func TestNetboxResync(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("10.1.2.3/32", "reserved", "tenant")
+
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", ReleaseStatus: netbox.ReleaseDelete}, Credentials{Token: "token"})
+	assert.Nil(t, err, "NewNetboxPool()")
+	nbp.RefreshNetworks()
+
+	alloc := New(netboxPoolTestLogger)
+	alloc.pools = map[string]Pool{"netbox": *nbp}
+
+	svc1 := service("svc1", ports("tcp/80"), "sharing1")
+	svc1.Spec.LoadBalancerIP = "10.1.2.3"
+	pool, err := alloc.allocateSpecificIP(&svc1)
+	assert.NoError(t, err)
+	assert.Equal(t, "netbox", pool)
+	id := server.Address("10.1.2.3/32").ID
+	requests := server.Requests()
+
+	// The service's status update was lost so we see it again without
+	// ingress. The pool already holds the address for it so we give it
+	// back without releasing it, which would delete Netbox's record
+	svc1.Status.LoadBalancer.Ingress = nil
+	pool, err = alloc.allocateSpecificIP(&svc1)
+	assert.NoError(t, err)
+	assert.Equal(t, "netbox", pool)
+	assert.Equal(t, "10.1.2.3", svc1.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, requests, server.Requests(), "re-sync talked to Netbox")
+	assert.Equal(t, id, server.Address("10.1.2.3/32").ID)
+	assert.Equal(t, 1, nbp.InUse())
+}
+
+func TestNetboxPrefixes(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddPrefix("10.1.2.0/29", "", "")
+	server.AddPrefix("2001:db8::/120", "", "")
+
+	// Each prefix selector needs exactly one field
+	_, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", Prefixes: []purelbv1.ServiceGroupNetboxPrefix{{}}}, Credentials{Token: "token"})
+	assert.Error(t, err, "empty prefix selector")
+	_, err = NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", Prefixes: []purelbv1.ServiceGroupNetboxPrefix{{ID: 1, Role: "lb"}}}, Credentials{Token: "token"})
+	assert.Error(t, err, "prefix selector with two fields")
+	_, err = NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", Prefixes: []purelbv1.ServiceGroupNetboxPrefix{{Prefix: "10.1.2.0"}}}, Credentials{Token: "token"})
+	assert.Error(t, err, "malformed prefix")
+
+	spec := purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", Prefixes: []purelbv1.ServiceGroupNetboxPrefix{
+		{Prefix: "10.1.2.0/29"},
+		{Prefix: "2001:db8::/120"},
+	}}
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, spec, Credentials{Token: "token"})
+	assert.NoError(t, err, "NewNetboxPool()")
+
+	// The pool knows how big its prefixes are
+	assert.Equal(t, uint64(6+256), nbp.Size())
+
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, nbp.AssignNext(&svc1))
+	assert.Equal(t, "10.1.2.1", svc1.Status.LoadBalancer.Ingress[0].IP)
+
+	status := nbp.Status()
+	assert.Equal(t, uint64(6), status.V4.Capacity)
+	assert.Equal(t, 1, status.V4.InUse)
+	assert.Equal(t, uint64(256), status.V6.Capacity)
+	assert.Equal(t, 0, status.V6.InUse)
+}
+
+func TestNetboxDualStack(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddPrefix("10.1.2.0/29", "", "")
+	server.AddPrefix("2001:db8::/120", "", "")
+	server.AddAddress("192.168.1.1/32", "reserved", "tenant")
+	server.AddAddress("192.168.1.2/32", "reserved", "someone-else")
+
+	spec := purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", Prefixes: []purelbv1.ServiceGroupNetboxPrefix{
+		{Prefix: "10.1.2.0/29"},
+		{Prefix: "2001:db8::/120"},
+	}}
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, spec, Credentials{Token: "token"})
+	assert.NoError(t, err, "NewNetboxPool()")
+	nbp.RefreshNetworks()
+
+	alloc := New(netboxPoolTestLogger)
+	alloc.client = &testK8S{t: t}
+	alloc.pools = map[string]Pool{"default": *nbp}
+
+	// Dual-stack services get one address per family
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc1.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+	_, err = alloc.AllocateAnyIP(&svc1)
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "2001:db8::"}, {IP: "10.1.2.1"}}, svc1.Status.LoadBalancer.Ingress)
+
+	// Single-stack services get one address in their family
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+	_, err = alloc.AllocateAnyIP(&svc2)
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "10.1.2.2"}}, svc2.Status.LoadBalancer.Ingress)
+
+	// Users can ask for addresses that are reserved for our tenant in
+	// Netbox, or that are in our prefixes
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc3.Spec.LoadBalancerIP = "192.168.1.1"
+	_, err = alloc.AllocateAnyIP(&svc3)
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "192.168.1.1"}}, svc3.Status.LoadBalancer.Ingress)
+	assert.Equal(t, "active", server.Address("192.168.1.1/32").Status)
+	assert.Equal(t, "svc3.unit.test", server.Address("192.168.1.1/32").DNSName)
+
+	svc4 := service("svc4", ports("tcp/80"), "")
+	svc4.Annotations = map[string]string{purelbv1.AddressesAnnotation: "10.1.2.6"}
+	svc4.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	_, err = alloc.AllocateAnyIP(&svc4)
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "10.1.2.6"}, {IP: "2001:db8::1"}}, svc4.Status.LoadBalancer.Ingress)
+
+	// but not addresses that belong to other tenants, or that are
+	// already in use
+	svc5 := service("svc5", ports("tcp/80"), "")
+	svc5.Spec.LoadBalancerIP = "192.168.1.2"
+	_, err = alloc.AllocateAnyIP(&svc5)
+	assert.Error(t, err)
+	svc5.Spec.LoadBalancerIP = "10.1.2.3"
+	server.AddAddress("10.1.2.3/29", "active", "tenant")
+	_, err = alloc.AllocateAnyIP(&svc5)
+	assert.Error(t, err)
+}
+
+func TestCredentials(t *testing.T) {
+	group := func(credentials *purelbv1.ServiceGroupCredentials) *purelbv1.ServiceGroup {
+		sg := serviceGroup("netbox", purelbv1.ServiceGroupSpec{Netbox: &purelbv1.ServiceGroupNetboxSpec{
+			URL:         "https://netbox.example.com/",
+			Tenant:      "tenant",
+			Cluster:     "test",
+			Credentials: credentials,
+		}})
+		sg.Namespace = "purelb"
+		return sg
+	}
+	secrets := map[string]*v1.Secret{
+		"purelb/netbox": {Data: map[string][]byte{
+			"token":  []byte("secret-token\n"),
+			"other":  []byte("other-token"),
+			"ca.crt": []byte("ca-bundle"),
+		}},
+	}
+
+	// Without a Secret the token comes from the environment
+	saved, set := os.LookupEnv("NETBOX_USER_TOKEN")
+	defer func() {
+		if set {
+			os.Setenv("NETBOX_USER_TOKEN", saved)
+		} else {
+			os.Unsetenv("NETBOX_USER_TOKEN")
+		}
+	}()
+	os.Setenv("NETBOX_USER_TOKEN", "env-token")
+	creds, err := poolCredentials(group(nil), secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Token: "env-token"}, creds)
+	os.Unsetenv("NETBOX_USER_TOKEN")
+	_, err = poolCredentials(group(nil), secrets)
+	assert.Error(t, err, "no token in the environment")
+
+	// Groups that don't use Netbox don't need credentials
+	creds, err = poolCredentials(localServiceGroup("local", "192.168.1.0/24"), secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{}, creds)
+
+	creds, err = poolCredentials(group(&purelbv1.ServiceGroupCredentials{SecretName: "netbox"}), secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Token: "secret-token"}, creds, "default token key")
+
+	creds, err = poolCredentials(group(&purelbv1.ServiceGroupCredentials{SecretName: "netbox", TokenKey: "other", CAKey: "ca.crt"}), secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Token: "other-token", CABundle: []byte("ca-bundle")}, creds)
+
+	_, err = poolCredentials(group(&purelbv1.ServiceGroupCredentials{SecretName: "missing"}), secrets)
+	assert.Error(t, err, "missing Secret")
+	_, err = poolCredentials(group(&purelbv1.ServiceGroupCredentials{SecretName: "netbox", TokenKey: "missing"}), secrets)
+	assert.Error(t, err, "missing token key")
+	_, err = poolCredentials(group(&purelbv1.ServiceGroupCredentials{SecretName: "netbox", CAKey: "missing"}), secrets)
+	assert.Error(t, err, "missing CA key")
+}
+
+func TestNetboxCABundle(t *testing.T) {
+	server := fake.NewTLSServer("token")
+	defer server.Close()
+	server.AddAddress("10.1.2.3/32", "reserved", "tenant")
+	spec := purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test"}
+
+	_, err := NewNetboxPool(netboxPoolTestLogger, spec, Credentials{Token: "token", CABundle: []byte("not PEM")})
+	assert.Error(t, err, "invalid CA bundle")
+
+	// The pool trusts the server's self-signed certificate only if it's
+	// in the bundle
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, spec, Credentials{Token: "token", CABundle: ca})
+	assert.NoError(t, err)
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, nbp.AssignNext(&svc1))
+	assert.Equal(t, "10.1.2.3", svc1.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, "active", server.Address("10.1.2.3/32").Status)
+}
+
+func TestNetboxReconcile(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("10.1.2.1/32", "active", "tenant").Description = "Service unit/svc1 in cluster test, allocated by PureLB"
+	server.AddAddress("10.1.2.2/32", "active", "tenant").Description = "Service unit/gone in cluster test, allocated by PureLB"
+	server.AddAddress("10.1.2.3/32", "active", "tenant").Description = "Service unit/old in cluster test, allocated by PureLB"
+	server.AddAddress("10.1.2.4/32", "reserved", "tenant")
+	server.AddAddress("10.1.2.5/32", "active", "tenant").Description = "Router loopback"
+	server.AddAddress("10.1.2.6/32", "active", "tenant").Description = "Service unit/gone in cluster other, allocated by PureLB"
+
+	group := func(releaseOrphansAfter *metav1.Duration) *purelbv1.ServiceGroup {
+		sg := serviceGroup("netbox", purelbv1.ServiceGroupSpec{Netbox: &purelbv1.ServiceGroupNetboxSpec{
+			URL:                 server.BaseURL(),
+			Tenant:              "tenant",
+			Cluster:             "test",
+			Credentials:         &purelbv1.ServiceGroupCredentials{SecretName: "netbox"},
+			ReleaseOrphansAfter: releaseOrphansAfter,
+		}})
+		sg.Namespace = "purelb"
+		return sg
+	}
+	alloc := New(netboxPoolTestLogger)
+	client := &testK8S{t: t}
+	alloc.client = client
+	alloc.SetSecrets([]*v1.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "purelb", Name: "netbox"},
+		Data:       map[string][]byte{"token": []byte("token")},
+	}})
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{group(nil)}))
+
+	// svc1 owns its address, and svc3 uses an address that Netbox says
+	// belongs to a service that doesn't exist. svc4's address has been
+	// allocated but svc4 hasn't been updated yet.
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc1.Status = statusAssigned("10.1.2.1")
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc3.Status = statusAssigned("10.1.2.3")
+	svc4 := service("svc4", ports("tcp/80"), "")
+	assert.NoError(t, alloc.pools["netbox"].AssignNext(&svc4))
+	assert.Equal(t, "10.1.2.4", svc4.Status.LoadBalancer.Ingress[0].IP)
+	services := []*v1.Service{&svc1, &svc3}
+
+	// Without a grace period orphans are only reported
+	start := time.Now()
+	assert.Equal(t, map[string]int{"orphaned": 1, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, start))
+	assert.Equal(t, map[string]int{"orphaned": 1, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, start.Add(time.Hour)))
+	assert.Equal(t, "active", server.Address("10.1.2.2/32").Status)
+	assert.Equal(t, 1, countEvents(client.warnings, "IPAMOrphan"), "orphans are reported once")
+
+	// With one they're released once they've been orphaned for that
+	// long, even if the pools are rebuilt in the meantime. Listings
+	// from before the pools were rebuilt are ignored.
+	listings := ListIPAM(alloc.IPAMPools())
+	assert.NoError(t, alloc.SetPools([]*purelbv1.ServiceGroup{group(&metav1.Duration{Duration: 2 * time.Hour})}))
+	assert.NoError(t, alloc.pools["netbox"].Notify(&svc4))
+	assert.Equal(t, map[string]int{"orphaned": 0, "mismatched": 0, "released": 0}, alloc.ReconcileIPAM(services, listings, start.Add(3*time.Hour)))
+	assert.Equal(t, map[string]int{"orphaned": 1, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, start.Add(90*time.Minute)))
+	assert.Equal(t, "active", server.Address("10.1.2.2/32").Status)
+	assert.Equal(t, map[string]int{"orphaned": 1, "mismatched": 1, "released": 1}, reconcileIPAM(alloc, services, start.Add(2*time.Hour)))
+	waitForRelease(t, alloc, "10.1.2.2")
+	assert.Equal(t, "reserved", server.Address("10.1.2.2/32").Status)
+	assert.Empty(t, server.Address("10.1.2.2/32").Description)
+	assert.Equal(t, map[string]int{"orphaned": 0, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, start.Add(3*time.Hour)))
+	assert.Equal(t, "active", server.Address("10.1.2.6/32").Status, "another cluster's address")
+	assert.Equal(t, 1, countEvents(client.warnings, "IPAMOrphan"))
+
+	// Addresses that have been orphaned but are in use again are
+	// forgotten
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Spec.LoadBalancerIP = "10.1.2.2"
+	assert.NoError(t, alloc.pools["netbox"].Assign(net.ParseIP("10.1.2.2"), &svc2))
+	assert.Equal(t, map[string]int{"orphaned": 0, "mismatched": 1, "released": 0}, reconcileIPAM(alloc, services, start.Add(4*time.Hour)))
+	assert.Empty(t, alloc.ipamOrphans)
+
+	_, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", Cluster: "test", ReleaseOrphansAfter: &metav1.Duration{Duration: -time.Minute}}, Credentials{Token: "token"})
+	assert.Error(t, err, "negative grace period")
+
+	// Groups from before the cluster name existed still work, but
+	// without it we can't tell our orphans from other clusters'
+	// addresses so we only report them
+	nbp, err := NewNetboxPool(netboxPoolTestLogger, purelbv1.ServiceGroupNetboxSpec{URL: server.BaseURL(), Tenant: "tenant", ReleaseOrphansAfter: &metav1.Duration{Duration: time.Hour}}, Credentials{Token: "token"})
+	assert.NoError(t, err, "no cluster")
+	assert.False(t, nbp.releaseOrphans)
+}
+
+// countEvents returns the number of events of type evtType in events.
+func countEvents(events []string, evtType string) int {
+	count := 0
+	for _, event := range events {
+		if event == evtType {
+			count++
+		}
+	}
+	return count
 }
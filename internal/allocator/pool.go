@@ -16,20 +16,27 @@
 package allocator
 
 import (
+	"bytes"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/go-kit/kit/log"
+	"github.com/vishvananda/netlink/nl"
 	v1 "k8s.io/api/core/v1"
 
+	"purelb.io/internal/local"
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
 // Port represents one port in use by a service.
 type Port struct {
-	Proto v1.Protocol
-	Port  int
+	Proto v1.Protocol `json:"protocol"`
+	Port  int         `json:"port"`
 }
 
 // String returns a text description of the port.
@@ -54,6 +61,23 @@ type Pool interface {
 	Overlaps(Pool) bool
 	Contains(net.IP) bool // FIXME: I'm not sure that we need this. It might be the case that we can always rely on the service's pool annotation to find to which pool an address belongs
 	Size() uint64
+
+	// Status returns a report on the pool's utilization. The Conditions
+	// are left empty since they're the Allocator's business.
+	Status() purelbv1.ServiceGroupStatus
+}
+
+// externalPool is implemented by pools whose addresses are managed
+// by an external system, e.g., Netbox.
+type externalPool interface {
+	// Forget releases the service's addresses from the pool without
+	// telling the external system. Standbys use it since only the
+	// leader may change the external system.
+	Forget(string) error
+
+	// Assigned returns the addresses that the pool has assigned to
+	// the service.
+	Assigned(string) []net.IP
 }
 
 func sharingOK(existing, new *Key) error {
@@ -69,7 +93,137 @@ func sharingOK(existing, new *Key) error {
 	return nil
 }
 
-func parsePool(log log.Logger, name string, group purelbv1.ServiceGroupSpec) (Pool, error) {
+// allocationStatus converts an addressesInUse map into a sorted list
+// of allocations.
+func allocationStatus(addressesInUse map[string]map[string]bool) []purelbv1.ServiceGroupAllocation {
+	allocs := []purelbv1.ServiceGroupAllocation{}
+	for ipstr, svcs := range addressesInUse {
+		alloc := purelbv1.ServiceGroupAllocation{Address: ipstr, Services: []string{}}
+		for svc := range svcs {
+			alloc.Services = append(alloc.Services, svc)
+		}
+		sort.Strings(alloc.Services)
+		allocs = append(allocs, alloc)
+	}
+
+	// Sort by address value (not by string) so the list reads in the
+	// same order as the pool.
+	sort.Slice(allocs, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(allocs[i].Address).To16(), net.ParseIP(allocs[j].Address).To16()) < 0
+	})
+
+	return allocs
+}
+
+// inUseStatus reports on the addresses that a pool whose addresses
+// are managed by a remote system has allocated. We don't know how
+// many addresses the remote system has so the report has only the
+// addresses that are in use.
+func inUseStatus(addressesInUse map[string]map[string]bool) purelbv1.ServiceGroupStatus {
+	status := purelbv1.ServiceGroupStatus{
+		Allocations: allocationStatus(addressesInUse),
+	}
+
+	for ipstr := range addressesInUse {
+		if local.AddrFamily(net.ParseIP(ipstr)) == nl.FAMILY_V4 {
+			if status.V4 == nil {
+				status.V4 = &purelbv1.ServiceGroupFamilyStatus{}
+			}
+			status.V4.InUse++
+		} else {
+			if status.V6 == nil {
+				status.V6 = &purelbv1.ServiceGroupFamilyStatus{}
+			}
+			status.V6.InUse++
+		}
+	}
+
+	return status
+}
+
+// Credentials are the credentials that a pool uses to connect to an
+// external IPAM system.
+type Credentials struct {
+	// Token is the Netbox user token or the webhook's bearer token.
+	Token string
+
+	// CABundle is a PEM-encoded bundle of the CAs that we use to
+	// verify the IPAM system's TLS certificate. If it's empty then we
+	// use the system's CAs.
+	CABundle []byte
+}
+
+// defaultTokenKey is the key of the token in a credentials Secret if
+// the ServiceGroup doesn't specify one.
+const defaultTokenKey = "token"
+
+// rootCAs parses the CA bundle, or returns nil if there isn't one.
+func (c Credentials) rootCAs() (*x509.CertPool, error) {
+	if len(c.CABundle) == 0 {
+		return nil, nil
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(c.CABundle) {
+		return nil, fmt.Errorf("CA bundle contains no PEM certificates")
+	}
+	return rootCAs, nil
+}
+
+// poolCredentials returns the credentials that group's pool uses. If
+// group refers to a credentials Secret then they come from that
+// Secret, which must be in secrets (whose keys are the Secrets'
+// namespaced names). Netbox pools that don't refer to a Secret get
+// their token from the NETBOX_USER_TOKEN environment variable.
+func poolCredentials(group *purelbv1.ServiceGroup, secrets map[string]*v1.Secret) (Credentials, error) {
+	creds := Credentials{}
+
+	var ref *purelbv1.ServiceGroupCredentials
+	switch {
+	case group.Spec.Netbox != nil:
+		ref = group.Spec.Netbox.Credentials
+		if ref == nil {
+			userToken, ok := os.LookupEnv("NETBOX_USER_TOKEN")
+			if !ok {
+				return creds, fmt.Errorf("NETBOX_USER_TOKEN not set, can't connect to Netbox")
+			}
+			creds.Token = userToken
+			return creds, nil
+		}
+	case group.Spec.Webhook != nil:
+		ref = group.Spec.Webhook.Credentials
+	}
+	if ref == nil {
+		return creds, nil
+	}
+
+	secretName := group.Namespace + "/" + ref.SecretName
+	secret, found := secrets[secretName]
+	if !found {
+		return creds, fmt.Errorf("credentials Secret %s not found", secretName)
+	}
+
+	tokenKey := ref.TokenKey
+	if tokenKey == "" {
+		tokenKey = defaultTokenKey
+	}
+	token, found := secret.Data[tokenKey]
+	if !found {
+		return creds, fmt.Errorf("credentials Secret %s has no key %q", secretName, tokenKey)
+	}
+	creds.Token = strings.TrimSpace(string(token))
+
+	if ref.CAKey != "" {
+		if creds.CABundle, found = secret.Data[ref.CAKey]; !found {
+			return creds, fmt.Errorf("credentials Secret %s has no key %q", secretName, ref.CAKey)
+		}
+	}
+
+	return creds, nil
+}
+
+// parsePool parses a ServiceGroup's spec into a Pool. Pools that use
+// external IPAM systems use credentials to connect to them.
+func parsePool(log log.Logger, name string, group purelbv1.ServiceGroupSpec, credentials Credentials) (Pool, error) {
 	if group.Local != nil {
 		ret, err := NewLocalPool(log, *group.Local)
 		if err != nil {
@@ -77,12 +231,18 @@ func parsePool(log log.Logger, name string, group purelbv1.ServiceGroupSpec) (Po
 		}
 		return *ret, nil
 	} else if group.Netbox != nil {
-		ret, err := NewNetboxPool(log, *group.Netbox)
+		ret, err := NewNetboxPool(log, *group.Netbox, credentials)
+		if err != nil {
+			return nil, err
+		}
+		return *ret, nil
+	} else if group.Webhook != nil {
+		ret, err := NewWebhookPool(log, name, *group.Webhook, credentials)
 		if err != nil {
 			return nil, err
 		}
 		return *ret, nil
 	}
 
-	return nil, fmt.Errorf("Pool is not local or Netbox")
+	return nil, fmt.Errorf("Pool is not local, Netbox, or webhook")
 }
@@ -27,9 +27,28 @@ import (
 )
 
 func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	nsName := svc.Namespace + "/" + svc.Name
 	log := log.With(c.logger, "svc-name", nsName)
 
+	// If we're a standby then we don't allocate, but we tell the
+	// allocator about the leader's allocations so we're ready to take
+	// over
+	if c.standby {
+		if len(svc.Status.LoadBalancer.Ingress) > 0 && svc.Annotations[purelbv1.BrandAnnotation] == purelbv1.Brand {
+			if err := c.ips.NotifyExisting(svc); err != nil {
+				log.Log("event", "notifyFailure", "ingress-address", svc.Status.LoadBalancer.Ingress, "reason", err.Error())
+			}
+		}
+		return k8s.SyncStateSuccess
+	}
+
+	// If we haven't seen every service yet then we don't know which
+	// addresses are in use. The ledger might know but we can't tell
+	// whether it's up to date until we've checked it against the
+	// services, so we don't trust it on its own.
 	if !c.synced {
 		log.Log("op", "allocateIP", "error", "controller not synced")
 		return k8s.SyncStateError
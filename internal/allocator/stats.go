@@ -38,9 +38,33 @@ var (
 		Name:      "addresses_in_use",
 		Help:      "Number of addresses allocated from the pool",
 	}, labelNames)
+
+	ledgerDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "allocation_ledger",
+		Name:      "drift",
+		Help:      "Number of differences between the allocation ledger and the services found by the most recent reconciliation, by kind",
+	}, []string{"kind"})
+
+	ipamDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "ipam_reconciliation",
+		Name:      "drift",
+		Help:      "Number of differences between the IPAM systems and the services found by the most recent reconciliation, by pool and kind",
+	}, []string{"pool", "kind"})
+
+	ipamOrphansReleased = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "ipam_reconciliation",
+		Name:      "orphans_released_total",
+		Help:      "Number of orphaned IPAM addresses that reconciliation released, by pool",
+	}, labelNames)
 )
 
 func init() {
 	prometheus.MustRegister(poolCapacity)
 	prometheus.MustRegister(poolActive)
+	prometheus.MustRegister(ledgerDrift)
+	prometheus.MustRegister(ipamDrift)
+	prometheus.MustRegister(ipamOrphansReleased)
 }
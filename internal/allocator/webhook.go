@@ -0,0 +1,189 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"purelb.io/internal/bgp"
+	"purelb.io/internal/local"
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// Webhook is a validating admission webhook that rejects PureLB
+// resources that the allocator or the lbnodeagents would be unable to
+// use, and Services to which the allocator would be unable to
+// allocate an address. It validates using the same code that the
+// allocator and lbnodeagents use, so anything that it admits will
+// parse successfully.
+type Webhook struct {
+	logger log.Logger
+
+	// groups returns the ServiceGroups that already exist so we can
+	// check new ones against them.
+	groups func() ([]*purelbv1.ServiceGroup, error)
+
+	// services checks whether the allocator would be able to allocate
+	// an address to a service.
+	services func(*v1.Service) error
+}
+
+// NewWebhook returns a Webhook. groups returns the ServiceGroups that
+// already exist, e.g., from an informer's cache, and services returns
+// an error if the allocator would be unable to allocate an address
+// to a service, e.g., Controller.ValidateService.
+func NewWebhook(logger log.Logger, groups func() ([]*purelbv1.ServiceGroup, error), services func(*v1.Service) error) *Webhook {
+	return &Webhook{
+		logger:   logger,
+		groups:   groups,
+		services: services,
+	}
+}
+
+// ServeHTTP handles an admission.k8s.io/v1 AdmissionReview request.
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+		http.Error(rw, fmt.Sprintf("decoding AdmissionReview: %s", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "AdmissionReview has no request", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	if err := w.review(review.Request); err != nil {
+		w.logger.Log("op", "admissionReview", "kind", review.Request.Kind.Kind, "namespace", review.Request.Namespace, "name", review.Request.Name, "error", err)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: err.Error(),
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(admissionv1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: response,
+	}); err != nil {
+		w.logger.Log("op", "admissionReview", "error", err)
+	}
+}
+
+// review returns an error if request should be denied.
+func (w *Webhook) review(request *admissionv1.AdmissionRequest) error {
+	// Anything can be deleted
+	if request.Operation != admissionv1.Create && request.Operation != admissionv1.Update {
+		return nil
+	}
+
+	switch request.Kind.Kind {
+	case "ServiceGroup":
+		group := purelbv1.ServiceGroup{}
+		if err := json.Unmarshal(request.Object.Raw, &group); err != nil {
+			return fmt.Errorf("decoding ServiceGroup: %w", err)
+		}
+		existing, err := w.groups()
+		if err != nil {
+			return fmt.Errorf("listing ServiceGroups: %w", err)
+		}
+		return ValidateServiceGroup(w.logger, &group, existing)
+
+	case "Service":
+		svc := v1.Service{}
+		if err := json.Unmarshal(request.Object.Raw, &svc); err != nil {
+			return fmt.Errorf("decoding Service: %w", err)
+		}
+		if raw, exists := svc.Annotations[purelbv1.NodeSelectorAnnotation]; exists {
+			if _, err := labels.Parse(raw); err != nil {
+				return fmt.Errorf("invalid %s annotation: %w", purelbv1.NodeSelectorAnnotation, err)
+			}
+		}
+		return w.services(&svc)
+
+	case "LBNodeAgent":
+		agent := purelbv1.LBNodeAgent{}
+		if err := json.Unmarshal(request.Object.Raw, &agent); err != nil {
+			return fmt.Errorf("decoding LBNodeAgent: %w", err)
+		}
+		if agent.Spec.Local != nil {
+			if err := local.ValidateAgentSpec(agent.Spec.Local); err != nil {
+				return err
+			}
+		}
+		if agent.Spec.BGP != nil {
+			return bgp.ValidateAgentSpec(agent.Spec.BGP)
+		}
+	}
+
+	return nil
+}
+
+// ValidateServiceGroup returns an error if the allocator would be
+// unable to use group. It parses group the same way that the
+// allocator does, and checks that it doesn't duplicate the name of, or
+// overlap the addresses of, any of the existing groups. If existing
+// contains an older version of group then that version is ignored.
+// It doesn't check IPAM credentials since their Secret might not
+// exist yet.
+func ValidateServiceGroup(logger log.Logger, group *purelbv1.ServiceGroup, existing []*purelbv1.ServiceGroup) error {
+	pool, err := parsePool(logger, group.Name, group.Spec, Credentials{})
+	if err != nil {
+		return err
+	}
+
+	for _, other := range existing {
+		if other.Namespace == group.Namespace && other.Name == group.Name {
+			continue
+		}
+
+		// Pools are identified by name only so names must be unique
+		// across namespaces
+		if other.Name == group.Name {
+			return fmt.Errorf("Duplicate definition of pool %s", group.Name)
+		}
+
+		// If the other group doesn't parse then the allocator ignores it
+		// so it can't conflict with this one
+		otherPool, err := parsePool(logger, other.Name, other.Spec, Credentials{})
+		if err != nil {
+			continue
+		}
+		if pool.Overlaps(otherPool) || otherPool.Overlaps(pool) {
+			return fmt.Errorf("Pool overlaps with already defined pool \"%s\"", other.Name)
+		}
+	}
+
+	return nil
+}
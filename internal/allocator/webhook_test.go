@@ -0,0 +1,359 @@
+// Copyright 2021 Acnodal Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"purelb.io/internal/k8s"
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// admissionReview posts an AdmissionReview for obj to server and
+// returns the response.
+func admissionReview(t *testing.T, server *httptest.Server, kind string, operation admissionv1.Operation, obj interface{}) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Kind:      metav1.GroupVersionKind{Group: "purelb.io", Version: "v1", Kind: kind},
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	assert.NoError(t, err)
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	review := admissionv1.AdmissionReview{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+	assert.Equal(t, "AdmissionReview", review.Kind)
+	assert.Equal(t, types.UID("test-uid"), review.Response.UID)
+	return review.Response
+}
+
+func TestWebhookServiceGroup(t *testing.T) {
+	existing := localServiceGroup("existing", "192.168.1.0/24")
+	existing.Namespace = "purelb"
+	server := httptest.NewServer(NewWebhook(log.NewNopLogger(), func() ([]*purelbv1.ServiceGroup, error) {
+		return []*purelbv1.ServiceGroup{existing}, nil
+	}, nil))
+	defer server.Close()
+
+	tests := []struct {
+		desc    string
+		group   *purelbv1.ServiceGroup
+		allowed bool
+	}{
+		{
+			desc:    "valid group",
+			group:   localServiceGroup("new", "192.168.2.0/24"),
+			allowed: true,
+		},
+		{
+			desc:    "update of an existing group",
+			group:   existing,
+			allowed: true,
+		},
+		{
+			desc:  "malformed range",
+			group: localServiceGroup("new", "192.168.2.0-"),
+		},
+		{
+			desc: "pool outside its subnet",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.3.0/24", Subnet: "192.168.2.0/24"}},
+			}}),
+		},
+		{
+			desc:  "overlaps another group",
+			group: localServiceGroup("new", "192.168.1.128/25"),
+		},
+		{
+			desc: "valid node selector",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools:      []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.2.0/24", Subnet: "192.168.2.0/24"}},
+				NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"topology.kubernetes.io/zone": "rack1"}},
+			}}),
+			allowed: true,
+		},
+		{
+			desc: "invalid node selector",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools:      []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.2.0/24", Subnet: "192.168.2.0/24"}},
+				NodeSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "zone", Operator: "Near"}}},
+			}}),
+		},
+		{
+			desc:  "duplicate name in a different namespace",
+			group: localServiceGroup("existing", "192.168.2.0/24"),
+		},
+		{
+			desc: "invalid aggregation",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.2.0/24", Subnet: "192.168.2.0/24", Aggregation: "/33"}},
+			}}),
+		},
+		{
+			desc: "valid aggregation",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V6Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "2001:db8::/120", Subnet: "2001:db8::/64", Aggregation: "/128"}},
+			}}),
+			allowed: true,
+		},
+		{
+			desc: "omitted aggregation means default",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.2.0/24", Subnet: "192.168.2.0/24", Aggregation: ""}},
+			}}),
+			allowed: true,
+		},
+		{
+			desc: "short aggregation",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.2.0/24", Subnet: "192.168.2.0/24", Aggregation: "/4"}},
+			}}),
+			allowed: true,
+		},
+		{
+			desc: "zero aggregation",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "192.168.2.0/24", Subnet: "192.168.2.0/24", Aggregation: "/0"}},
+			}}),
+		},
+		{
+			desc: "IPAM webhook group",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Webhook: &purelbv1.ServiceGroupWebhookSpec{
+				URL:         "https://ipam.example.com/purelb/",
+				Credentials: &purelbv1.ServiceGroupCredentials{SecretName: "not-created-yet"},
+			}}),
+			allowed: true,
+		},
+		{
+			desc: "IPAM webhook group with a relative URL",
+			group: serviceGroup("new", purelbv1.ServiceGroupSpec{Webhook: &purelbv1.ServiceGroupWebhookSpec{
+				URL: "ipam.example.com",
+			}}),
+		},
+	}
+
+	for _, test := range tests {
+		response := admissionReview(t, server, "ServiceGroup", admissionv1.Create, test.group)
+		assert.Equal(t, test.allowed, response.Allowed, test.desc)
+		if !test.allowed {
+			assert.NotEmpty(t, response.Result.Message, test.desc)
+		}
+	}
+
+	// Deletes are always allowed
+	response := admissionReview(t, server, "ServiceGroup", admissionv1.Delete, localServiceGroup("new", "192.168.2.0-"))
+	assert.True(t, response.Allowed)
+}
+
+func TestWebhookLBNodeAgent(t *testing.T) {
+	server := httptest.NewServer(NewWebhook(log.NewNopLogger(), func() ([]*purelbv1.ServiceGroup, error) {
+		return []*purelbv1.ServiceGroup{}, nil
+	}, nil))
+	defer server.Close()
+
+	agent := func(localint string, extlbint string) *purelbv1.LBNodeAgent {
+		return &purelbv1.LBNodeAgent{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "purelb", Name: "default"},
+			Spec: purelbv1.LBNodeAgentSpec{Local: &purelbv1.LBNodeAgentLocalSpec{
+				LocalInterface: localint,
+				ExtLBInterface: extlbint,
+			}},
+		}
+	}
+
+	assert.True(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, agent("default", "kube-lb0")).Allowed)
+	assert.True(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Update, agent("^eth[0-9]+$", "kube-lb0")).Allowed)
+	assert.False(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, agent("eth[", "kube-lb0")).Allowed, "invalid localint regex")
+	assert.False(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, agent("default", "")).Allowed, "empty extlbint")
+	assert.False(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, agent("default", "kube-lb0-too-long")).Allowed, "extlbint too long")
+
+	count := 5
+	burst := agent("default", "kube-lb0")
+	burst.Spec.Local.GratuitousCount = &count
+	burst.Spec.Local.GratuitousInterval = &metav1.Duration{Duration: 200 * time.Millisecond}
+	assert.True(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, burst).Allowed)
+	count = -1
+	assert.False(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, burst).Allowed, "negative gratuitousCount")
+	count = 0
+	burst.Spec.Local.GratuitousInterval.Duration = 0
+	assert.False(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, burst).Allowed, "zero gratuitousInterval")
+
+	sticky := agent("default", "kube-lb0")
+	sticky.Spec.Local.PreemptionDelay = &metav1.Duration{Duration: time.Minute}
+	assert.True(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, sticky).Allowed)
+	sticky.Spec.Local.PreemptionDelay.Duration = -time.Minute
+	assert.False(t, admissionReview(t, server, "LBNodeAgent", admissionv1.Create, sticky).Allowed, "negative preemptionDelay")
+}
+
+func TestWebhookService(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+	server := httptest.NewServer(NewWebhook(l, func() ([]*purelbv1.ServiceGroup, error) {
+		return []*purelbv1.ServiceGroup{}, nil
+	}, c.ValidateService))
+	defer server.Close()
+
+	lbService := func(name string, ip string, group string, sharingKey string, ports []v1.ServicePort) *v1.Service {
+		svc := service(name, ports, sharingKey)
+		svc.Spec.Type = v1.ServiceTypeLoadBalancer
+		svc.Spec.ClusterIP = "10.96.0.1"
+		svc.Spec.LoadBalancerIP = ip
+		if group != "" {
+			svc.Annotations[purelbv1.DesiredGroupAnnotation] = group
+		}
+		return &svc
+	}
+
+	addressesService := func(name string, addresses string) *v1.Service {
+		svc := lbService(name, "", "", "", ports("tcp/80"))
+		svc.Annotations[purelbv1.AddressesAnnotation] = addresses
+		return svc
+	}
+
+	nodeSelectorService := func(name string, selector string) *v1.Service {
+		svc := lbService(name, "", "", "", ports("tcp/80"))
+		svc.Annotations[purelbv1.NodeSelectorAnnotation] = selector
+		return svc
+	}
+
+	// Until the allocator has synced it doesn't know which addresses
+	// are in use so it admits everything
+	assert.True(t, admissionReview(t, server, "Service", admissionv1.Create, lbService("early", "1.2.5.1", "", "", ports("tcp/80"))).Allowed)
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(&purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup(defaultPoolName, "1.2.3.0/24"),
+			localServiceGroup("other", "1.2.4.0/24"),
+		},
+	}))
+	c.MarkSynced()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(lbService("first", "1.2.3.1", "", "key-a", ports("tcp/80")), nil))
+
+	tests := []struct {
+		desc    string
+		svc     *v1.Service
+		allowed bool
+	}{
+		{
+			desc:    "unused address",
+			svc:     lbService("new", "1.2.3.2", "", "", ports("tcp/80")),
+			allowed: true,
+		},
+		{
+			desc:    "no address requested",
+			svc:     lbService("new", "", "other", "", ports("tcp/80")),
+			allowed: true,
+		},
+		{
+			desc: "address not in any group",
+			svc:  lbService("new", "1.2.5.1", "", "", ports("tcp/80")),
+		},
+		{
+			desc: "invalid address",
+			svc:  lbService("new", "1.2.3", "", "", ports("tcp/80")),
+		},
+		{
+			desc: "address in a different group",
+			svc:  lbService("new", "1.2.3.2", "other", "", ports("tcp/80")),
+		},
+		{
+			desc: "unknown group",
+			svc:  lbService("new", "", "missing", "", ports("tcp/80")),
+		},
+		{
+			desc: "different sharing key",
+			svc:  lbService("new", "1.2.3.1", "", "key-b", ports("tcp/443")),
+		},
+		{
+			desc: "port conflict",
+			svc:  lbService("new", "1.2.3.1", "", "key-a", ports("tcp/80")),
+		},
+		{
+			desc:    "compatible sharing",
+			svc:     lbService("new", "1.2.3.1", "", "key-a", ports("tcp/443")),
+			allowed: true,
+		},
+		{
+			desc: "addresses annotation with an address in use",
+			svc:  addressesService("new", "1.2.3.1"),
+		},
+		{
+			desc:    "addresses annotation",
+			svc:     addressesService("new", "1.2.3.2"),
+			allowed: true,
+		},
+		{
+			desc:    "node selector annotation",
+			svc:     nodeSelectorService("new", "zone in (rack1, rack2)"),
+			allowed: true,
+		},
+		{
+			desc: "invalid node selector annotation",
+			svc:  nodeSelectorService("new", "zone in rack1"),
+		},
+		{
+			desc:    "the owner of the address",
+			svc:     lbService("first", "1.2.3.1", "", "key-a", ports("tcp/80")),
+			allowed: true,
+		},
+	}
+
+	for _, test := range tests {
+		response := admissionReview(t, server, "Service", admissionv1.Create, test.svc)
+		assert.Equal(t, test.allowed, response.Allowed, test.desc)
+		if !test.allowed {
+			assert.NotEmpty(t, response.Result.Message, test.desc)
+		}
+	}
+
+	// Services that we don't allocate to are always admitted
+	notLB := lbService("new", "1.2.5.1", "", "", ports("tcp/80"))
+	notLB.Spec.Type = v1.ServiceTypeClusterIP
+	assert.True(t, admissionReview(t, server, "Service", admissionv1.Create, notLB).Allowed)
+	otherClass := lbService("new", "1.2.5.1", "", "", ports("tcp/80"))
+	class := "example.com/other"
+	otherClass.Spec.LoadBalancerClass = &class
+	assert.True(t, admissionReview(t, server, "Service", admissionv1.Create, otherClass).Allowed)
+}
@@ -0,0 +1,465 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"purelb.io/internal/election"
+	"purelb.io/internal/k8s"
+	"purelb.io/internal/lbnodeagent"
+	purelbv1 "purelb.io/pkg/apis/v1"
+
+	"github.com/go-kit/kit/log"
+)
+
+// IsLocalFunc determines whether lbIP is on the same network as one
+// of the node's local interfaces. Local addresses are announced using
+// ARP/ND, so the BGP announcer doesn't advertise routes for them.
+// localint is the LBNodeAgent's localint setting.
+type IsLocalFunc func(localint string, lbIP net.IP) bool
+
+// wellKnownCommunities are the communities (RFC 1997) that users can
+// refer to by name.
+var wellKnownCommunities = map[string]uint32{
+	"no-export":           0xffffff01,
+	"no-advertise":        0xffffff02,
+	"no-export-subconfed": 0xffffff03,
+}
+
+type announcer struct {
+	client  k8s.ServiceEvent
+	logger  log.Logger
+	myNode  string
+	isLocal IsLocalFunc
+
+	// config is the BGP configuration that we're using, or nil if we
+	// haven't been configured to use BGP. speaker is the speaker that
+	// implements config.
+	config  *purelbv1.LBNodeAgentBGPSpec
+	speaker *Speaker
+
+	// localint is the LBNodeAgent's localint setting, and groups
+	// holds the local service group configs, keyed by name.
+	localint string
+	groups   map[string]*purelbv1.ServiceGroupLocalSpec
+
+	// svcRoutes holds the routes that each service needs, keyed by
+	// namespaced name.
+	svcRoutes map[string][]Route
+
+	// advertised holds the routes that we've asked the speaker to
+	// advertise, keyed by prefix.
+	advertised map[string]Route
+
+	// lock serializes access to the announcer by the k8s client and
+	// the status reporter.
+	lock sync.Mutex
+}
+
+// NewAnnouncer returns a new BGP Announcer. isLocal determines which
+// addresses are local, since the BGP announcer advertises routes only
+// for addresses that aren't.
+func NewAnnouncer(l log.Logger, node string, isLocal IsLocalFunc) lbnodeagent.Announcer {
+	return &announcer{
+		logger:     l,
+		myNode:     node,
+		isLocal:    isLocal,
+		svcRoutes:  map[string][]Route{},
+		advertised: map[string]Route{},
+	}
+}
+
+// SetClient configures this announcer to use the provided client.
+func (a *announcer) SetClient(client *k8s.Client) {
+	a.client = client
+}
+
+func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var spec *purelbv1.LBNodeAgentBGPSpec
+	a.localint = "default"
+	for _, agent := range cfg.Agents {
+		if agent.Spec.BGP != nil {
+			spec = agent.Spec.BGP
+			if agent.Spec.Local != nil && agent.Spec.Local.LocalInterface != "" {
+				a.localint = agent.Spec.Local.LocalInterface
+			}
+			a.logger.Log("op", "setConfig", "spec", spec, "name", agent.Namespace+"/"+agent.Name)
+			break
+		}
+	}
+
+	a.groups = map[string]*purelbv1.ServiceGroupLocalSpec{}
+	for _, group := range cfg.Groups {
+		if group.Spec.Local != nil {
+			a.groups[group.ObjectMeta.Name] = group.Spec.Local
+		}
+	}
+
+	if spec == nil {
+		a.stopSpeaker()
+		a.config = nil
+		return nil
+	}
+
+	config, peers, err := parseSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	// The speaker's settings apply to all of its sessions so if they
+	// change we need a new speaker. It connects once the old one has
+	// disconnected, so we don't wait for that here.
+	if a.speaker == nil || !reflect.DeepEqual(a.speaker.config, config) {
+		closed := a.stopSpeaker()
+		a.speaker = NewSpeaker(a.logger, config)
+		a.speaker.after = closed
+	}
+	a.speaker.SetPeers(peers)
+	a.config = spec
+
+	// The route attributes might have changed. The k8s client will
+	// call SetBalancer for each service since the config changed, so
+	// that will update the routes.
+	return nil
+}
+
+// ValidateAgentSpec checks that spec is a configuration that the
+// announcer can use. It's used by the admission webhook so users find
+// out about bad LBNodeAgents when they create them instead of when
+// the lbnodeagents try to load them.
+func ValidateAgentSpec(spec *purelbv1.LBNodeAgentBGPSpec) error {
+	if _, _, err := parseSpec(spec); err != nil {
+		return err
+	}
+	for _, group := range spec.ServiceGroups {
+		if _, err := parseCommunities(group.Communities); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSpec converts spec into a speaker config and a list of peers.
+func parseSpec(spec *purelbv1.LBNodeAgentBGPSpec) (Config, []Peer, error) {
+	config := Config{ASN: spec.ASN, HoldTime: defaultHoldTime, ConnectRetry: defaultConnectRetry}
+	if spec.ASN == 0 {
+		return config, nil, fmt.Errorf("asn must not be 0")
+	}
+	if spec.RouterID != "" {
+		if config.RouterID = net.ParseIP(spec.RouterID).To4(); config.RouterID == nil {
+			return config, nil, fmt.Errorf("routerID \"%s\" is not an IPv4 address", spec.RouterID)
+		}
+	}
+	if spec.HoldTime != nil {
+		// BGP hold times are whole seconds, and can't be 1 or 2
+		config.HoldTime = spec.HoldTime.Duration.Truncate(time.Second)
+		if config.HoldTime < 3*time.Second || config.HoldTime > 0xffff*time.Second {
+			return config, nil, fmt.Errorf("holdTime %s must be between 3s and 65535s", spec.HoldTime.Duration)
+		}
+	}
+	if _, err := parseCommunities(spec.Communities); err != nil {
+		return config, nil, err
+	}
+
+	peers := []Peer{}
+	for _, peer := range spec.Peers {
+		address := net.ParseIP(peer.Address)
+		if address == nil {
+			return config, nil, fmt.Errorf("peer address \"%s\" is not an IP address", peer.Address)
+		}
+		if address.To4() == nil && config.RouterID == nil {
+			return config, nil, fmt.Errorf("routerID is required for IPv6 peer %s", peer.Address)
+		}
+		if peer.ASN == 0 {
+			return config, nil, fmt.Errorf("peer %s asn must not be 0", peer.Address)
+		}
+		if peer.Port < 0 || peer.Port > 65535 {
+			return config, nil, fmt.Errorf("peer %s port %d is invalid", peer.Address, peer.Port)
+		}
+		peers = append(peers, Peer{Address: address, ASN: peer.ASN, Port: peer.Port})
+	}
+
+	return config, peers, nil
+}
+
+// parseCommunities parses communities in "ASN:value" format, or
+// well-known community names.
+func parseCommunities(communities []string) ([]uint32, error) {
+	parsed := []uint32{}
+	for _, community := range communities {
+		if value, wellKnown := wellKnownCommunities[community]; wellKnown {
+			parsed = append(parsed, value)
+			continue
+		}
+		parts := strings.Split(community, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("community \"%s\" is not in ASN:value format", community)
+		}
+		high, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("community \"%s\" is invalid: %s", community, err.Error())
+		}
+		low, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("community \"%s\" is invalid: %s", community, err.Error())
+		}
+		parsed = append(parsed, uint32(high<<16|low))
+	}
+	return parsed, nil
+}
+
+func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	nsName := svc.Namespace + "/" + svc.Name
+	l := log.With(a.logger, "service", nsName)
+
+	// if we haven't been configured then we won't announce
+	if a.config == nil {
+		return nil
+	}
+
+	routes := []Route{}
+	var retErr error
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		lbIP := net.ParseIP(ingress.IP)
+		if lbIP == nil {
+			l.Log("op", "setBalancer", "error", "invalid LoadBalancer IP", "ip", ingress.IP)
+			continue
+		}
+
+		// The local announcer handles local addresses
+		if a.isLocal(a.localint, lbIP) {
+			continue
+		}
+
+		// Nodes without a ready endpoint don't attract traffic for
+		// services whose externalTrafficPolicy is Local
+		if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !lbnodeagent.NodeHasHealthyEndpoint(endpoints, a.myNode) {
+			l.Log("msg", "policyLocalNoEndpoints", "node", a.myNode, "ip", lbIP)
+			continue
+		}
+
+		route, err := a.route(svc, lbIP)
+		if err != nil {
+			retErr = err
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	if len(routes) > 0 {
+		if !reflect.DeepEqual(a.svcRoutes[nsName], routes) {
+			prefixes := []string{}
+			for _, route := range routes {
+				prefixes = append(prefixes, route.Prefix.String())
+			}
+			a.client.Infof(svc, "AnnouncingBGP", "Node %s advertising %s to BGP peers", a.myNode, strings.Join(prefixes, ", "))
+		}
+		a.svcRoutes[nsName] = routes
+	} else {
+		delete(a.svcRoutes, nsName)
+	}
+	a.reconcile()
+
+	return retErr
+}
+
+// route returns the route to lbIP, which belongs to svc.
+func (a *announcer) route(svc *v1.Service, lbIP net.IP) (Route, error) {
+	nsName := svc.Namespace + "/" + svc.Name
+
+	poolName, gotName := svc.Annotations[purelbv1.PoolAnnotation]
+	if !gotName {
+		return Route{}, fmt.Errorf("PoolAnnotation missing from service %s", nsName)
+	}
+	group, knownGroup := a.groups[poolName]
+	if !knownGroup {
+		return Route{}, fmt.Errorf("unknown ServiceGroup %s on service %s", poolName, nsName)
+	}
+	pool, err := group.AddressPool(lbIP)
+	if err != nil {
+		return Route{}, err
+	}
+	prefix, err := routePrefix(lbIP, pool)
+	if err != nil {
+		return Route{}, err
+	}
+
+	// The config has already been validated so we can ignore errors
+	route := Route{Prefix: prefix}
+	route.Communities, _ = parseCommunities(a.config.Communities)
+	for _, attrs := range a.config.ServiceGroups {
+		if attrs.ServiceGroup == poolName {
+			communities, _ := parseCommunities(attrs.Communities)
+			route.Communities = append(route.Communities, communities...)
+			route.LocalPref = attrs.LocalPref
+			route.MED = attrs.MED
+		}
+	}
+	if len(route.Communities) == 0 {
+		route.Communities = nil
+	}
+
+	return route, nil
+}
+
+// routePrefix returns the prefix of the route to lbIP. It's a host
+// route unless pool has an aggregation, in which case the prefix is
+// the same as the one that the local announcer adds to the dummy
+// interface.
+func routePrefix(lbIP net.IP, pool *purelbv1.ServiceGroupAddressPool) (net.IPNet, error) {
+	bits := 128
+	if lbIP.To4() != nil {
+		lbIP = lbIP.To4()
+		bits = 32
+	}
+	mask := net.CIDRMask(bits, bits)
+
+	switch pool.Aggregation {
+	case "":
+	case "default":
+		_, subnet, err := net.ParseCIDR(pool.Subnet)
+		if err != nil {
+			return net.IPNet{}, err
+		}
+		mask = subnet.Mask
+	default:
+		ones, err := strconv.Atoi(strings.TrimPrefix(pool.Aggregation, "/"))
+		if err != nil || ones < 0 || ones > bits {
+			return net.IPNet{}, fmt.Errorf("invalid aggregation %s for %s", pool.Aggregation, lbIP)
+		}
+		mask = net.CIDRMask(ones, bits)
+	}
+
+	return net.IPNet{IP: lbIP.Mask(mask), Mask: mask}, nil
+}
+
+// reconcile tells the speaker to advertise the routes that the
+// services need, and to withdraw the routes that they don't. Several
+// services can share a route (e.g., if their addresses aggregate into
+// the same prefix), in which case the route's attributes come from
+// the service whose name sorts first. The caller must hold a.lock.
+func (a *announcer) reconcile() {
+	names := []string{}
+	for nsName := range a.svcRoutes {
+		names = append(names, nsName)
+	}
+	sort.Strings(names)
+
+	needed := map[string]Route{}
+	for _, nsName := range names {
+		for _, route := range a.svcRoutes[nsName] {
+			if _, exists := needed[route.Prefix.String()]; !exists {
+				needed[route.Prefix.String()] = route
+			}
+		}
+	}
+
+	for key, route := range a.advertised {
+		if _, stillNeeded := needed[key]; !stillNeeded {
+			a.logger.Log("event", "withdrawRoute", "prefix", key)
+			a.speaker.Withdraw(route.Prefix)
+			delete(a.advertised, key)
+		}
+	}
+	for key, route := range needed {
+		if previous, exists := a.advertised[key]; !exists || !reflect.DeepEqual(previous, route) {
+			a.logger.Log("event", "advertiseRoute", "prefix", key)
+			a.speaker.Announce(route)
+			a.advertised[key] = route
+		}
+	}
+}
+
+// DeleteBalancer withdraws the routes that nsName needed, unless
+// other services need them too.
+func (a *announcer) DeleteBalancer(nsName, reason string, _ net.IP) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, knowAboutIt := a.svcRoutes[nsName]; !knowAboutIt {
+		return nil
+	}
+
+	a.logger.Log("event", "withdrawService", "service", nsName, "reason", reason)
+	delete(a.svcRoutes, nsName)
+	if a.speaker != nil {
+		a.reconcile()
+	}
+	return nil
+}
+
+// stopSpeaker starts disconnecting from our peers, which withdraws
+// our routes. It returns a channel that's closed when it's done, or
+// nil if we had no speaker. The caller must hold a.lock, and
+// shouldn't wait for the channel while it does.
+func (a *announcer) stopSpeaker() <-chan struct{} {
+	var closed <-chan struct{}
+	if a.speaker != nil {
+		closed = a.speaker.Close()
+		a.speaker = nil
+	}
+	a.advertised = map[string]Route{}
+	return closed
+}
+
+// Shutdown disconnects from our peers.
+func (a *announcer) Shutdown() {
+	a.lock.Lock()
+	closed := a.stopSpeaker()
+	a.lock.Unlock()
+
+	if closed != nil {
+		<-closed
+	}
+}
+
+func (a *announcer) SetElection(_ *election.Election) {
+	// All nodes advertise routes so we don't need elections
+}
+
+// ReportStatus adds this announcer's view of the node to status.
+func (a *announcer) ReportStatus(status *purelbv1.LBNodeAgentNodeStatus) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.speaker == nil {
+		return
+	}
+
+	for _, session := range a.speaker.Status() {
+		status.BGPPeers = append(status.BGPPeers, purelbv1.LBNodeAgentBGPPeerStatus{
+			Address: session.Peer,
+			State:   session.State,
+			Routes:  session.Routes,
+			Error:   session.Error,
+		})
+	}
+}
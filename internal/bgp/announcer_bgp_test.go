@@ -0,0 +1,235 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+const testNode = "node-a"
+
+type testK8S struct {
+	t *testing.T
+}
+
+func (s *testK8S) Infof(_ runtime.Object, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Info event %q: %s", evtType, fmt.Sprintf(msg, args...))
+}
+
+func (s *testK8S) Errorf(_ runtime.Object, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Warning event %q: %s", evtType, fmt.Sprintf(msg, args...))
+}
+
+func (s *testK8S) ForceSync() {}
+
+func (s *testK8S) UpdateGroupStatus(_ *purelbv1.ServiceGroup) error {
+	return nil
+}
+
+func (s *testK8S) UpdateAgentNodeStatus(_ *purelbv1.LBNodeAgent, _ *purelbv1.LBNodeAgentNodeStatus) error {
+	return nil
+}
+
+// isLocal pretends that 192.168.1.0/24 is the node's local subnet.
+func isLocal(_ string, lbIP net.IP) bool {
+	_, local, _ := net.ParseCIDR("192.168.1.0/24")
+	return local.Contains(lbIP)
+}
+
+func lbService(name string, group string, policy v1.ServiceExternalTrafficPolicyType, ips ...string) *v1.Service {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "unit",
+			Name:        name,
+			Annotations: map[string]string{purelbv1.PoolAnnotation: group},
+		},
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeLoadBalancer,
+			ExternalTrafficPolicy: policy,
+		},
+	}
+	for _, ip := range ips {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+	}
+	return svc
+}
+
+// endpointsOn returns Endpoints with one ready endpoint on node.
+func endpointsOn(node string) *v1.Endpoints {
+	return &v1.Endpoints{Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.128.0.1", NodeName: &node}},
+	}}}
+}
+
+func TestAnnouncer(t *testing.T) {
+	peer := newTestPeer(t, 65001)
+	defer peer.close()
+
+	a := NewAnnouncer(log.NewNopLogger(), testNode, isLocal).(*announcer)
+	a.client = &testK8S{t: t}
+
+	localPref := uint32(200)
+	agent := &purelbv1.LBNodeAgent{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "purelb", Name: "default"},
+		Spec: purelbv1.LBNodeAgentSpec{BGP: &purelbv1.LBNodeAgentBGPSpec{
+			ASN:         65000,
+			Peers:       []purelbv1.LBNodeAgentBGPPeer{{Address: "127.0.0.1", ASN: 65001, Port: peer.port()}},
+			Communities: []string{"65000:100"},
+			ServiceGroups: []purelbv1.LBNodeAgentBGPRouteAttributes{
+				{ServiceGroup: "aggregated", Communities: []string{"no-export"}, LocalPref: &localPref},
+			},
+		}},
+	}
+	groups := []*purelbv1.ServiceGroup{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "remote"},
+			Spec: purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "172.30.0.0/24", Subnet: "172.30.0.0/24", Aggregation: "default"}},
+				V6Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "2001:db8::/120", Subnet: "2001:db8::/64", Aggregation: "/128"}},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "aggregated"},
+			Spec: purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "172.31.0.0/24", Subnet: "172.31.0.0/16", Aggregation: "/24"}},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "host"},
+			Spec: purelbv1.ServiceGroupSpec{Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []purelbv1.ServiceGroupAddressPool{{Pool: "172.29.0.0/24", Subnet: "172.29.0.0/24"}},
+			}},
+		},
+	}
+
+	// Without a BGP config the announcer does nothing
+	assert.NoError(t, a.SetConfig(&purelbv1.Config{Groups: groups}))
+	assert.NoError(t, a.SetBalancer(lbService("early", "aggregated", v1.ServiceExternalTrafficPolicyTypeCluster, "172.31.0.1"), nil))
+	assert.Empty(t, a.advertised)
+
+	assert.NoError(t, a.SetConfig(&purelbv1.Config{Agents: []*purelbv1.LBNodeAgent{agent}, Groups: groups}))
+
+	// Local addresses are the local announcer's job, and routes use
+	// the pool's aggregation
+	assert.NoError(t, a.SetBalancer(lbService("local", "remote", v1.ServiceExternalTrafficPolicyTypeCluster, "192.168.1.10"), nil))
+	assert.NoError(t, a.SetBalancer(lbService("dual", "remote", v1.ServiceExternalTrafficPolicyTypeCluster, "172.30.0.1", "2001:db8::1"), nil))
+	assert.NoError(t, a.SetBalancer(lbService("agg1", "aggregated", v1.ServiceExternalTrafficPolicyTypeCluster, "172.31.0.1"), nil))
+	assert.NoError(t, a.SetBalancer(lbService("agg2", "aggregated", v1.ServiceExternalTrafficPolicyTypeCluster, "172.31.0.2"), nil))
+	eventually(t, func() bool { return len(peer.received()) == 2 }, "IPv4 routes")
+	routes := peer.received()
+	assert.Equal(t, []uint32{65000<<16 | 100}, routes["172.30.0.0/24"].Communities)
+	assert.Equal(t, []uint32{65000<<16 | 100, 0xffffff01}, routes["172.31.0.0/24"].Communities)
+	assert.Nil(t, routes["172.31.0.0/24"].LocalPref, "LOCAL_PREF isn't sent to eBGP peers")
+	assert.Contains(t, a.advertised, "2001:db8::1/128", "IPv6 routes are advertised to IPv6 peers")
+
+	// Services whose externalTrafficPolicy is Local need an endpoint
+	// on this node
+	assert.NoError(t, a.SetBalancer(lbService("etp-local", "remote", v1.ServiceExternalTrafficPolicyTypeLocal, "172.30.1.1"), endpointsOn("node-b")))
+	assert.Error(t, a.SetBalancer(lbService("etp-local", "remote", v1.ServiceExternalTrafficPolicyTypeLocal, "172.30.1.1"), endpointsOn(testNode)), "address outside the group's pools")
+	svc := lbService("etp-local", "host", v1.ServiceExternalTrafficPolicyTypeLocal, "172.29.0.1")
+	assert.NoError(t, a.SetBalancer(svc, endpointsOn(testNode)))
+	eventually(t, func() bool { return peer.received()["172.29.0.1/32"] != nil }, "route for a local endpoint")
+	assert.NoError(t, a.SetBalancer(svc, endpointsOn("node-b")))
+	eventually(t, func() bool { return len(peer.received()) == 2 }, "the endpoint went away")
+
+	// Aggregated routes stay until no service needs them
+	assert.NoError(t, a.DeleteBalancer("unit/agg1", "test", nil))
+	assert.NoError(t, a.DeleteBalancer("unit/dual", "test", nil))
+	eventually(t, func() bool { return len(peer.received()) == 1 }, "withdrawal")
+	assert.NotNil(t, peer.received()["172.31.0.0/24"])
+	assert.NoError(t, a.DeleteBalancer("unit/agg2", "test", nil))
+	eventually(t, func() bool { return len(peer.received()) == 0 }, "withdrawal of a shared route")
+
+	status := purelbv1.LBNodeAgentNodeStatus{}
+	a.ReportStatus(&status)
+	assert.Equal(t, 1, len(status.BGPPeers))
+	assert.Equal(t, stateEstablished, status.BGPPeers[0].State)
+
+	// Shutting down disconnects from the peers
+	a.Shutdown()
+	eventually(t, func() bool {
+		peer.lock.Lock()
+		defer peer.lock.Unlock()
+		return !peer.established
+	}, "disconnect")
+	status = purelbv1.LBNodeAgentNodeStatus{}
+	a.ReportStatus(&status)
+	assert.Empty(t, status.BGPPeers)
+}
+
+func TestValidateAgentSpec(t *testing.T) {
+	valid := func() *purelbv1.LBNodeAgentBGPSpec {
+		return &purelbv1.LBNodeAgentBGPSpec{
+			ASN:         65000,
+			Peers:       []purelbv1.LBNodeAgentBGPPeer{{Address: "10.0.0.1", ASN: 65001}},
+			Communities: []string{"65000:1", "no-export"},
+		}
+	}
+	assert.NoError(t, ValidateAgentSpec(valid()))
+
+	tests := map[string]func(*purelbv1.LBNodeAgentBGPSpec){
+		"no ASN":            func(s *purelbv1.LBNodeAgentBGPSpec) { s.ASN = 0 },
+		"IPv6 router ID":    func(s *purelbv1.LBNodeAgentBGPSpec) { s.RouterID = "2001:db8::1" },
+		"short hold time":   func(s *purelbv1.LBNodeAgentBGPSpec) { s.HoldTime = &metav1.Duration{Duration: 2 * time.Second} },
+		"bad peer address":  func(s *purelbv1.LBNodeAgentBGPSpec) { s.Peers[0].Address = "router" },
+		"no peer ASN":       func(s *purelbv1.LBNodeAgentBGPSpec) { s.Peers[0].ASN = 0 },
+		"bad port":          func(s *purelbv1.LBNodeAgentBGPSpec) { s.Peers[0].Port = 70000 },
+		"IPv6 peer, no ID":  func(s *purelbv1.LBNodeAgentBGPSpec) { s.Peers[0].Address = "2001:db8::1" },
+		"bad community":     func(s *purelbv1.LBNodeAgentBGPSpec) { s.Communities = []string{"65000"} },
+		"community too big": func(s *purelbv1.LBNodeAgentBGPSpec) { s.Communities = []string{"65536:1"} },
+		"bad group community": func(s *purelbv1.LBNodeAgentBGPSpec) {
+			s.ServiceGroups = []purelbv1.LBNodeAgentBGPRouteAttributes{{ServiceGroup: "default", Communities: []string{"x"}}}
+		},
+	}
+	for desc, mutate := range tests {
+		spec := valid()
+		mutate(spec)
+		assert.Error(t, ValidateAgentSpec(spec), desc)
+	}
+
+	spec := valid()
+	spec.RouterID = "10.0.0.2"
+	spec.Peers[0].Address = "2001:db8::1"
+	assert.NoError(t, ValidateAgentSpec(spec), "IPv6 peer with a router ID")
+}
+
+func TestRoutePrefix(t *testing.T) {
+	pool := &purelbv1.ServiceGroupAddressPool{Subnet: "172.30.0.0/16"}
+	for aggregation, expected := range map[string]string{"": "172.30.1.1/32", "default": "172.30.0.0/16", "/24": "172.30.1.0/24", "/32": "172.30.1.1/32"} {
+		pool.Aggregation = aggregation
+		prefix, err := routePrefix(net.ParseIP("172.30.1.1"), pool)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, prefix.String(), aggregation)
+	}
+	pool.Aggregation = "/33"
+	_, err := routePrefix(net.ParseIP("172.30.1.1"), pool)
+	assert.Error(t, err)
+
+	pool = &purelbv1.ServiceGroupAddressPool{Subnet: "2001:db8::/64"}
+	prefix, err := routePrefix(net.ParseIP("2001:db8::10"), pool)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::10/128", prefix.String())
+}
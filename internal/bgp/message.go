@@ -0,0 +1,526 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	headerLen     = 19
+	maxMessageLen = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	// asTrans is the two-octet ASN that four-octet ASNs use in
+	// places that only have room for two octets (RFC 6793).
+	asTrans = 23456
+
+	paramCapabilities   = 2
+	capMultiprotocol    = 1
+	capFourOctetASN     = 65
+	afiIPv4             = 1
+	afiIPv6             = 2
+	safiUnicast         = 1
+	attrFlagOptional    = 0x80
+	attrFlagTransitive  = 0x40
+	attrFlagExtendedLen = 0x10
+	attrOrigin          = 1
+	attrASPath          = 2
+	attrNextHop         = 3
+	attrMED             = 4
+	attrLocalPref       = 5
+	attrCommunities     = 8
+	attrMPReachNLRI     = 14
+	attrMPUnreachNLRI   = 15
+	originIGP           = 0
+	asSequence          = 2
+)
+
+// Notification error codes and subcodes (RFC 4271 section 4.5 and
+// RFC 4486).
+const (
+	codeOpenMessage      = 2
+	codeHoldTimerExpired = 4
+	codeCease            = 6
+
+	subcodeBadPeerAS              = 2
+	subcodeUnacceptableHoldTime   = 6
+	subcodeUnsupportedCapability  = 7
+	subcodeAdministrativeShutdown = 2
+)
+
+// Message is a BGP message.
+type Message interface {
+	// Marshal returns the message in wire format, including the
+	// header.
+	Marshal() ([]byte, error)
+}
+
+// Open is a BGP OPEN message. FourOctetAS indicates whether the
+// speaker has the four-octet ASN capability (RFC 6793), in which case
+// ASN comes from the capability. Our sessions require it, so AS_PATH
+// attributes always use four-octet ASNs.
+type Open struct {
+	ASN         uint32
+	HoldTime    uint16
+	RouterID    net.IP
+	FourOctetAS bool
+
+	// Families lists the address families (afiIPv4 or afiIPv6) that
+	// the speaker supports, all with the unicast SAFI.
+	Families []uint16
+}
+
+// Keepalive is a BGP KEEPALIVE message.
+type Keepalive struct{}
+
+// Notification is a BGP NOTIFICATION message.
+type Notification struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+// Update is a BGP UPDATE message. IPv4 prefixes use the message's
+// Withdrawn Routes and NLRI fields and IPv6 prefixes use the
+// multiprotocol attributes (RFC 4760). NextHop applies to both
+// families, so a message that has NLRI in both families can't be
+// marshaled.
+type Update struct {
+	Withdrawn []net.IPNet
+	NLRI      []net.IPNet
+
+	// The path attributes. They're marshaled only if NLRI isn't empty.
+	NextHop     net.IP
+	ASPath      []uint32
+	MED         *uint32
+	LocalPref   *uint32
+	Communities []uint32
+}
+
+// Error makes Notification an error, so receiving one can end a
+// session.
+func (n *Notification) Error() string {
+	return fmt.Sprintf("BGP notification code %d subcode %d", n.Code, n.Subcode)
+}
+
+// ReadMessage reads one message from r. It returns *Open,
+// *Keepalive, *Notification, or *Update.
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	for _, b := range header[0:16] {
+		if b != 0xff {
+			return nil, fmt.Errorf("invalid BGP message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMessageLen {
+		return nil, fmt.Errorf("invalid BGP message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[18] {
+	case msgOpen:
+		return parseOpen(body)
+	case msgUpdate:
+		return parseUpdate(body)
+	case msgNotification:
+		if len(body) < 2 {
+			return nil, fmt.Errorf("short BGP notification")
+		}
+		return &Notification{Code: body[0], Subcode: body[1], Data: body[2:]}, nil
+	case msgKeepalive:
+		return &Keepalive{}, nil
+	}
+	return nil, fmt.Errorf("unknown BGP message type %d", header[18])
+}
+
+// Marshal implements Message.
+func (o *Open) Marshal() ([]byte, error) {
+	routerID := o.RouterID.To4()
+	if routerID == nil {
+		return nil, fmt.Errorf("router ID %s is not an IPv4 address", o.RouterID)
+	}
+
+	caps := []byte{}
+	for _, family := range o.Families {
+		caps = append(caps, capMultiprotocol, 4, 0, 0, 0, safiUnicast)
+		binary.BigEndian.PutUint16(caps[len(caps)-4:], family)
+	}
+	if o.FourOctetAS {
+		caps = append(caps, capFourOctetASN, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(caps[len(caps)-4:], o.ASN)
+	}
+
+	body := make([]byte, 10, 10+2+len(caps))
+	body[0] = 4 // BGP version
+	myAS := o.ASN
+	if myAS > 0xffff {
+		myAS = asTrans
+	}
+	binary.BigEndian.PutUint16(body[1:3], uint16(myAS))
+	binary.BigEndian.PutUint16(body[3:5], o.HoldTime)
+	copy(body[5:9], routerID)
+	if len(caps) > 0 {
+		body[9] = byte(2 + len(caps))
+		body = append(body, paramCapabilities, byte(len(caps)))
+		body = append(body, caps...)
+	}
+
+	return message(msgOpen, body)
+}
+
+// Marshal implements Message.
+func (k *Keepalive) Marshal() ([]byte, error) {
+	return message(msgKeepalive, nil)
+}
+
+// Marshal implements Message.
+func (n *Notification) Marshal() ([]byte, error) {
+	return message(msgNotification, append([]byte{n.Code, n.Subcode}, n.Data...))
+}
+
+// Marshal implements Message.
+func (u *Update) Marshal() ([]byte, error) {
+	withdrawn4, withdrawn6 := splitFamilies(u.Withdrawn)
+	nlri4, nlri6 := splitFamilies(u.NLRI)
+	if len(nlri4) > 0 && len(nlri6) > 0 {
+		return nil, fmt.Errorf("update has NLRI in both families")
+	}
+
+	attrs := []byte{}
+	if len(withdrawn6) > 0 {
+		value := []byte{0, afiIPv6, safiUnicast}
+		value = append(value, prefixes(withdrawn6)...)
+		attrs = append(attrs, attribute(attrFlagOptional, attrMPUnreachNLRI, value)...)
+	}
+	if len(u.NLRI) > 0 {
+		attrs = append(attrs, attribute(attrFlagTransitive, attrOrigin, []byte{originIGP})...)
+
+		asPath := []byte{}
+		if len(u.ASPath) > 0 {
+			asPath = append(asPath, asSequence, byte(len(u.ASPath)))
+			for _, asn := range u.ASPath {
+				asPath = append(asPath, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(asPath[len(asPath)-4:], asn)
+			}
+		}
+		attrs = append(attrs, attribute(attrFlagTransitive, attrASPath, asPath)...)
+
+		if len(nlri4) > 0 {
+			nextHop := u.NextHop.To4()
+			if nextHop == nil {
+				return nil, fmt.Errorf("next hop %s is not an IPv4 address", u.NextHop)
+			}
+			attrs = append(attrs, attribute(attrFlagTransitive, attrNextHop, nextHop)...)
+		}
+		if u.MED != nil {
+			attrs = append(attrs, attribute(attrFlagOptional, attrMED, uint32Bytes(*u.MED))...)
+		}
+		if u.LocalPref != nil {
+			attrs = append(attrs, attribute(attrFlagTransitive, attrLocalPref, uint32Bytes(*u.LocalPref))...)
+		}
+		if len(u.Communities) > 0 {
+			value := []byte{}
+			for _, community := range u.Communities {
+				value = append(value, uint32Bytes(community)...)
+			}
+			attrs = append(attrs, attribute(attrFlagOptional|attrFlagTransitive, attrCommunities, value)...)
+		}
+		if len(nlri6) > 0 {
+			if u.NextHop.To4() != nil || u.NextHop.To16() == nil {
+				return nil, fmt.Errorf("next hop %s is not an IPv6 address", u.NextHop)
+			}
+			value := []byte{0, afiIPv6, safiUnicast, 16}
+			value = append(value, u.NextHop.To16()...)
+			value = append(value, 0) // reserved
+			value = append(value, prefixes(nlri6)...)
+			attrs = append(attrs, attribute(attrFlagOptional, attrMPReachNLRI, value)...)
+		}
+	}
+
+	withdrawn := prefixes(withdrawn4)
+	body := make([]byte, 2, 4+len(withdrawn)+len(attrs))
+	binary.BigEndian.PutUint16(body[0:2], uint16(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = append(body, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(len(attrs)))
+	body = append(body, attrs...)
+	body = append(body, prefixes(nlri4)...)
+
+	return message(msgUpdate, body)
+}
+
+// parseOpen parses the body of an OPEN message.
+func parseOpen(body []byte) (*Open, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("short BGP open")
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("unsupported BGP version %d", body[0])
+	}
+	open := &Open{
+		ASN:      uint32(binary.BigEndian.Uint16(body[1:3])),
+		HoldTime: binary.BigEndian.Uint16(body[3:5]),
+		RouterID: net.IP(append([]byte{}, body[5:9]...)),
+	}
+
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, fmt.Errorf("invalid BGP open parameters length")
+	}
+	for len(params) > 0 {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return nil, fmt.Errorf("truncated BGP open parameter")
+		}
+		paramType, value := params[0], params[2:2+int(params[1])]
+		params = params[2+int(params[1]):]
+		if paramType != paramCapabilities {
+			continue
+		}
+
+		for len(value) > 0 {
+			if len(value) < 2 || len(value) < 2+int(value[1]) {
+				return nil, fmt.Errorf("truncated BGP capability")
+			}
+			code, capValue := value[0], value[2:2+int(value[1])]
+			value = value[2+int(value[1]):]
+			switch {
+			case code == capMultiprotocol && len(capValue) == 4 && capValue[3] == safiUnicast:
+				open.Families = append(open.Families, binary.BigEndian.Uint16(capValue[0:2]))
+			case code == capFourOctetASN && len(capValue) == 4:
+				open.FourOctetAS = true
+				open.ASN = binary.BigEndian.Uint32(capValue)
+			}
+		}
+	}
+
+	return open, nil
+}
+
+// parseUpdate parses the body of an UPDATE message. It ignores path
+// attributes that it doesn't understand.
+func parseUpdate(body []byte) (*Update, error) {
+	update := &Update{}
+
+	if len(body) < 2 {
+		return nil, fmt.Errorf("short BGP update")
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(body[0:2]))
+	body = body[2:]
+	if len(body) < withdrawnLen+2 {
+		return nil, fmt.Errorf("truncated BGP update")
+	}
+	withdrawn, err := parsePrefixes(body[:withdrawnLen], net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	update.Withdrawn = withdrawn
+	body = body[withdrawnLen:]
+
+	attrsLen := int(binary.BigEndian.Uint16(body[0:2]))
+	body = body[2:]
+	if len(body) < attrsLen {
+		return nil, fmt.Errorf("truncated BGP update")
+	}
+	attrs := body[:attrsLen]
+	nlri, err := parsePrefixes(body[attrsLen:], net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	update.NLRI = nlri
+
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, fmt.Errorf("truncated BGP path attribute")
+		}
+		flags, attrType := attrs[0], attrs[1]
+		var value []byte
+		if flags&attrFlagExtendedLen != 0 {
+			if len(attrs) < 4 || len(attrs) < 4+int(binary.BigEndian.Uint16(attrs[2:4])) {
+				return nil, fmt.Errorf("truncated BGP path attribute")
+			}
+			value = attrs[4 : 4+int(binary.BigEndian.Uint16(attrs[2:4]))]
+			attrs = attrs[4+len(value):]
+		} else {
+			if len(attrs) < 3+int(attrs[2]) {
+				return nil, fmt.Errorf("truncated BGP path attribute")
+			}
+			value = attrs[3 : 3+int(attrs[2])]
+			attrs = attrs[3+len(value):]
+		}
+
+		if err := update.parseAttribute(attrType, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return update, nil
+}
+
+// parseAttribute parses one path attribute into u.
+func (u *Update) parseAttribute(attrType uint8, value []byte) error {
+	switch attrType {
+	case attrASPath:
+		for len(value) >= 2 {
+			count := int(value[1])
+			if len(value) < 2+4*count {
+				return fmt.Errorf("truncated BGP AS_PATH")
+			}
+			for i := 0; i < count; i++ {
+				u.ASPath = append(u.ASPath, binary.BigEndian.Uint32(value[2+4*i:]))
+			}
+			value = value[2+4*count:]
+		}
+	case attrNextHop:
+		if len(value) != 4 {
+			return fmt.Errorf("invalid BGP NEXT_HOP")
+		}
+		u.NextHop = net.IP(append([]byte{}, value...))
+	case attrMED, attrLocalPref:
+		if len(value) != 4 {
+			return fmt.Errorf("invalid BGP attribute %d", attrType)
+		}
+		v := binary.BigEndian.Uint32(value)
+		if attrType == attrMED {
+			u.MED = &v
+		} else {
+			u.LocalPref = &v
+		}
+	case attrCommunities:
+		for ; len(value) >= 4; value = value[4:] {
+			u.Communities = append(u.Communities, binary.BigEndian.Uint32(value))
+		}
+	case attrMPReachNLRI:
+		if len(value) < 5 || len(value) < 5+int(value[3]) {
+			return fmt.Errorf("truncated BGP MP_REACH_NLRI")
+		}
+		nextHopLen := int(value[3])
+		if binary.BigEndian.Uint16(value[0:2]) != afiIPv6 || nextHopLen < 16 {
+			return nil
+		}
+		u.NextHop = net.IP(append([]byte{}, value[4:20]...))
+		nlri, err := parsePrefixes(value[5+nextHopLen:], net.IPv6len)
+		if err != nil {
+			return err
+		}
+		u.NLRI = append(u.NLRI, nlri...)
+	case attrMPUnreachNLRI:
+		if len(value) < 3 {
+			return fmt.Errorf("truncated BGP MP_UNREACH_NLRI")
+		}
+		if binary.BigEndian.Uint16(value[0:2]) != afiIPv6 {
+			return nil
+		}
+		withdrawn, err := parsePrefixes(value[3:], net.IPv6len)
+		if err != nil {
+			return err
+		}
+		u.Withdrawn = append(u.Withdrawn, withdrawn...)
+	}
+	return nil
+}
+
+// message returns a message with a header.
+func message(msgType uint8, body []byte) ([]byte, error) {
+	length := headerLen + len(body)
+	if length > maxMessageLen {
+		return nil, fmt.Errorf("BGP message too long: %d bytes", length)
+	}
+
+	msg := make([]byte, headerLen, length)
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:18], uint16(length))
+	msg[18] = msgType
+	return append(msg, body...), nil
+}
+
+// attribute returns a path attribute, using the extended length
+// format if the value needs it.
+func attribute(flags uint8, attrType uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		attr := []byte{flags | attrFlagExtendedLen, attrType, 0, 0}
+		binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+		return append(attr, value...)
+	}
+	return append([]byte{flags, attrType, byte(len(value))}, value...)
+}
+
+// prefixes returns the wire format of a list of prefixes.
+func prefixes(nets []net.IPNet) []byte {
+	encoded := []byte{}
+	for _, prefix := range nets {
+		ones, _ := prefix.Mask.Size()
+		ip := prefix.IP.To4()
+		if ip == nil {
+			ip = prefix.IP.To16()
+		}
+		encoded = append(encoded, byte(ones))
+		encoded = append(encoded, ip.Mask(prefix.Mask)[:(ones+7)/8]...)
+	}
+	return encoded
+}
+
+// parsePrefixes parses the wire format of a list of prefixes whose
+// addresses are addrLen bytes long.
+func parsePrefixes(encoded []byte, addrLen int) ([]net.IPNet, error) {
+	nets := []net.IPNet{}
+	for len(encoded) > 0 {
+		ones := int(encoded[0])
+		octets := (ones + 7) / 8
+		if ones > addrLen*8 || len(encoded) < 1+octets {
+			return nil, fmt.Errorf("invalid BGP prefix")
+		}
+		ip := make(net.IP, addrLen)
+		copy(ip, encoded[1:1+octets])
+		nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(ones, addrLen*8)})
+		encoded = encoded[1+octets:]
+	}
+	return nets, nil
+}
+
+// splitFamilies splits a list of prefixes into IPv4 and IPv6
+// prefixes.
+func splitFamilies(nets []net.IPNet) (v4 []net.IPNet, v6 []net.IPNet) {
+	for _, prefix := range nets {
+		if prefix.IP.To4() != nil {
+			v4 = append(v4, prefix)
+		} else {
+			v6 = append(v6, prefix)
+		}
+	}
+	return
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
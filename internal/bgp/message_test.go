@@ -0,0 +1,116 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCIDR(cidr string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return *ipnet
+}
+
+// roundTrip marshals msg and reads it back.
+func roundTrip(t *testing.T, msg Message) Message {
+	raw, err := msg.Marshal()
+	assert.NoError(t, err)
+	parsed, err := ReadMessage(bytes.NewReader(raw))
+	assert.NoError(t, err)
+	return parsed
+}
+
+func TestOpen(t *testing.T) {
+	open := &Open{ASN: 4200000000, HoldTime: 90, RouterID: net.ParseIP("10.0.0.1").To4(), FourOctetAS: true, Families: []uint16{afiIPv4, afiIPv6}}
+	raw, err := open.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x5b, 0xa0}, raw[20:22], "four-octet ASNs use AS_TRANS in the My Autonomous System field")
+	assert.Equal(t, open, roundTrip(t, open))
+
+	open = &Open{ASN: 65000, HoldTime: 0, RouterID: net.ParseIP("10.0.0.1").To4()}
+	assert.Equal(t, open, roundTrip(t, open), "no capabilities")
+
+	_, err = (&Open{ASN: 65000, RouterID: net.ParseIP("2001:db8::1")}).Marshal()
+	assert.Error(t, err, "IPv6 router ID")
+}
+
+func TestUpdate(t *testing.T) {
+	med := uint32(10)
+	localPref := uint32(200)
+	update := &Update{
+		Withdrawn:   []net.IPNet{mustCIDR("192.168.2.0/24")},
+		NLRI:        []net.IPNet{mustCIDR("192.168.1.10/32"), mustCIDR("10.0.0.0/8")},
+		NextHop:     net.ParseIP("172.16.0.1").To4(),
+		ASPath:      []uint32{65000},
+		MED:         &med,
+		LocalPref:   &localPref,
+		Communities: []uint32{65000<<16 | 100, 0xffffff01},
+	}
+	parsed := roundTrip(t, update).(*Update)
+	assert.Equal(t, update, parsed)
+
+	// IPv6 uses the multiprotocol attributes
+	update = &Update{
+		Withdrawn: []net.IPNet{mustCIDR("2001:db8:1::/64")},
+		NLRI:      []net.IPNet{mustCIDR("2001:db8::10/128")},
+		NextHop:   net.ParseIP("2001:db8::1"),
+		ASPath:    []uint32{65000},
+	}
+	parsed = roundTrip(t, update).(*Update)
+	assert.Equal(t, update.Withdrawn, parsed.Withdrawn)
+	assert.Equal(t, update.NLRI, parsed.NLRI)
+	assert.True(t, update.NextHop.Equal(parsed.NextHop))
+
+	// Withdrawals don't need path attributes
+	update = &Update{Withdrawn: []net.IPNet{mustCIDR("192.168.1.10/32")}}
+	raw, err := update.Marshal()
+	assert.NoError(t, err)
+	assert.Len(t, raw, headerLen+2+5+2)
+	parsed = roundTrip(t, update).(*Update)
+	assert.Equal(t, update.Withdrawn, parsed.Withdrawn)
+	assert.Empty(t, parsed.NLRI)
+
+	_, err = (&Update{NLRI: []net.IPNet{mustCIDR("192.168.1.10/32"), mustCIDR("2001:db8::10/128")}, NextHop: net.ParseIP("172.16.0.1")}).Marshal()
+	assert.Error(t, err, "NLRI in both families")
+	_, err = (&Update{NLRI: []net.IPNet{mustCIDR("2001:db8::10/128")}, NextHop: net.ParseIP("172.16.0.1")}).Marshal()
+	assert.Error(t, err, "IPv4 next hop for IPv6 NLRI")
+}
+
+func TestReadMessage(t *testing.T) {
+	assert.Equal(t, &Keepalive{}, roundTrip(t, &Keepalive{}))
+	notification := &Notification{Code: codeCease, Subcode: subcodeAdministrativeShutdown, Data: []byte{}}
+	assert.Equal(t, notification, roundTrip(t, notification))
+
+	raw, _ := (&Keepalive{}).Marshal()
+	raw[0] = 0
+	_, err := ReadMessage(bytes.NewReader(raw))
+	assert.Error(t, err, "bad marker")
+
+	raw, _ = (&Keepalive{}).Marshal()
+	raw[17] = 10
+	_, err = ReadMessage(bytes.NewReader(raw))
+	assert.Error(t, err, "bad length")
+
+	raw, _ = (&Update{NLRI: []net.IPNet{mustCIDR("192.168.1.10/32")}, NextHop: net.ParseIP("172.16.0.1")}).Marshal()
+	_, err = ReadMessage(bytes.NewReader(raw[:len(raw)-1]))
+	assert.Error(t, err, "truncated message")
+}
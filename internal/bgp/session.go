@@ -0,0 +1,447 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// Session states, from RFC 4271 section 8.2.2. We only connect,
+	// we never listen, so we don't use Active.
+	stateIdle        = "Idle"
+	stateConnect     = "Connect"
+	stateOpenSent    = "OpenSent"
+	stateOpenConfirm = "OpenConfirm"
+	stateEstablished = "Established"
+
+	// openHoldTime is how long we wait for the peer's OPEN (RFC 4271
+	// suggests 4 minutes).
+	openHoldTime = 4 * time.Minute
+
+	// writeTimeout is how long we wait for a peer to accept a
+	// message before we give up on the connection.
+	writeTimeout = 10 * time.Second
+
+	// defaultLocalPref is the LOCAL_PREF that we send to iBGP peers if
+	// the route doesn't have one.
+	defaultLocalPref = 100
+)
+
+// errStopped means that the session was closed.
+var errStopped = errors.New("session closed")
+
+// SessionStatus describes a session with one peer.
+type SessionStatus struct {
+	// Peer is the peer's address and port.
+	Peer string
+
+	State string
+
+	// Routes is the number of routes that we're advertising to the
+	// peer.
+	Routes int
+
+	// Error describes why the session most recently failed.
+	Error string
+}
+
+// session maintains a connection to one peer and keeps the peer up to
+// date with the speaker's routes.
+type session struct {
+	speaker *Speaker
+	peer    Peer
+	address string // the peer's address and port
+	logger  log.Logger
+
+	// changed is signaled when the speaker's routes change. It's
+	// buffered so the speaker doesn't block, and several changes can
+	// coalesce into one signal.
+	changed chan struct{}
+
+	// stop is closed to end the session, and the session closes done
+	// when it has ended.
+	stop chan struct{}
+	done chan struct{}
+
+	// lock protects the status fields.
+	lock      sync.Mutex
+	state     string
+	routes    int
+	lastError string
+}
+
+// newSession starts a session with peer.
+func newSession(speaker *Speaker, peer Peer) *session {
+	address := net.JoinHostPort(peer.Address.String(), strconv.Itoa(peer.Port))
+	s := &session{
+		speaker: speaker,
+		peer:    peer,
+		address: address,
+		logger:  log.With(speaker.logger, "peer", address),
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		state:   stateIdle,
+	}
+	go s.run()
+	return s
+}
+
+// notify tells the session that the speaker's routes have changed.
+func (s *session) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// there's already a signal pending
+	}
+}
+
+// close ends the session. It doesn't wait for the session to
+// end. Use the done channel for that.
+func (s *session) close() {
+	close(s.stop)
+}
+
+func (s *session) status() SessionStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return SessionStatus{Peer: s.address, State: s.state, Routes: s.routes, Error: s.lastError}
+}
+
+func (s *session) setState(state string) {
+	s.lock.Lock()
+	s.state = state
+	s.lock.Unlock()
+
+	if state == stateEstablished {
+		sessionUp.WithLabelValues(s.address).Set(1)
+	} else {
+		sessionUp.WithLabelValues(s.address).Set(0)
+	}
+}
+
+func (s *session) setRoutes(routes int) {
+	s.lock.Lock()
+	s.routes = routes
+	s.lock.Unlock()
+
+	routesAdvertised.WithLabelValues(s.address).Set(float64(routes))
+}
+
+// run connects to the peer, and reconnects if the connection fails,
+// until the session is closed.
+func (s *session) run() {
+	defer close(s.done)
+	defer func() {
+		sessionUp.DeleteLabelValues(s.address)
+		routesAdvertised.DeleteLabelValues(s.address)
+	}()
+
+	if s.speaker.after != nil {
+		select {
+		case <-s.speaker.after:
+		case <-s.stop:
+			return
+		}
+	}
+
+	for {
+		err := s.connect()
+		s.setState(stateIdle)
+		s.setRoutes(0)
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			s.logger.Log("op", "bgpSession", "error", err)
+			s.lock.Lock()
+			s.lastError = err.Error()
+			s.lock.Unlock()
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.speaker.config.ConnectRetry):
+		}
+	}
+}
+
+// connect connects to the peer and runs the session until the
+// connection fails or the session is closed.
+func (s *session) connect() error {
+	s.setState(stateConnect)
+
+	// Closing the session cancels the dial so we don't hold up
+	// Shutdown while we wait for a peer that doesn't answer
+	finished := make(chan struct{})
+	defer close(finished)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-finished:
+		}
+	}()
+	dialer := net.Dialer{Timeout: writeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		select {
+		case <-s.stop:
+			return errStopped
+		default:
+			return err
+		}
+	}
+	defer conn.Close()
+
+	// All reads happen in this goroutine so the session can wait for
+	// messages, timers, and route changes at the same time
+	messages := make(chan Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	routerID := s.speaker.config.RouterID
+	if routerID == nil {
+		routerID = localIP.To4()
+	}
+	if routerID == nil {
+		return fmt.Errorf("a router ID is required to connect to IPv6 peers")
+	}
+	family := uint16(afiIPv4)
+	if localIP.To4() == nil {
+		family = afiIPv6
+	}
+
+	// Exchange OPENs
+	holdTime := uint16(s.speaker.config.HoldTime / time.Second)
+	if err := s.write(conn, &Open{ASN: s.speaker.config.ASN, HoldTime: holdTime, RouterID: routerID, FourOctetAS: true, Families: []uint16{family}}); err != nil {
+		return err
+	}
+	s.setState(stateOpenSent)
+	msg, err := s.receive(messages, readErr, openHoldTime)
+	if err != nil {
+		return err
+	}
+	open, ok := msg.(*Open)
+	if !ok {
+		return fmt.Errorf("expected OPEN, received %T", msg)
+	}
+	if !open.FourOctetAS {
+		s.write(conn, &Notification{Code: codeOpenMessage, Subcode: subcodeUnsupportedCapability})
+		return fmt.Errorf("peer doesn't support four-octet ASNs")
+	}
+	if open.ASN != s.peer.ASN {
+		s.write(conn, &Notification{Code: codeOpenMessage, Subcode: subcodeBadPeerAS})
+		return fmt.Errorf("peer ASN is %d, expected %d", open.ASN, s.peer.ASN)
+	}
+	if open.HoldTime < holdTime {
+		holdTime = open.HoldTime
+	}
+	if holdTime == 1 || holdTime == 2 {
+		s.write(conn, &Notification{Code: codeOpenMessage, Subcode: subcodeUnacceptableHoldTime})
+		return fmt.Errorf("unacceptable hold time %d", holdTime)
+	}
+	hold := time.Duration(holdTime) * time.Second
+
+	// Exchange KEEPALIVEs
+	if err := s.write(conn, &Keepalive{}); err != nil {
+		return err
+	}
+	s.setState(stateOpenConfirm)
+	confirmWait := hold
+	if confirmWait == 0 {
+		confirmWait = openHoldTime
+	}
+	if msg, err = s.receive(messages, readErr, confirmWait); err != nil {
+		return err
+	}
+	if _, ok := msg.(*Keepalive); !ok {
+		return fmt.Errorf("expected KEEPALIVE, received %T", msg)
+	}
+
+	s.setState(stateEstablished)
+	s.lock.Lock()
+	s.lastError = ""
+	s.lock.Unlock()
+	s.logger.Log("op", "bgpSession", "state", stateEstablished, "holdTime", hold)
+
+	// A hold time of 0 means that neither side sends KEEPALIVEs
+	var keepalives, holdExpired <-chan time.Time
+	var holdTimer *time.Timer
+	if hold > 0 {
+		ticker := time.NewTicker(hold / 3)
+		defer ticker.Stop()
+		keepalives = ticker.C
+		holdTimer = time.NewTimer(hold)
+		defer holdTimer.Stop()
+		holdExpired = holdTimer.C
+	}
+
+	advertised := map[string]Route{}
+	ibgp := s.peer.ASN == s.speaker.config.ASN
+	if err := s.sync(conn, localIP, ibgp, advertised); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-s.changed:
+			if err := s.sync(conn, localIP, ibgp, advertised); err != nil {
+				return err
+			}
+		case <-keepalives:
+			if err := s.write(conn, &Keepalive{}); err != nil {
+				return err
+			}
+		case msg := <-messages:
+			if notification, ok := msg.(*Notification); ok {
+				return notification
+			}
+			// We don't accept routes so the only thing that matters
+			// about the peer's messages is that it's still alive
+			if holdTimer != nil {
+				if !holdTimer.Stop() {
+					select {
+					case <-holdTimer.C:
+					default:
+					}
+				}
+				holdTimer.Reset(hold)
+			}
+		case err := <-readErr:
+			return err
+		case <-holdExpired:
+			s.write(conn, &Notification{Code: codeHoldTimerExpired})
+			return fmt.Errorf("hold timer expired")
+		case <-s.stop:
+			s.write(conn, &Notification{Code: codeCease, Subcode: subcodeAdministrativeShutdown})
+			return errStopped
+		}
+	}
+}
+
+// receive waits for the next message from the peer. It returns the
+// peer's NOTIFICATION as an error.
+func (s *session) receive(messages <-chan Message, readErr <-chan error, timeout time.Duration) (Message, error) {
+	select {
+	case msg := <-messages:
+		if notification, ok := msg.(*Notification); ok {
+			return nil, notification
+		}
+		return msg, nil
+	case err := <-readErr:
+		return nil, err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for the peer")
+	case <-s.stop:
+		return nil, errStopped
+	}
+}
+
+// sync sends UPDATEs that make the routes that we've advertised to
+// the peer match the speaker's routes. advertised holds the routes
+// that we've advertised, and sync updates it.
+func (s *session) sync(conn net.Conn, nextHop net.IP, ibgp bool, advertised map[string]Route) error {
+	routes := s.speaker.routesFor(nextHop)
+
+	for key, route := range advertised {
+		if _, current := routes[key]; !current {
+			if err := s.write(conn, &Update{Withdrawn: []net.IPNet{route.Prefix}}); err != nil {
+				return err
+			}
+			delete(advertised, key)
+		}
+	}
+
+	keys := []string{}
+	for key := range routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		route := routes[key]
+		if previous, exists := advertised[key]; exists && reflect.DeepEqual(previous, route) {
+			continue
+		}
+
+		update := &Update{
+			NLRI:        []net.IPNet{route.Prefix},
+			NextHop:     nextHop,
+			MED:         route.MED,
+			Communities: route.Communities,
+		}
+		if ibgp {
+			localPref := uint32(defaultLocalPref)
+			if route.LocalPref != nil {
+				localPref = *route.LocalPref
+			}
+			update.LocalPref = &localPref
+		} else {
+			update.ASPath = []uint32{s.speaker.config.ASN}
+		}
+		if err := s.write(conn, update); err != nil {
+			return err
+		}
+		advertised[key] = route
+	}
+
+	s.setRoutes(len(advertised))
+	return nil
+}
+
+// write sends msg to the peer.
+func (s *session) write(conn net.Conn, msg Message) error {
+	bytes, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write(bytes); err != nil {
+		return err
+	}
+	if _, isUpdate := msg.(*Update); isUpdate {
+		updatesSent.WithLabelValues(s.address).Inc()
+	}
+	return nil
+}
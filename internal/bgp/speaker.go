@@ -0,0 +1,246 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	defaultPort         = 179
+	defaultHoldTime     = 90 * time.Second
+	defaultConnectRetry = 5 * time.Second
+)
+
+// Config configures a Speaker.
+type Config struct {
+	ASN uint32
+
+	// RouterID is the BGP identifier. If it's nil then each session
+	// uses its local IPv4 address.
+	RouterID net.IP
+
+	// HoldTime is the hold time that the speaker proposes to its
+	// peers. If it's 0 then the speaker uses defaultHoldTime.
+	HoldTime time.Duration
+
+	// ConnectRetry is the time between attempts to connect to a
+	// peer. If it's 0 then the speaker uses defaultConnectRetry.
+	ConnectRetry time.Duration
+}
+
+// Peer describes one of a Speaker's peers.
+type Peer struct {
+	Address net.IP
+	ASN     uint32
+
+	// Port is the peer's TCP port. If it's 0 then the speaker uses
+	// 179.
+	Port int
+}
+
+// Route is a route that a Speaker advertises. The Speaker provides
+// the NEXT_HOP and AS_PATH attributes.
+type Route struct {
+	Prefix      net.IPNet
+	Communities []uint32
+	MED         *uint32
+
+	// LocalPref is sent only to iBGP peers.
+	LocalPref *uint32
+}
+
+// Speaker is a BGP speaker that advertises routes to its peers. It
+// doesn't accept routes from them. It connects to each of its peers
+// and keeps trying if a connection fails, so routes reach each peer
+// as soon as it's reachable.
+type Speaker struct {
+	logger log.Logger
+	config Config
+
+	// after, if it's not nil, is closed when the speaker that this
+	// one replaces has closed its sessions. Our sessions wait for it
+	// so peers don't see two sessions from us at once.
+	after <-chan struct{}
+
+	// lock protects routes and sessions.
+	lock     sync.Mutex
+	routes   map[string]Route    // prefix -> route
+	sessions map[string]*session // peer key -> session
+}
+
+// NewSpeaker returns a Speaker that has no peers or routes.
+func NewSpeaker(l log.Logger, config Config) *Speaker {
+	if config.HoldTime == 0 {
+		config.HoldTime = defaultHoldTime
+	}
+	if config.ConnectRetry == 0 {
+		config.ConnectRetry = defaultConnectRetry
+	}
+
+	return &Speaker{
+		logger:   l,
+		config:   config,
+		routes:   map[string]Route{},
+		sessions: map[string]*session{},
+	}
+}
+
+// SetPeers sets the speaker's peers. It connects to new peers and
+// disconnects from peers that aren't in peers anymore.
+func (s *Speaker) SetPeers(peers []Peer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := map[string]bool{}
+	for _, peer := range peers {
+		if peer.Port == 0 {
+			peer.Port = defaultPort
+		}
+		key := net.JoinHostPort(peer.Address.String(), strconv.Itoa(peer.Port))
+		current[key] = true
+
+		if session, exists := s.sessions[key]; exists {
+			if session.peer.ASN == peer.ASN {
+				continue
+			}
+			// The peer's ASN changed so we need a new session
+			session.close()
+		}
+		s.sessions[key] = newSession(s, peer)
+	}
+
+	for key, session := range s.sessions {
+		if !current[key] {
+			session.close()
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// Announce advertises route to the speaker's peers. If the speaker is
+// already advertising a route to route's prefix then route replaces
+// it.
+func (s *Speaker) Announce(route Route) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := route.Prefix.String()
+	if existing, exists := s.routes[key]; exists && reflect.DeepEqual(existing, route) {
+		return
+	}
+	s.routes[key] = route
+	s.notifySessions()
+}
+
+// Withdraw withdraws the route to prefix from the speaker's peers.
+func (s *Speaker) Withdraw(prefix net.IPNet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := prefix.String()
+	if _, exists := s.routes[key]; !exists {
+		return
+	}
+	delete(s.routes, key)
+	s.notifySessions()
+}
+
+// Status describes the speaker's sessions, sorted by address.
+func (s *Speaker) Status() []SessionStatus {
+	s.lock.Lock()
+	sessions := []*session{}
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.lock.Unlock()
+
+	status := []SessionStatus{}
+	for _, session := range sessions {
+		status = append(status, session.status())
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Peer < status[j].Peer
+	})
+	return status
+}
+
+// Shutdown disconnects from the speaker's peers, which withdraws the
+// routes that it advertised. It waits (briefly) for the sessions to
+// tell their peers that they're closing, so the peers withdraw the
+// routes right away instead of when their hold timers expire.
+func (s *Speaker) Shutdown() {
+	<-s.Close()
+}
+
+// Close is like Shutdown but it doesn't wait. It returns a channel
+// that's closed when the sessions have told their peers, or when
+// writeTimeout has passed. The sessions close at the same time so one
+// slow peer doesn't hold up the others.
+func (s *Speaker) Close() <-chan struct{} {
+	s.lock.Lock()
+	sessions := []*session{}
+	for key, session := range s.sessions {
+		session.close()
+		sessions = append(sessions, session)
+		delete(s.sessions, key)
+	}
+	s.lock.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		timeout := time.After(writeTimeout)
+		for _, session := range sessions {
+			select {
+			case <-session.done:
+			case <-timeout:
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// routesFor returns the routes whose family matches ip's family. The
+// sessions use it to decide what to advertise.
+func (s *Speaker) routesFor(ip net.IP) map[string]Route {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v4 := ip.To4() != nil
+	routes := map[string]Route{}
+	for key, route := range s.routes {
+		if (route.Prefix.IP.To4() != nil) == v4 {
+			routes[key] = route
+		}
+	}
+	return routes
+}
+
+// notifySessions tells each session that the routes have changed. The
+// caller must hold s.lock.
+func (s *Speaker) notifySessions() {
+	for _, session := range s.sessions {
+		session.notify()
+	}
+}
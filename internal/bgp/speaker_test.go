@@ -0,0 +1,316 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPeer is an in-process BGP speaker that accepts connections
+// from our Speaker and records the routes that it receives. It
+// proposes a hold time of 0 so neither side needs to send KEEPALIVEs.
+type testPeer struct {
+	asn      uint32
+	listener net.Listener
+
+	lock          sync.Mutex
+	conn          net.Conn
+	open          *Open
+	established   bool
+	routes        map[string]*Update // prefix -> the UPDATE that advertised it
+	updates       [][]byte           // the UPDATEs that it received, as they were on the wire
+	notifications []*Notification
+}
+
+// newTestPeer starts a testPeer that listens on a random port on
+// the IPv4 loopback interface.
+func newTestPeer(t *testing.T, asn uint32) *testPeer {
+	return newTestPeerOn(t, asn, "127.0.0.1")
+}
+
+// newTestPeerOn starts a testPeer that listens on a random port on
+// address.
+func newTestPeerOn(t *testing.T, asn uint32, address string) *testPeer {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		t.Skipf("can't listen on %s: %s", address, err)
+	}
+	p := &testPeer{asn: asn, listener: listener, routes: map[string]*Update{}}
+	go p.serve()
+	return p
+}
+
+func (p *testPeer) port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (p *testPeer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.handle(conn)
+	}
+}
+
+// handle runs one session.
+func (p *testPeer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return
+	}
+	open, ok := msg.(*Open)
+	if !ok {
+		return
+	}
+	reply, _ := (&Open{ASN: p.asn, RouterID: net.ParseIP("10.0.0.254"), FourOctetAS: true, Families: open.Families}).Marshal()
+	keepalive, _ := (&Keepalive{}).Marshal()
+	conn.Write(append(reply, keepalive...))
+
+	p.lock.Lock()
+	p.conn = conn
+	p.open = open
+	p.routes = map[string]*Update{}
+	p.lock.Unlock()
+
+	wire := &bytes.Buffer{}
+	reader := io.TeeReader(conn, wire)
+	for {
+		wire.Reset()
+		msg, err := ReadMessage(reader)
+		if err != nil {
+			break
+		}
+
+		p.lock.Lock()
+		switch msg := msg.(type) {
+		case *Keepalive:
+			p.established = true
+		case *Update:
+			p.updates = append(p.updates, append([]byte{}, wire.Bytes()...))
+			for _, prefix := range msg.Withdrawn {
+				delete(p.routes, prefix.String())
+			}
+			for _, prefix := range msg.NLRI {
+				p.routes[prefix.String()] = msg
+			}
+		case *Notification:
+			p.notifications = append(p.notifications, msg)
+		}
+		p.lock.Unlock()
+	}
+
+	// A real router would forget the routes when the session ends
+	p.lock.Lock()
+	p.established = false
+	p.routes = map[string]*Update{}
+	p.lock.Unlock()
+}
+
+// received returns the routes that the peer has received, keyed by
+// prefix.
+func (p *testPeer) received() map[string]*Update {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	routes := map[string]*Update{}
+	for prefix, update := range p.routes {
+		routes[prefix] = update
+	}
+	return routes
+}
+
+// disconnect drops the current session.
+func (p *testPeer) disconnect() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (p *testPeer) close() {
+	p.listener.Close()
+	p.disconnect()
+}
+
+// eventually fails the test if condition doesn't become true soon.
+func eventually(t *testing.T, condition func() bool, msg string) {
+	assert.Eventually(t, condition, 5*time.Second, 10*time.Millisecond, msg)
+}
+
+func TestSpeaker(t *testing.T) {
+	peer := newTestPeer(t, 65001)
+	defer peer.close()
+
+	speaker := NewSpeaker(log.NewNopLogger(), Config{ASN: 65000, ConnectRetry: 10 * time.Millisecond})
+	med := uint32(50)
+	speaker.Announce(Route{Prefix: mustCIDR("192.168.1.10/32"), Communities: []uint32{65000<<16 | 100}, MED: &med})
+	speaker.SetPeers([]Peer{{Address: net.ParseIP("127.0.0.1"), ASN: 65001, Port: peer.port()}})
+
+	// Routes that the speaker already had reach the peer when the
+	// session comes up
+	eventually(t, func() bool { return len(peer.received()) == 1 }, "initial route")
+	update := peer.received()["192.168.1.10/32"]
+	assert.NotNil(t, update)
+	assert.True(t, net.ParseIP("127.0.0.1").Equal(update.NextHop))
+	assert.Equal(t, []uint32{65000}, update.ASPath, "eBGP")
+	assert.Nil(t, update.LocalPref, "eBGP")
+	assert.Equal(t, []uint32{65000<<16 | 100}, update.Communities)
+	assert.Equal(t, &med, update.MED)
+	assert.Equal(t, uint32(65000), peer.open.ASN)
+	assert.True(t, peer.open.RouterID.Equal(net.ParseIP("127.0.0.1")), "the default router ID is the local address")
+
+	status := speaker.Status()
+	assert.Equal(t, 1, len(status))
+	assert.Equal(t, stateEstablished, status[0].State)
+	assert.Equal(t, 1, status[0].Routes)
+
+	// New routes, and withdrawals. IPv6 routes don't go to IPv4 peers.
+	speaker.Announce(Route{Prefix: mustCIDR("10.1.0.0/24")})
+	speaker.Announce(Route{Prefix: mustCIDR("2001:db8::10/128")})
+	speaker.Withdraw(mustCIDR("192.168.1.10/32"))
+	eventually(t, func() bool {
+		routes := peer.received()
+		return len(routes) == 1 && routes["10.1.0.0/24"] != nil
+	}, "route changes")
+
+	// The speaker reconnects if the session fails
+	peer.disconnect()
+	eventually(t, func() bool { return len(peer.received()) == 1 }, "reconnect")
+
+	// Shutting down tells the peer
+	speaker.Shutdown()
+	eventually(t, func() bool {
+		peer.lock.Lock()
+		defer peer.lock.Unlock()
+		return len(peer.notifications) == 1 && peer.notifications[0].Code == codeCease
+	}, "cease notification")
+}
+
+func TestSpeakerIBGP(t *testing.T) {
+	peer := newTestPeer(t, 4200000000)
+	defer peer.close()
+
+	speaker := NewSpeaker(log.NewNopLogger(), Config{ASN: 4200000000, RouterID: net.ParseIP("10.0.0.1"), ConnectRetry: 10 * time.Millisecond})
+	defer speaker.Shutdown()
+	localPref := uint32(300)
+	speaker.Announce(Route{Prefix: mustCIDR("192.168.1.10/32")})
+	speaker.Announce(Route{Prefix: mustCIDR("192.168.1.11/32"), LocalPref: &localPref})
+	speaker.SetPeers([]Peer{{Address: net.ParseIP("127.0.0.1"), ASN: 4200000000, Port: peer.port()}})
+
+	eventually(t, func() bool { return len(peer.received()) == 2 }, "routes")
+	routes := peer.received()
+	assert.Empty(t, routes["192.168.1.10/32"].ASPath, "iBGP")
+	assert.Equal(t, uint32(defaultLocalPref), *routes["192.168.1.10/32"].LocalPref)
+	assert.Equal(t, localPref, *routes["192.168.1.11/32"].LocalPref)
+	assert.Equal(t, uint32(4200000000), peer.open.ASN)
+	assert.True(t, peer.open.RouterID.Equal(net.ParseIP("10.0.0.1")))
+}
+
+func TestSpeakerBadPeerASN(t *testing.T) {
+	peer := newTestPeer(t, 65002)
+	defer peer.close()
+
+	speaker := NewSpeaker(log.NewNopLogger(), Config{ASN: 65000, ConnectRetry: time.Hour})
+	defer speaker.Shutdown()
+	speaker.SetPeers([]Peer{{Address: net.ParseIP("127.0.0.1"), ASN: 65001, Port: peer.port()}})
+
+	eventually(t, func() bool {
+		status := speaker.Status()
+		return len(status) == 1 && status[0].State == stateIdle && status[0].Error != ""
+	}, "session failed")
+	assert.Contains(t, speaker.Status()[0].Error, "peer ASN is 65002")
+
+	// Removing the peer closes the session
+	speaker.SetPeers(nil)
+	assert.Empty(t, speaker.Status())
+}
+
+func TestSpeakerIPv6(t *testing.T) {
+	peer := newTestPeerOn(t, 65001, "::1")
+	defer peer.close()
+
+	speaker := NewSpeaker(log.NewNopLogger(), Config{ASN: 65000, RouterID: net.ParseIP("10.0.0.1"), ConnectRetry: 10 * time.Millisecond})
+	defer speaker.Shutdown()
+	speaker.Announce(Route{Prefix: mustCIDR("192.168.1.10/32")})
+	speaker.Announce(Route{Prefix: mustCIDR("2001:db8::10/128")})
+	speaker.SetPeers([]Peer{{Address: net.ParseIP("::1"), ASN: 65001, Port: peer.port()}})
+
+	// IPv4 routes don't go to IPv6 peers
+	eventually(t, func() bool { return len(peer.received()) == 1 }, "initial route")
+	assert.NotNil(t, peer.received()["2001:db8::10/128"])
+	assert.Equal(t, []uint16{afiIPv6}, peer.open.Families)
+
+	// The route is in MP_REACH_NLRI with our IPv6 address as its next
+	// hop
+	peer.lock.Lock()
+	assert.Equal(t, 1, len(peer.updates))
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff"+"004d02"+ // header
+		"0000"+"0036"+ // no withdrawn routes, 54 bytes of attributes
+		"40010100"+ // ORIGIN IGP
+		"4002060201"+"0000fde8"+ // AS_PATH 65000
+		"800e26"+"000201"+"10"+"00000000000000000000000000000001"+"00"+ // MP_REACH_NLRI IPv6 unicast, next hop ::1
+		"80"+"20010db8000000000000000000000010", // 2001:db8::10/128
+		hex.EncodeToString(peer.updates[0]))
+	peer.lock.Unlock()
+
+	// Withdrawals are in MP_UNREACH_NLRI
+	speaker.Withdraw(mustCIDR("2001:db8::10/128"))
+	eventually(t, func() bool { return len(peer.received()) == 0 }, "withdrawal")
+	peer.lock.Lock()
+	assert.Equal(t, 2, len(peer.updates))
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff"+"002e02"+
+		"0000"+"0017"+
+		"800f14"+"000201"+"80"+"20010db8000000000000000000000010",
+		hex.EncodeToString(peer.updates[1]))
+	peer.lock.Unlock()
+}
+
+func TestSpeakerClose(t *testing.T) {
+	// Nobody answers at this address so the sessions are stuck
+	// connecting
+	peers := []Peer{}
+	for port := 1; port <= 3; port++ {
+		peers = append(peers, Peer{Address: net.ParseIP("192.0.2.1"), ASN: 65001, Port: port})
+	}
+	speaker := NewSpeaker(log.NewNopLogger(), Config{ASN: 65000})
+	speaker.SetPeers(peers)
+	eventually(t, func() bool {
+		for _, session := range speaker.Status() {
+			if session.State != stateConnect && session.Error == "" {
+				return false
+			}
+		}
+		return true
+	}, "sessions connecting")
+
+	start := time.Now()
+	speaker.Shutdown()
+	assert.Less(t, int64(time.Since(start)), int64(writeTimeout), "Shutdown waited for the peers")
+}
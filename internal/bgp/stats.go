@@ -0,0 +1,56 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+var (
+	sessionUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "bgp",
+		Name:      "session_up",
+		Help:      "1 if the BGP session with the peer is established, 0 otherwise",
+	}, []string{
+		"peer",
+	})
+
+	routesAdvertised = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "bgp",
+		Name:      "routes_advertised",
+		Help:      "Number of routes that this node is advertising to the peer",
+	}, []string{
+		"peer",
+	})
+
+	updatesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "bgp",
+		Name:      "updates_sent_total",
+		Help:      "Number of BGP UPDATE messages sent to the peer",
+	}, []string{
+		"peer",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sessionUp)
+	prometheus.MustRegister(routesAdvertised)
+	prometheus.MustRegister(updatesSent)
+}
@@ -16,7 +16,9 @@ package election
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"log"
+	"math"
 	"sort"
 	"time"
 
@@ -24,40 +26,103 @@ import (
 
 	gokitlog "github.com/go-kit/kit/log"
 	"github.com/hashicorp/memberlist"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// metaRefreshInterval is how often we check our node's labels and
+	// weight for changes.
+	metaRefreshInterval = time.Minute
+
+	// divergenceCheckInterval is how often we compare the memberlist
+	// members with the member pods.
+	divergenceCheckInterval = 10 * time.Second
+
+	// divergenceGrace is how long the members and the member pods can
+	// disagree before we raise the alarm. They disagree briefly
+	// whenever a pod starts or stops because memberlist and k8s find
+	// out at different times.
+	divergenceGrace = time.Minute
 )
 
 // Config provides the configuration data that New() needs.
 type Config struct {
-	Namespace string
-	Labels    string
-	NodeName  string
-	BindAddr  string
-	BindPort  int
-	Secret    []byte
-	StopCh    chan struct{}
-	Logger    *gokitlog.Logger
-	Client    *k8s.Client
+	NodeName string
+	BindAddr string
+	BindPort int
+	Secret   []byte
+	StopCh   chan struct{}
+	Logger   *gokitlog.Logger
+	Client   *k8s.Client
+
+	// KeyringNamespace and KeyringSecret identify the Secret that
+	// holds the memberlist keyring. If KeyringSecret is set then
+	// Secret is ignored.
+	KeyringNamespace string
+	KeyringSecret    string
 }
 
 type Election struct {
-	namespace  string
-	labels     string
+	nodeName   string
+	meta       *metaDelegate
 	Memberlist *memberlist.Memberlist
 	logger     gokitlog.Logger
 	stopCh     chan struct{}
 	eventCh    chan memberlist.NodeEvent
 	Client     *k8s.Client
+
+	// metaChanged tells watchEvents that our metadata has changed so
+	// it needs to tell the other members.
+	metaChanged chan struct{}
+
+	// divergentSince is when the members and the member pods started
+	// to disagree, or zero if they agree. alarmed is true if they've
+	// disagreed for longer than divergenceGrace. Only watchEvents uses
+	// them.
+	divergentSince time.Time
+	alarmed        bool
+
+	// keyring holds the keys that memberlist uses to encrypt and
+	// decrypt its traffic. If keyringSecret is set then we watch that
+	// Secret, and keyringUpdates passes its new versions to
+	// watchEvents, which keeps the keyring in sync with it.
+	keyring          *memberlist.Keyring
+	keyringNamespace string
+	keyringSecret    string
+	keyringUpdates   chan *corev1.Secret
 }
 
 func New(cfg *Config) (Election, error) {
-	election := Election{stopCh: cfg.StopCh, logger: *cfg.Logger}
+	election := Election{stopCh: cfg.StopCh, logger: *cfg.Logger, nodeName: cfg.NodeName, meta: newMetaDelegate(cfg.NodeName), Client: cfg.Client, metaChanged: make(chan struct{}, 1), keyringNamespace: cfg.KeyringNamespace, keyringSecret: cfg.KeyringSecret, keyringUpdates: make(chan *corev1.Secret, 1)}
 
 	mconfig := memberlist.DefaultLANConfig()
 	mconfig.Name = cfg.NodeName
 	mconfig.BindAddr = cfg.BindAddr
 	mconfig.BindPort = cfg.BindPort
 	mconfig.AdvertisePort = cfg.BindPort
-	mconfig.SecretKey = cfg.Secret
+
+	// If we have a keyring Secret then we load our keys from it,
+	// otherwise we use the single shared secret
+	keys := keyGenerations{}
+	if cfg.KeyringSecret != "" {
+		var primary int
+		var err error
+		keys, primary, err = election.loadKeyring()
+		if err != nil {
+			return election, err
+		}
+		if mconfig.Keyring, err = newKeyring(keys, primary); err != nil {
+			return election, err
+		}
+	} else {
+		mconfig.SecretKey = cfg.Secret
+	}
+
+	// Publish our node's labels and weight so the other members can
+	// run weighted and node-selected elections
+	election.refreshMeta()
+	mconfig.Delegate = election.meta
 
 	loggerout := gokitlog.NewStdlibAdapter(gokitlog.With(*cfg.Logger, "component", "MemberList"))
 	mconfig.Logger = log.New(loggerout, "", log.Lshortfile)
@@ -65,18 +130,23 @@ func New(cfg *Config) (Election, error) {
 	eventCh := make(chan memberlist.NodeEvent, 16)
 	mconfig.Events = &memberlist.ChannelEventDelegate{Ch: eventCh}
 	election.eventCh = eventCh
-	election.namespace = cfg.Namespace
-	election.labels = cfg.Labels
 
 	mlist, err := memberlist.Create(mconfig)
 	election.Memberlist = mlist
-	election.Client = cfg.Client
+	if mlist != nil {
+		election.meta.owners.memberlist.Store(mlist)
+	}
+	election.keyring = mconfig.Keyring
+	recordKeyring(election.keyring, keys)
 
 	return election, err
 }
 
 func (e *Election) Join(iplist []string) error {
 	go e.watchEvents()
+	if e.keyringSecret != "" && e.Client != nil {
+		e.Client.WatchSecret(e.keyringNamespace, e.keyringSecret, e.keyringChanged, e.stopCh)
+	}
 
 	// To minimize the system impact of joining the memberlist we limit
 	// the number of initial peers to 5 no matter how many pods we have.
@@ -99,55 +169,319 @@ func (e *Election) shutdown() error {
 }
 
 // Winner returns the node name of the "winning" node, i.e., the node
-// that will announce the service represented by "key".
-func (e *Election) Winner(key string) string {
+// that will announce the service represented by "key". Only nodes
+// whose labels match selector, and for which eligible returns true,
+// are candidates. Nodes with higher weights are more likely to
+// win. If no node is a candidate then Winner returns "".
+func (e *Election) Winner(key string, selector labels.Selector, eligible func(node string) bool) string {
+	nodes, weights := candidates(e.members(), selector, eligible)
+	if len(nodes) == 0 {
+		e.logger.Log("op", "Election", "error", "no eligible nodes", "key", key, "selector", selector)
+		return ""
+	}
+
+	return weightedElection(key, nodes, weights)[0]
+}
+
+// Owner returns the node name of the node that currently owns the
+// address represented by "key", i.e., that claims that it's
+// announcing it. Only nodes that could win an election with the
+// same selector and eligible are considered, so Owner ignores nodes
+// that have failed or that can't announce the address anymore. If
+// more than one node claims the address then the one that would do
+// best in the election owns it. If no node owns the address then
+// Owner returns "".
+func (e *Election) Owner(key string, selector labels.Selector, eligible func(node string) bool) string {
+	return owner(key, e.members(), e.meta.owners.owns, selector, eligible)
+}
+
+// members returns the memberlist members that can take part in
+// elections. If we know which nodes are running member pods then
+// members that aren't, e.g., because their pods have been deleted but
+// memberlist hasn't noticed yet, can't.
+func (e *Election) members() []*memberlist.Node {
 	members := e.Memberlist.Members()
-	pods, err := e.Client.GetPodsIPs(e.namespace, e.labels)
+	if e.Client == nil {
+		return members
+	}
+	podNodes, known := e.Client.MemberNodes()
+	if !known {
+		return members
+	}
+
+	withPods, _, _ := reconcileMembers(members, podNodes)
+	return withPods
+}
+
+// reconcileMembers compares the memberlist members with the nodes
+// that are running member pods. It returns the members that are
+// running pods, the names of the members that aren't, and the names
+// of the nodes whose pods aren't members.
+func reconcileMembers(members []*memberlist.Node, podNodes map[string]bool) ([]*memberlist.Node, []string, []string) {
+	withPods := []*memberlist.Node{}
+	withoutPods := []string{}
+	isMember := map[string]bool{}
+	for _, member := range members {
+		isMember[member.Name] = true
+		if podNodes[member.Name] {
+			withPods = append(withPods, member)
+		} else {
+			withoutPods = append(withoutPods, member.Name)
+		}
+	}
+
+	withoutMembers := []string{}
+	for node := range podNodes {
+		if !isMember[node] {
+			withoutMembers = append(withoutMembers, node)
+		}
+	}
+	sort.Strings(withoutMembers)
+
+	return withPods, withoutPods, withoutMembers
+}
+
+// checkDivergence compares the memberlist members with the member
+// pods and updates the divergence metrics. If they've disagreed for
+// longer than divergenceGrace then it sets the divergent metric so
+// the problem can raise an alarm.
+func (e *Election) checkDivergence(now time.Time) {
+	if e.Client == nil {
+		return
+	}
+	podNodes, known := e.Client.MemberNodes()
+	if !known {
+		return
+	}
+
+	e.updateDivergence(now, e.Memberlist.Members(), podNodes)
+}
+
+// updateDivergence implements checkDivergence.
+func (e *Election) updateDivergence(now time.Time, members []*memberlist.Node, podNodes map[string]bool) {
+	_, withoutPods, withoutMembers := reconcileMembers(members, podNodes)
+	membersWithoutPods.Set(float64(len(withoutPods)))
+	podsWithoutMembers.Set(float64(len(withoutMembers)))
+
+	if len(withoutPods) == 0 && len(withoutMembers) == 0 {
+		if e.alarmed {
+			e.logger.Log("op", "checkDivergence", "msg", "members and pods agree")
+		}
+		e.divergentSince = time.Time{}
+		e.alarmed = false
+		divergent.Set(0)
+		return
+	}
+
+	if e.divergentSince.IsZero() {
+		e.divergentSince = now
+	}
+	if !e.alarmed && now.Sub(e.divergentSince) >= divergenceGrace {
+		e.logger.Log("op", "checkDivergence", "error", "members/pods out of sync", "since", e.divergentSince, "membersWithoutPods", withoutPods, "podsWithoutMembers", withoutMembers)
+		e.alarmed = true
+		divergent.Set(1)
+	}
+}
+
+// SetOwned tells the other members which local addresses we're
+// announcing so they can tell who owns each address.
+func (e *Election) SetOwned(addrs []string) {
+	owned := append([]string{}, addrs...)
+	sort.Strings(owned)
+
+	e.meta.owners.set(owned)
+}
+
+// SetLabelKeys sets the keys of the node labels that we publish. The
+// announcers call it with the keys that their node selectors use,
+// since memberlist metadata doesn't have room for all of our labels.
+func (e *Election) SetLabelKeys(keys []string) {
+	changed, err := e.meta.setLabelKeys(keys)
 	if err != nil {
-		e.logger.Log("op", "Election", "error", err, "msg", "failed to get Pod count")
+		e.logger.Log("op", "setLabelKeys", "error", err)
 	}
+	e.metaUpdated(changed)
+}
 
-	// if the number of pods that k8s reports is different than the
-	// number of members in the memberlist then something has gotten out
-	// of sync.
-	if len(members) != len(pods) {
-		e.logger.Log("op", "Election", "error", "members/pods out of sync", "members", members, "pods", pods)
+// metaUpdated tells watchEvents if our metadata has changed so it
+// can tell the other members.
+func (e *Election) metaUpdated(changed bool) {
+	if changed {
+		select {
+		case e.metaChanged <- struct{}{}:
+		default:
+			// watchEvents already knows
+		}
 	}
+}
 
-	nodes := []string{}
-	for _, node := range members {
-		nodes = append(nodes, node.Name)
+// owner implements Owner. owns indicates whether a node claims an
+// address.
+func owner(key string, members []*memberlist.Node, owns func(node string, addr string) bool, selector labels.Selector, eligible func(string) bool) string {
+	nodes, weights := candidates(members, selector, eligible)
+
+	claimants := []string{}
+	for _, node := range nodes {
+		if owns(node, key) {
+			claimants = append(claimants, node)
+		}
+	}
+	if len(claimants) == 0 {
+		return ""
 	}
 
-	return election(key, nodes)[0]
+	return weightedElection(key, claimants, weights)[0]
+}
+
+// candidates returns the names of the members whose labels match
+// selector and for which eligible returns true, and their weights. A
+// nil selector matches every member, and a nil eligible accepts
+// every member. Members whose labels didn't fit in their metadata
+// match only selectors that match everything, since we can't tell
+// whether they'd match the others.
+func candidates(members []*memberlist.Node, selector labels.Selector, eligible func(string) bool) ([]string, map[string]int) {
+	if selector == nil {
+		selector = labels.Everything()
+	}
+
+	nodes := []string{}
+	weights := map[string]int{}
+	for _, member := range members {
+		meta := decodeMeta(member.Meta)
+		if meta.NoLabels && !selector.Empty() {
+			continue
+		}
+		if !selector.Matches(labels.Set(meta.Labels)) {
+			continue
+		}
+		if eligible != nil && !eligible(member.Name) {
+			continue
+		}
+		nodes = append(nodes, member.Name)
+		weights[member.Name] = meta.weight()
+	}
+	return nodes, weights
 }
 
 // election conducts an election among the candidates based on the
 // provided key. The order of the candidates in the return array is
 // the result of the election.
 func election(key string, candidates []string) []string {
-	// Sort the slice by the hash of candidate name + service key. This
-	// produces an ordering of ready candidates that is unique to this
-	// service.
+	return weightedElection(key, candidates, nil)
+}
+
+// weightedElection conducts an election among the candidates based
+// on the provided key, like election, but biased by each candidate's
+// weight. Candidates that aren't in weights have weight 1. If every
+// candidate has the same weight then the result is the same as
+// election's.
+func weightedElection(key string, candidates []string, weights map[string]int) []string {
+	// Each candidate's score is derived from the hash of candidate
+	// name + service key. This produces an ordering of ready candidates
+	// that is unique to this service. Treating the hash as a uniform
+	// random number h in [0, 1), the score -ln(1-h)/weight is
+	// exponentially distributed with rate weight, so each candidate's
+	// chance of having the lowest score is proportional to its
+	// weight. This is weighted rendezvous hashing. The score increases
+	// with h so with equal weights the lowest hash wins, as it does in
+	// an unweighted election.
+	type ballot struct {
+		hash  [sha256.Size]byte
+		score float64
+	}
+	ballots := map[string]ballot{}
+	for _, candidate := range candidates {
+		hash := sha256.Sum256([]byte(candidate + "#" + key))
+		h := float64(binary.BigEndian.Uint64(hash[:8])>>11) / (1 << 53)
+		weight := 1
+		if w, exists := weights[candidate]; exists && w > 0 {
+			weight = w
+		}
+		ballots[candidate] = ballot{hash: hash, score: -math.Log1p(-h) / float64(weight)}
+	}
+
 	sort.Slice(candidates, func(i, j int) bool {
-		hi := sha256.Sum256([]byte(candidates[i] + "#" + key))
-		hj := sha256.Sum256([]byte(candidates[j] + "#" + key))
+		bi := ballots[candidates[i]]
+		bj := ballots[candidates[j]]
 
-		return bytes.Compare(hi[:], hj[:]) < 0
+		if bi.score != bj.score {
+			return bi.score < bj.score
+		}
+		return bytes.Compare(bi.hash[:], bj.hash[:]) < 0
 	})
 
 	return candidates
 }
 
+// refreshMeta reads our node's labels and weight and publishes them
+// in our memberlist metadata. It returns true if they changed.
+func (e *Election) refreshMeta() bool {
+	if e.Client == nil {
+		return false
+	}
+
+	node, err := e.Client.GetNode(e.nodeName)
+	if err != nil {
+		e.logger.Log("op", "refreshMeta", "error", err, "msg", "failed to get Node")
+		return false
+	}
+	meta, err := nodeMeta(node)
+	if err != nil {
+		e.logger.Log("op", "refreshMeta", "error", err)
+	}
+	changed, err := e.meta.update(func(published *NodeMeta) {
+		published.Labels = meta.Labels
+		published.Weight = meta.Weight
+	})
+	if err != nil {
+		e.logger.Log("op", "refreshMeta", "error", err)
+	}
+	return changed
+}
+
+// updateNode tells the other members about our new metadata. It
+// waits for the broadcast so it can't be called from the announcers,
+// which hold locks.
+func (e *Election) updateNode() {
+	if err := e.Memberlist.UpdateNode(time.Second); err != nil {
+		e.logger.Log("op", "updateNode", "error", err, "msg", "failed to update memberlist metadata")
+	}
+}
+
 func event2String(e memberlist.NodeEventType) string {
 	return [...]string{"NodeJoin", "NodeLeave", "NodeUpdate"}[e]
 }
 
 func (e *Election) watchEvents() {
+	ticker := time.NewTicker(metaRefreshInterval)
+	defer ticker.Stop()
+	divergenceTicker := time.NewTicker(divergenceCheckInterval)
+	defer divergenceTicker.Stop()
+
 	for {
 		select {
 		case event := <-e.eventCh:
 			e.logger.Log("msg", "Node event", "node addr", event.Node.Addr, "node name", event.Node.Name, "node event", event2String(event.Event))
+			if event.Event == memberlist.NodeLeave {
+				e.meta.owners.forget(event.Node.Name)
+			}
+			e.Client.ForceSync()
+			e.checkDivergence(time.Now())
+		case now := <-divergenceTicker.C:
+			e.checkDivergence(now)
+		case <-ticker.C:
+			// If our labels or weight have changed then tell the other
+			// members. They'll see a NodeUpdate event.
+			if e.refreshMeta() {
+				e.updateNode()
+				e.Client.ForceSync()
+			}
+		case secret := <-e.keyringUpdates:
+			e.updateKeyring(secret)
+		case <-e.metaChanged:
+			e.updateNode()
+		case <-e.meta.owners.changed:
+			// Another node has claimed or given up addresses
 			e.Client.ForceSync()
 		case <-e.stopCh:
 			e.shutdown()
@@ -13,9 +13,20 @@
 package election
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/hashicorp/memberlist"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
 var nodes []string = []string{"test-node0", "test-node1", "test-node2"}
@@ -25,3 +36,400 @@ func TestWinner(t *testing.T) {
 	assert.Equal(t, "test-node1", election("test-key-nodeXX", nodes)[0])
 	assert.Equal(t, "test-node2", election("test-key-foo", nodes)[0])
 }
+
+func TestWeightedElection(t *testing.T) {
+	// Equal weights give the same result as an unweighted election
+	for _, key := range []string{"test-key", "test-key-nodeXX", "test-key-foo", "192.168.1.1"} {
+		expected := election(key, append([]string{}, nodes...))
+		assert.Equal(t, expected, weightedElection(key, append([]string{}, nodes...), map[string]int{"test-node0": 3, "test-node1": 3, "test-node2": 3}), key)
+		assert.Equal(t, expected, weightedElection(key, append([]string{}, nodes...), map[string]int{}), key)
+	}
+
+	// Heavier nodes win more elections, in proportion to their weight
+	weights := map[string]int{"test-node0": 1, "test-node1": 1, "test-node2": 2}
+	wins := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		wins[weightedElection(fmt.Sprintf("192.168.%d.%d", i/256, i%256), append([]string{}, nodes...), weights)[0]]++
+	}
+	assert.InDelta(t, 1000, wins["test-node0"], 150)
+	assert.InDelta(t, 1000, wins["test-node1"], 150)
+	assert.InDelta(t, 2000, wins["test-node2"], 150)
+
+	// The result doesn't depend on the order of the candidates
+	assert.Equal(t,
+		weightedElection("test-key", []string{"test-node0", "test-node1", "test-node2"}, weights),
+		weightedElection("test-key", []string{"test-node2", "test-node0", "test-node1"}, weights))
+}
+
+func TestCandidates(t *testing.T) {
+	member := func(name string, meta NodeMeta) *memberlist.Node {
+		raw, err := meta.encode(memberlist.MetaMaxSize)
+		assert.NoError(t, err)
+		return &memberlist.Node{Name: name, Meta: raw}
+	}
+	members := []*memberlist.Node{
+		member("test-node0", NodeMeta{Labels: map[string]string{"zone": "rack1"}}),
+		member("test-node1", NodeMeta{Labels: map[string]string{"zone": "rack2"}, Weight: 5}),
+		member("test-node2", NodeMeta{Labels: map[string]string{"zone": "rack1", "node-role.kubernetes.io/control-plane": ""}}),
+		{Name: "test-node3"}, // doesn't publish metadata
+	}
+
+	names, weights := candidates(members, nil, nil)
+	assert.Equal(t, []string{"test-node0", "test-node1", "test-node2", "test-node3"}, names)
+	assert.Equal(t, map[string]int{"test-node0": 1, "test-node1": 5, "test-node2": 1, "test-node3": 1}, weights)
+
+	selector, err := labels.Parse("zone=rack1,!node-role.kubernetes.io/control-plane")
+	assert.NoError(t, err)
+	names, _ = candidates(members, selector, nil)
+	assert.Equal(t, []string{"test-node0"}, names)
+
+	selector, err = labels.Parse("zone=rack3")
+	assert.NoError(t, err)
+	names, _ = candidates(members, selector, nil)
+	assert.Empty(t, names)
+
+	// Eligibility, e.g., having a ready endpoint, narrows the field
+	// further
+	eligible := func(node string) bool { return node == "test-node1" || node == "test-node3" }
+	names, _ = candidates(members, nil, eligible)
+	assert.Equal(t, []string{"test-node1", "test-node3"}, names)
+	selector, err = labels.Parse("zone")
+	assert.NoError(t, err)
+	names, _ = candidates(members, selector, eligible)
+	assert.Equal(t, []string{"test-node1"}, names)
+}
+
+func TestCandidatesWithoutLabels(t *testing.T) {
+	// test-node1's labels didn't fit in its metadata
+	overflow, err := NodeMeta{Labels: map[string]string{"description": strings.Repeat("x", memberlist.MetaMaxSize)}}.encode(memberlist.MetaMaxSize)
+	assert.Error(t, err)
+	zone, err := NodeMeta{Labels: map[string]string{"zone": "rack1"}}.encode(memberlist.MetaMaxSize)
+	assert.NoError(t, err)
+	members := []*memberlist.Node{
+		{Name: "test-node0", Meta: zone},
+		{Name: "test-node1", Meta: overflow},
+	}
+
+	// It can't tell whether it matches a selector, even one that
+	// matches nodes that don't have a label, so it's a candidate only
+	// if the selector matches everything
+	names, _ := candidates(members, nil, nil)
+	assert.Equal(t, []string{"test-node0", "test-node1"}, names)
+	names, _ = candidates(members, labels.Everything(), nil)
+	assert.Equal(t, []string{"test-node0", "test-node1"}, names)
+	for _, raw := range []string{"!dedicated", "zone notin (rack2)", "zone=rack1"} {
+		selector, err := labels.Parse(raw)
+		assert.NoError(t, err)
+		names, _ = candidates(members, selector, nil)
+		assert.Equal(t, []string{"test-node0"}, names, raw)
+	}
+}
+
+func TestSetLabelKeys(t *testing.T) {
+	e := &Election{logger: gokitlog.NewNopLogger(), meta: newMetaDelegate("test-node0"), metaChanged: make(chan struct{}, 1)}
+	e.meta.update(func(meta *NodeMeta) {
+		meta.Labels = map[string]string{"zone": "rack1", "description": strings.Repeat("x", memberlist.MetaMaxSize)}
+	})
+
+	// We publish only the labels that the selectors use, so the others
+	// don't crowd them out
+	assert.Equal(t, NodeMeta{}, decodeMeta(e.meta.NodeMeta(memberlist.MetaMaxSize)))
+	e.SetLabelKeys([]string{"zone", "dedicated"})
+	assert.Len(t, e.metaChanged, 1, "the other members need to hear about the change")
+	assert.Equal(t, NodeMeta{Labels: map[string]string{"zone": "rack1"}}, decodeMeta(e.meta.NodeMeta(memberlist.MetaMaxSize)))
+	<-e.metaChanged
+
+	e.SetLabelKeys([]string{"dedicated", "zone"})
+	assert.Len(t, e.metaChanged, 0, "nothing changed")
+
+	e.SetLabelKeys([]string{"zone", "description"})
+	assert.Len(t, e.metaChanged, 1)
+	assert.Equal(t, NodeMeta{NoLabels: true}, decodeMeta(e.meta.NodeMeta(memberlist.MetaMaxSize)))
+}
+
+func TestNodeMeta(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test-node0",
+		Labels:      map[string]string{"zone": "rack1"},
+		Annotations: map[string]string{purelbv1.ElectionWeightAnnotation: "3"},
+	}}
+	meta, err := nodeMeta(node)
+	assert.NoError(t, err)
+	assert.Equal(t, NodeMeta{Labels: map[string]string{"zone": "rack1"}, Weight: 3}, meta)
+	raw, err := meta.encode(memberlist.MetaMaxSize)
+	assert.NoError(t, err)
+	assert.Equal(t, meta, decodeMeta(raw))
+
+	for _, bad := range []string{"0", "-1", "heavy"} {
+		node.Annotations[purelbv1.ElectionWeightAnnotation] = bad
+		meta, err = nodeMeta(node)
+		assert.Error(t, err, bad)
+		assert.Equal(t, 1, meta.weight(), bad)
+	}
+
+	// Labels that don't fit are dropped but the weight survives
+	meta = NodeMeta{Labels: map[string]string{"description": strings.Repeat("x", memberlist.MetaMaxSize)}, Weight: 2}
+	raw, err = meta.encode(memberlist.MetaMaxSize)
+	assert.Error(t, err)
+	assert.LessOrEqual(t, len(raw), memberlist.MetaMaxSize)
+	assert.Equal(t, NodeMeta{Weight: 2, NoLabels: true}, decodeMeta(raw))
+
+	// Garbled metadata is ignored
+	assert.Equal(t, NodeMeta{}, decodeMeta([]byte("{")))
+}
+
+func TestOwner(t *testing.T) {
+	member := func(name string, meta NodeMeta) *memberlist.Node {
+		raw, err := meta.encode(memberlist.MetaMaxSize)
+		assert.NoError(t, err)
+		return &memberlist.Node{Name: name, Meta: raw}
+	}
+	key := "test-key"
+	members := []*memberlist.Node{
+		member("test-node0", NodeMeta{}),
+		member("test-node1", NodeMeta{Labels: map[string]string{"zone": "rack1"}}),
+		member("test-node2", NodeMeta{}),
+	}
+	claims := newOwners("test-node0")
+	claims.merge([]claim{
+		{Node: "test-node1", Version: 1, Owns: []string{key}},
+		{Node: "test-node2", Version: 1, Owns: []string{"another-key"}},
+	})
+
+	// test-node0 would win the election but test-node1 owns the address
+	assert.Equal(t, "test-node0", election(key, append([]string{}, nodes...))[0])
+	assert.Equal(t, "test-node1", owner(key, members, claims.owns, nil, nil))
+	assert.Equal(t, "", owner("unowned-key", members, claims.owns, nil, nil))
+
+	// Owners that can't win don't count
+	selector, err := labels.Parse("zone=rack2")
+	assert.NoError(t, err)
+	assert.Equal(t, "", owner(key, members, claims.owns, selector, nil))
+	assert.Equal(t, "", owner(key, members, claims.owns, nil, func(node string) bool { return node != "test-node1" }))
+
+	// If more than one node claims the address then the one that does
+	// best in the election keeps it
+	claims.set([]string{key})
+	assert.Equal(t, "test-node0", owner(key, members, claims.owns, nil, nil))
+}
+
+func TestSetOwned(t *testing.T) {
+	e := &Election{logger: gokitlog.NewNopLogger(), meta: newMetaDelegate("test-node0"), metaChanged: make(chan struct{}, 1)}
+
+	// Claims don't go in the metadata so there's room for as many as
+	// we need
+	owned := []string{}
+	for i := 0; i < 250; i++ {
+		owned = append(owned, fmt.Sprintf("192.168.1.%d", i))
+	}
+	e.SetOwned(owned)
+	assert.Equal(t, 1, e.meta.owners.broadcasts.NumQueued(), "the other members need to hear about the change")
+	assert.True(t, e.meta.owners.owns("test-node0", "192.168.1.249"))
+	assert.Len(t, e.metaChanged, 0, "the metadata didn't change")
+
+	e.SetOwned(owned)
+	assert.Equal(t, 1, e.meta.owners.broadcasts.NumQueued(), "nothing changed")
+
+	e.SetOwned(nil)
+	assert.Equal(t, 1, e.meta.owners.broadcasts.NumQueued(), "the new claim replaces the old one")
+	assert.False(t, e.meta.owners.owns("test-node0", "192.168.1.249"))
+}
+
+func TestClaims(t *testing.T) {
+	node0 := newMetaDelegate("test-node0")
+	node1 := newMetaDelegate("test-node1")
+
+	// Claims arrive in broadcasts, which the receivers pass on
+	node0.owners.set([]string{"192.168.1.1"})
+	for _, raw := range node0.GetBroadcasts(0, 1400) {
+		node1.NotifyMsg(raw)
+	}
+	assert.True(t, node1.owners.owns("test-node0", "192.168.1.1"))
+	assert.Len(t, node1.owners.changed, 1, "node1 needs to re-run its elections")
+	<-node1.owners.changed
+	assert.Equal(t, 1, node1.owners.broadcasts.NumQueued())
+
+	// and in full state syncs, where old news doesn't replace new
+	stale := node0.LocalState(false)
+	node0.owners.set([]string{"192.168.1.2"})
+	node1.MergeRemoteState(node0.LocalState(false), false)
+	node1.MergeRemoteState(stale, false)
+	assert.True(t, node1.owners.owns("test-node0", "192.168.1.2"))
+	assert.False(t, node1.owners.owns("test-node0", "192.168.1.1"))
+
+	// Nodes know their own claims best
+	node0.MergeRemoteState(stale, false)
+	assert.True(t, node0.owners.owns("test-node0", "192.168.1.2"))
+
+	// When a node leaves we forget its claims
+	node1.owners.forget("test-node0")
+	assert.False(t, node1.owners.owns("test-node0", "192.168.1.2"))
+}
+
+func TestReconcileMembers(t *testing.T) {
+	members := []*memberlist.Node{{Name: "test-node0"}, {Name: "test-node1"}, {Name: "test-node2"}}
+
+	withPods, withoutPods, withoutMembers := reconcileMembers(members, map[string]bool{"test-node0": true, "test-node1": true, "test-node2": true})
+	assert.Equal(t, members, withPods)
+	assert.Empty(t, withoutPods)
+	assert.Empty(t, withoutMembers)
+
+	// test-node1's pod is gone but memberlist hasn't noticed, and
+	// test-node3's pod hasn't joined yet
+	withPods, withoutPods, withoutMembers = reconcileMembers(members, map[string]bool{"test-node0": true, "test-node2": true, "test-node3": true})
+	assert.Equal(t, []*memberlist.Node{members[0], members[2]}, withPods)
+	assert.Equal(t, []string{"test-node1"}, withoutPods)
+	assert.Equal(t, []string{"test-node3"}, withoutMembers)
+}
+
+func TestUpdateDivergence(t *testing.T) {
+	e := &Election{logger: gokitlog.NewNopLogger()}
+	members := []*memberlist.Node{{Name: "test-node0"}, {Name: "test-node1"}}
+	agree := map[string]bool{"test-node0": true, "test-node1": true}
+	disagree := map[string]bool{"test-node0": true}
+	start := time.Now()
+
+	e.updateDivergence(start, members, agree)
+	assert.Equal(t, 0.0, testutil.ToFloat64(divergent))
+
+	// Brief disagreements are normal
+	e.updateDivergence(start, members, disagree)
+	assert.Equal(t, 1.0, testutil.ToFloat64(membersWithoutPods))
+	assert.Equal(t, 0.0, testutil.ToFloat64(podsWithoutMembers))
+	assert.Equal(t, 0.0, testutil.ToFloat64(divergent))
+	e.updateDivergence(start.Add(divergenceGrace/2), members, disagree)
+	assert.Equal(t, 0.0, testutil.ToFloat64(divergent))
+
+	// Persistent ones raise the alarm
+	e.updateDivergence(start.Add(divergenceGrace), members, disagree)
+	assert.Equal(t, 1.0, testutil.ToFloat64(divergent))
+
+	e.updateDivergence(start.Add(2*divergenceGrace), members, agree)
+	assert.Equal(t, 0.0, testutil.ToFloat64(membersWithoutPods))
+	assert.Equal(t, 0.0, testutil.ToFloat64(divergent))
+
+	// The grace period starts again
+	e.updateDivergence(start.Add(3*divergenceGrace), members, disagree)
+	assert.Equal(t, 0.0, testutil.ToFloat64(divergent))
+}
+
+func TestParseKeyring(t *testing.T) {
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210fedcba98")
+
+	keys, primary, err := parseKeyring(map[string][]byte{"key-1": key1, "key-2": key2, "README": []byte("ignored")})
+	assert.NoError(t, err)
+	assert.Equal(t, keyGenerations{1: key1, 2: key2}, keys)
+	assert.Equal(t, 0, primary, "no primary")
+
+	_, primary, err = parseKeyring(map[string][]byte{"key-1": key1, "key-2": key2, "primary": []byte("1\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, primary)
+
+	for name, data := range map[string]map[string][]byte{
+		"no keys":         {"primary": []byte("1")},
+		"bad generation":  {"key-one": key1},
+		"zero generation": {"key-0": key1},
+		"bad key length":  {"key-1": []byte("short")},
+		"bad primary":     {"key-1": key1, "primary": []byte("one")},
+		"missing primary": {"key-1": key1, "primary": []byte("2")},
+	} {
+		_, _, err := parseKeyring(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestApplyKeyring(t *testing.T) {
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	key3 := []byte("aaaaaaaaaaaaaaaa")
+
+	ring, err := newKeyring(keyGenerations{1: key1}, 1)
+	assert.NoError(t, err)
+	recordKeyring(ring, keyGenerations{1: key1})
+	assert.Equal(t, 1.0, testutil.ToFloat64(primaryKeyGeneration))
+
+	// Without a primary a new keyring starts with the oldest key
+	oldest, err := newKeyring(keyGenerations{1: key1, 2: key2}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, key1, oldest.GetPrimaryKey())
+
+	// Nothing to do
+	changed, err := applyKeyring(ring, keyGenerations{1: key1}, 1)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// Step 1: install the new key but keep using the old one, even
+	// without a primary
+	keys := keyGenerations{1: key1, 2: key2}
+	changed, err = applyKeyring(ring, keys, 0)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, key1, ring.GetPrimaryKey())
+	assert.Equal(t, 2, len(ring.GetKeys()))
+
+	// Step 2: switch to the new key
+	changed, err = applyKeyring(ring, keys, 2)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, key2, ring.GetPrimaryKey())
+	assert.Equal(t, 2, len(ring.GetKeys()))
+	recordKeyring(ring, keys)
+	assert.Equal(t, 2.0, testutil.ToFloat64(primaryKeyGeneration))
+	assert.Equal(t, 2.0, testutil.ToFloat64(installedKeys))
+
+	// Step 3: retire the old key
+	keys = keyGenerations{2: key2}
+	changed, err = applyKeyring(ring, keys, 2)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, [][]byte{key2}, ring.GetKeys())
+
+	// Replacing every key in one go leaves only the new ones, and
+	// without a primary the oldest of them becomes the primary
+	keys = keyGenerations{3: key3, 4: key1}
+	changed, err = applyKeyring(ring, keys, 0)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, key3, ring.GetPrimaryKey())
+	keys = keyGenerations{3: key3}
+	changed, err = applyKeyring(ring, keys, 3)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, [][]byte{key3}, ring.GetKeys())
+	recordKeyring(ring, keys)
+	assert.Equal(t, 3.0, testutil.ToFloat64(primaryKeyGeneration))
+	assert.Equal(t, 1.0, testutil.ToFloat64(installedKeys))
+
+	// Keys that didn't come from the Secret are generation 0
+	recordKeyring(ring, keyGenerations{})
+	assert.Equal(t, 0.0, testutil.ToFloat64(primaryKeyGeneration))
+}
+
+func TestKeyringUpdates(t *testing.T) {
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	ring, err := newKeyring(keyGenerations{1: key1}, 1)
+	assert.NoError(t, err)
+	e := &Election{logger: gokitlog.NewNopLogger(), keyring: ring, keyringNamespace: "purelb", keyringSecret: "keyring", keyringUpdates: make(chan *corev1.Secret, 1)}
+
+	// If the Secret changes twice before watchEvents catches up then
+	// it sees only the latest version
+	step1 := &corev1.Secret{Data: map[string][]byte{"key-1": key1, "key-2": key2}}
+	step2 := &corev1.Secret{Data: map[string][]byte{"key-1": key1, "key-2": key2, "primary": []byte("2")}}
+	e.keyringChanged(step1)
+	e.keyringChanged(step2)
+	assert.Len(t, e.keyringUpdates, 1)
+	e.updateKeyring(<-e.keyringUpdates)
+	assert.Equal(t, key2, ring.GetPrimaryKey())
+	assert.Equal(t, 2, len(ring.GetKeys()))
+
+	// Dropping the primary entry doesn't switch keys
+	e.updateKeyring(step1)
+	assert.Equal(t, key2, ring.GetPrimaryKey())
+
+	// Bad Secrets don't change the keyring
+	e.updateKeyring(&corev1.Secret{Data: map[string][]byte{"key-3": []byte("short")}})
+	assert.Equal(t, key2, ring.GetPrimaryKey())
+	assert.Equal(t, 2, len(ring.GetKeys()))
+}
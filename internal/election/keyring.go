@@ -0,0 +1,257 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/memberlist"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// keyEntryPrefix starts the names of the keyring Secret's key
+	// entries. The rest of each name is the key's generation, e.g.,
+	// "key-3".
+	keyEntryPrefix = "key-"
+
+	// primaryEntry is the name of the keyring Secret's optional entry
+	// that holds the generation of the primary key. If it's absent then
+	// we keep using the primary key that we have, or the oldest key if
+	// we don't have one or it's been removed. If we picked the newest
+	// key then the members that picked it up first would encrypt
+	// messages with a key that the others don't have yet.
+	primaryEntry = "primary"
+)
+
+// keyGenerations maps each key's generation to the key.
+type keyGenerations map[int][]byte
+
+// parseKeyring parses the data from a keyring Secret. It returns the
+// keys and the generation of the primary key, or 0 if the Secret
+// doesn't say which key is the primary.
+func parseKeyring(data map[string][]byte) (keyGenerations, int, error) {
+	keys := keyGenerations{}
+	for name, key := range data {
+		if !strings.HasPrefix(name, keyEntryPrefix) {
+			continue
+		}
+		generation, err := strconv.Atoi(strings.TrimPrefix(name, keyEntryPrefix))
+		if err != nil || generation < 1 {
+			return nil, 0, fmt.Errorf("keyring entry %s must be %s followed by a positive integer", name, keyEntryPrefix)
+		}
+		if err := memberlist.ValidateKey(key); err != nil {
+			return nil, 0, fmt.Errorf("keyring entry %s: %w", name, err)
+		}
+		keys[generation] = key
+	}
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("keyring has no %s entries", keyEntryPrefix)
+	}
+
+	raw, exists := data[primaryEntry]
+	if !exists {
+		return keys, 0, nil
+	}
+	primary, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("keyring entry %s must be a key generation, not %q", primaryEntry, raw)
+	}
+	if _, exists := keys[primary]; !exists {
+		return nil, 0, fmt.Errorf("keyring has no %s%d entry for the primary key", keyEntryPrefix, primary)
+	}
+	return keys, primary, nil
+}
+
+// oldest returns the lowest generation.
+func (k keyGenerations) oldest() int {
+	oldest := 0
+	for generation := range k {
+		if oldest == 0 || generation < oldest {
+			oldest = generation
+		}
+	}
+	return oldest
+}
+
+// choosePrimary returns primary if it's set, otherwise the generation
+// of ring's primary key if it's one of keys, otherwise the oldest
+// key's generation. ring can be nil if we don't have one yet.
+func choosePrimary(ring *memberlist.Keyring, keys keyGenerations, primary int) int {
+	if primary != 0 {
+		return primary
+	}
+	if ring != nil {
+		if current := keys.generationOf(ring.GetPrimaryKey()); current != 0 {
+			return current
+		}
+	}
+	return keys.oldest()
+}
+
+// generationOf returns key's generation, or 0 if it isn't one of k's
+// keys.
+func (k keyGenerations) generationOf(key []byte) int {
+	for generation, candidate := range k {
+		if bytes.Equal(candidate, key) {
+			return generation
+		}
+	}
+	return 0
+}
+
+// newKeyring returns a memberlist Keyring that holds keys, with the
+// key from generation primary (or the oldest key if primary is 0) as
+// its primary key.
+func newKeyring(keys keyGenerations, primary int) (*memberlist.Keyring, error) {
+	primary = choosePrimary(nil, keys, primary)
+
+	generations := []int{}
+	for generation := range keys {
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+
+	all := [][]byte{}
+	for _, generation := range generations {
+		all = append(all, keys[generation])
+	}
+	return memberlist.NewKeyring(all, keys[primary])
+}
+
+// applyKeyring makes ring hold keys, with the key from generation
+// primary as its primary key. If primary is 0 then ring keeps its
+// primary key unless it's not in keys. It installs the new keys, then switches
+// the primary key, then removes the keys that aren't in keys anymore,
+// so the ring is never without a key that the other members might
+// be using. It returns true if it changed the ring.
+func applyKeyring(ring *memberlist.Keyring, keys keyGenerations, primary int) (bool, error) {
+	changed := false
+	primary = choosePrimary(ring, keys, primary)
+
+	for _, key := range keys {
+		if !hasKey(ring.GetKeys(), key) {
+			if err := ring.AddKey(key); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	if !bytes.Equal(ring.GetPrimaryKey(), keys[primary]) {
+		if err := ring.UseKey(keys[primary]); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	// RemoveKey modifies the ring's slice of keys in place so we work
+	// from a copy
+	for _, key := range append([][]byte{}, ring.GetKeys()...) {
+		if keys.generationOf(key) == 0 {
+			if err := ring.RemoveKey(key); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// hasKey returns true if key is one of keys.
+func hasKey(keys [][]byte, key []byte) bool {
+	for _, candidate := range keys {
+		if bytes.Equal(candidate, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadKeyring reads the keyring Secret. It returns the keys and the
+// generation of the primary key.
+func (e *Election) loadKeyring() (keyGenerations, int, error) {
+	secret, err := e.Client.GetSecret(e.keyringNamespace, e.keyringSecret)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e.parseKeyringSecret(secret)
+}
+
+// parseKeyringSecret parses the keyring Secret. It returns the keys
+// and the generation of the primary key.
+func (e *Election) parseKeyringSecret(secret *corev1.Secret) (keyGenerations, int, error) {
+	keys, primary, err := parseKeyring(secret.Data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("secret %s/%s: %w", e.keyringNamespace, e.keyringSecret, err)
+	}
+	return keys, primary, nil
+}
+
+// keyringChanged receives the keyring Secret from the k8s client
+// when it changes, and passes it to watchEvents. If watchEvents
+// hasn't picked up the previous version yet then this version
+// replaces it.
+func (e *Election) keyringChanged(secret *corev1.Secret) {
+	for {
+		select {
+		case e.keyringUpdates <- secret:
+			return
+		default:
+			select {
+			case <-e.keyringUpdates:
+			default:
+			}
+		}
+	}
+}
+
+// updateKeyring installs the keys in secret, which is the keyring
+// Secret, in our memberlist keyring.
+func (e *Election) updateKeyring(secret *corev1.Secret) {
+	keys, primary, err := e.parseKeyringSecret(secret)
+	if err != nil {
+		e.logger.Log("op", "updateKeyring", "error", err, "msg", "failed to load keyring")
+		keyringErrors.Inc()
+		return
+	}
+	changed, err := applyKeyring(e.keyring, keys, primary)
+	if err != nil {
+		e.logger.Log("op", "updateKeyring", "error", err, "msg", "failed to update keyring")
+		keyringErrors.Inc()
+	}
+	if changed {
+		e.logger.Log("op", "updateKeyring", "msg", "keyring updated", "primary", keys.generationOf(e.keyring.GetPrimaryKey()), "keys", len(e.keyring.GetKeys()))
+	}
+	recordKeyring(e.keyring, keys)
+}
+
+// recordKeyring updates the keyring metrics. keys identifies the
+// generations of the keys in ring; keys that it doesn't know about
+// are generation 0.
+func recordKeyring(ring *memberlist.Keyring, keys keyGenerations) {
+	if ring == nil {
+		primaryKeyGeneration.Set(0)
+		installedKeys.Set(0)
+		return
+	}
+	primaryKeyGeneration.Set(float64(keys.generationOf(ring.GetPrimaryKey())))
+	installedKeys.Set(float64(len(ring.GetKeys())))
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+	corev1 "k8s.io/api/core/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// NodeMeta is the information that each member publishes about its
+// node in its memberlist metadata. Every member needs it to run the
+// same election as every other member.
+type NodeMeta struct {
+	// Labels are the node's labels whose keys the node selectors
+	// use. Elections that have a node selector consider only the nodes
+	// whose labels match it. We don't publish the rest since
+	// memberlist metadata is small.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// NoLabels is true if the node's labels didn't fit in its
+	// metadata, so elections that have a node selector don't consider
+	// the node.
+	NoLabels bool `json:"noLabels,omitempty"`
+
+	// Weight biases elections towards this node. 0 means the default
+	// of 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// nodeMeta returns the NodeMeta for node, and an error if the node's
+// ElectionWeightAnnotation is invalid, in which case the weight is
+// the default.
+func nodeMeta(node *corev1.Node) (NodeMeta, error) {
+	meta := NodeMeta{Labels: node.Labels}
+
+	if raw, exists := node.Annotations[purelbv1.ElectionWeightAnnotation]; exists {
+		weight, err := strconv.Atoi(raw)
+		if err != nil || weight < 1 {
+			return meta, fmt.Errorf("node %s annotation %s must be a positive integer, not %q", node.Name, purelbv1.ElectionWeightAnnotation, raw)
+		}
+		meta.Weight = weight
+	}
+
+	return meta, nil
+}
+
+// weight returns the meta's weight, which is at least 1.
+func (m NodeMeta) weight() int {
+	if m.Weight < 1 {
+		return 1
+	}
+	return m.Weight
+}
+
+// withLabels returns a copy of the meta that has only the labels
+// whose keys are in keys.
+func (m NodeMeta) withLabels(keys map[string]bool) NodeMeta {
+	labels := map[string]string{}
+	for key, value := range m.Labels {
+		if keys[key] {
+			labels[key] = value
+		}
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	m.Labels = labels
+	return m
+}
+
+// encode marshals the meta so it's at most limit bytes long. If it
+// doesn't fit then encode drops the labels, which means that the node
+// won't match any node selector, and returns an error.
+func (m NodeMeta) encode(limit int) ([]byte, error) {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) <= limit {
+		return raw, nil
+	}
+	needed := len(raw)
+
+	raw, err = json.Marshal(NodeMeta{Weight: m.Weight, NoLabels: true})
+	if err != nil {
+		return nil, err
+	}
+	return raw, fmt.Errorf("node metadata needs %d bytes but memberlist allows %d so the labels have been dropped", needed, limit)
+}
+
+// decodeMeta unmarshals a member's metadata. Members that don't
+// publish metadata have no labels and the default weight.
+func decodeMeta(raw []byte) NodeMeta {
+	meta := NodeMeta{}
+	if len(raw) > 0 {
+		// If the metadata is garbled then we treat the member as if it
+		// didn't publish any
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return NodeMeta{}
+		}
+	}
+	return meta
+}
+
+// metaDelegate is a memberlist.Delegate that publishes our NodeMeta
+// and gossips the nodes' claims to local addresses.
+type metaDelegate struct {
+	lock sync.Mutex
+	meta NodeMeta // Labels holds all of the node's labels
+	raw  []byte   // meta, with only the labels in labelKeys, encoded
+
+	// labelKeys holds the label keys that the node selectors use.
+	labelKeys map[string]bool
+
+	owners *owners
+}
+
+// newMetaDelegate returns a metaDelegate for node that publishes
+// empty metadata.
+func newMetaDelegate(node string) *metaDelegate {
+	return &metaDelegate{owners: newOwners(node)}
+}
+
+var _ memberlist.Delegate = &metaDelegate{}
+
+// update applies change to the metadata that we publish. It returns
+// true if the encoded metadata changed, and an error if some of the
+// metadata didn't fit.
+func (d *metaDelegate) update(change func(*NodeMeta)) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	change(&d.meta)
+	return d.encode()
+}
+
+// setLabelKeys sets the keys of the labels that we publish. It
+// returns the same as update.
+func (d *metaDelegate) setLabelKeys(keys []string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.labelKeys = map[string]bool{}
+	for _, key := range keys {
+		d.labelKeys[key] = true
+	}
+	return d.encode()
+}
+
+// encode encodes our metadata. It returns the same as update. The
+// caller must hold d.lock.
+func (d *metaDelegate) encode() (bool, error) {
+	raw, err := d.meta.withLabels(d.labelKeys).encode(memberlist.MetaMaxSize)
+	if raw == nil {
+		return false, err
+	}
+	changed := string(d.raw) != string(raw)
+	d.raw = raw
+	return changed, err
+}
+
+func (d *metaDelegate) NodeMeta(limit int) []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.raw) > limit {
+		return nil
+	}
+	return d.raw
+}
+
+// NotifyMsg receives another node's claim.
+func (d *metaDelegate) NotifyMsg(raw []byte) {
+	received := claim{}
+	if err := json.Unmarshal(raw, &received); err != nil {
+		return
+	}
+	d.owners.merge([]claim{received})
+}
+
+// GetBroadcasts returns the claims that we need to gossip.
+func (d *metaDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.owners.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState returns the claims that we know about so memberlist can
+// send them to another member.
+func (d *metaDelegate) LocalState(join bool) []byte {
+	return d.owners.state()
+}
+
+// MergeRemoteState receives the claims that another member knows
+// about.
+func (d *metaDelegate) MergeRemoteState(raw []byte, join bool) {
+	claims := []claim{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return
+	}
+	d.owners.merge(claims)
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// claim is one node's list of the local addresses that it's
+// announcing. Nodes gossip their claims instead of publishing them in
+// their metadata since a node can announce more addresses than fit
+// in memberlist's metadata.
+type claim struct {
+	Node string `json:"node"`
+
+	// Version orders the node's claims so newer claims replace older
+	// ones however they arrive. It's the time at which the node made
+	// the claim so it keeps increasing when the node restarts.
+	Version int64 `json:"version"`
+
+	Owns []string `json:"owns,omitempty"`
+}
+
+// owners holds the latest claim that we've heard from each node,
+// including our own. New claims reach the other members in
+// memberlist broadcasts, which each member passes on the first time
+// it hears them, and the members also exchange all of their claims
+// when they do memberlist's periodic full state sync, which catches
+// up members that missed a broadcast, e.g., because it was too big
+// for a gossip packet.
+type owners struct {
+	node string
+
+	lock   sync.Mutex
+	claims map[string]claim // node name -> its latest claim
+
+	broadcasts *memberlist.TransmitLimitedQueue
+
+	// memberlist holds our *memberlist.Memberlist once it's been
+	// created. The broadcast queue uses it to count the members.
+	memberlist atomic.Value
+
+	// changed is signaled when another node's claim changes so we can
+	// re-run our elections. It's buffered so several changes can
+	// coalesce into one signal.
+	changed chan struct{}
+}
+
+// newOwners returns an owners for node that hasn't heard any claims.
+func newOwners(node string) *owners {
+	o := &owners{
+		node:    node,
+		claims:  map[string]claim{},
+		changed: make(chan struct{}, 1),
+	}
+	o.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       o.numMembers,
+		RetransmitMult: memberlist.DefaultLANConfig().RetransmitMult,
+	}
+	return o
+}
+
+// numMembers returns the number of memberlist members, or 1 if
+// memberlist hasn't started yet.
+func (o *owners) numMembers() int {
+	if list, started := o.memberlist.Load().(*memberlist.Memberlist); started {
+		return list.NumMembers()
+	}
+	return 1
+}
+
+// set records the addresses that we're announcing, and broadcasts
+// them if they've changed.
+func (o *owners) set(addrs []string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	current, exists := o.claims[o.node]
+	if exists && reflect.DeepEqual(current.Owns, addrs) {
+		return
+	}
+
+	ours := claim{Node: o.node, Version: time.Now().UnixNano(), Owns: addrs}
+	if ours.Version <= current.Version {
+		ours.Version = current.Version + 1
+	}
+	o.claims[o.node] = ours
+	o.broadcast(ours)
+}
+
+// merge records the claims that are newer than the ones that we
+// have, and passes them on. We know our own claims best so we ignore
+// other members' copies of them.
+func (o *owners) merge(claims []claim) {
+	o.lock.Lock()
+	changed := false
+	for _, received := range claims {
+		if received.Node == o.node {
+			continue
+		}
+		if existing, exists := o.claims[received.Node]; exists && existing.Version >= received.Version {
+			continue
+		}
+		o.claims[received.Node] = received
+		o.broadcast(received)
+		changed = true
+	}
+	o.lock.Unlock()
+
+	if changed {
+		select {
+		case o.changed <- struct{}{}:
+		default:
+			// there's already a signal pending
+		}
+	}
+}
+
+// forget forgets node's claim, e.g., because it's left, so if it
+// comes back then we don't think that it owns the addresses that it
+// was announcing before.
+func (o *owners) forget(node string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if node != o.node {
+		delete(o.claims, node)
+	}
+}
+
+// owns indicates whether node claims addr.
+func (o *owners) owns(node string, addr string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, owned := range o.claims[node].Owns {
+		if owned == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast queues news for broadcast. It replaces any of the
+// node's claims that haven't gone out yet. The caller must hold
+// o.lock.
+func (o *owners) broadcast(news claim) {
+	raw, err := json.Marshal(news)
+	if err != nil {
+		return
+	}
+	o.broadcasts.QueueBroadcast(claimBroadcast{node: news.Node, raw: raw})
+}
+
+// state returns all of the claims that we know about, encoded for
+// memberlist's full state sync.
+func (o *owners) state() []byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	claims := []claim{}
+	for _, known := range o.claims {
+		claims = append(claims, known)
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// claimBroadcast is a memberlist.Broadcast that carries one node's
+// claim.
+type claimBroadcast struct {
+	node string
+	raw  []byte
+}
+
+var _ memberlist.Broadcast = claimBroadcast{}
+
+// Invalidates indicates whether b is newer news about the same node
+// as other.
+func (b claimBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	previous, isClaim := other.(claimBroadcast)
+	return isClaim && previous.node == b.node
+}
+
+func (b claimBroadcast) Message() []byte {
+	return b.raw
+}
+
+func (b claimBroadcast) Finished() {}
@@ -16,6 +16,27 @@
    unavailable then memberlist re-runs the election and chooses a new
    winner.
 
+   Each member publishes its node's election weight, and the labels
+   that the node selectors use, in its memberlist metadata so every
+   member can run the same election. An election can be limited to
+   the nodes that match a label selector, and nodes with higher
+   weights win proportionally more elections. A member whose labels
+   don't fit in its metadata takes part only in elections that aren't
+   limited. Members also gossip the local addresses that they're
+   announcing, outside of their metadata so there's no limit on how
+   many, which lets an address stay with its current owner instead of
+   moving to the election's winner.
+
+   Memberlist encrypts its traffic with the keys in its keyring. The
+   keys can come from a Secret, which each member watches so keys
+   can be rotated without restarts: add the new key, then switch the
+   primary key to it, then retire the old key, giving each step time
+   to reach every member. A member that's missing a key that the
+   others use can't talk to them, so adding a key doesn't change the
+   primary key; only the Secret's "primary" entry does. Without one
+   each member keeps the primary key that it has, or uses the oldest
+   key if it doesn't have one or it's been retired.
+
    [1] https://github.com/hashicorp/memberlist
 
 */
@@ -0,0 +1,76 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	purelbv1 "purelb.io/pkg/apis/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const subsystem = "election"
+
+var (
+	membersWithoutPods = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "members_without_pods",
+		Help:      "Number of memberlist members whose nodes aren't running lbnodeagent pods. They're excluded from elections.",
+	})
+
+	podsWithoutMembers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "pods_without_members",
+		Help:      "Number of nodes running lbnodeagent pods that aren't memberlist members.",
+	})
+
+	divergent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "members_pods_divergent",
+		Help:      "1 if the memberlist members and the lbnodeagent pods have disagreed for longer than a minute.",
+	})
+
+	primaryKeyGeneration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "primary_key_generation",
+		Help:      "Generation of the keyring Secret key that this node uses to encrypt memberlist traffic. 0 means that the key didn't come from the keyring Secret.",
+	})
+
+	installedKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "installed_keys",
+		Help:      "Number of keys in this node's memberlist keyring.",
+	})
+
+	keyringErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "keyring_errors_total",
+		Help:      "Number of times that this node failed to load the keyring Secret or to install its keys.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(membersWithoutPods)
+	prometheus.MustRegister(podsWithoutMembers)
+	prometheus.MustRegister(divergent)
+	prometheus.MustRegister(primaryKeyGeneration)
+	prometheus.MustRegister(installedKeys)
+	prometheus.MustRegister(keyringErrors)
+}
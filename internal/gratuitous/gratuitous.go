@@ -0,0 +1,208 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gratuitous builds and sends gratuitous ARP requests (IPv4)
+// and unsolicited neighbor advertisements (IPv6). When a node takes
+// over a service address from another node, the switches and routers
+// on the subnet still have the old node's MAC address in their
+// caches, so they keep sending traffic to the old node until their
+// entries expire. Announcing the address tells them about the new
+// owner right away.
+//
+// The frame builders are pure functions so they can be tested
+// without raw sockets. Sending needs CAP_NET_RAW.
+package gratuitous
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	ethernetHeaderLen = 14
+	arpLen            = 28
+	ipv6HeaderLen     = 40
+	naLen             = 32 // the advertisement plus one link-layer address option
+
+	protocolICMPv6        = 58
+	icmpv6NeighborAdvert  = 136
+	optionTargetLinkLayer = 2
+	naFlagOverride        = 0x20
+	ndHopLimit            = 255
+)
+
+var (
+	// ethernetBroadcast is the destination of gratuitous ARPs.
+	ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	// allNodes is the IPv6 all-nodes multicast address, and
+	// allNodesEthernet is the Ethernet address to which it maps.
+	allNodes         = net.ParseIP("ff02::1")
+	allNodesEthernet = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// Sender sends Ethernet frames on an interface.
+type Sender interface {
+	// Send sends frame, which must be a complete Ethernet frame.
+	Send(frame []byte) error
+
+	// Close releases the Sender's resources.
+	Close() error
+}
+
+// Frame returns the Ethernet frame that announces that ip is at
+// hwAddr: a gratuitous ARP if ip is an IPv4 address or an unsolicited
+// neighbor advertisement if it's IPv6.
+func Frame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if ip.To4() != nil {
+		return ARP(hwAddr, ip)
+	}
+	return NeighborAdvertisement(hwAddr, ip)
+}
+
+// ARP returns an Ethernet frame that contains a gratuitous ARP
+// request announcing that ip is at hwAddr. We send requests and not
+// replies because some devices only update their caches when they
+// see requests (RFC 5227 section 3).
+func ARP(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("%s is not an Ethernet address", hwAddr)
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+
+	frame := make([]byte, ethernetHeaderLen+arpLen)
+	ethernetHeader(frame, ethernetBroadcast, hwAddr, etherTypeARP)
+
+	arp := frame[ethernetHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // hardware type: Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // protocol type: IPv4
+	arp[4] = 6                                   // hardware address length
+	arp[5] = 4                                   // protocol address length
+	binary.BigEndian.PutUint16(arp[6:8], 1)      // operation: request
+	copy(arp[8:14], hwAddr)                      // sender hardware address
+	copy(arp[14:18], ip4)                        // sender protocol address
+	// the target hardware address is zero
+	copy(arp[24:28], ip4) // target protocol address
+
+	return frame, nil
+}
+
+// NeighborAdvertisement returns an Ethernet frame that contains an
+// unsolicited neighbor advertisement (RFC 4861 section 7.2.6)
+// announcing that ip is at hwAddr. The advertisement goes to the
+// all-nodes multicast address and has the Override flag set so
+// receivers replace their existing cache entries.
+func NeighborAdvertisement(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("%s is not an Ethernet address", hwAddr)
+	}
+	if ip.To4() != nil || ip.To16() == nil {
+		return nil, fmt.Errorf("%s is not an IPv6 address", ip)
+	}
+	ip6 := ip.To16()
+
+	frame := make([]byte, ethernetHeaderLen+ipv6HeaderLen+naLen)
+	ethernetHeader(frame, allNodesEthernet, hwAddr, etherTypeIPv6)
+
+	ipv6 := frame[ethernetHeaderLen:]
+	ipv6[0] = 0x60 // version 6, no traffic class or flow label
+	binary.BigEndian.PutUint16(ipv6[4:6], naLen)
+	ipv6[6] = protocolICMPv6
+	ipv6[7] = ndHopLimit // RFC 4861 requires 255
+	copy(ipv6[8:24], ip6)
+	copy(ipv6[24:40], allNodes)
+
+	na := ipv6[ipv6HeaderLen:]
+	na[0] = icmpv6NeighborAdvert
+	na[4] = naFlagOverride
+	copy(na[8:24], ip6)
+	na[24] = optionTargetLinkLayer
+	na[25] = 1 // option length in units of 8 bytes
+	copy(na[26:32], hwAddr)
+	binary.BigEndian.PutUint16(na[2:4], icmpv6Checksum(ip6, allNodes, na))
+
+	return frame, nil
+}
+
+// Announce sends frame count times, interval apart, using
+// sender. It stops early if stop is closed, so callers can cancel a
+// burst if they lose the address. It calls sent after each attempt
+// with the result of the attempt.
+func Announce(sender Sender, frame []byte, count int, interval time.Duration, stop <-chan struct{}, sent func(error)) {
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+
+		// stop might have been closed while we were sending the
+		// previous frame
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		sent(sender.Send(frame))
+	}
+}
+
+// ethernetHeader writes an Ethernet header into the start of frame.
+func ethernetHeader(frame []byte, dst net.HardwareAddr, src net.HardwareAddr, etherType uint16) {
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], etherType)
+}
+
+// icmpv6Checksum calculates the checksum of an ICMPv6 message,
+// including the IPv6 pseudo-header (RFC 8200 section 8.1). The
+// message's checksum field must be zero.
+func icmpv6Checksum(src net.IP, dst net.IP, message []byte) uint16 {
+	pseudo := make([]byte, 0, 40+len(message))
+	pseudo = append(pseudo, src.To16()...)
+	pseudo = append(pseudo, dst.To16()...)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(message)))
+	pseudo = append(pseudo, length...)
+	pseudo = append(pseudo, 0, 0, 0, protocolICMPv6)
+	pseudo = append(pseudo, message...)
+
+	return checksum(pseudo)
+}
+
+// checksum calculates the Internet checksum (RFC 1071) of data.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gratuitous
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var hwAddr = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+
+// fakeSender records the frames that it's asked to send.
+type fakeSender struct {
+	lock   sync.Mutex
+	frames [][]byte
+	err    error
+}
+
+func (s *fakeSender) Send(frame []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.frames = append(s.frames, frame)
+	return s.err
+}
+
+func (s *fakeSender) Close() error {
+	return nil
+}
+
+func (s *fakeSender) sent() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.frames)
+}
+
+func TestARP(t *testing.T) {
+	frame, err := ARP(hwAddr, net.ParseIP("192.168.1.10"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		// Ethernet
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0x42, 0xac, 0x11, 0x00, 0x02,
+		0x08, 0x06,
+		// ARP request, Ethernet/IPv4
+		0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01,
+		// sender
+		0x02, 0x42, 0xac, 0x11, 0x00, 0x02,
+		192, 168, 1, 10,
+		// target
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		192, 168, 1, 10,
+	}, frame)
+
+	_, err = ARP(hwAddr, net.ParseIP("2001:db8::10"))
+	assert.Error(t, err)
+	_, err = ARP(net.HardwareAddr{0x02}, net.ParseIP("192.168.1.10"))
+	assert.Error(t, err)
+}
+
+func TestNeighborAdvertisement(t *testing.T) {
+	ip := net.ParseIP("2001:db8::10")
+	frame, err := NeighborAdvertisement(hwAddr, ip)
+	assert.NoError(t, err)
+	assert.Len(t, frame, 86)
+
+	// Ethernet
+	assert.Equal(t, net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}, net.HardwareAddr(frame[0:6]))
+	assert.Equal(t, hwAddr, net.HardwareAddr(frame[6:12]))
+	assert.Equal(t, []byte{0x86, 0xdd}, frame[12:14])
+
+	// IPv6
+	ipv6 := frame[14:54]
+	assert.Equal(t, byte(0x60), ipv6[0])
+	assert.Equal(t, []byte{0, 32}, ipv6[4:6], "payload length")
+	assert.Equal(t, byte(58), ipv6[6], "next header")
+	assert.Equal(t, byte(255), ipv6[7], "hop limit")
+	assert.True(t, ip.Equal(ipv6[8:24]), "source")
+	assert.True(t, net.ParseIP("ff02::1").Equal(ipv6[24:40]), "destination")
+
+	// Neighbor advertisement
+	na := frame[54:]
+	assert.Equal(t, byte(136), na[0])
+	assert.Equal(t, byte(0x20), na[4], "override flag")
+	assert.True(t, ip.Equal(na[8:24]), "target")
+	assert.Equal(t, []byte{2, 1}, na[24:26], "target link-layer address option")
+	assert.Equal(t, hwAddr, net.HardwareAddr(na[26:32]))
+
+	// The checksum of a message that includes its checksum is zero
+	assert.Equal(t, uint16(0), icmpv6Checksum(ip, net.ParseIP("ff02::1"), na))
+
+	_, err = NeighborAdvertisement(hwAddr, net.ParseIP("192.168.1.10"))
+	assert.Error(t, err)
+}
+
+func TestChecksum(t *testing.T) {
+	// RFC 1071 section 3's example
+	assert.Equal(t, ^uint16(0xddf2), checksum([]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}))
+	assert.Equal(t, ^uint16(0x0100), checksum([]byte{0x01}), "odd length")
+}
+
+func TestFrame(t *testing.T) {
+	frame, err := Frame(hwAddr, net.ParseIP("192.168.1.10"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 0x06}, frame[12:14])
+	frame, err = Frame(hwAddr, net.ParseIP("2001:db8::10"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x86, 0xdd}, frame[12:14])
+}
+
+func TestAnnounce(t *testing.T) {
+	frame := []byte{1, 2, 3}
+
+	sender := &fakeSender{}
+	results := []error{}
+	Announce(sender, frame, 3, time.Millisecond, make(chan struct{}), func(err error) {
+		results = append(results, err)
+	})
+	assert.Equal(t, 3, sender.sent())
+	assert.Equal(t, []error{nil, nil, nil}, results)
+
+	// Errors are reported but don't stop the burst
+	sender = &fakeSender{err: errors.New("network is down")}
+	results = []error{}
+	Announce(sender, frame, 2, time.Millisecond, make(chan struct{}), func(err error) {
+		results = append(results, err)
+	})
+	assert.Equal(t, 2, sender.sent())
+	assert.Equal(t, []error{sender.err, sender.err}, results)
+
+	// Closing stop cancels the rest of the burst
+	sender = &fakeSender{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Announce(sender, frame, 1000, time.Hour, stop, func(error) {})
+		close(done)
+	}()
+	for sender.sent() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	assert.Equal(t, 1, sender.sent())
+
+	// Nothing is sent if stop is already closed
+	sender = &fakeSender{}
+	Announce(sender, frame, 3, time.Millisecond, stop, func(error) {})
+	assert.Equal(t, 0, sender.sent())
+}
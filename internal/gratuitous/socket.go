@@ -0,0 +1,53 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gratuitous
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// socket is a Sender that uses an AF_PACKET socket.
+type socket struct {
+	fd   int
+	addr syscall.SockaddrLinklayer
+}
+
+// NewSender returns a Sender that sends frames on the interface with
+// index ifIndex.
+func NewSender(ifIndex int) (Sender, error) {
+	// We only send so the socket's protocol is 0, which means that
+	// the kernel doesn't deliver any received frames to it.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening raw socket: %w", err)
+	}
+
+	return &socket{
+		fd:   fd,
+		addr: syscall.SockaddrLinklayer{Ifindex: ifIndex, Halen: 6},
+	}, nil
+}
+
+func (s *socket) Send(frame []byte) error {
+	// The kernel sends frame as-is since it includes the Ethernet
+	// header, but it wants a destination address anyway
+	copy(s.addr.Addr[:], frame[0:6])
+	return syscall.Sendto(s.fd, frame, 0, &s.addr)
+}
+
+func (s *socket) Close() error {
+	return syscall.Close(s.fd)
+}
@@ -0,0 +1,247 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides a reference implementation of the IPAM
+// webhook API for tests.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"purelb.io/internal/ipam"
+)
+
+// Server is an in-memory implementation of the IPAM webhook API
+// that's described in the ipam package documentation. It's meant for
+// tests: create one with NewServer, add pools with AddPool, point an
+// ipam.Webhook at URL, and then inspect Owner to see what the client
+// did. Each pool allocates its addresses in the order in which they
+// were added.
+type Server struct {
+	*httptest.Server
+
+	// Token is the bearer token that requests must present. If it's ""
+	// then the server doesn't check requests' credentials.
+	Token string
+
+	lock     sync.Mutex
+	pools    map[string]*serverPool
+	requests int
+}
+
+// serverPool is the stand-in server's record of one pool.
+type serverPool struct {
+	addresses []string
+	owners    map[string]ipam.Owner // address -> owner
+}
+
+// NewServer starts a stand-in IPAM server that has no pools. Call
+// Close when you're done with it.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token: token,
+		pools: map[string]*serverPool{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddPool adds a pool with the provided addresses, which must be
+// plain IP addresses.
+func (s *Server) AddPool(name string, addresses ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pool := &serverPool{owners: map[string]ipam.Owner{}}
+	for _, address := range addresses {
+		pool.addresses = append(pool.addresses, net.ParseIP(address).String())
+	}
+	s.pools[name] = pool
+}
+
+// Allocate allocates an address to owner, e.g., to simulate another
+// user of the IPAM system.
+func (s *Server) Allocate(pool string, address string, owner ipam.Owner) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pools[pool].owners[net.ParseIP(address).String()] = owner
+}
+
+// Owner returns the owner of an address, or nil if it's free.
+func (s *Server) Owner(pool string, address string) *ipam.Owner {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	owner, allocated := s.pools[pool].owners[net.ParseIP(address).String()]
+	if !allocated {
+		return nil
+	}
+	return &owner
+}
+
+// Requests returns the number of requests that the server has
+// received.
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.requests
+}
+
+// request is the union of the webhook API's request bodies.
+type request struct {
+	Pool    string     `json:"pool"`
+	Family  string     `json:"family"`
+	Address string     `json:"address"`
+	Owner   ipam.Owner `json:"owner"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests++
+
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pool, exists := s.pools[req.Pool]
+	if !exists {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown pool %q", req.Pool))
+		return
+	}
+
+	var address string
+	if req.Address != "" {
+		ip := net.ParseIP(req.Address)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid address %q", req.Address))
+			return
+		}
+		address = ip.String()
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "allocate":
+		s.allocate(w, pool, req.Family, address, req.Owner)
+	case "release":
+		if _, allocated := pool.owners[address]; !allocated {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("%s isn't allocated", address))
+			return
+		}
+		delete(pool.owners, address)
+		writeJSON(w, struct{}{})
+	case "lookup":
+		if !pool.contains(address) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("%s isn't in pool %s", address, req.Pool))
+			return
+		}
+		writeJSON(w, pool.allocation(address))
+	case "networks":
+		networks := []string{}
+		for _, address := range pool.addresses {
+			networks = append(networks, ipam.HostNetwork(net.ParseIP(address)).String())
+		}
+		writeJSON(w, map[string][]string{"networks": networks})
+	case "list":
+		allocations := []ipam.Allocation{}
+		for _, address := range pool.addresses {
+			if _, allocated := pool.owners[address]; allocated {
+				allocations = append(allocations, pool.allocation(address))
+			}
+		}
+		writeJSON(w, map[string][]ipam.Allocation{"allocations": allocations})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown operation %q", r.URL.Path))
+	}
+}
+
+// allocate implements the allocate operation.
+func (s *Server) allocate(w http.ResponseWriter, pool *serverPool, family string, address string, owner ipam.Owner) {
+	if address != "" {
+		if !pool.contains(address) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("%s isn't in the pool", address))
+			return
+		}
+		if current, allocated := pool.owners[address]; allocated && current != owner {
+			writeError(w, http.StatusConflict, fmt.Sprintf("%s is allocated to %s/%s", address, current.Namespace, current.Name))
+			return
+		}
+		pool.owners[address] = owner
+		writeJSON(w, pool.allocation(address))
+		return
+	}
+
+	for _, candidate := range pool.addresses {
+		if _, allocated := pool.owners[candidate]; allocated {
+			continue
+		}
+		isV4 := net.ParseIP(candidate).To4() != nil
+		if (family == "ipv4" && !isV4) || (family == "ipv6" && isV4) {
+			continue
+		}
+		pool.owners[candidate] = owner
+		writeJSON(w, pool.allocation(candidate))
+		return
+	}
+	writeError(w, http.StatusConflict, "no free addresses")
+}
+
+// contains indicates whether address is in the pool.
+func (p *serverPool) contains(address string) bool {
+	for _, candidate := range p.addresses {
+		if candidate == address {
+			return true
+		}
+	}
+	return false
+}
+
+// allocation describes address.
+func (p *serverPool) allocation(address string) ipam.Allocation {
+	allocation := ipam.Allocation{Address: address}
+	if owner, allocated := p.owners[address]; allocated {
+		allocation.Owner = &owner
+	}
+	return allocation
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
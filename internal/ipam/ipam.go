@@ -0,0 +1,163 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipam defines the interface between the allocator and
+// external IPAM systems, and implements it using a JSON HTTP API
+// (a "webhook") that users can implement in front of their own IPAM
+// systems.
+//
+// The allocator sends each request as a POST to the ServiceGroup's
+// URL plus the name of the operation, e.g.,
+// "https://ipam.example.com/purelb/allocate". Request and response
+// bodies are JSON. If the ServiceGroup has credentials then each
+// request has an "Authorization: Bearer <token>" header. Every
+// request includes the name of the pool from which the allocator
+// wants addresses, so one server can serve several ServiceGroups.
+// Addresses are plain IP addresses, e.g., "192.168.1.10" or
+// "2001:db8::10", without prefix lengths.
+//
+// An allocation describes an address and the service that owns it:
+//
+//	{"address": "192.168.1.10", "owner": {"namespace": "default", "name": "echo"}}
+//
+// allocate allocates an address to a service. family is "ipv4",
+// "ipv6", or "" if any address will do. If address is set then the
+// server must allocate that address or fail. If the address is
+// already allocated to the same owner then the server should succeed
+// since the allocator might be retrying:
+//
+//	request:  {"pool": "default", "family": "ipv4", "address": "", "owner": {"namespace": "default", "name": "echo"}}
+//	response: {"address": "192.168.1.10", "owner": {"namespace": "default", "name": "echo"}}
+//
+// The server responds with 409 Conflict if the requested address is
+// allocated to another service or if the pool has no free addresses,
+// and with 404 Not Found if the requested address isn't in the pool.
+//
+// release returns an address to the pool. The server responds with
+// 404 Not Found if the address isn't allocated, which the allocator
+// treats as success. The response body is ignored:
+//
+//	request:  {"pool": "default", "address": "192.168.1.10"}
+//
+// lookup describes an address. The allocation has no owner if the
+// address is free. The server responds with 404 Not Found if the
+// address isn't in the pool:
+//
+//	request:  {"pool": "default", "address": "192.168.1.10"}
+//	response: {"address": "192.168.1.10", "owner": {"namespace": "default", "name": "echo"}}
+//
+// networks describes the networks from which the pool allocates
+// addresses, in CIDR notation. Bare addresses mean single addresses.
+// The allocator caches them so it can tell which pool a user-specified
+// address belongs to without asking the server each time:
+//
+//	request:  {"pool": "default"}
+//	response: {"networks": ["192.168.1.0/24", "2001:db8::10"]}
+//
+// list describes every address in the pool that's allocated:
+//
+//	request:  {"pool": "default"}
+//	response: {"allocations": [{"address": "192.168.1.10", "owner": {"namespace": "default", "name": "echo"}}]}
+//
+// The server responds to requests that fail with a non-2xx status
+// and, optionally, a body like {"error": "pool default is full"}.
+// 401 Unauthorized and 403 Forbidden mean that the allocator's
+// credentials are bad.
+package ipam
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrAuthentication means that the IPAM system didn't accept our
+	// credentials.
+	ErrAuthentication = errors.New("IPAM authentication failed, check the credentials")
+
+	// ErrUnavailable means that the IPAM system can't allocate the
+	// address that we asked for because another service is using it,
+	// or that it has no free addresses.
+	ErrUnavailable = errors.New("IPAM address unavailable")
+
+	// ErrNotFound means that the address isn't in the IPAM system's
+	// pool, or that the IPAM system doesn't know about it.
+	ErrNotFound = errors.New("address not in the IPAM pool")
+)
+
+// Owner identifies the service that owns an address.
+type Owner struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Allocation describes an address and the service that owns it.
+type Allocation struct {
+	Address string `json:"address"`
+
+	// Owner is nil if the address is free.
+	Owner *Owner `json:"owner,omitempty"`
+}
+
+// Backend is an external IPAM system from which the allocator
+// allocates addresses.
+type Backend interface {
+	// Allocate allocates an address in family (nl.FAMILY_V4 or
+	// nl.FAMILY_V6, or 0 for either) to owner, and returns it. If
+	// address isn't "" then the backend allocates that address or
+	// fails.
+	Allocate(family int, address string, owner Owner) (string, error)
+
+	// Release returns address to the backend's pool. Releasing an
+	// address that isn't allocated isn't an error.
+	Release(address string) error
+
+	// Lookup describes address, or returns ErrNotFound if it isn't in
+	// the backend's pool.
+	Lookup(address string) (Allocation, error)
+
+	// Networks returns the networks from which the backend allocates
+	// addresses.
+	Networks() ([]*net.IPNet, error)
+
+	// List describes every address in the backend's pool that's
+	// allocated. The allocator compares it with the services
+	// periodically to find addresses that no service uses.
+	List() ([]Allocation, error)
+}
+
+// Transferer is a Backend that can change the owner of an allocated
+// address, e.g., because the service that allocated a shared address
+// released it but other services still use it. Backends that aren't
+// Transferers list the service that allocated a shared address as
+// its owner until the address is released.
+type Transferer interface {
+	Transfer(address string, owner Owner) error
+}
+
+// Sizer is a Backend that knows how many addresses it can allocate.
+type Sizer interface {
+	// Capacity returns the number of addresses in family (or in both
+	// families if family is 0) that the backend can allocate, or 0 if
+	// there's no fixed limit.
+	Capacity(family int) (uint64, error)
+}
+
+// HostNetwork returns the network that contains only ip.
+func HostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
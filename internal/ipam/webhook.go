@@ -0,0 +1,294 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// defaultTimeout is how long we wait for the webhook to respond to a
+// request if WebhookConfig.Timeout isn't set.
+const defaultTimeout = 10 * time.Second
+
+// WebhookConfig configures a Webhook.
+type WebhookConfig struct {
+	// URL is the base URL of the webhook API. We append the names of
+	// the operations to it.
+	URL string
+
+	// Pool is the name of the pool that we send in each request.
+	Pool string
+
+	// Token is the bearer token that we send in each request. If it's
+	// "" then we don't send an Authorization header.
+	Token string
+
+	// RootCAs are the CAs that we use to verify the server's TLS
+	// certificate. If it's nil then we use the system's CAs.
+	RootCAs *x509.CertPool
+
+	// Timeout is how long we wait for the server to respond to each
+	// request.
+	Timeout time.Duration
+}
+
+// Webhook is a Backend that talks to a JSON HTTP API. The package
+// documentation describes the API.
+type Webhook struct {
+	config WebhookConfig
+	http   http.Client
+}
+
+// The request and response bodies of the webhook API.
+type (
+	allocateRequest struct {
+		Pool    string `json:"pool"`
+		Family  string `json:"family"`
+		Address string `json:"address"`
+		Owner   Owner  `json:"owner"`
+	}
+
+	addressRequest struct {
+		Pool    string `json:"pool"`
+		Address string `json:"address"`
+	}
+
+	listRequest struct {
+		Pool string `json:"pool"`
+	}
+
+	listResponse struct {
+		Allocations []Allocation `json:"allocations"`
+	}
+
+	networksResponse struct {
+		Networks []string `json:"networks"`
+	}
+
+	errorResponse struct {
+		Error string `json:"error"`
+	}
+)
+
+// WebhookError is the error that we return when the webhook responds
+// to a request with an HTTP status that indicates failure.
+type WebhookError struct {
+	Op         string
+	StatusCode int
+	Status     string
+	Message    string
+	err        error
+}
+
+func (e *WebhookError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("IPAM %s: webhook returned %s", e.Op, e.Status)
+	}
+	return fmt.Sprintf("IPAM %s: webhook returned %s: %s", e.Op, e.Status, e.Message)
+}
+
+// Unwrap returns the package error that corresponds to the HTTP
+// status, if there is one, so callers can use errors.Is.
+func (e *WebhookError) Unwrap() error {
+	return e.err
+}
+
+// NewWebhook returns a Webhook that uses config.
+func NewWebhook(config WebhookConfig) *Webhook {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if !strings.HasSuffix(config.URL, "/") {
+		config.URL += "/"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: config.RootCAs}
+	}
+
+	return &Webhook{
+		config: config,
+		http:   http.Client{Transport: transport},
+	}
+}
+
+// Allocate allocates an address by calling the webhook's allocate
+// operation.
+func (w *Webhook) Allocate(family int, address string, owner Owner) (string, error) {
+	request := allocateRequest{Pool: w.config.Pool, Address: address, Owner: owner}
+	switch family {
+	case nl.FAMILY_V4:
+		request.Family = "ipv4"
+	case nl.FAMILY_V6:
+		request.Family = "ipv6"
+	}
+
+	allocation := Allocation{}
+	if err := w.call("allocate", request, &allocation); err != nil {
+		return "", err
+	}
+	return parseAddress("allocate", allocation.Address)
+}
+
+// Release returns an address to the pool by calling the webhook's
+// release operation.
+func (w *Webhook) Release(address string) error {
+	err := w.call("release", addressRequest{Pool: w.config.Pool, Address: address}, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Lookup describes an address by calling the webhook's lookup
+// operation.
+func (w *Webhook) Lookup(address string) (Allocation, error) {
+	allocation := Allocation{}
+	if err := w.call("lookup", addressRequest{Pool: w.config.Pool, Address: address}, &allocation); err != nil {
+		return allocation, err
+	}
+	var err error
+	allocation.Address, err = parseAddress("lookup", allocation.Address)
+	return allocation, err
+}
+
+// Networks describes the pool's networks by calling the webhook's
+// networks operation.
+func (w *Webhook) Networks() ([]*net.IPNet, error) {
+	response := networksResponse{}
+	if err := w.call("networks", listRequest{Pool: w.config.Pool}, &response); err != nil {
+		return nil, err
+	}
+	networks := make([]*net.IPNet, 0, len(response.Networks))
+	for _, network := range response.Networks {
+		_, cidr, err := net.ParseCIDR(network)
+		if err != nil {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("IPAM networks: webhook returned invalid network %q", network)
+			}
+			cidr = HostNetwork(ip)
+		}
+		networks = append(networks, cidr)
+	}
+	return networks, nil
+}
+
+// List describes the allocated addresses by calling the webhook's
+// list operation.
+func (w *Webhook) List() ([]Allocation, error) {
+	response := listResponse{}
+	if err := w.call("list", listRequest{Pool: w.config.Pool}, &response); err != nil {
+		return nil, err
+	}
+	allocations := make([]Allocation, 0, len(response.Allocations))
+	for _, allocation := range response.Allocations {
+		var err error
+		if allocation.Address, err = parseAddress("list", allocation.Address); err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, allocation)
+	}
+	return allocations, nil
+}
+
+// call POSTs request to the webhook's op operation and decodes the
+// response into response, unless it's nil.
+func (w *Webhook) call(op string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL+op, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	if w.config.Token != "" {
+		req.Header.Add("Authorization", "Bearer "+w.config.Token)
+	}
+
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("IPAM %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("IPAM %s: %w", op, err)
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return statusError(op, resp, data)
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(data, response); err != nil {
+			return fmt.Errorf("IPAM %s: decoding webhook response: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// statusError returns a *WebhookError that describes resp.
+func statusError(op string, resp *http.Response, data []byte) error {
+	webhookErr := &WebhookError{Op: op, StatusCode: resp.StatusCode, Status: resp.Status}
+
+	body := errorResponse{}
+	if json.Unmarshal(data, &body) == nil {
+		webhookErr.Message = body.Error
+	}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		webhookErr.err = ErrAuthentication
+	case http.StatusConflict:
+		webhookErr.err = ErrUnavailable
+	case http.StatusNotFound:
+		webhookErr.err = ErrNotFound
+	}
+	return webhookErr
+}
+
+// parseAddress validates an address from a webhook response. We
+// tolerate prefix lengths, e.g., "192.168.1.10/32", and strip them.
+func parseAddress(op string, address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(address); err != nil {
+			return "", fmt.Errorf("IPAM %s: webhook returned invalid address %q", op, address)
+		}
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink/nl"
+
+	"purelb.io/internal/ipam"
+	"purelb.io/internal/ipam/fake"
+)
+
+var (
+	echo  = ipam.Owner{Namespace: "default", Name: "echo"}
+	other = ipam.Owner{Namespace: "default", Name: "other"}
+)
+
+func TestWebhookAllocateRelease(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddPool("default", "192.168.1.1", "2001:db8::1", "192.168.1.2")
+	server.AddPool("other", "192.168.2.1")
+
+	backend := ipam.NewWebhook(ipam.WebhookConfig{URL: server.URL, Pool: "default", Token: "token"})
+
+	// The backend allocates from its own pool, in the requested family
+	addr, err := backend.Allocate(nl.FAMILY_V6, "", echo)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", addr)
+	addr, err = backend.Allocate(0, "", echo)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1", addr)
+	assert.Equal(t, &echo, server.Owner("default", "192.168.1.1"))
+	assert.Nil(t, server.Owner("other", "192.168.2.1"))
+
+	// Specific addresses
+	_, err = backend.Allocate(nl.FAMILY_V4, "192.168.1.1", other)
+	assert.True(t, errors.Is(err, ipam.ErrUnavailable), "address allocated to another service")
+	addr, err = backend.Allocate(nl.FAMILY_V4, "192.168.1.1", echo)
+	assert.NoError(t, err, "retry by the same owner")
+	assert.Equal(t, "192.168.1.1", addr)
+	_, err = backend.Allocate(nl.FAMILY_V4, "192.168.9.9", echo)
+	assert.True(t, errors.Is(err, ipam.ErrNotFound), "address not in the pool")
+
+	// Exhaustion
+	_, err = backend.Allocate(nl.FAMILY_V4, "", other)
+	assert.NoError(t, err)
+	_, err = backend.Allocate(nl.FAMILY_V4, "", other)
+	assert.True(t, errors.Is(err, ipam.ErrUnavailable), "pool is full")
+
+	// Release returns the address to the pool, and releasing it again
+	// is OK
+	assert.NoError(t, backend.Release("192.168.1.1"))
+	assert.Nil(t, server.Owner("default", "192.168.1.1"))
+	assert.NoError(t, backend.Release("192.168.1.1"))
+	addr, err = backend.Allocate(nl.FAMILY_V4, "", other)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1", addr)
+}
+
+func TestWebhookLookupNetworksList(t *testing.T) {
+	server := fake.NewServer("")
+	defer server.Close()
+	server.AddPool("default", "192.168.1.1", "192.168.1.2", "2001:db8::1")
+	server.Allocate("default", "192.168.1.2", other)
+
+	backend := ipam.NewWebhook(ipam.WebhookConfig{URL: server.URL + "/", Pool: "default"})
+	_, err := backend.Allocate(nl.FAMILY_V6, "", echo)
+	assert.NoError(t, err)
+
+	allocation, err := backend.Lookup("192.168.1.2")
+	assert.NoError(t, err)
+	assert.Equal(t, ipam.Allocation{Address: "192.168.1.2", Owner: &other}, allocation)
+	allocation, err = backend.Lookup("192.168.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, ipam.Allocation{Address: "192.168.1.1"}, allocation, "free address")
+	_, err = backend.Lookup("10.0.0.1")
+	assert.True(t, errors.Is(err, ipam.ErrNotFound))
+
+	networks, err := backend.Networks()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.1/32", "192.168.1.2/32", "2001:db8::1/128"}, networkStrings(networks))
+
+	allocations, err := backend.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []ipam.Allocation{
+		{Address: "192.168.1.2", Owner: &other},
+		{Address: "2001:db8::1", Owner: &echo},
+	}, allocations)
+}
+
+func TestWebhookErrors(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddPool("default", "192.168.1.1")
+
+	backend := ipam.NewWebhook(ipam.WebhookConfig{URL: server.URL, Pool: "default", Token: "wrong"})
+	_, err := backend.Allocate(0, "", echo)
+	assert.True(t, errors.Is(err, ipam.ErrAuthentication))
+	var webhookErr *ipam.WebhookError
+	assert.True(t, errors.As(err, &webhookErr))
+	assert.Equal(t, "invalid token", webhookErr.Message)
+
+	backend = ipam.NewWebhook(ipam.WebhookConfig{URL: server.URL, Pool: "missing", Token: "token"})
+	_, err = backend.List()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown pool")
+
+	// Servers that don't respond time out
+	backend = ipam.NewWebhook(ipam.WebhookConfig{URL: "http://192.0.2.1/", Pool: "default", Timeout: 10 * time.Millisecond})
+	_, err = backend.List()
+	assert.Error(t, err)
+}
+
+// networkStrings converts networks into strings in CIDR notation.
+func networkStrings(networks []*net.IPNet) []string {
+	strs := []string{}
+	for _, network := range networks {
+		strs = append(strs, network.String())
+	}
+	return strs
+}
@@ -90,7 +90,7 @@ func (f *fixture) newController() (*Controller, informers.SharedInformerFactory,
 
 	c := NewCRController(log.NewJSONLogger(log.NewSyncWriter(os.Stdout)),
 		stubConfigChanged, func() {}, f.kubeclient, f.client,
-		i)
+		i, nil)
 
 	c.sgsSynced = alwaysReady
 	c.recorder = &record.FakeRecorder{}
@@ -22,12 +22,15 @@ import (
 
 	"github.com/go-kit/kit/log"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -56,6 +59,10 @@ type Controller struct {
 	lbnasSynced cache.InformerSynced
 	lbnaLister  listers.LBNodeAgentLister
 
+	// secretLister is nil if we don't watch Secrets.
+	secretsSynced cache.InformerSynced
+	secretLister  corelisters.SecretLister
+
 	// workqueue is a rate limited work queue. This is used to queue
 	// work to be processed instead of performing it as soon as a change
 	// happens. This means we can ensure we only process a fixed amount
@@ -70,14 +77,17 @@ type Controller struct {
 }
 
 // NewCRController returns a new controller that watches for changes
-// to PureLB custom resources.
+// to PureLB custom resources. If secretInformer isn't nil then the
+// controller also watches the Secrets that the ServiceGroups
+// reference, and includes them in the config.
 func NewCRController(
 	logger log.Logger,
 	configCB func(*purelbv1.Config) SyncState,
 	forceSync func(),
 	kubeclientset kubernetes.Interface,
 	purelbclientset clientset.Interface,
-	informerFactory externalversions.SharedInformerFactory) *Controller {
+	informerFactory externalversions.SharedInformerFactory,
+	secretInformer coreinformers.SecretInformer) *Controller {
 
 	sgInformer := informerFactory.Purelb().V1().ServiceGroups()
 	lbnaInformer := informerFactory.Purelb().V1().LBNodeAgents()
@@ -127,6 +137,21 @@ func NewCRController(
 			controller.enqueueResource("lbna", deleted)
 		},
 	})
+	if secretInformer != nil {
+		controller.secretLister = secretInformer.Lister()
+		controller.secretsSynced = secretInformer.Informer().HasSynced
+		secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(added interface{}) {
+				controller.enqueueSecret(added)
+			},
+			UpdateFunc: func(old, new interface{}) {
+				controller.enqueueSecret(new)
+			},
+			DeleteFunc: func(deleted interface{}) {
+				controller.enqueueSecret(deleted)
+			},
+		})
+	}
 
 	return controller
 }
@@ -141,7 +166,11 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer c.workqueue.ShutDown()
 
 	// Wait for the caches to be synced before starting workers
-	if ok := cache.WaitForCacheSync(stopCh, c.sgsSynced, c.lbnasSynced); !ok {
+	synced := []cache.InformerSynced{c.sgsSynced, c.lbnasSynced}
+	if c.secretsSynced != nil {
+		synced = append(synced, c.secretsSynced)
+	}
+	if ok := cache.WaitForCacheSync(stopCh, synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -239,6 +268,9 @@ func (c *Controller) syncHandler() error {
 		c.logger.Log("error listing node agents", err)
 		return err
 	}
+	if c.secretLister != nil {
+		cfg.Secrets = c.referencedSecrets(cfg.Groups)
+	}
 
 	// Check whether we should be the default service announcer
 	if os.Getenv("DEFAULT_ANNOUNCER") == purelbv1.Brand {
@@ -258,6 +290,74 @@ func (c *Controller) syncHandler() error {
 	return nil
 }
 
+// referencedSecrets returns the Secrets that groups reference. If a
+// Secret doesn't exist then we leave it out, and the allocator will
+// report that it's missing.
+func (c *Controller) referencedSecrets(groups []*purelbv1.ServiceGroup) []*corev1.Secret {
+	secrets := []*corev1.Secret{}
+	for _, group := range groups {
+		name := secretReference(group)
+		if name == "" {
+			continue
+		}
+		secret, err := c.secretLister.Secrets(group.Namespace).Get(name)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				c.logger.Log("op", "getSecret", "namespace", group.Namespace, "name", name, "error", err)
+			}
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+// secretReference returns the name of the Secret, in its own
+// namespace, that group references, or "" if it doesn't reference
+// one.
+func secretReference(group *purelbv1.ServiceGroup) string {
+	var credentials *purelbv1.ServiceGroupCredentials
+	switch {
+	case group.Spec.Netbox != nil:
+		credentials = group.Spec.Netbox.Credentials
+	case group.Spec.Webhook != nil:
+		credentials = group.Spec.Webhook.Credentials
+	}
+	if credentials == nil {
+		return ""
+	}
+	return credentials.SecretName
+}
+
+// enqueueSecret enqueues a Secret if a ServiceGroup references it, so
+// the pools that use it are rebuilt. Other Secrets don't affect our
+// config so we ignore them.
+func (c *Controller) enqueueSecret(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	groups, err := c.sgLister.ServiceGroups(namespace).List(labels.Everything())
+	if err != nil {
+		c.logger.Log("error listing service groups", err)
+		return
+	}
+	for _, group := range groups {
+		if secretReference(group) == name {
+			c.logger.Log("op", "secretChanged", "namespace", namespace, "name", name, "service-group", group.Name)
+			c.workqueue.Add("secret/" + key)
+			return
+		}
+	}
+}
+
 // enqueueResource takes a resource and converts it into a
 // thing/namespace/name string which is then put onto the work
 // queue. This method should *not* be passed resources of any type
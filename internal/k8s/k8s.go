@@ -17,6 +17,7 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -30,7 +31,11 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -44,20 +49,31 @@ import (
 // Client watches a Kubernetes cluster and translates events into
 // Controller method calls.
 type Client struct {
-	logger log.Logger
+	logger   log.Logger
+	nodeName string
 
-	client *kubernetes.Clientset
-	events record.EventRecorder
-	queue  workqueue.RateLimitingInterface
+	client   *kubernetes.Clientset
+	crClient *versioned.Clientset
+	events   record.EventRecorder
+	queue    workqueue.RateLimitingInterface
 
 	svcIndexer  cache.Indexer
 	svcInformer cache.Controller
 	epIndexer   cache.Indexer
 	epInformer  cache.Controller
 
+	// podIndexer caches the memberlist member pods. It's nil if we
+	// don't watch them.
+	podIndexer  cache.Indexer
+	podInformer cache.Controller
+	podSynced   cache.InformerSynced
+
 	crInformerFactory externalversions.SharedInformerFactory
 	crController      Controller
 
+	// secretInformerFactory is nil if we don't watch Secrets.
+	secretInformerFactory informers.SharedInformerFactory
+
 	syncFuncs []cache.InformerSynced
 
 	serviceChanged func(*corev1.Service, *corev1.Endpoints) SyncState
@@ -67,11 +83,14 @@ type Client struct {
 	shutdown       func()
 }
 
-// ServiceEvent adds events to services.
+// ServiceEvent adds events to services and reports status back to
+// the cluster.
 type ServiceEvent interface {
 	Infof(obj runtime.Object, desc, msg string, args ...interface{})
 	Errorf(obj runtime.Object, desc, msg string, args ...interface{})
 	ForceSync()
+	UpdateGroupStatus(group *purelbv1.ServiceGroup) error
+	UpdateAgentNodeStatus(agent *purelbv1.LBNodeAgent, status *purelbv1.LBNodeAgentNodeStatus) error
 }
 
 // SyncState is the result of calling synchronization callbacks.
@@ -97,6 +116,18 @@ type Config struct {
 	Logger        log.Logger
 	Kubeconfig    string
 
+	// ReadSecrets tells the client to watch the Secrets that
+	// ServiceGroups reference in SecretNamespace (or in all
+	// namespaces if it's empty).
+	ReadSecrets     bool
+	SecretNamespace string
+
+	// MemberLabels tells the client to watch the pods in
+	// MemberNamespace that match it, i.e., the lbnodeagent pods, so it
+	// can tell which nodes should be memberlist members.
+	MemberNamespace string
+	MemberLabels    string
+
 	ServiceChanged func(*corev1.Service, *corev1.Endpoints) SyncState
 	ServiceDeleted func(string) SyncState
 	ConfigChanged  func(*purelbv1.Config) SyncState
@@ -137,16 +168,23 @@ func New(cfg *Config) (*Client, error) {
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
 
 	c := &Client{
-		logger: cfg.Logger,
-		client: clientset,
-		events: recorder,
-		queue:  queue,
+		logger:   cfg.Logger,
+		nodeName: cfg.NodeName,
+		client:   clientset,
+		crClient: crClient,
+		events:   recorder,
+		queue:    queue,
 	}
 
 	// Custom Resource Watcher
 
 	c.crInformerFactory = externalversions.NewSharedInformerFactory(crClient, time.Second*0)
-	c.crController = *NewCRController(c.logger, cfg.ConfigChanged, c.ForceSync, clientset, crClient, c.crInformerFactory)
+	var secretInformer coreinformers.SecretInformer
+	if cfg.ReadSecrets {
+		c.secretInformerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, time.Second*0, informers.WithNamespace(cfg.SecretNamespace))
+		secretInformer = c.secretInformerFactory.Core().V1().Secrets()
+	}
+	c.crController = *NewCRController(c.logger, cfg.ConfigChanged, c.ForceSync, clientset, crClient, c.crInformerFactory, secretInformer)
 
 	// Service Watcher
 
@@ -206,6 +244,34 @@ func New(cfg *Config) (*Client, error) {
 		c.syncFuncs = append(c.syncFuncs, c.epInformer.HasSynced)
 	}
 
+	// Member Pod Watcher (used by node agents, not the allocator)
+
+	if cfg.MemberLabels != "" {
+		// Elections depend on which nodes have member pods, so
+		// reprocess the services when that changes. Pod status updates
+		// are frequent but they don't change the nodes so we ignore them.
+		podHandlers := cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.ForceSync()
+			},
+			UpdateFunc: func(old interface{}, new interface{}) {
+				if memberNode(old.(*corev1.Pod)) != memberNode(new.(*corev1.Pod)) {
+					c.ForceSync()
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				c.ForceSync()
+			},
+		}
+		podWatcher := cache.NewFilteredListWatchFromClient(c.client.CoreV1().RESTClient(), "pods", cfg.MemberNamespace, func(options *metav1.ListOptions) {
+			options.LabelSelector = cfg.MemberLabels
+		})
+		c.podIndexer, c.podInformer = cache.NewIndexerInformer(podWatcher, &corev1.Pod{}, 0, podHandlers, cache.Indexers{})
+		c.podSynced = c.podInformer.HasSynced
+
+		c.syncFuncs = append(c.syncFuncs, c.podSynced)
+	}
+
 	// Sync Watcher
 
 	c.synced = cfg.Synced
@@ -240,10 +306,93 @@ func (c *Client) GetPodsIPs(namespace string, labels string) ([]string, error) {
 	return iplist, nil
 }
 
+// MemberNodes returns the names of the nodes that are running member
+// pods, i.e., pods that match the MemberLabels, from the client's
+// cache. It returns false if the client doesn't watch member pods or
+// hasn't loaded them yet, in which case it can't tell which nodes
+// should be members.
+func (c *Client) MemberNodes() (map[string]bool, bool) {
+	if c.podIndexer == nil || !c.podSynced() {
+		return nil, false
+	}
+
+	nodes := map[string]bool{}
+	for _, obj := range c.podIndexer.List() {
+		if node := memberNode(obj.(*corev1.Pod)); node != "" {
+			nodes[node] = true
+		}
+	}
+	return nodes, true
+}
+
+// memberNode returns the name of the node on which pod is running, or
+// "" if it isn't running, i.e., it hasn't been scheduled yet, or it's
+// finished or being deleted.
+func memberNode(pod *corev1.Pod) string {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return ""
+	}
+	return pod.Spec.NodeName
+}
+
+// GetNode gets the node called name.
+func (c *Client) GetNode(name string) (*corev1.Node, error) {
+	return c.client.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// GetSecret returns the Secret called name in namespace.
+func (c *Client) GetSecret(namespace string, name string) (*corev1.Secret, error) {
+	return c.client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// WatchSecret watches the Secret called name in namespace, and calls
+// changed with it when we first see it and whenever it changes. It
+// watches only that Secret, so it needs permission to list and watch
+// only that Secret. If the Secret is deleted then changed isn't
+// called. The watch runs until stopCh is closed.
+func (c *Client) WatchSecret(namespace string, name string, changed func(*corev1.Secret), stopCh <-chan struct{}) {
+	watcher := cache.NewFilteredListWatchFromClient(c.client.CoreV1().RESTClient(), "secrets", namespace, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	})
+	_, informer := cache.NewInformer(watcher, &corev1.Secret{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			changed(obj.(*corev1.Secret))
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			changed(new.(*corev1.Secret))
+		},
+	})
+	go informer.Run(stopCh)
+}
+
+// Services returns the services in the informer's cache.
+func (c *Client) Services() []*corev1.Service {
+	services := []*corev1.Service{}
+	if c.svcIndexer != nil {
+		for _, obj := range c.svcIndexer.List() {
+			services = append(services, obj.(*corev1.Service))
+		}
+	}
+	return services
+}
+
+// ServiceGroups returns the ServiceGroups in the informer's cache.
+func (c *Client) ServiceGroups() ([]*purelbv1.ServiceGroup, error) {
+	return c.crController.sgLister.ServiceGroups("").List(labels.Everything())
+}
+
+// Clientset returns the Kubernetes client that this Client uses.
+func (c *Client) Clientset() kubernetes.Interface {
+	return c.client
+}
+
 // Run watches for events on the Kubernetes cluster, and dispatches
 // calls to the Controller.
 func (c *Client) Run(stopCh <-chan struct{}) error {
 	c.crInformerFactory.Start(stopCh)
+	if c.secretInformerFactory != nil {
+		c.secretInformerFactory.Start(stopCh)
+	}
 	go func() {
 		if err := c.crController.Run(1, stopCh); err != nil {
 			c.logger.Log("CR controller init error", err)
@@ -256,6 +405,9 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 	if c.epInformer != nil {
 		go c.epInformer.Run(stopCh)
 	}
+	if c.podInformer != nil {
+		go c.podInformer.Run(stopCh)
+	}
 
 	if !cache.WaitForCacheSync(stopCh, c.syncFuncs...) {
 		return errors.New("timed out waiting for cache sync")
@@ -345,6 +497,53 @@ func (c *Client) Errorf(obj runtime.Object, kind, msg string, args ...interface{
 	c.events.Eventf(obj, corev1.EventTypeWarning, kind, msg, args...)
 }
 
+// UpdateGroupStatus writes group's Status to the cluster. We replace
+// the whole status using a JSON patch so we don't need to worry about
+// the group's resourceVersion, and so empty lists in the new status
+// overwrite non-empty lists in the old one.
+func (c *Client) UpdateGroupStatus(group *purelbv1.ServiceGroup) error {
+	patch, err := json.Marshal([]map[string]interface{}{
+		{"op": "add", "path": "/status", "value": group.Status},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.crClient.PurelbV1().ServiceGroups(group.Namespace).Patch(context.TODO(), group.Name, types.JSONPatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// UpdateAgentNodeStatus writes status to agent's Status.Nodes
+// list. We use server-side apply with a per-node field manager so
+// each node owns its own entry in the list, and agents on different
+// nodes can update the list without conflicting. If status is nil
+// then this node's entry is removed.
+func (c *Client) UpdateAgentNodeStatus(agent *purelbv1.LBNodeAgent, status *purelbv1.LBNodeAgentNodeStatus) error {
+	nodes := []purelbv1.LBNodeAgentNodeStatus{}
+	if status != nil {
+		nodes = append(nodes, *status)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"apiVersion": purelbv1.SchemeGroupVersion.String(),
+		"kind":       "LBNodeAgent",
+		"metadata": map[string]string{
+			"namespace": agent.Namespace,
+			"name":      agent.Name,
+		},
+		"status": map[string]interface{}{
+			"nodes": nodes,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.crClient.PurelbV1().LBNodeAgents(agent.Namespace).Patch(context.TODO(), agent.Name, types.ApplyPatchType, patch, metav1.PatchOptions{FieldManager: "purelb-lbnodeagent-" + c.nodeName, Force: &force}, "status")
+	return err
+}
+
 func (c *Client) sync(key interface{}) SyncState {
 	defer c.queue.Done(key)
 
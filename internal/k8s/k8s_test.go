@@ -0,0 +1,60 @@
+// Copyright 2021 Acnodal Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func memberPod(name string, node string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "purelb", Name: name},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+func TestMemberNodes(t *testing.T) {
+	// Without a pod watch we can't tell
+	c := &Client{}
+	_, known := c.MemberNodes()
+	assert.False(t, known)
+
+	synced := false
+	c.podIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c.podSynced = func() bool { return synced }
+	_, known = c.MemberNodes()
+	assert.False(t, known, "pods not loaded yet")
+
+	deleting := memberPod("lbnodeagent-d", "node-d", corev1.PodRunning)
+	deleting.DeletionTimestamp = &metav1.Time{}
+	for _, pod := range []*corev1.Pod{
+		memberPod("lbnodeagent-a", "node-a", corev1.PodRunning),
+		memberPod("lbnodeagent-b", "node-b", corev1.PodPending),
+		memberPod("lbnodeagent-c", "node-c", corev1.PodFailed),
+		deleting,
+		memberPod("lbnodeagent-e", "", corev1.PodPending), // not scheduled
+	} {
+		assert.NoError(t, c.podIndexer.Add(pod))
+	}
+	synced = true
+	nodes, known := c.MemberNodes()
+	assert.True(t, known)
+	assert.Equal(t, map[string]bool{"node-a": true, "node-b": true}, nodes)
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderConfig configures leader election among replicas of a
+// process.
+type LeaderConfig struct {
+	// Namespace and Name identify the coordination.k8s.io Lease that
+	// the replicas compete for.
+	Namespace string
+	Name      string
+
+	// Identity uniquely identifies this replica, e.g., its pod name.
+	Identity string
+
+	// LeaseDuration, RenewDeadline, and RetryPeriod are passed to
+	// client-go's leader elector. See leaderelection.LeaderElectionConfig
+	// for details.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	// StartedLeading is called when this replica becomes the leader
+	// and StoppedLeading is called when it stops being the leader.
+	StartedLeading func()
+	StoppedLeading func()
+}
+
+// RunLeaderElection competes for leadership until stopCh is
+// closed. If this replica loses the lease it goes back to competing
+// for it, so it can take over again if the new leader fails.
+func (c *Client) RunLeaderElection(cfg LeaderConfig, stopCh <-chan struct{}) error {
+	lock := &failoverLock{
+		Interface: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: cfg.Namespace,
+				Name:      cfg.Name,
+			},
+			Client:     c.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				c.logger.Log("op", "leaderElection", "msg", "started leading", "identity", cfg.Identity)
+				isLeader.Set(1)
+				cfg.StartedLeading()
+			},
+			OnStoppedLeading: func() {
+				c.logger.Log("op", "leaderElection", "msg", "stopped leading", "identity", cfg.Identity)
+				isLeader.Set(0)
+				cfg.StoppedLeading()
+			},
+			OnNewLeader: func(identity string) {
+				c.logger.Log("op", "leaderElection", "msg", "new leader", "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Run returns when we lose the lease so we loop until we're told
+	// to stop
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+
+	return nil
+}
+
+// failoverLock wraps a resourcelock.Interface so we can measure how
+// long it takes for a new leader to take over from the old one. It
+// remembers the most recent record that it read, and when this
+// replica updates the record to take over the lease, the difference
+// between the old leader's last renewal and our acquisition is the
+// time during which there was no leader.
+type failoverLock struct {
+	resourcelock.Interface
+
+	observed *resourcelock.LeaderElectionRecord
+}
+
+// Get reads the lock record and remembers it.
+func (l *failoverLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	record, raw, err := l.Interface.Get(ctx)
+	if err == nil {
+		observed := *record
+		l.observed = &observed
+	}
+	return record, raw, err
+}
+
+// Update writes the lock record. If the write takes the lease from
+// another holder then we report the failover.
+func (l *failoverLock) Update(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	if err := l.Interface.Update(ctx, record); err != nil {
+		return err
+	}
+
+	if l.observed != nil && l.observed.HolderIdentity != record.HolderIdentity && record.HolderIdentity == l.Identity() {
+		leaderTransitions.Inc()
+		failoverDuration.Observe(record.AcquireTime.Sub(l.observed.RenewTime.Time).Seconds())
+	}
+	observed := record
+	l.observed = &observed
+
+	return nil
+}
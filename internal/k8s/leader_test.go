@@ -0,0 +1,78 @@
+// Copyright 2021 Acnodal Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// testLock is an in-memory resourcelock.Interface.
+type testLock struct {
+	identity string
+	record   resourcelock.LeaderElectionRecord
+}
+
+func (l *testLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	record := l.record
+	return &record, nil, nil
+}
+
+func (l *testLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.record = ler
+	return nil
+}
+
+func (l *testLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.record = ler
+	return nil
+}
+
+func (l *testLock) RecordEvent(string) {}
+
+func (l *testLock) Identity() string {
+	return l.identity
+}
+
+func (l *testLock) Describe() string {
+	return "test"
+}
+
+func TestFailoverLock(t *testing.T) {
+	now := time.Now()
+	oldRenew := metav1.NewTime(now.Add(-20 * time.Second))
+	lock := &failoverLock{Interface: &testLock{
+		identity: "standby",
+		record:   resourcelock.LeaderElectionRecord{HolderIdentity: "leader", AcquireTime: oldRenew, RenewTime: oldRenew},
+	}}
+	takeovers := testutil.ToFloat64(leaderTransitions)
+
+	// The standby sees the old leader's record and then takes over
+	_, _, err := lock.Get(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Update(context.TODO(), resourcelock.LeaderElectionRecord{HolderIdentity: "standby", AcquireTime: metav1.NewTime(now), RenewTime: metav1.NewTime(now)}))
+	assert.Equal(t, takeovers+1, testutil.ToFloat64(leaderTransitions), "takeover wasn't counted")
+
+	// Renewing the lease isn't a takeover
+	_, _, err = lock.Get(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Update(context.TODO(), resourcelock.LeaderElectionRecord{HolderIdentity: "standby", AcquireTime: metav1.NewTime(now), RenewTime: metav1.NewTime(now.Add(2 * time.Second))}))
+	assert.Equal(t, takeovers+1, testutil.ToFloat64(leaderTransitions), "renewal was counted as a takeover")
+}
@@ -48,12 +48,37 @@ var (
 		Name:      "config_loaded_bool",
 		Help:      "1 if the PureLB configuration was successfully loaded at least once.",
 	})
+
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "leader_election",
+		Name:      "is_leader",
+		Help:      "1 if this replica currently holds the leader lease.",
+	})
+
+	leaderTransitions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "leader_election",
+		Name:      "takeovers_total",
+		Help:      "Number of times this replica took the leader lease from another replica.",
+	})
+
+	failoverDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "leader_election",
+		Name:      "failover_duration_seconds",
+		Help:      "Time between the old leader's last lease renewal and this replica's takeover.",
+		Buckets:   []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 120},
+	})
 )
 
 func init() {
 	prometheus.MustRegister(updates)
 	prometheus.MustRegister(updateErrors)
 	prometheus.MustRegister(configLoaded)
+	prometheus.MustRegister(isLeader)
+	prometheus.MustRegister(leaderTransitions)
+	prometheus.MustRegister(failoverDuration)
 }
 
 // RunMetrics runs the metrics server. It doesn't ever return.
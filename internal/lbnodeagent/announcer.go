@@ -31,5 +31,41 @@ type Announcer interface {
 	SetBalancer(*v1.Service, *v1.Endpoints) error
 	DeleteBalancer(string, string, net.IP) error
 	SetElection(*election.Election)
+
+	// ReportStatus adds the announcer's view of this node to the
+	// provided status.
+	ReportStatus(*purelbv1.LBNodeAgentNodeStatus)
+
 	Shutdown()
 }
+
+// NodeHasHealthyEndpoint returns true if node has at least one
+// healthy endpoint. Announcers use it to decide whether to announce
+// services whose externalTrafficPolicy is Local.
+func NodeHasHealthyEndpoint(eps *v1.Endpoints, node string) bool {
+	ready := map[string]bool{}
+	for _, subset := range eps.Subsets {
+		for _, ep := range subset.Addresses {
+			if ep.NodeName == nil || *ep.NodeName != node {
+				continue
+			}
+			if _, ok := ready[ep.IP]; !ok {
+				// Only set true if nothing else has expressed an
+				// opinion. This means that false will take precedence
+				// if there's any unready ports for a given endpoint.
+				ready[ep.IP] = true
+			}
+		}
+		for _, ep := range subset.NotReadyAddresses {
+			ready[ep.IP] = false
+		}
+	}
+
+	for _, r := range ready {
+		if r {
+			// At least one fully healthy endpoint on this node
+			return true
+		}
+	}
+	return false
+}
@@ -18,10 +18,17 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"purelb.io/internal/election"
+	"purelb.io/internal/gratuitous"
 	"purelb.io/internal/k8s"
 	"purelb.io/internal/lbnodeagent"
 	purelbv1 "purelb.io/pkg/apis/v1"
@@ -50,6 +57,35 @@ type announcer struct {
 	// localNameRegex is the pattern that we use to determine if an
 	// interface is local or not.
 	localNameRegex *regexp.Regexp
+
+	// announced holds the addresses that we're currently announcing,
+	// keyed by address. It's used to report our status.
+	announced map[string]*purelbv1.LBNodeAgentAnnouncement
+
+	// announceErrors holds the most recent announcement error for each
+	// service that we failed to announce, keyed by namespaced name.
+	announceErrors map[string]string
+
+	// bursts holds a stop channel for each address for which we've
+	// started a burst of gratuitous ARPs or neighbor advertisements,
+	// keyed by address. Closing the channel cancels the rest of the
+	// burst.
+	bursts map[string]chan struct{}
+
+	// preempting holds the time at which we started waiting to take
+	// each address from the node that owns it, keyed by address. We
+	// take the address once we've waited for the PreemptionDelay.
+	preempting map[string]time.Time
+
+	// selectorKeys holds the label keys that each service's node
+	// selector uses, keyed by namespaced name. We publish the node's
+	// labels with those keys, and the keys that the groups' selectors
+	// use, so the other nodes can run the same elections.
+	selectorKeys map[string][]string
+
+	// lock serializes access to the announcer by the k8s client and
+	// the status reporter.
+	lock sync.Mutex
 }
 
 var announcing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -63,13 +99,50 @@ var announcing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	"ip",
 })
 
+var gratuitousSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: purelbv1.MetricsNamespace,
+	Subsystem: "lbnodeagent",
+	Name:      "gratuitous_sent_total",
+	Help:      "Gratuitous ARPs and unsolicited neighbor advertisements sent from this node",
+}, []string{
+	"ip",
+})
+
+var gratuitousErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: purelbv1.MetricsNamespace,
+	Subsystem: "lbnodeagent",
+	Name:      "gratuitous_errors_total",
+	Help:      "Gratuitous ARPs and unsolicited neighbor advertisements that this node failed to send",
+}, []string{
+	"ip",
+})
+
+const (
+	// defaultGratuitousCount and defaultGratuitousInterval describe
+	// the burst of announcements that we send when we take over a
+	// local address if the LBNodeAgent doesn't say otherwise.
+	defaultGratuitousCount    = 3
+	defaultGratuitousInterval = time.Second
+)
+
 func init() {
 	prometheus.MustRegister(announcing)
+	prometheus.MustRegister(gratuitousSent)
+	prometheus.MustRegister(gratuitousErrors)
 }
 
 // NewAnnouncer returns a new local Announcer.
 func NewAnnouncer(l log.Logger, node string) lbnodeagent.Announcer {
-	return &announcer{logger: l, myNode: node, svcIngresses: map[string][]v1.LoadBalancerIngress{}}
+	return &announcer{
+		logger:         l,
+		myNode:         node,
+		svcIngresses:   map[string][]v1.LoadBalancerIngress{},
+		announced:      map[string]*purelbv1.LBNodeAgentAnnouncement{},
+		announceErrors: map[string]string{},
+		bursts:         map[string]chan struct{}{},
+		preempting:     map[string]time.Time{},
+		selectorKeys:   map[string][]string{},
+	}
 }
 
 // SetClient configures this announcer to use the provided client.
@@ -78,6 +151,8 @@ func (a *announcer) SetClient(client *k8s.Client) {
 }
 
 func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
 	// the default is nil which means that we don't announce
 	a.config = nil
@@ -95,23 +170,18 @@ func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
 					a.groups[group.ObjectMeta.Name] = group.Spec.Local
 				}
 			}
+			a.publishLabelKeys()
 
 			// if the user specified an interface regex then we'll compile
 			// that now, and use it (when we get an address) to find a local
 			// interface
-			if spec.LocalInterface != "default" {
-				if regex, err := regexp.Compile(spec.LocalInterface); err != nil {
-					return fmt.Errorf("error compiling regex \"%s\": %s", spec.LocalInterface, err.Error())
-				} else {
-					a.localNameRegex = regex
-				}
-			} else {
-				a.localNameRegex = nil
-
+			regex, err := localInterfaceRegex(spec.LocalInterface)
+			if err != nil {
+				return err
 			}
+			a.localNameRegex = regex
 
 			// now that we've got a config we can create the dummy interface
-			var err error
 			if a.dummyInt, err = addDummyInterface(spec.ExtLBInterface); err != nil {
 				return fmt.Errorf("error adding interface \"%s\": %s", spec.ExtLBInterface, err.Error())
 			}
@@ -129,7 +199,71 @@ func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
 	return nil
 }
 
+// ValidateAgentSpec checks that spec is a configuration that the
+// announcer can use. It's used by the admission webhook so users find
+// out about bad LBNodeAgents when they create them instead of when
+// the lbnodeagents try to load them.
+func ValidateAgentSpec(spec *purelbv1.LBNodeAgentLocalSpec) error {
+	if _, err := localInterfaceRegex(spec.LocalInterface); err != nil {
+		return err
+	}
+
+	// Linux interface names are at most 15 characters and can't contain
+	// slashes or whitespace
+	if spec.ExtLBInterface == "" {
+		return fmt.Errorf("extlbint must not be empty")
+	}
+	if len(spec.ExtLBInterface) > 15 {
+		return fmt.Errorf("extlbint \"%s\" is longer than 15 characters", spec.ExtLBInterface)
+	}
+	if strings.ContainsAny(spec.ExtLBInterface, "/ \t\n") {
+		return fmt.Errorf("extlbint \"%s\" is not a valid interface name", spec.ExtLBInterface)
+	}
+
+	if spec.GratuitousCount != nil && *spec.GratuitousCount < 0 {
+		return fmt.Errorf("gratuitousCount %d is negative", *spec.GratuitousCount)
+	}
+	if spec.GratuitousInterval != nil && spec.GratuitousInterval.Duration <= 0 {
+		return fmt.Errorf("gratuitousInterval %s is not positive", spec.GratuitousInterval.Duration)
+	}
+	if spec.PreemptionDelay != nil && spec.PreemptionDelay.Duration < 0 {
+		return fmt.Errorf("preemptionDelay %s is negative", spec.PreemptionDelay.Duration)
+	}
+
+	return nil
+}
+
+// gratuitousBurst returns the number of announcements to send when
+// we take over a local address and the time between them.
+func gratuitousBurst(spec *purelbv1.LBNodeAgentLocalSpec) (int, time.Duration) {
+	count := defaultGratuitousCount
+	if spec.GratuitousCount != nil {
+		count = *spec.GratuitousCount
+	}
+	interval := defaultGratuitousInterval
+	if spec.GratuitousInterval != nil {
+		interval = spec.GratuitousInterval.Duration
+	}
+	return count, interval
+}
+
+// localInterfaceRegex compiles the localint regex. It returns nil if
+// the user asked for the "default" interface.
+func localInterfaceRegex(localint string) (*regexp.Regexp, error) {
+	if localint == "default" {
+		return nil, nil
+	}
+	regex, err := regexp.Compile(localint)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling regex \"%s\": %s", localint, err.Error())
+	}
+	return regex, nil
+}
+
 func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	// retErr caches an error while we try other operations. Because we
 	// might have more than one interface to announce, if an error
 	// happens on the first one we still want to try the second. Instead
@@ -164,7 +298,7 @@ func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error
 			lbIPNet, localif, err := findLocal(a.localNameRegex, lbIP)
 			if err == nil {
 				// We found a local interface, announce the address on it
-				if err := a.announceLocal(svc, localif, lbIP, lbIPNet); err != nil {
+				if err := a.announceLocal(svc, endpoints, localif, lbIP, lbIPNet); err != nil {
 					retErr = err
 				}
 			} else {
@@ -185,7 +319,7 @@ func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error
 			if lbIPNet, defaultif, err := checkLocal(announceInt, lbIP); err == nil {
 				// The default interface is a local interface, announce the
 				// address on it
-				if err := a.announceLocal(svc, defaultif, lbIP, lbIPNet); err != nil {
+				if err := a.announceLocal(svc, endpoints, defaultif, lbIP, lbIPNet); err != nil {
 					retErr = err
 				}
 			} else {
@@ -197,26 +331,48 @@ func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error
 		}
 	}
 
+	// Remember the most recent error so we can report it in our
+	// status
+	if retErr != nil {
+		a.announceErrors[nsName] = retErr.Error()
+	} else {
+		delete(a.announceErrors, nsName)
+	}
+
 	// Return the most recent error
 	return retErr
 }
 
-func (a *announcer) announceLocal(svc *v1.Service, announceInt netlink.Link, lbIP net.IP, lbIPNet net.IPNet) error {
+func (a *announcer) announceLocal(svc *v1.Service, endpoints *v1.Endpoints, announceInt netlink.Link, lbIP net.IP, lbIPNet net.IPNet) error {
 	l := log.With(a.logger, "service", svc.Name)
 	nsName := svc.Namespace + "/" + svc.Name
 
-	// Local addresses do not support ExternalTrafficPolicyLocal
-	// Set the service back to ExternalTrafficPolicyCluster if adding to local interface
-	//if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
-	//	l.Log("op", "setBalancer", "error", "ExternalTrafficPolicy Local not supported on local Interfaces, setting to Cluster")
-	//	svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
-	//	if err := a.deleteAddress(nsName, "ClusterLocal", lbIP); err != nil {
-	//		return err
-	//	}
-	//}
+	// Only the nodes that the service's selector allows can win
+	selector, err := a.nodeSelector(svc)
+	if err != nil {
+		a.client.Errorf(svc, "BadNodeSelector", "Invalid node selector: %s", err)
+		return err
+	}
+	a.selectorKeys[nsName] = labelKeys(selector)
+	a.publishLabelKeys()
+
+	// If externalTrafficPolicy is Local then only nodes with a ready
+	// endpoint can win, otherwise traffic would reach a node that
+	// would drop it. The endpoints cover every node so each node runs
+	// the same election, and when the endpoints move the address
+	// moves with them.
+	var eligible func(string) bool
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		eligible = func(node string) bool {
+			return lbnodeagent.NodeHasHealthyEndpoint(endpoints, node)
+		}
+	}
 
-	// We can announce the address if we win the election
-	if winner := a.election.Winner(lbIP.String()); winner == a.myNode {
+	// We can announce the address if we win the election, but if
+	// another node already owns it then it might keep it
+	winner := a.election.Winner(lbIP.String(), selector, eligible)
+	winner = a.stickyWinner(l, lbIP.String(), winner, selector, eligible)
+	if winner == a.myNode {
 
 		// we won the election so we'll add the service address to our
 		// node's default interface so linux will respond to ARP
@@ -224,7 +380,17 @@ func (a *announcer) announceLocal(svc *v1.Service, announceInt netlink.Link, lbI
 		l.Log("msg", "Winner, winner, Chicken dinner", "node", a.myNode, "service", nsName, "memberCount", a.election.Memberlist.NumMembers())
 		a.client.Infof(svc, "AnnouncingLocal", "Node %s announcing %s on interface %s", a.myNode, lbIP, announceInt.Attrs().Name)
 
+		// If we weren't already announcing the address on this
+		// interface then we've just taken it over, possibly from
+		// another node, so we need to tell the network
+		announcement, announced := a.announced[lbIP.String()]
+		takeover := !announced || announcement.Interface != announceInt.Attrs().Name
+
 		addNetwork(lbIPNet, announceInt)
+		a.addAnnouncement(nsName, lbIP, announceInt.Attrs().Name, purelbv1.AnnouncementLocal)
+		if takeover {
+			a.announceGratuitous(l, announceInt, lbIP)
+		}
 		if svc.Annotations == nil {
 			svc.Annotations = map[string]string{}
 		}
@@ -237,6 +403,13 @@ func (a *announcer) announceLocal(svc *v1.Service, announceInt netlink.Link, lbI
 
 	} else {
 
+		// If no node could win, e.g., because no node has a ready
+		// endpoint, then nobody announces
+		if winner == "" {
+			l.Log("msg", "noEligibleNodes", "node", a.myNode, "service", nsName, "memberCount", a.election.Memberlist.NumMembers())
+			return a.deleteAddress(nsName, "noEligibleNodes", lbIP)
+		}
+
 		// We lost the election so we'll withdraw any announcement that
 		// we might have been making
 		l.Log("msg", "notWinner", "node", a.myNode, "winner", winner, "service", nsName, "memberCount", a.election.Memberlist.NumMembers())
@@ -246,6 +419,115 @@ func (a *announcer) announceLocal(svc *v1.Service, announceInt netlink.Link, lbI
 	return nil
 }
 
+// nodeSelector returns the selector that limits the nodes that can
+// announce svc's local addresses. The service's
+// NodeSelectorAnnotation overrides its group's NodeSelector. If
+// neither is set then every node can announce.
+func (a *announcer) nodeSelector(svc *v1.Service) (labels.Selector, error) {
+	if raw, exists := svc.Annotations[purelbv1.NodeSelectorAnnotation]; exists {
+		return labels.Parse(raw)
+	}
+
+	if group, exists := a.groups[svc.Annotations[purelbv1.PoolAnnotation]]; exists && group.NodeSelector != nil {
+		return metav1.LabelSelectorAsSelector(group.NodeSelector)
+	}
+
+	return labels.Everything(), nil
+}
+
+// labelKeys returns the label keys that selector uses.
+func labelKeys(selector labels.Selector) []string {
+	requirements, _ := selector.Requirements()
+	keys := []string{}
+	for _, requirement := range requirements {
+		keys = append(keys, requirement.Key())
+	}
+	return keys
+}
+
+// publishLabelKeys tells the election which of our node's labels the
+// node selectors use, so it can publish them. The caller must hold
+// a.lock.
+func (a *announcer) publishLabelKeys() {
+	if a.election == nil {
+		return
+	}
+
+	unique := map[string]bool{}
+	for _, group := range a.groups {
+		if group.NodeSelector == nil {
+			continue
+		}
+		// Bad selectors are reported when services use them
+		if selector, err := metav1.LabelSelectorAsSelector(group.NodeSelector); err == nil {
+			for _, key := range labelKeys(selector) {
+				unique[key] = true
+			}
+		}
+	}
+	for _, keys := range a.selectorKeys {
+		for _, key := range keys {
+			unique[key] = true
+		}
+	}
+
+	keys := []string{}
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	a.election.SetLabelKeys(keys)
+}
+
+// stickyWinner returns the node that should announce the local
+// address represented by key, given that winner won its election. If
+// another node already owns the address then it keeps it if we're
+// non-preemptive, or until winner has waited for the preemption
+// delay. The caller must hold a.lock.
+func (a *announcer) stickyWinner(l log.Logger, key string, winner string, selector labels.Selector, eligible func(string) bool) string {
+	if winner == "" {
+		delete(a.preempting, key)
+		return winner
+	}
+
+	owner := a.election.Owner(key, selector, eligible)
+	if owner == "" || owner == winner {
+		delete(a.preempting, key)
+		return winner
+	}
+
+	// Another node owns the address. It keeps it unless we're the
+	// winner and we've waited long enough. The owner gives the address
+	// up when it sees that we've claimed it.
+	if a.config.NonPreemptive || winner != a.myNode {
+		delete(a.preempting, key)
+		return owner
+	}
+
+	delay := time.Duration(0)
+	if a.config.PreemptionDelay != nil {
+		delay = a.config.PreemptionDelay.Duration
+	}
+	since, waiting := a.preempting[key]
+	if !waiting {
+		since = time.Now()
+		a.preempting[key] = since
+		if delay > 0 {
+			l.Log("msg", "preemptionDelayed", "node", a.myNode, "owner", owner, "ip", key, "delay", delay)
+			// Nothing else might happen to make us check again so we
+			// need to remind ourselves
+			time.AfterFunc(delay, a.client.ForceSync)
+		}
+	}
+	if time.Since(since) < delay {
+		return owner
+	}
+
+	delete(a.preempting, key)
+	l.Log("msg", "preempting", "node", a.myNode, "owner", owner, "ip", key)
+	return winner
+}
+
 func (a *announcer) announceRemote(svc *v1.Service, endpoints *v1.Endpoints, announceInt *netlink.Link, lbIP net.IP) error {
 	l := log.With(a.logger, "service", svc.Name)
 	nsName := svc.Namespace + "/" + svc.Name
@@ -256,7 +538,7 @@ func (a *announcer) announceRemote(svc *v1.Service, endpoints *v1.Endpoints, ann
 	// Should we announce?
 	// No, if externalTrafficPolicy is Local && there's no ready local endpoint
 	// Yes, in all other cases
-	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !nodeHasHealthyEndpoint(endpoints, a.myNode) {
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !lbnodeagent.NodeHasHealthyEndpoint(endpoints, a.myNode) {
 		l.Log("msg", "policyLocalNoEndpoints", "node", a.myNode, "service", nsName)
 		return a.deleteAddress(nsName, "noEndpoints", lbIP)
 	}
@@ -265,18 +547,20 @@ func (a *announcer) announceRemote(svc *v1.Service, endpoints *v1.Endpoints, ann
 	// (e.g., bird) will announce routes for it
 	poolName, gotName := svc.Annotations[purelbv1.PoolAnnotation]
 	if gotName {
-		allocPool := a.groups[poolName]
+		allocPool, knownPool := a.groups[poolName]
+		if !knownPool {
+			return fmt.Errorf("unknown ServiceGroup %s on service %s", poolName, nsName)
+		}
 		l.Log("msg", "announcingNonLocal", "node", a.myNode, "service", nsName)
 		a.client.Infof(svc, "AnnouncingNonLocal", "Announcing %s from node %s interface %s", lbIP, a.myNode, (*a.dummyInt).Attrs().Name)
-		family := AddrFamily(lbIP)
-		subnet, err := allocPool.FamilySubnet(family)
+		addrPool, err := allocPool.AddressPool(lbIP)
 		if err != nil {
+			return err
 		}
-		aggregation, err := allocPool.FamilyAggregation(family)
-		if err != nil {
+		if err := addVirtualInt(lbIP, *a.dummyInt, addrPool.Subnet, addrPool.Aggregation); err != nil {
 			return err
 		}
-		addVirtualInt(lbIP, *a.dummyInt, subnet, aggregation)
+		a.addAnnouncement(nsName, lbIP, (*a.dummyInt).Attrs().Name, purelbv1.AnnouncementRemote)
 		announcing.With(prometheus.Labels{
 			"service": nsName,
 			"node":    a.myNode,
@@ -296,7 +580,18 @@ func (a *announcer) announceRemote(svc *v1.Service, endpoints *v1.Endpoints, ann
 // calls to DeleteBalancer with services that weren't in the svcAdvs
 // map, so the service's address wasn't removed. For now, this is a
 // "belt and suspenders" double-check.
-func (a *announcer) DeleteBalancer(nsName, reason string, _ net.IP) error {
+func (a *announcer) DeleteBalancer(nsName, reason string, addr net.IP) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.deleteBalancer(nsName, reason, addr)
+}
+
+// deleteBalancer implements DeleteBalancer. The caller must hold
+// a.lock.
+func (a *announcer) deleteBalancer(nsName, reason string, _ net.IP) error {
+	delete(a.announceErrors, nsName)
+
 	ingress, knowAboutIt := a.svcIngresses[nsName]
 	if !knowAboutIt {
 		a.logger.Log("msg", "Unknown LB, can't delete", "name", nsName)
@@ -305,6 +600,10 @@ func (a *announcer) DeleteBalancer(nsName, reason string, _ net.IP) error {
 
 	// delete this service from our announcement database
 	delete(a.svcIngresses, nsName)
+	if _, hadSelector := a.selectorKeys[nsName]; hadSelector {
+		delete(a.selectorKeys, nsName)
+		a.publishLabelKeys()
+	}
 
 	for _, ingress := range ingress {
 		lbIP := net.ParseIP(ingress.IP)
@@ -312,6 +611,7 @@ func (a *announcer) DeleteBalancer(nsName, reason string, _ net.IP) error {
 			return fmt.Errorf("invalid LoadBalancer IP: %s, belongs to %s", ingress.IP, nsName)
 		}
 		a.deleteAddress(nsName, reason, lbIP)
+		delete(a.preempting, lbIP.String())
 	}
 	return nil
 }
@@ -337,6 +637,7 @@ func (a *announcer) deleteAddress(nsName, reason string, svcAddr net.IP) error {
 		for _, announcedAddr := range announcedAddrs {
 			if announcedAddr.IP == svcAddr.String() && otherSvc != nsName {
 				a.logger.Log("event", "withdrawAnnouncement", "service", nsName, "reason", reason, "msg", "ip in use by other service", "other", otherSvc)
+				a.removeAnnouncement(nsName, svcAddr)
 				return nil
 			}
 		}
@@ -344,6 +645,9 @@ func (a *announcer) deleteAddress(nsName, reason string, svcAddr net.IP) error {
 
 	a.logger.Log("event", "withdrawAddress", "ip", svcAddr, "service", nsName, "reason", reason)
 	deleteAddr(svcAddr)
+	delete(a.announced, svcAddr.String())
+	a.stopGratuitous(svcAddr)
+	a.publishOwned()
 
 	return nil
 }
@@ -351,9 +655,12 @@ func (a *announcer) deleteAddress(nsName, reason string, svcAddr net.IP) error {
 // Shutdown cleans up changes that we've made to the local networking
 // configuration.
 func (a *announcer) Shutdown() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	// withdraw any announcements that we have made
 	for nsName := range a.svcIngresses {
-		if err := a.DeleteBalancer(nsName, "shutdown", nil); err != nil {
+		if err := a.deleteBalancer(nsName, "shutdown", nil); err != nil {
 			a.logger.Log("op", "shutdown", "error", err)
 		}
 	}
@@ -366,34 +673,152 @@ func (a *announcer) SetElection(election *election.Election) {
 	a.election = election
 }
 
-// nodeHasHealthyEndpoint returns true if node has at least one
-// healthy endpoint.
-func nodeHasHealthyEndpoint(eps *v1.Endpoints, node string) bool {
-	ready := map[string]bool{}
-	for _, subset := range eps.Subsets {
-		for _, ep := range subset.Addresses {
-			if ep.NodeName == nil || *ep.NodeName != node {
-				continue
-			}
-			if _, ok := ready[ep.IP]; !ok {
-				// Only set true if nothing else has expressed an
-				// opinion. This means that false will take precedence
-				// if there's any unready ports for a given endpoint.
-				ready[ep.IP] = true
-			}
+// ReportStatus adds this announcer's view of the node to status.
+func (a *announcer) ReportStatus(status *purelbv1.LBNodeAgentNodeStatus) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// if we haven't been configured then we're not doing anything
+	if a.config == nil {
+		return
+	}
+
+	status.LocalInterfaces = append(status.LocalInterfaces, localInterfaceNames(a.localNameRegex)...)
+
+	if a.dummyInt != nil {
+		name := (*a.dummyInt).Attrs().Name
+		status.DummyInterface = &purelbv1.LBNodeAgentInterfaceStatus{Name: name, Up: interfaceUp(name)}
+	}
+
+	for _, announcement := range a.announced {
+		status.Announcements = append(status.Announcements, *announcement.DeepCopy())
+	}
+	sort.Slice(status.Announcements, func(i, j int) bool {
+		return status.Announcements[i].Address < status.Announcements[j].Address
+	})
+
+	if a.election != nil && a.election.Memberlist != nil {
+		for _, member := range a.election.Memberlist.Members() {
+			status.Members = append(status.Members, member.Name)
 		}
-		for _, ep := range subset.NotReadyAddresses {
-			ready[ep.IP] = false
+		sort.Strings(status.Members)
+	}
+
+	for nsName, msg := range a.announceErrors {
+		status.Errors = append(status.Errors, purelbv1.LBNodeAgentAnnounceError{Service: nsName, Message: msg})
+	}
+	sort.Slice(status.Errors, func(i, j int) bool {
+		return status.Errors[i].Service < status.Errors[j].Service
+	})
+}
+
+// addAnnouncement records that we're announcing lbIP on intf on
+// behalf of nsName.
+func (a *announcer) addAnnouncement(nsName string, lbIP net.IP, intf string, announcementType string) {
+	defer a.publishOwned()
+
+	announcement, exists := a.announced[lbIP.String()]
+	if !exists {
+		announcement = &purelbv1.LBNodeAgentAnnouncement{Address: lbIP.String()}
+		a.announced[lbIP.String()] = announcement
+	}
+	announcement.Interface = intf
+	announcement.Type = announcementType
+
+	for _, svc := range announcement.Services {
+		if svc == nsName {
+			return
 		}
 	}
+	announcement.Services = append(announcement.Services, nsName)
+	sort.Strings(announcement.Services)
+}
 
-	for _, r := range ready {
-		if r {
-			// At least one fully healthy endpoint on this node
-			return true
+// publishOwned tells the other nodes which local addresses we're
+// announcing, so they can leave them with us. The caller must hold
+// a.lock.
+func (a *announcer) publishOwned() {
+	if a.election == nil {
+		return
+	}
+
+	owned := []string{}
+	for addr, announcement := range a.announced {
+		if announcement.Type == purelbv1.AnnouncementLocal {
+			owned = append(owned, addr)
 		}
 	}
-	return false
+	a.election.SetOwned(owned)
+}
+
+// removeAnnouncement records that we're no longer announcing lbIP on
+// behalf of nsName. Other services might still be using lbIP so we
+// might still be announcing it.
+func (a *announcer) removeAnnouncement(nsName string, lbIP net.IP) {
+	announcement, exists := a.announced[lbIP.String()]
+	if !exists {
+		return
+	}
+
+	services := []string{}
+	for _, svc := range announcement.Services {
+		if svc != nsName {
+			services = append(services, svc)
+		}
+	}
+	announcement.Services = services
+}
+
+// announceGratuitous starts a burst of gratuitous ARPs (IPv4) or
+// unsolicited neighbor advertisements (IPv6) that tell the switches
+// and routers on intf's network that lbIP is now on this node. The
+// burst runs in the background so it doesn't hold up the k8s
+// client. The caller must hold a.lock.
+func (a *announcer) announceGratuitous(l log.Logger, intf netlink.Link, lbIP net.IP) {
+	count, interval := gratuitousBurst(a.config)
+	if count == 0 {
+		return
+	}
+
+	// If a previous burst for this address is still running then we
+	// replace it
+	a.stopGratuitous(lbIP)
+
+	frame, err := gratuitous.Frame(intf.Attrs().HardwareAddr, lbIP)
+	if err != nil {
+		// Probably an interface that doesn't use Ethernet addresses
+		l.Log("op", "announceGratuitous", "interface", intf.Attrs().Name, "error", err)
+		return
+	}
+	sender, err := gratuitous.NewSender(intf.Attrs().Index)
+	if err != nil {
+		l.Log("op", "announceGratuitous", "interface", intf.Attrs().Name, "error", err)
+		gratuitousErrors.WithLabelValues(lbIP.String()).Inc()
+		return
+	}
+
+	stop := make(chan struct{})
+	a.bursts[lbIP.String()] = stop
+	go func() {
+		defer sender.Close()
+		gratuitous.Announce(sender, frame, count, interval, stop, func(err error) {
+			if err != nil {
+				l.Log("op", "announceGratuitous", "ip", lbIP, "interface", intf.Attrs().Name, "error", err)
+				gratuitousErrors.WithLabelValues(lbIP.String()).Inc()
+				return
+			}
+			gratuitousSent.WithLabelValues(lbIP.String()).Inc()
+		})
+	}()
+}
+
+// stopGratuitous cancels the burst of announcements for lbIP, if
+// there is one. The caller must hold a.lock.
+func (a *announcer) stopGratuitous(lbIP net.IP) {
+	if stop, running := a.bursts[lbIP.String()]; running {
+		close(stop)
+		delete(a.bursts, lbIP.String())
+	}
 }
 
 // addrFamilyName returns whether lbIP is an IPV4 or IPV6 address.
@@ -0,0 +1,131 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// The addresses are from TEST-NET-1 so they're not on any of the test
+// host's interfaces and withdrawing them doesn't touch the host.
+const (
+	sharedIP = "192.0.2.10"
+	otherIP  = "192.0.2.11"
+)
+
+// step is one change to the announcer's bookkeeping. If withdraw is
+// true then the service is deleted, otherwise it announces ip.
+type step struct {
+	service  string
+	ip       string
+	withdraw bool
+}
+
+func TestAnnouncementBookkeeping(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []step
+		expected []purelbv1.LBNodeAgentAnnouncement
+	}{
+		{
+			name:  "one service",
+			steps: []step{{service: "ns/a", ip: sharedIP}},
+			expected: []purelbv1.LBNodeAgentAnnouncement{
+				{Address: sharedIP, Interface: "eth0", Type: purelbv1.AnnouncementLocal, Services: []string{"ns/a"}},
+			},
+		},
+		{
+			name:  "announcing twice doesn't duplicate the service",
+			steps: []step{{service: "ns/a", ip: sharedIP}, {service: "ns/a", ip: sharedIP}},
+			expected: []purelbv1.LBNodeAgentAnnouncement{
+				{Address: sharedIP, Interface: "eth0", Type: purelbv1.AnnouncementLocal, Services: []string{"ns/a"}},
+			},
+		},
+		{
+			name:  "shared address lists both services",
+			steps: []step{{service: "ns/b", ip: sharedIP}, {service: "ns/a", ip: sharedIP}},
+			expected: []purelbv1.LBNodeAgentAnnouncement{
+				{Address: sharedIP, Interface: "eth0", Type: purelbv1.AnnouncementLocal, Services: []string{"ns/a", "ns/b"}},
+			},
+		},
+		{
+			name:  "removing one sharer keeps the address",
+			steps: []step{{service: "ns/a", ip: sharedIP}, {service: "ns/b", ip: sharedIP}, {service: "ns/a", withdraw: true}},
+			expected: []purelbv1.LBNodeAgentAnnouncement{
+				{Address: sharedIP, Interface: "eth0", Type: purelbv1.AnnouncementLocal, Services: []string{"ns/b"}},
+			},
+		},
+		{
+			name:     "removing the last sharer removes the address",
+			steps:    []step{{service: "ns/a", ip: sharedIP}, {service: "ns/b", ip: sharedIP}, {service: "ns/a", withdraw: true}, {service: "ns/b", withdraw: true}},
+			expected: nil,
+		},
+		{
+			name:     "removing the only service removes the address",
+			steps:    []step{{service: "ns/a", ip: sharedIP}, {service: "ns/a", withdraw: true}},
+			expected: nil,
+		},
+		{
+			name:  "removing one service leaves the others' addresses",
+			steps: []step{{service: "ns/a", ip: sharedIP}, {service: "ns/b", ip: otherIP}, {service: "ns/a", withdraw: true}},
+			expected: []purelbv1.LBNodeAgentAnnouncement{
+				{Address: otherIP, Interface: "eth0", Type: purelbv1.AnnouncementLocal, Services: []string{"ns/b"}},
+			},
+		},
+		{
+			name:     "removing an unknown service is harmless",
+			steps:    []step{{service: "ns/a", withdraw: true}},
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		a := NewAnnouncer(log.NewNopLogger(), "test-node").(*announcer)
+		a.config = &purelbv1.LBNodeAgentLocalSpec{}
+		a.localNameRegex = regexp.MustCompile("^no-such-interface$")
+
+		for _, step := range test.steps {
+			if step.withdraw {
+				assert.NoError(t, a.DeleteBalancer(step.service, "test", nil), test.name)
+				continue
+			}
+			a.svcIngresses[step.service] = []v1.LoadBalancerIngress{{IP: step.ip}}
+			a.addAnnouncement(step.service, net.ParseIP(step.ip), "eth0", purelbv1.AnnouncementLocal)
+		}
+
+		status := purelbv1.LBNodeAgentNodeStatus{}
+		a.ReportStatus(&status)
+		assert.Equal(t, test.expected, status.Announcements, test.name)
+	}
+}
+
+func TestReportStatusUnconfigured(t *testing.T) {
+	a := NewAnnouncer(log.NewNopLogger(), "test-node").(*announcer)
+	a.addAnnouncement("ns/a", net.ParseIP(sharedIP), "eth0", purelbv1.AnnouncementLocal)
+
+	// An announcer without a config isn't doing anything so it
+	// doesn't report anything
+	status := purelbv1.LBNodeAgentNodeStatus{}
+	a.ReportStatus(&status)
+	assert.Equal(t, purelbv1.LBNodeAgentNodeStatus{}, status)
+}
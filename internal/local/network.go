@@ -158,6 +158,29 @@ func defaultInterface(family int) (*netlink.Link, error) {
 	return &defaultint, err
 }
 
+// IsLocal determines whether lbIP belongs to the same network as one
+// of this node's local interfaces, i.e., whether the local announcer
+// announces it using ARP/ND instead of adding it to the dummy
+// interface. localint is the LBNodeAgent's localint setting.
+func IsLocal(localint string, lbIP net.IP) bool {
+	regex, err := localInterfaceRegex(localint)
+	if err != nil {
+		return false
+	}
+
+	if regex != nil {
+		_, _, err = findLocal(regex, lbIP)
+		return err == nil
+	}
+
+	announceInt, err := defaultInterface(AddrFamily(lbIP))
+	if err != nil {
+		return false
+	}
+	_, _, err = checkLocal(announceInt, lbIP)
+	return err == nil
+}
+
 // addNetwork adds lbIPNet to link.
 func addNetwork(lbIPNet net.IPNet, link netlink.Link) error {
 	addr, _ := netlink.ParseAddr(lbIPNet.String())
@@ -223,62 +246,79 @@ func deleteAddr(lbIP net.IP) error {
 	return nil
 }
 
+// addVirtualInt adds lbIP to link. The address's mask comes from
+// aggregation: "default" (or empty, which means the same thing) means
+// the subnet's mask, otherwise aggregation is a mask length like
+// "/24".
 func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) error {
 
 	lbIPNet := net.IPNet{IP: lbIP}
 
-	if aggregation == "default" {
-
-		switch AddrFamily(lbIP) {
-		case (nl.FAMILY_V4):
+	if aggregation == "" || aggregation == "default" {
 
-			_, poolipnet, _ := net.ParseCIDR(subnet)
-
-			lbIPNet.Mask = poolipnet.Mask
-
-			err := addNetwork(lbIPNet, link)
-			if err != nil {
-				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
-			}
-
-		case (nl.FAMILY_V6):
-
-			_, poolipnet, _ := net.ParseCIDR(subnet)
-
-			lbIPNet.Mask = poolipnet.Mask
-
-			err := addNetwork(lbIPNet, link)
-			if err != nil {
-				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
-			}
+		_, poolipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("could not add %v to %v: invalid subnet %q: %w", lbIP, link.Attrs().Name, subnet, err)
 		}
+		lbIPNet.Mask = poolipnet.Mask
 
 	} else {
 
-		switch AddrFamily(lbIP) {
-		case (nl.FAMILY_V4):
+		zero := "0.0.0.0"
+		if AddrFamily(lbIP) == nl.FAMILY_V6 {
+			zero = "::"
+		}
+		_, poolaggr, err := net.ParseCIDR(zero + aggregation)
+		if err != nil {
+			return fmt.Errorf("could not add %v to %v: invalid aggregation %q: %w", lbIP, link.Attrs().Name, aggregation, err)
+		}
+		lbIPNet.Mask = poolaggr.Mask
+	}
 
-			_, poolaggr, _ := net.ParseCIDR("0.0.0.0" + aggregation)
+	if err := addNetwork(lbIPNet, link); err != nil {
+		return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
+	}
 
-			lbIPNet.Mask = poolaggr.Mask
+	return nil
+}
 
-			err := addNetwork(lbIPNet, link)
-			if err != nil {
-				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
+// localInterfaceNames returns the names of the interfaces that we
+// consider for local announcements. If regex is non-nil then they're
+// the interfaces whose names match regex, otherwise they're the
+// interfaces that carry the default routes.
+func localInterfaceNames(regex *regexp.Regexp) []string {
+	names := []string{}
+
+	if regex != nil {
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return names
+		}
+		for _, intf := range interfaces {
+			if regex.MatchString(intf.Name) {
+				names = append(names, intf.Name)
 			}
+		}
+		return names
+	}
 
-		case (nl.FAMILY_V6):
-
-			_, poolaggr, _ := net.ParseCIDR("::" + aggregation)
-
-			lbIPNet.Mask = poolaggr.Mask
-
-			err := addNetwork(lbIPNet, link)
-			if err != nil {
-				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
+	for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+		if link, err := defaultInterface(family); err == nil {
+			name := (*link).Attrs().Name
+			if len(names) == 0 || names[0] != name {
+				names = append(names, name)
 			}
 		}
 	}
+	return names
+}
 
-	return nil
+// interfaceUp returns true if the interface called name exists and is
+// administratively up.
+func interfaceUp(name string) bool {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false
+	}
+	return link.Attrs().Flags&net.FlagUp != 0
 }
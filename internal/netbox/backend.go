@@ -0,0 +1,143 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netbox
+
+import (
+	"fmt"
+	"net"
+
+	"purelb.io/internal/ipam"
+)
+
+// backend adapts a connection to Netbox to ipam.Backend so the
+// allocator can allocate addresses from Netbox the same way that it
+// allocates them from any other IPAM system.
+type backend struct {
+	netbox *netbox
+}
+
+// NewBackend returns an ipam.Backend that allocates addresses from
+// the Netbox system that config describes. It's also an
+// ipam.Transferer and an ipam.Sizer.
+func NewBackend(config Config) ipam.Backend {
+	return &backend{netbox: NewNetbox(config).(*netbox)}
+}
+
+// Allocate fetches an address from Netbox, or claims address if it
+// isn't "".
+func (b *backend) Allocate(family int, address string, owner ipam.Owner) (string, error) {
+	var (
+		cidr string
+		err  error
+	)
+	if address == "" {
+		cidr, err = b.netbox.Fetch(family, Owner(owner))
+	} else {
+		cidr, err = b.netbox.Claim(address, Owner(owner))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ip, err := parseAddress(cidr)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// Release returns address to Netbox.
+func (b *backend) Release(address string) error {
+	return b.netbox.Release(address)
+}
+
+// Lookup describes address. Netbox doesn't record the addresses in
+// our prefixes until we allocate them so an address without a record
+// is free if it's in one of our prefixes. If another tenant or
+// cluster uses the address then we can't name its owner so we return
+// ipam.ErrUnavailable.
+func (b *backend) Lookup(address string) (ipam.Allocation, error) {
+	ip, err := parseAddress(address)
+	if err != nil {
+		return ipam.Allocation{}, err
+	}
+	allocation := ipam.Allocation{Address: ip.String()}
+
+	ctx, cancel := b.netbox.operation()
+	defer cancel()
+
+	records, err := b.netbox.lookup(ctx, address, "")
+	if err != nil {
+		return allocation, err
+	}
+	if len(records) == 0 {
+		prefixes, err := b.netbox.selectedPrefixes(ctx, 0)
+		if err != nil {
+			return allocation, err
+		}
+		for _, prefix := range prefixes {
+			if _, cidr, err := net.ParseCIDR(prefix.Prefix); err == nil && cidr.Contains(ip) {
+				return allocation, nil
+			}
+		}
+		return allocation, fmt.Errorf("%s isn't in Netbox: %w", address, ipam.ErrNotFound)
+	}
+
+	for _, record := range records {
+		if b.netbox.available(record) {
+			continue
+		}
+		owner, ours := b.netbox.parseOwner(record.Description)
+		if !ours || record.Tenant == nil || record.Tenant.Slug != b.netbox.config.Tenant {
+			return allocation, fmt.Errorf("%s is %s and isn't ours: %w", address, record.Status.Value, ipam.ErrUnavailable)
+		}
+		allocation.Owner = &ipam.Owner{Namespace: owner.Namespace, Name: owner.Name}
+	}
+	return allocation, nil
+}
+
+// Networks returns the networks that contain the addresses that we
+// could allocate.
+func (b *backend) Networks() ([]*net.IPNet, error) {
+	return b.netbox.Networks()
+}
+
+// List describes the addresses that we've allocated.
+func (b *backend) List() ([]ipam.Allocation, error) {
+	owned, err := b.netbox.Owned()
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := make([]ipam.Allocation, 0, len(owned))
+	for _, allocation := range owned {
+		allocations = append(allocations, ipam.Allocation{
+			Address: allocation.Address,
+			Owner:   &ipam.Owner{Namespace: allocation.Owner.Namespace, Name: allocation.Owner.Name},
+		})
+	}
+	return allocations, nil
+}
+
+// Transfer records in Netbox that owner now uses address.
+func (b *backend) Transfer(address string, owner ipam.Owner) error {
+	return b.netbox.SetOwner(address, Owner(owner))
+}
+
+// Capacity returns the number of addresses in the prefixes from which
+// we allocate.
+func (b *backend) Capacity(family int) (uint64, error) {
+	return b.netbox.Capacity(family)
+}
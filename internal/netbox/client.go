@@ -0,0 +1,294 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTimeout is how long we wait for Netbox to respond to a
+	// request if Config.Timeout isn't set.
+	defaultTimeout = 5 * time.Second
+
+	// defaultOperationTimeout is how long an operation can take if
+	// Config.OperationTimeout isn't set. The allocator holds its lock
+	// while it waits for Netbox so we keep this short.
+	defaultOperationTimeout = 10 * time.Second
+
+	// defaultRetryBackoff is how long we wait before we retry a failed
+	// request if Config.RetryBackoff isn't set. We double the wait
+	// after each attempt.
+	defaultRetryBackoff = 250 * time.Millisecond
+
+	// maxAttempts is the number of times that we try a request before
+	// we give up.
+	maxAttempts = 3
+
+	// maxErrorBody is the amount of an error response's body that we
+	// include in an Error.
+	maxErrorBody = 256
+)
+
+var (
+	// ErrAuthentication means that Netbox didn't accept our user
+	// token. Netbox redirects unauthenticated requests to its login
+	// page, even if they ask for JSON, so redirects mean this too.
+	ErrAuthentication = errors.New("Netbox authentication failed, check the user token")
+
+	// ErrConflict means that another client updated an address while
+	// we were allocating it, e.g., because two allocators tried to
+	// claim the same reserved address at the same time.
+	ErrConflict = errors.New("another Netbox client claimed the address")
+)
+
+// Error is the error that we return when Netbox responds to a request
+// with an HTTP status that indicates failure.
+type Error struct {
+	Op         string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *Error) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s: Netbox returned %s", e.Op, e.Status)
+	}
+	return fmt.Sprintf("%s: Netbox returned %s: %s", e.Op, e.Status, e.Body)
+}
+
+// statusCode returns the HTTP status code of err if it's an Error, or
+// 0 if it's not.
+func statusCode(err error) int {
+	var nbErr *Error
+	if errors.As(err, &nbErr) {
+		return nbErr.StatusCode
+	}
+	return 0
+}
+
+// operation returns the context of one Netbox operation, e.g.,
+// allocating an address, which can make several requests. It's done
+// when the operation has taken Config.OperationTimeout.
+func (n *netbox) operation() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), n.config.OperationTimeout)
+}
+
+// newHTTPClient returns an http.Client that doesn't follow redirects,
+// so we can see when Netbox redirects us to its login page. If
+// rootCAs isn't nil then the client uses them to verify Netbox's TLS
+// certificate.
+func newHTTPClient(rootCAs *x509.CertPool) http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	return http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// call sends a request to Netbox and returns the response's HTTP
+// status code. If body isn't nil then we send it as JSON, and if
+// result isn't nil then we decode the JSON response into it. path is
+// relative to the Netbox base URL unless it's absolute, e.g., a
+// pagination link.
+//
+// Each attempt times out after Config.Timeout, and we give up when
+// ctx, which covers the whole operation, is done. If Netbox fails with
+// a server error then we retry with exponential backoff, and we also
+// retry transport errors, except on POSTs since Netbox might have
+// acted on them. Status codes that indicate failure are returned as
+// *Error, except for those that mean that our user token is bad,
+// which are returned as ErrAuthentication.
+func (n *netbox) call(ctx context.Context, op string, method string, path string, query url.Values, body interface{}, result interface{}) (int, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	target := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		target = n.config.URL + path
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	backoff := n.config.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		status, retry, err := n.attempt(ctx, op, method, target, reqBody, result)
+		if !retry || attempt == maxAttempts {
+			return status, err
+		}
+		if deadline, set := ctx.Deadline(); set && time.Now().Add(backoff).After(deadline) {
+			return status, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attempt sends one request to Netbox. It returns the response's
+// HTTP status code, whether the request is worth retrying, and any
+// error.
+func (n *netbox) attempt(ctx context.Context, op string, method string, target string, reqBody []byte, result interface{}) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.config.Timeout)
+	defer cancel()
+
+	var reader io.Reader
+	if reqBody != nil {
+		reader = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("Authorization", "Token "+n.config.Token)
+
+	start := time.Now()
+	resp, err := n.http.Do(req)
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			requestDuration.WithLabelValues(op, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+			return n.response(op, resp, data, result)
+		}
+	}
+
+	requestDuration.WithLabelValues(op, "error").Observe(time.Since(start).Seconds())
+	reason := "transport"
+	if errors.Is(err, context.DeadlineExceeded) {
+		reason = "timeout"
+	}
+	requestErrors.WithLabelValues(op, reason).Inc()
+	return 0, method != http.MethodPost, fmt.Errorf("%s: %w", op, err)
+}
+
+// response interprets Netbox's response to a request.
+func (n *netbox) response(op string, resp *http.Response, data []byte, result interface{}) (int, bool, error) {
+	switch {
+	case resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode < http.StatusBadRequest,
+		resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		requestErrors.WithLabelValues(op, "authentication").Inc()
+		return resp.StatusCode, false, fmt.Errorf("%s: %w (%s)", op, ErrAuthentication, resp.Status)
+
+	case resp.StatusCode >= http.StatusInternalServerError:
+		requestErrors.WithLabelValues(op, "server").Inc()
+		return resp.StatusCode, true, n.statusError(op, resp, data)
+
+	case resp.StatusCode >= http.StatusBadRequest:
+		requestErrors.WithLabelValues(op, "client").Inc()
+		return resp.StatusCode, false, n.statusError(op, resp, data)
+	}
+
+	if result != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			requestErrors.WithLabelValues(op, "decode").Inc()
+			return resp.StatusCode, false, fmt.Errorf("%s: decoding Netbox response: %w", op, err)
+		}
+	}
+	return resp.StatusCode, false, nil
+}
+
+// statusError returns an *Error that describes resp.
+func (n *netbox) statusError(op string, resp *http.Response, data []byte) error {
+	body := strings.TrimSpace(string(data))
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody] + "..."
+	}
+	return &Error{Op: op, StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+}
+
+// page is one page of the results of a Netbox query.
+type page struct {
+	Count   int             `json:"count"`
+	Next    *string         `json:"next"`
+	Results json.RawMessage `json:"results"`
+}
+
+// list sends a query to Netbox and follows its "next" links until
+// it has fetched every page of the results. It calls each with the
+// results from each page.
+func (n *netbox) list(ctx context.Context, op string, path string, query url.Values, each func(json.RawMessage) error) error {
+	for path != "" {
+		results := page{}
+		if _, err := n.call(ctx, op, http.MethodGet, path, query, nil, &results); err != nil {
+			return err
+		}
+		if err := each(results.Results); err != nil {
+			return fmt.Errorf("%s: decoding Netbox response: %w", op, err)
+		}
+
+		// The next link includes the query
+		path, query = "", nil
+		if results.Next != nil {
+			path = *results.Next
+		}
+	}
+	return nil
+}
+
+// listAddresses returns every address that matches query.
+func (n *netbox) listAddresses(ctx context.Context, op string, query url.Values) ([]Address, error) {
+	addrs := []Address{}
+	err := n.list(ctx, op, addressesPath, query, func(results json.RawMessage) error {
+		found := []Address{}
+		if err := json.Unmarshal(results, &found); err != nil {
+			return err
+		}
+		addrs = append(addrs, found...)
+		return nil
+	})
+	return addrs, err
+}
+
+// listPrefixes returns every prefix that matches query.
+func (n *netbox) listPrefixes(ctx context.Context, op string, query url.Values) ([]Prefix, error) {
+	prefixes := []Prefix{}
+	err := n.list(ctx, op, prefixesPath, query, func(results json.RawMessage) error {
+		found := []Prefix{}
+		if err := json.Unmarshal(results, &found); err != nil {
+			return err
+		}
+		prefixes = append(prefixes, found...)
+		return nil
+	})
+	return prefixes, err
+}
@@ -1,33 +0,0 @@
-// Copyright 2021 Acnodal Inc.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-//      http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package fake
-
-import (
-	"purelb.io/internal/netbox"
-)
-
-type fakeNetbox struct{}
-
-// NewNetbox configures a new connection to a Netbox system.
-func NewNetbox(base string, tenant string, token string) netbox.Netbox {
-	return &fakeNetbox{}
-}
-
-// Fetch fetches an address from an imaginary Netbox. If the fetch is
-// successful then error will be nil and the returned string will
-// describe an address.
-func (n *fakeNetbox) Fetch() (string, error) {
-	return "10.1.2.3/32", nil
-}
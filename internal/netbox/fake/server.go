@@ -0,0 +1,511 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerAddress is the stand-in server's record of one IP address.
+type ServerAddress struct {
+	ID           int
+	Address      string
+	Status       string
+	Tenant       string
+	Description  string
+	DNSName      string
+	CustomFields map[string]interface{}
+}
+
+// ServerPrefix is the stand-in server's record of one prefix.
+type ServerPrefix struct {
+	ID     int
+	Prefix string
+	Role   string
+	Tag    string
+	IsPool bool
+}
+
+// Server is an in-memory stand-in for the parts of the Netbox REST
+// API that PureLB uses. It's meant for tests: create one with
+// NewServer, point a Netbox client at URL, and then inspect Addresses
+// to see what the client did.
+type Server struct {
+	*httptest.Server
+
+	// Token is the user token that requests must present.
+	Token string
+
+	// PageSize is the number of results per page that queries return
+	// if they don't specify a limit. If it's 0 then queries return all
+	// of their results in one page.
+	PageSize int
+
+	// Delay is how long the server waits before it handles each
+	// request.
+	Delay time.Duration
+
+	// Hook, if it's set, is called before the server handles each
+	// request. Tests can use it to simulate other Netbox clients.
+	Hook func(*http.Request)
+
+	lock      sync.Mutex
+	addresses map[int]*ServerAddress
+	prefixes  map[int]*ServerPrefix
+	nextID    int
+	failures  []int
+	requests  int
+}
+
+// NewServer starts a stand-in Netbox server that knows about no
+// addresses. Call Close when you're done with it.
+func NewServer(token string) *Server {
+	s := newServer(token)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// NewTLSServer starts a stand-in Netbox server that uses HTTPS. Its
+// certificate is signed by a CA whose certificate is in
+// Server.Certificate(). Call Close when you're done with it.
+func NewTLSServer(token string) *Server {
+	s := newServer(token)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func newServer(token string) *Server {
+	return &Server{
+		Token:     token,
+		addresses: map[int]*ServerAddress{},
+		prefixes:  map[int]*ServerPrefix{},
+		nextID:    1,
+	}
+}
+
+// BaseURL returns the URL to pass to netbox.NewNetbox.
+func (s *Server) BaseURL() string {
+	return s.URL + "/"
+}
+
+// AddAddress adds an address to the server's database. address
+// should be in CIDR notation, e.g., "192.168.1.1/32".
+func (s *Server) AddAddress(address string, status string, tenant string) *ServerAddress {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addr := &ServerAddress{ID: s.nextID, Address: address, Status: status, Tenant: tenant, CustomFields: map[string]interface{}{}}
+	s.addresses[addr.ID] = addr
+	s.nextID++
+	return addr
+}
+
+// AddPrefix adds a prefix to the server's database. Clients can
+// allocate addresses from it using its available-ips endpoint.
+func (s *Server) AddPrefix(prefix string, role string, tag string) *ServerPrefix {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := &ServerPrefix{ID: s.nextID, Prefix: prefix, Role: role, Tag: tag}
+	s.prefixes[p.ID] = p
+	s.nextID++
+	return p
+}
+
+// FailNext tells the server to fail the next count requests with an
+// HTTP status of status.
+func (s *Server) FailNext(count int, status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := 0; i < count; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// Requests returns the number of requests that the server has
+// received.
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.requests
+}
+
+// Address returns a copy of the server's record of address, or nil
+// if it doesn't have one.
+func (s *Server) Address(address string) *ServerAddress {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, addr := range s.addresses {
+		if addr.Address == address {
+			found := *addr
+			found.CustomFields = map[string]interface{}{}
+			for name, value := range addr.CustomFields {
+				found.CustomFields[name] = value
+			}
+			return &found
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.Delay)
+	if s.Hook != nil {
+		s.Hook(r)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests++
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Real Netbox redirects unauthenticated requests to its login page
+	if r.Header.Get("Authorization") != "Token "+s.Token {
+		http.Redirect(w, r, "/login/", http.StatusFound)
+		return
+	}
+
+	const (
+		addressesPath = "/api/ipam/ip-addresses/"
+		prefixesPath  = "/api/ipam/prefixes/"
+	)
+	if strings.HasPrefix(r.URL.Path, prefixesPath) {
+		s.servePrefixes(w, r, strings.TrimPrefix(r.URL.Path, prefixesPath))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, addressesPath) {
+		http.NotFound(w, r)
+		return
+	}
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, addressesPath), "/")
+
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.list(w, r)
+		case http.MethodPost:
+			s.create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	addr, exists := s.addresses[id]
+	if err != nil || !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, addr.json())
+	case http.MethodPatch:
+		patch := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr.update(patch)
+		writeJSON(w, http.StatusOK, addr.json())
+	case http.MethodDelete:
+		delete(s.addresses, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// update applies the fields in patch to addr.
+func (addr *ServerAddress) update(patch map[string]interface{}) {
+	if status, ok := patch["status"].(string); ok {
+		addr.Status = status
+	}
+	if description, ok := patch["description"].(string); ok {
+		addr.Description = description
+	}
+	if dnsName, ok := patch["dns_name"].(string); ok {
+		addr.DNSName = dnsName
+	}
+	if fields, ok := patch["custom_fields"].(map[string]interface{}); ok {
+		for name, value := range fields {
+			addr.CustomFields[name] = value
+		}
+	}
+	if tenant, ok := patch["tenant"].(map[string]interface{}); ok {
+		addr.Tenant, _ = tenant["slug"].(string)
+	}
+}
+
+// servePrefixes handles prefix queries and allocations from prefixes'
+// available-ips endpoints.
+func (s *Server) servePrefixes(w http.ResponseWriter, r *http.Request, rest string) {
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		results := []map[string]interface{}{}
+		for _, id := range sortedIDs(s.prefixes) {
+			p := s.prefixes[id]
+			if want := query.Get("id"); want != "" && want != strconv.Itoa(p.ID) {
+				continue
+			}
+			if want := query.Get("prefix"); want != "" && want != p.Prefix {
+				continue
+			}
+			if want := query.Get("role"); want != "" && want != p.Role {
+				continue
+			}
+			if want := query.Get("tag"); want != "" && want != p.Tag {
+				continue
+			}
+			results = append(results, p.json())
+		}
+		s.writePage(w, r, results)
+		return
+	}
+
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	p, exists := s.prefixes[id]
+	if err != nil || !exists || len(parts) != 2 || parts[1] != "available-ips" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := s.availableIP(p)
+	if ip == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"detail": "Insufficient space is available to accommodate the requested number of IP addresses"})
+		return
+	}
+	_, cidr, _ := net.ParseCIDR(p.Prefix)
+	ones, _ := cidr.Mask.Size()
+	addr := &ServerAddress{ID: s.nextID, Address: fmt.Sprintf("%s/%d", ip, ones), CustomFields: map[string]interface{}{}}
+	s.nextID++
+	addr.update(fields)
+	s.addresses[addr.ID] = addr
+	writeJSON(w, http.StatusCreated, addr.json())
+}
+
+// availableIP returns the first address in p that isn't in use, or
+// nil if they're all in use. Like Netbox, it skips the network and
+// broadcast addresses of IPV4 prefixes that aren't pools.
+func (s *Server) availableIP(p *ServerPrefix) net.IP {
+	_, cidr, err := net.ParseCIDR(p.Prefix)
+	if err != nil {
+		return nil
+	}
+	ones, bits := cidr.Mask.Size()
+	skipEnds := bits == 32 && !p.IsPool && ones < 31
+
+	used := map[string]bool{}
+	for _, addr := range s.addresses {
+		if ip, _, err := net.ParseCIDR(addr.Address); err == nil {
+			used[ip.String()] = true
+		}
+	}
+
+	ip := make(net.IP, len(cidr.IP))
+	copy(ip, cidr.IP)
+	for ; cidr.Contains(ip); ip = nextIP(ip) {
+		if skipEnds && (ip.Equal(cidr.IP) || !cidr.Contains(nextIP(ip))) {
+			continue
+		}
+		if !used[ip.String()] {
+			return ip
+		}
+	}
+	return nil
+}
+
+// nextIP returns the address that follows ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// json returns the Netbox API representation of p.
+func (p *ServerPrefix) json() map[string]interface{} {
+	family := 4
+	if ip, _, err := net.ParseCIDR(p.Prefix); err == nil && ip.To4() == nil {
+		family = 6
+	}
+	return map[string]interface{}{
+		"id":      p.ID,
+		"prefix":  p.Prefix,
+		"family":  map[string]int{"value": family},
+		"is_pool": p.IsPool,
+	}
+}
+
+// sortedIDs returns the keys of prefixes in ascending order.
+func sortedIDs(prefixes map[int]*ServerPrefix) []int {
+	ids := []int{}
+	for id := range prefixes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// create handles address creation.
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	fields := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	address, _ := fields["address"].(string)
+	if _, _, err := net.ParseCIDR(address); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string][]string{"address": {err.Error()}})
+		return
+	}
+
+	addr := &ServerAddress{ID: s.nextID, Address: address, CustomFields: map[string]interface{}{}}
+	s.nextID++
+	addr.update(fields)
+	s.addresses[addr.ID] = addr
+	writeJSON(w, http.StatusCreated, addr.json())
+}
+
+// list handles address queries. It supports the tenant, status,
+// family, and address filters.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	results := []map[string]interface{}{}
+
+	ids := []int{}
+	for id := range s.addresses {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		addr := s.addresses[id]
+		if tenant := query.Get("tenant"); tenant != "" && tenant != addr.Tenant {
+			continue
+		}
+		if status := query.Get("status"); status != "" && status != addr.Status {
+			continue
+		}
+		if family := query.Get("family"); family != "" {
+			ip, _, _ := net.ParseCIDR(addr.Address)
+			if (family == "4") != (ip.To4() != nil) {
+				continue
+			}
+		}
+		if address := query.Get("address"); address != "" {
+			ip, _, _ := net.ParseCIDR(addr.Address)
+			if ip == nil || !ip.Equal(net.ParseIP(address)) {
+				continue
+			}
+		}
+		results = append(results, addr.json())
+	}
+
+	s.writePage(w, r, results)
+}
+
+// writePage writes the page of results that r asks for. Like Netbox,
+// the server supports the limit and offset query parameters and
+// returns a link to the next page, if there is one.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, results []map[string]interface{}) {
+	query := r.URL.Query()
+	limit := s.PageSize
+	if requested, err := strconv.Atoi(query.Get("limit")); err == nil && requested > 0 {
+		limit = requested
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(results) {
+		offset = len(results)
+	}
+
+	end := len(results)
+	var next interface{}
+	if limit > 0 && offset+limit < len(results) {
+		end = offset + limit
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(end))
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		next = fmt.Sprintf("%s://%s%s?%s", scheme, r.Host, r.URL.Path, query.Encode())
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":   len(results),
+		"next":    next,
+		"results": results[offset:end],
+	})
+}
+
+// json returns the Netbox API representation of addr.
+func (addr *ServerAddress) json() map[string]interface{} {
+	rep := map[string]interface{}{
+		"id":            addr.ID,
+		"url":           fmt.Sprintf("/api/ipam/ip-addresses/%d/", addr.ID),
+		"address":       addr.Address,
+		"status":        map[string]string{"value": addr.Status},
+		"tenant":        nil,
+		"description":   addr.Description,
+		"dns_name":      addr.DNSName,
+		"custom_fields": addr.CustomFields,
+	}
+	if addr.Tenant != "" {
+		rep["tenant"] = map[string]interface{}{"slug": addr.Tenant}
+	}
+	return rep
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
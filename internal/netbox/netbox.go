@@ -15,133 +15,827 @@
 package netbox
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+
+	"purelb.io/internal/ipam"
+	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
+// Netbox is the interface to a Netbox IPAM system.
 type Netbox interface {
-	Fetch() (string, error)
+	// Fetch allocates an address in family (nl.FAMILY_V4 or
+	// nl.FAMILY_V6, or 0 for either) to owner. If the fetch is
+	// successful then error will be nil and the returned string will
+	// describe an address in CIDR notation, e.g., "192.168.1.1/32".
+	Fetch(family int, owner Owner) (string, error)
+
+	// SetOwner records in Netbox that owner now uses address, e.g.,
+	// because the service that was using it released it but another
+	// service still shares it.
+	SetOwner(address string, owner Owner) error
+
+	// Release returns address, which was returned by Fetch, to Netbox
+	// and erases its ownership metadata.
+	Release(address string) error
+
+	// Lookup returns Netbox's record of address. If Netbox doesn't
+	// know about the address then the returned Address will be nil.
+	Lookup(address string) (*Address, error)
+
+	// Networks returns the networks that contain the addresses that
+	// we could allocate, i.e., the prefixes from which we allocate, and
+	// a single-address network for each address that Netbox has a
+	// record of for our tenant.
+	Networks() ([]*net.IPNet, error)
+
+	// Claim allocates a specific address to owner. The address must
+	// belong to our tenant and be available, i.e., its status must be
+	// "reserved" or our release status. If we allocate from prefixes
+	// then Claim can also create the address if it's in one of them
+	// and Netbox doesn't have a record of it. If the claim is
+	// successful then the returned string will describe the address
+	// in CIDR notation.
+	Claim(address string, owner Owner) (string, error)
+
+	// Owned returns the addresses that belong to our tenant, are
+	// active, and whose ownership metadata says that we allocated them
+	// to a service in our cluster.
+	Owned() ([]Allocation, error)
+
+	// Capacity returns the number of addresses in family (or in both
+	// families if family is 0) that Fetch can allocate. It's 0 if we
+	// allocate reserved addresses, since there's no fixed limit on how
+	// many can be reserved.
+	Capacity(family int) (uint64, error)
+}
+
+// ReleaseDelete is the release status that tells Netbox.Release to
+// delete addresses instead of changing their status.
+const ReleaseDelete = "delete"
+
+// Config configures a connection to a Netbox system.
+type Config struct {
+	// URL is the base URL of the Netbox system.
+	URL string
+
+	// Tenant is the Netbox tenant slug. We allocate only addresses
+	// that belong to this tenant.
+	Tenant string
+
+	// Token is the Netbox user token that PureLB uses to
+	// authenticate.
+	Token string
+
+	// RootCAs are the CAs that we use to verify Netbox's TLS
+	// certificate. If it's nil then we use the system's CAs.
+	RootCAs *x509.CertPool
+
+	// Prefixes selects the Netbox prefixes from which we allocate
+	// addresses. If it's empty then we allocate addresses that have
+	// been reserved for our tenant instead.
+	Prefixes []PrefixSelector
+
+	// ReleaseStatus is the status to which we set addresses when we
+	// release them, or ReleaseDelete to delete them. If it's empty then
+	// addresses that came from Prefixes are deleted, and reserved
+	// addresses are set back to "reserved", so Fetch can allocate them
+	// again.
+	ReleaseStatus string
+
+	// Cluster identifies this Kubernetes cluster in the ownership
+	// metadata that we write into Netbox. Fetch and Claim can tell that
+	// another allocator claimed a reserved address at the same time as
+	// we did only if the other allocator's Cluster is different.
+	Cluster string
+
+	// CustomFields tells us to write the ownership metadata into the
+	// Netbox custom fields purelb_cluster, purelb_service, and
+	// purelb_allocated_by, which the Netbox administrator must
+	// define, as well as into the description and DNS name.
+	CustomFields bool
+
+	// Timeout is how long we wait for Netbox to respond to each
+	// request. If it's 0 then we wait 5 seconds.
+	Timeout time.Duration
+
+	// OperationTimeout is how long each operation, e.g., Fetch, can
+	// take, including all of its requests and retries. If it's 0 then
+	// operations can take 10 seconds.
+	OperationTimeout time.Duration
+
+	// RetryBackoff is how long we wait before we retry a request that
+	// failed because of a Netbox server error or a network problem. We
+	// double it after each attempt, but we don't retry if the wait
+	// would take the operation past OperationTimeout. If it's 0 then we
+	// wait a quarter of a second.
+	RetryBackoff time.Duration
+}
+
+// PrefixSelector selects Netbox prefixes by their ID, their CIDR,
+// their role slug, or a tag slug. Exactly one field should be set.
+type PrefixSelector struct {
+	ID     int
+	Prefix string
+	Role   string
+	Tag    string
+}
+
+// Owner identifies the service that uses an address.
+type Owner struct {
+	Namespace string
+	Name      string
+}
+
+// Allocation is an address that we allocated, and the service to
+// which we allocated it.
+type Allocation struct {
+	// Address is a bare address, e.g., "192.168.1.1".
+	Address string
+	Owner   Owner
 }
 
 // netbox represents a connection to a
 // [Netbox](https://netbox.readthedocs.io/) IPAM system.
 type netbox struct {
-	http http.Client
-	// The base URL of the Netbox system.
-	base string
-	// The Netbox tenant slug.
-	tenant string
-	// The Netbox user token that PureLB uses to authenticate.
-	token string
+	http   http.Client
+	config Config
+
+	// prefixes caches the prefixes that config.Prefixes selects.
+	prefixLock   sync.Mutex
+	prefixes     []Prefix
+	prefixesAsOf time.Time
 }
 
-type address struct {
-	ID      int
-	Address string
+// prefixCacheTTL is how long we cache the prefixes that our
+// selectors select before we ask Netbox again.
+const prefixCacheTTL = time.Minute
+
+const (
+	addressesPath = "api/ipam/ip-addresses/"
+	prefixesPath  = "api/ipam/prefixes/"
+)
+
+// Address is Netbox's record of an IP address.
+type Address struct {
+	ID          int     `json:"id"`
+	Address     string  `json:"address"`
+	Status      Status  `json:"status"`
+	Tenant      *Tenant `json:"tenant"`
+	Description string  `json:"description"`
 }
-type addressQueryResponse struct {
-	Count   int
-	Results []address
+
+// Status is the status of a Netbox object, e.g., "active".
+type Status struct {
+	Value string `json:"value"`
+}
+
+// Tenant identifies the Netbox tenant that owns an object.
+type Tenant struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+}
+
+// Prefix is Netbox's record of an IP prefix.
+type Prefix struct {
+	ID     int    `json:"id"`
+	Prefix string `json:"prefix"`
+	Family Family `json:"family"`
+	IsPool bool   `json:"is_pool"`
+}
+
+// Family is the address family of a Netbox object, i.e., 4 or 6.
+type Family struct {
+	Value int `json:"value"`
 }
 
 // NewNetbox configures a new connection to a Netbox system.
-func NewNetbox(base string, tenant string, token string) Netbox {
-	return &netbox{http: http.Client{}, base: base, tenant: tenant, token: token}
+func NewNetbox(config Config) Netbox {
+	if config.ReleaseStatus == "" {
+		// If we leave addresses in a prefix then the prefix's
+		// available-ips won't offer them again
+		config.ReleaseStatus = "reserved"
+		if len(config.Prefixes) > 0 {
+			config.ReleaseStatus = ReleaseDelete
+		}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.OperationTimeout == 0 {
+		config.OperationTimeout = defaultOperationTimeout
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	return &netbox{http: newHTTPClient(config.RootCAs), config: config}
 }
 
-func (n *netbox) newRequest(verb string, url string) (*http.Request, error) {
-	req, err := http.NewRequest(verb, n.base+url, nil)
+// addressPath returns the API path of the address whose Netbox ID is
+// id.
+func addressPath(id int) string {
+	return fmt.Sprintf("%s%d/", addressesPath, id)
+}
+
+// fetchAddrs finds out if Netbox has any available addresses. An
+// address is available if it belongs to our tenant, its status
+// matches the status parameter, and it's in family (or family is 0).
+func (n *netbox) fetchAddrs(ctx context.Context, tenant string, status string, family int) ([]Address, error) {
+	query := url.Values{"tenant": []string{tenant}, "status": []string{status}}
+	if family != 0 {
+		query.Set("family", strconv.Itoa(netboxFamily(family)))
+	}
+	addrs, err := n.listAddresses(ctx, "fetch", query)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("Authorization", "Token "+n.token)
-	return req, nil
+	if len(addrs) < 1 {
+		return nil, fmt.Errorf("No addresses available")
+	}
+
+	return addrs, nil
 }
 
-func (n *netbox) newGetRequest(url string) (*http.Request, error) {
-	return n.newRequest(http.MethodGet, url)
+// allocateAddr marks addr, which was available when we listed it, as
+// "in use" by setting its Netbox status to "active", and tells Netbox
+// who's using it.
+//
+// Netbox can't update an address conditionally, and available-ips,
+// which fetchFromPrefixes uses, only creates addresses, so there's no
+// atomic way to claim one that the administrator reserved. Another
+// allocator could claim the same address at the same time and we can
+// only narrow that window, not close it. We check that the address is
+// still available immediately before we update it. Afterwards we wait
+// for as long as our update took, so an update that another allocator
+// sent at about the same time has landed, and check that the address
+// records us as its user. The ownership metadata includes
+// Config.Cluster, which is what makes it ours, since another cluster
+// could have a service with the same name. If either check fails then
+// we return ErrConflict so the caller can try another address, and we
+// leave the address to the allocator whose update won. If the other
+// allocator's update is slower than that then both allocators think
+// that they own the address, so clusters that share a tenant should
+// allocate from prefixes instead.
+func (n *netbox) allocateAddr(ctx context.Context, addr Address, owner Owner) error {
+	current := Address{}
+	if _, err := n.call(ctx, "allocate", http.MethodGet, addressPath(addr.ID), nil, nil, &current); err != nil {
+		return err
+	}
+	if !n.available(current) {
+		conflicts.Inc()
+		return fmt.Errorf("%s is %s: %w", addr.Address, current.Status.Value, ErrConflict)
+	}
+
+	fields := n.ownerFields(&owner)
+	fields["status"] = "active"
+	start := time.Now()
+	if err := n.patchAddr(ctx, addr, fields); err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(time.Since(start)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := n.call(ctx, "allocate", http.MethodGet, addressPath(addr.ID), nil, nil, &current); err != nil {
+		return err
+	}
+	if current.Status.Value != "active" || current.Description != fields["description"] {
+		conflicts.Inc()
+		return fmt.Errorf("%s is now described as %q: %w", addr.Address, current.Description, ErrConflict)
+	}
+	return nil
 }
 
-func (n *netbox) newPatchRequest(url string, body []byte) (*http.Request, error) {
-	req, err := n.newRequest(http.MethodPatch, url)
+// available indicates whether addr is available for us to allocate,
+// i.e., it belongs to our tenant and its status is "reserved" or our
+// release status.
+func (n *netbox) available(addr Address) bool {
+	return addr.Tenant != nil && addr.Tenant.Slug == n.config.Tenant &&
+		(addr.Status.Value == "reserved" || addr.Status.Value == n.config.ReleaseStatus)
+}
+
+// patchAddr sends fields to Netbox in an HTTP PATCH request that
+// updates addr.
+func (n *netbox) patchAddr(ctx context.Context, addr Address, fields map[string]interface{}) error {
+	_, err := n.call(ctx, "update", http.MethodPatch, addressPath(addr.ID), nil, fields, nil)
+	return err
+}
+
+// ownerFields returns the Netbox address fields that describe
+// owner. If owner is nil then the fields erase the description.
+func (n *netbox) ownerFields(owner *Owner) map[string]interface{} {
+	if owner == nil {
+		fields := map[string]interface{}{"description": "", "dns_name": ""}
+		if n.config.CustomFields {
+			fields["custom_fields"] = map[string]interface{}{
+				"purelb_cluster":      nil,
+				"purelb_service":      nil,
+				"purelb_allocated_by": nil,
+			}
+		}
+		return fields
+	}
+
+	service := owner.Namespace + "/" + owner.Name
+	description := fmt.Sprintf("Service %s, allocated by %s", service, purelbv1.Brand)
+	dnsName := owner.Name + "." + owner.Namespace
+	if n.config.Cluster != "" {
+		description = fmt.Sprintf("Service %s in cluster %s, allocated by %s", service, n.config.Cluster, purelbv1.Brand)
+		dnsName += "." + n.config.Cluster
+	}
+
+	fields := map[string]interface{}{"description": description, "dns_name": dnsName}
+	if n.config.CustomFields {
+		fields["custom_fields"] = map[string]interface{}{
+			"purelb_cluster":      n.config.Cluster,
+			"purelb_service":      service,
+			"purelb_allocated_by": purelbv1.Brand,
+		}
+	}
+	return fields
+}
+
+// parseOwner is the inverse of ownerFields: it returns the owner that
+// description names, if it's one that we wrote for a service in our
+// cluster.
+func (n *netbox) parseOwner(description string) (Owner, bool) {
+	prefix, suffix := "Service ", ", allocated by "+purelbv1.Brand
+	if !strings.HasPrefix(description, prefix) || !strings.HasSuffix(description, suffix) {
+		return Owner{}, false
+	}
+	service := strings.TrimSuffix(strings.TrimPrefix(description, prefix), suffix)
+
+	if n.config.Cluster != "" {
+		inCluster := " in cluster " + n.config.Cluster
+		if !strings.HasSuffix(service, inCluster) {
+			return Owner{}, false
+		}
+		service = strings.TrimSuffix(service, inCluster)
+	}
+
+	// Service names can't contain spaces, so if there's one left then
+	// the address belongs to another cluster
+	parts := strings.SplitN(service, "/", 2)
+	if len(parts) != 2 || strings.Contains(service, " ") {
+		return Owner{}, false
+	}
+	return Owner{Namespace: parts[0], Name: parts[1]}, true
+}
+
+// Fetch fetches an address from Netbox and records owner as its
+// user. If the fetch is successful then error will be nil and the
+// returned string will describe an address. If another client claims
+// a reserved address while we're allocating it then we try the next
+// one.
+func (n *netbox) Fetch(family int, owner Owner) (string, error) {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	if len(n.config.Prefixes) > 0 {
+		return n.fetchFromPrefixes(ctx, family, owner)
+	}
+
+	var (
+		ipStatus string = "reserved"
+	)
+
+	// fetch list of addresses
+	addrs, err := n.fetchAddrs(ctx, n.config.Tenant, ipStatus, family)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		err = n.allocateAddr(ctx, addr, owner)
+		if !errors.Is(err, ErrConflict) {
+			return addr.Address, err
+		}
 	}
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
-	return req, nil
+
+	return "", err
 }
 
-// fetchAddrs finds out if Netbox has any available addresses. An
-// address is available if it belongs to our tenant and its status
-// matches the status parameter.
-func (n *netbox) fetchAddrs(tenant string, status string) ([]address, error) {
-	req, err := n.newGetRequest("api/ipam/ip-addresses/")
+// fetchFromPrefixes asks Netbox to create an address in one of our
+// prefixes. We try the prefixes in order until one of them has room.
+// Netbox serializes allocations from available-ips so we don't need
+// to worry about conflicts.
+func (n *netbox) fetchFromPrefixes(ctx context.Context, family int, owner Owner) (string, error) {
+	prefixes, err := n.selectedPrefixes(ctx, family)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	fields := n.ownerFields(&owner)
+	fields["status"] = "active"
+	if n.config.Tenant != "" {
+		fields["tenant"] = map[string]string{"slug": n.config.Tenant}
 	}
-	req.URL.RawQuery = url.Values{"tenant": []string{tenant}, "status": []string{status}}.Encode()
-	resp, err := n.http.Do(req)
+
+	for _, prefix := range prefixes {
+		addr := Address{}
+		status, err := n.call(ctx, "fetch", http.MethodPost, fmt.Sprintf("%s%d/available-ips/", prefixesPath, prefix.ID), nil, fields, &addr)
+		if statusCode(err) == http.StatusConflict || status == http.StatusNoContent {
+			// This prefix is full, so try the next one
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("allocating from prefix %s: %w", prefix.Prefix, err)
+		}
+		return addr.Address, nil
+	}
+
+	return "", fmt.Errorf("No addresses available")
+}
+
+// Capacity returns the number of addresses in the prefixes that we
+// allocate from.
+func (n *netbox) Capacity(family int) (uint64, error) {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	if len(n.config.Prefixes) == 0 {
+		return 0, nil
+	}
+
+	prefixes, err := n.selectedPrefixes(ctx, family)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	var capacity uint64
+	for _, prefix := range prefixes {
+		size := prefixSize(prefix)
+		if capacity+size < capacity {
+			return math.MaxUint64, nil
+		}
+		capacity += size
+	}
+	return capacity, nil
+}
+
+// selectedPrefixes returns the prefixes in family (or all of them if
+// family is 0) that our selectors select. Prefixes don't change often
+// so we cache them for a while.
+func (n *netbox) selectedPrefixes(ctx context.Context, family int) ([]Prefix, error) {
+	n.prefixLock.Lock()
+	defer n.prefixLock.Unlock()
+
+	if n.prefixes == nil || time.Since(n.prefixesAsOf) > prefixCacheTTL {
+		prefixes, err := n.queryPrefixes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		n.prefixes = prefixes
+		n.prefixesAsOf = time.Now()
 	}
-	defer resp.Body.Close()
 
-	// FIXME: Netbox is not good about HTTP response codes.  If our
-	// authn fails then Netbox 302's to a login page even though we
-	// specified that we want a JSON response. We need to treat 302 as
-	// an error.
+	selected := []Prefix{}
+	for _, prefix := range n.prefixes {
+		if family == 0 || prefix.Family.Value == netboxFamily(family) {
+			selected = append(selected, prefix)
+		}
+	}
+	return selected, nil
+}
 
-	var body addressQueryResponse
-	err = json.NewDecoder(resp.Body).Decode(&body)
+// queryPrefixes asks Netbox for the prefixes that our selectors
+// select, in the order of the selectors.
+func (n *netbox) queryPrefixes(ctx context.Context) ([]Prefix, error) {
+	prefixes := []Prefix{}
+	seen := map[int]bool{}
+
+	for _, selector := range n.config.Prefixes {
+		query := url.Values{}
+		switch {
+		case selector.ID != 0:
+			query.Set("id", strconv.Itoa(selector.ID))
+		case selector.Prefix != "":
+			query.Set("prefix", selector.Prefix)
+		case selector.Role != "":
+			query.Set("role", selector.Role)
+		case selector.Tag != "":
+			query.Set("tag", selector.Tag)
+		default:
+			return nil, fmt.Errorf("empty prefix selector")
+		}
+
+		found, err := n.listPrefixes(ctx, "prefixes", query)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range found {
+			if !seen[prefix.ID] {
+				seen[prefix.ID] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+
+	return prefixes, nil
+}
+
+// prefixSize returns the number of addresses that Netbox can
+// allocate from prefix. Like Netbox, we don't count the network and
+// broadcast addresses of IPV4 prefixes that aren't pools.
+func prefixSize(prefix Prefix) uint64 {
+	_, cidr, err := net.ParseCIDR(prefix.Prefix)
 	if err != nil {
-		return nil, err
+		return 0
 	}
-	if body.Count < 1 {
-		return nil, fmt.Errorf("No addresses available")
+	ones, bits := cidr.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64
+	}
+	size := uint64(1) << uint(bits-ones)
+	if bits == 32 && !prefix.IsPool && ones < 31 {
+		size -= 2
 	}
+	return size
+}
 
-	return body.Results, nil
+// netboxFamily converts a netlink address family into a Netbox
+// address family.
+func netboxFamily(family int) int {
+	if family == nl.FAMILY_V6 {
+		return 6
+	}
+	return 4
 }
 
-func (n *netbox) allocateAddr(addr address) error {
-	// mark the address as "in use" by sending an HTTP PATCH request to
-	// set the Netbox address status to "active"
-	url := fmt.Sprintf("api/ipam/ip-addresses/%d/", addr.ID)
-	req, err := n.newPatchRequest(url, []byte("{\"status\": \"active\"}"))
+// SetOwner records in Netbox that owner uses address.
+func (n *netbox) SetOwner(address string, owner Owner) error {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	addr, err := n.ourAddress(ctx, address)
 	if err != nil {
 		return err
 	}
-	resp, err := n.http.Do(req)
+	if addr == nil {
+		return fmt.Errorf("address %s not found in Netbox", address)
+	}
+	return n.patchAddr(ctx, *addr, n.ownerFields(&owner))
+}
+
+// Release returns address to Netbox. Depending on how we were
+// configured we either delete the address or erase its ownership
+// metadata and set its status. It's not an error if Netbox doesn't
+// know about the address, since there's nothing to release.
+func (n *netbox) Release(address string) error {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	addr, err := n.ourAddress(ctx, address)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
+	if addr == nil {
+		return nil
+	}
+
+	if n.config.ReleaseStatus != ReleaseDelete {
+		fields := n.ownerFields(nil)
+		fields["status"] = n.config.ReleaseStatus
+		return n.patchAddr(ctx, *addr, fields)
+	}
 
+	return n.deleteAddr(ctx, *addr)
+}
+
+// deleteAddr deletes addr from Netbox. It's not an error if Netbox
+// has already deleted it.
+func (n *netbox) deleteAddr(ctx context.Context, addr Address) error {
+	_, err := n.call(ctx, "release", http.MethodDelete, addressPath(addr.ID), nil, nil, nil)
+	if statusCode(err) == http.StatusNotFound {
+		return nil
+	}
 	return err
 }
 
-// Fetch fetches an address from Netbox. If the fetch is successful
-// then error will be nil and the returned string will describe an
-// address.
-func (n *netbox) Fetch() (string, error) {
-	var (
-		ipStatus string = "reserved"
-	)
+// Lookup returns Netbox's record of address, which can be a bare
+// address or one in CIDR notation. If our tenant doesn't have the
+// address then the returned Address will be nil.
+func (n *netbox) Lookup(address string) (*Address, error) {
+	ctx, cancel := n.operation()
+	defer cancel()
 
-	// fetch list of addresses
-	addrs, err := n.fetchAddrs(n.tenant, ipStatus)
+	return n.ourAddress(ctx, address)
+}
+
+// ourAddress implements Lookup.
+func (n *netbox) ourAddress(ctx context.Context, address string) (*Address, error) {
+	addrs, err := n.lookup(ctx, address, n.config.Tenant)
+	if err != nil || len(addrs) < 1 {
+		return nil, err
+	}
+	return &addrs[0], nil
+}
+
+// lookup returns Netbox's records of address if it belongs to tenant,
+// or to any tenant if tenant is "". Netbox can have more than one
+// record of an address unless it's configured to enforce uniqueness.
+func (n *netbox) lookup(ctx context.Context, address string, tenant string) ([]Address, error) {
+	ip, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"address": []string{ip.String()}}
+	if tenant != "" {
+		query.Set("tenant", tenant)
+	}
+	return n.listAddresses(ctx, "lookup", query)
+}
+
+// Owned returns the addresses that we've allocated.
+func (n *netbox) Owned() ([]Allocation, error) {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	addrs, err := n.listAddresses(ctx, "owned", url.Values{"tenant": []string{n.config.Tenant}, "status": []string{"active"}})
+	if err != nil {
+		return nil, err
+	}
+
+	owned := []Allocation{}
+	for _, addr := range addrs {
+		owner, ours := n.parseOwner(addr.Description)
+		if !ours {
+			continue
+		}
+		ip, err := parseAddress(addr.Address)
+		if err != nil {
+			return nil, err
+		}
+		owned = append(owned, Allocation{Address: ip.String(), Owner: owner})
+	}
+	return owned, nil
+}
+
+// Networks returns the networks that contain the addresses that we
+// could allocate.
+func (n *netbox) Networks() ([]*net.IPNet, error) {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	networks := []*net.IPNet{}
+	if len(n.config.Prefixes) > 0 {
+		prefixes, err := n.selectedPrefixes(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range prefixes {
+			_, cidr, err := net.ParseCIDR(prefix.Prefix)
+			if err != nil {
+				return nil, fmt.Errorf("Netbox prefix %s invalid: %w", prefix.Prefix, err)
+			}
+			networks = append(networks, cidr)
+		}
+	}
+
+	addrs, err := n.listAddresses(ctx, "networks", url.Values{"tenant": []string{n.config.Tenant}})
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ip, err := parseAddress(addr.Address)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipam.HostNetwork(ip))
+	}
+	return networks, nil
+}
+
+// Claim allocates a specific address to owner.
+func (n *netbox) Claim(address string, owner Owner) (string, error) {
+	ctx, cancel := n.operation()
+	defer cancel()
+
+	// Look the address up regardless of its tenant so we can tell the
+	// user why they can't have it
+	addrs, err := n.lookup(ctx, address, "")
 	if err != nil {
 		return "", err
 	}
 
-	first := addrs[0]
-	err = n.allocateAddr(addrs[0])
+	if len(addrs) < 1 {
+		// Netbox doesn't know about the address, but if it's in one of
+		// our prefixes then we can create it
+		prefix, err := n.containingPrefix(ctx, address)
+		if err != nil {
+			return "", err
+		}
+		if prefix == nil {
+			return "", fmt.Errorf("%s is not in Netbox", address)
+		}
+		return n.createAddr(ctx, address, *prefix, owner)
+	}
+
+	addr := addrs[0]
+	if addr.Tenant == nil || addr.Tenant.Slug != n.config.Tenant {
+		tenant := "no tenant"
+		if addr.Tenant != nil {
+			tenant = "tenant " + addr.Tenant.Slug
+		}
+		return "", fmt.Errorf("%s belongs to %s, not %s", address, tenant, n.config.Tenant)
+	}
+	if !n.available(addr) {
+		return "", fmt.Errorf("%s is %s, not available", address, addr.Status.Value)
+	}
+
+	return addr.Address, n.allocateAddr(ctx, addr, owner)
+}
 
-	return first.Address, err
+// createAddr creates address, which is in prefix, and allocates it to
+// owner. If another client created the same address at the same time
+// then the older record wins, and we delete ours and return
+// ErrConflict.
+func (n *netbox) createAddr(ctx context.Context, address string, prefix Prefix, owner Owner) (string, error) {
+	ip, err := parseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	_, cidr, err := net.ParseCIDR(prefix.Prefix)
+	if err != nil {
+		return "", err
+	}
+	ones, _ := cidr.Mask.Size()
+
+	fields := n.ownerFields(&owner)
+	fields["address"] = fmt.Sprintf("%s/%d", ip, ones)
+	fields["status"] = "active"
+	if n.config.Tenant != "" {
+		fields["tenant"] = map[string]string{"slug": n.config.Tenant}
+	}
+
+	created := Address{}
+	if _, err := n.call(ctx, "create", http.MethodPost, addressesPath, nil, fields, &created); err != nil {
+		return "", err
+	}
+
+	addrs, err := n.lookup(ctx, address, "")
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if addr.ID < created.ID {
+			conflicts.Inc()
+			if err := n.deleteAddr(ctx, created); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%s was created concurrently: %w", address, ErrConflict)
+		}
+	}
+
+	return created.Address, nil
+}
+
+// containingPrefix returns the selected prefix that contains address,
+// or nil if none does.
+func (n *netbox) containingPrefix(ctx context.Context, address string) (*Prefix, error) {
+	if len(n.config.Prefixes) == 0 {
+		return nil, nil
+	}
+
+	ip, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := n.selectedPrefixes(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		if _, cidr, err := net.ParseCIDR(prefix.Prefix); err == nil && cidr.Contains(ip) {
+			return &prefix, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseAddress parses address, which can be either a bare IP address
+// or an address in CIDR notation.
+func parseAddress(address string) (net.IP, error) {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		if ip = net.ParseIP(address); ip == nil {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	return ip, nil
 }
@@ -0,0 +1,511 @@
+// Copyright 2021 Acnodal Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink/nl"
+
+	"purelb.io/internal/ipam"
+	"purelb.io/internal/netbox"
+	"purelb.io/internal/netbox/fake"
+)
+
+func TestFetchRelease(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "reserved", "someone-else")
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token"})
+
+	// Fetch activates our tenant's reserved address
+	addr, err := nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1/32", addr)
+	assert.Equal(t, "active", server.Address("192.168.1.1/32").Status)
+
+	// There's nothing else for us to fetch
+	_, err = nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.Error(t, err)
+
+	// Lookup finds the address by its bare IP or its CIDR
+	found, err := nb.Lookup("192.168.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1/32", found.Address)
+	assert.Equal(t, "active", found.Status.Value)
+	assert.Equal(t, "purelb", found.Tenant.Slug)
+	found, err = nb.Lookup("192.168.1.1/32")
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+
+	// Lookup doesn't find other tenants' addresses
+	found, err = nb.Lookup("192.168.1.2")
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+	_, err = nb.Lookup("not-an-address")
+	assert.Error(t, err)
+
+	// Release sets the address back to reserved so we can fetch it
+	// again
+	assert.NoError(t, nb.Release("192.168.1.1"))
+	assert.Equal(t, "reserved", server.Address("192.168.1.1/32").Status)
+	addr, err = nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1/32", addr)
+
+	// Releasing an address that Netbox doesn't know about is a no-op
+	assert.NoError(t, nb.Release("192.168.1.99"))
+}
+
+func TestReleaseStatus(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "active", "purelb")
+	server.AddAddress("192.168.1.2/32", "active", "purelb")
+
+	// Release can move addresses to a status of the user's choosing
+	assert.NoError(t, netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", ReleaseStatus: "deprecated"}).Release("192.168.1.1"))
+	assert.Equal(t, "deprecated", server.Address("192.168.1.1/32").Status)
+
+	// or delete them
+	assert.NoError(t, netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", ReleaseStatus: netbox.ReleaseDelete}).Release("192.168.1.2"))
+	assert.Nil(t, server.Address("192.168.1.2/32"))
+}
+
+func TestOwnership(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Cluster: "prod", CustomFields: true})
+
+	// Fetch records who's using the address
+	_, err := nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	addr := server.Address("192.168.1.1/32")
+	assert.Equal(t, "Service default/echo in cluster prod, allocated by PureLB", addr.Description)
+	assert.Equal(t, "echo.default.prod", addr.DNSName)
+	assert.Equal(t, map[string]interface{}{
+		"purelb_cluster":      "prod",
+		"purelb_service":      "default/echo",
+		"purelb_allocated_by": "PureLB",
+	}, addr.CustomFields)
+
+	// SetOwner hands the address to someone else
+	assert.NoError(t, nb.SetOwner("192.168.1.1", netbox.Owner{Namespace: "web", Name: "frontend"}))
+	addr = server.Address("192.168.1.1/32")
+	assert.Equal(t, "frontend.web.prod", addr.DNSName)
+	assert.Equal(t, "web/frontend", addr.CustomFields["purelb_service"])
+	assert.Error(t, nb.SetOwner("192.168.1.99", netbox.Owner{Namespace: "web", Name: "frontend"}))
+
+	// Release erases it all
+	assert.NoError(t, nb.Release("192.168.1.1"))
+	addr = server.Address("192.168.1.1/32")
+	assert.Equal(t, "reserved", addr.Status)
+	assert.Empty(t, addr.Description)
+	assert.Empty(t, addr.DNSName)
+	assert.Nil(t, addr.CustomFields["purelb_service"])
+
+	// Without a cluster name or custom fields we describe the service
+	// only
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token"})
+	_, err = nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	addr = server.Address("192.168.1.1/32")
+	assert.Equal(t, "Service default/echo, allocated by PureLB", addr.Description)
+	assert.Equal(t, "echo.default", addr.DNSName)
+	assert.Nil(t, addr.CustomFields["purelb_service"])
+}
+
+func TestOwned(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("2001:db8::1/128", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "active", "purelb").Description = "Service default/echo in cluster test, allocated by PureLB"
+	server.AddAddress("192.168.1.3/32", "active", "purelb").Description = "Service default/echo, allocated by PureLB"
+	server.AddAddress("192.168.1.4/32", "active", "purelb").Description = "Router loopback"
+	server.AddAddress("192.168.1.5/32", "active", "someone-else").Description = "Service default/echo in cluster prod, allocated by PureLB"
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Cluster: "prod"})
+	_, err := nb.Fetch(nl.FAMILY_V4, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	_, err = nb.Fetch(nl.FAMILY_V6, netbox.Owner{Namespace: "web", Name: "frontend"})
+	assert.NoError(t, err)
+
+	// We own only the active addresses that we describe as ours in our
+	// own cluster
+	owned, err := nb.Owned()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []netbox.Allocation{
+		{Address: "192.168.1.1", Owner: netbox.Owner{Namespace: "default", Name: "echo"}},
+		{Address: "2001:db8::1", Owner: netbox.Owner{Namespace: "web", Name: "frontend"}},
+	}, owned)
+
+	// Without a cluster name we own only the addresses that don't name
+	// one
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token"})
+	owned, err = nb.Owned()
+	assert.NoError(t, err)
+	assert.Equal(t, []netbox.Allocation{{Address: "192.168.1.3", Owner: netbox.Owner{Namespace: "default", Name: "echo"}}}, owned)
+}
+
+func TestBackendLookup(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddPrefix("10.0.0.0/24", "loadbalancer", "")
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "active", "purelb").Description = "Service default/echo in cluster prod, allocated by PureLB"
+	server.AddAddress("192.168.1.3/32", "active", "purelb").Description = "Service default/echo in cluster test, allocated by PureLB"
+	server.AddAddress("10.0.0.2/24", "active", "someone-else")
+
+	backend := netbox.NewBackend(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Cluster: "prod", Prefixes: []netbox.PrefixSelector{{Role: "loadbalancer"}}})
+	allocation, err := backend.Lookup("192.168.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, ipam.Allocation{Address: "192.168.1.1"}, allocation, "reserved address")
+	allocation, err = backend.Lookup("192.168.1.2")
+	assert.NoError(t, err)
+	assert.Equal(t, ipam.Allocation{Address: "192.168.1.2", Owner: &ipam.Owner{Namespace: "default", Name: "echo"}}, allocation)
+	allocation, err = backend.Lookup("10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, ipam.Allocation{Address: "10.0.0.1"}, allocation, "prefix address without a record")
+
+	// We can't name the owners of other clusters' and tenants'
+	// addresses
+	_, err = backend.Lookup("192.168.1.3")
+	assert.True(t, errors.Is(err, ipam.ErrUnavailable), "Lookup: %s", err)
+	_, err = backend.Lookup("10.0.0.2")
+	assert.True(t, errors.Is(err, ipam.ErrUnavailable), "Lookup: %s", err)
+
+	_, err = backend.Lookup("172.16.0.1")
+	assert.True(t, errors.Is(err, ipam.ErrNotFound), "Lookup: %s", err)
+}
+
+func TestFetchFromPrefixes(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	small := server.AddPrefix("192.168.1.0/30", "loadbalancer", "")
+	server.AddPrefix("192.168.2.0/29", "", "purelb")
+	server.AddPrefix("2001:db8::/126", "loadbalancer", "")
+	server.AddPrefix("10.0.0.0/24", "", "")
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Prefixes: []netbox.PrefixSelector{
+		{ID: small.ID},
+		{Tag: "purelb"},
+		{Role: "loadbalancer"},
+	}})
+
+	// The first prefix has room for two addresses since Netbox doesn't
+	// allocate its network and broadcast addresses, and when it's full
+	// we move on to the next prefix
+	for _, want := range []string{"192.168.1.1/30", "192.168.1.2/30", "192.168.2.1/29"} {
+		addr, err := nb.Fetch(nl.FAMILY_V4, netbox.Owner{Namespace: "default", Name: "echo"})
+		assert.NoError(t, err)
+		assert.Equal(t, want, addr)
+	}
+	created := server.Address("192.168.1.1/30")
+	assert.Equal(t, "active", created.Status)
+	assert.Equal(t, "purelb", created.Tenant)
+	assert.Equal(t, "echo.default", created.DNSName)
+
+	// We can ask for a specific family
+	addr, err := nb.Fetch(nl.FAMILY_V6, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::/126", addr)
+
+	// Capacity counts the selected prefixes only
+	capacity, err := nb.Capacity(nl.FAMILY_V4)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2+6), capacity)
+	capacity, err = nb.Capacity(nl.FAMILY_V6)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), capacity)
+	capacity, err = nb.Capacity(0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2+6+4), capacity)
+
+	// By default we delete addresses that we allocated from prefixes
+	// when they're released
+	assert.NoError(t, nb.Release("192.168.1.1"))
+	assert.Nil(t, server.Address("192.168.1.1/30"))
+
+	// A prefix selected by its CIDR works too, and when every prefix is
+	// full Fetch fails
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Prefixes: []netbox.PrefixSelector{
+		{Prefix: "192.168.1.0/30"},
+	}})
+	addr, err = nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1/30", addr)
+	_, err = nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.Error(t, err)
+}
+
+func TestClaim(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "active", "purelb")
+	server.AddAddress("192.168.1.3/32", "reserved", "someone-else")
+	server.AddPrefix("10.0.0.0/24", "", "")
+	server.AddAddress("10.0.0.5/24", "reserved", "someone-else")
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token"})
+	owner := netbox.Owner{Namespace: "default", Name: "echo"}
+
+	// We can claim our tenant's reserved addresses only
+	networks, err := nb.Networks()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.1/32", "192.168.1.2/32"}, networkStrings(networks))
+	addr, err := nb.Claim("192.168.1.1", owner)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1/32", addr)
+	assert.Equal(t, "active", server.Address("192.168.1.1/32").Status)
+	assert.Equal(t, "echo.default", server.Address("192.168.1.1/32").DNSName)
+	_, err = nb.Claim("192.168.1.2", owner)
+	assert.Error(t, err, "address in use")
+	_, err = nb.Claim("192.168.1.3", owner)
+	assert.Error(t, err, "other tenant's address")
+	_, err = nb.Claim("192.168.1.4", owner)
+	assert.Error(t, err, "unknown address")
+
+	// If we allocate from prefixes then we can claim addresses that
+	// Netbox doesn't know about yet
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Prefixes: []netbox.PrefixSelector{{Prefix: "10.0.0.0/24"}}})
+	networks, err = nb.Networks()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/24", "192.168.1.1/32", "192.168.1.2/32"}, networkStrings(networks))
+	addr, err = nb.Claim("10.0.0.1", owner)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1/24", addr)
+	assert.Equal(t, "purelb", server.Address("10.0.0.1/24").Tenant)
+	assert.Equal(t, "active", server.Address("10.0.0.1/24").Status)
+	_, err = nb.Claim("10.0.0.5", owner)
+	assert.Error(t, err, "other tenant's address in our prefix")
+}
+
+// conflicts returns the value of the Netbox allocation conflicts
+// counter.
+func conflicts(t *testing.T) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "purelb_netbox_allocation_conflicts_total" {
+			return family.Metric[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestAuthentication(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddPrefix("10.0.0.0/24", "", "")
+
+	// Netbox redirects requests with bad tokens to its login page
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "wrong"})
+	_, err := nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+	assert.True(t, errors.Is(err, netbox.ErrAuthentication), "Fetch: %s", err)
+	_, err = nb.Lookup("192.168.1.1")
+	assert.True(t, errors.Is(err, netbox.ErrAuthentication), "Lookup: %s", err)
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "wrong", Prefixes: []netbox.PrefixSelector{{Prefix: "10.0.0.0/24"}}})
+	_, err = nb.Capacity(0)
+	assert.True(t, errors.Is(err, netbox.ErrAuthentication), "Capacity: %s", err)
+
+	// We don't retry authentication failures
+	assert.Equal(t, 3, server.Requests())
+	assert.Equal(t, "reserved", server.Address("192.168.1.1/32").Status)
+}
+
+func TestRetries(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", RetryBackoff: time.Millisecond})
+
+	// We retry server errors
+	server.FailNext(2, http.StatusServiceUnavailable)
+	found, err := nb.Lookup("192.168.1.1")
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+	assert.Equal(t, 3, server.Requests())
+
+	// but not forever
+	server.FailNext(3, http.StatusInternalServerError)
+	_, err = nb.Lookup("192.168.1.1")
+	nbErr := &netbox.Error{}
+	assert.True(t, errors.As(err, &nbErr))
+	assert.Equal(t, http.StatusInternalServerError, nbErr.StatusCode)
+	assert.Equal(t, 3+3, server.Requests())
+
+	// and we don't retry client errors
+	server.FailNext(1, http.StatusBadRequest)
+	_, err = nb.Lookup("192.168.1.1")
+	assert.Error(t, err)
+	assert.Equal(t, 3+3+1, server.Requests())
+}
+
+func TestTimeout(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.Delay = 100 * time.Millisecond
+
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Timeout: 10 * time.Millisecond, RetryBackoff: time.Millisecond})
+	_, err := nb.Lookup("192.168.1.1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Lookup: %s", err)
+
+	// Retries can't take an operation past its deadline, even if each
+	// attempt is within the request timeout
+	server.Delay = time.Second
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Timeout: 100 * time.Millisecond, OperationTimeout: 150 * time.Millisecond, RetryBackoff: time.Millisecond})
+	start := time.Now()
+	_, err = nb.Lookup("192.168.1.1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Lookup: %s", err)
+	assert.Less(t, int64(time.Since(start)), int64(250*time.Millisecond), "the operation outlived its deadline")
+}
+
+func TestPagination(t *testing.T) {
+	server := fake.NewServer("token")
+	defer server.Close()
+	server.PageSize = 1
+	server.AddPrefix("10.0.0.0/24", "loadbalancer", "")
+	server.AddPrefix("10.0.1.0/24", "loadbalancer", "")
+	server.AddPrefix("10.0.2.0/24", "loadbalancer", "")
+	for i := 1; i <= 3; i++ {
+		server.AddAddress(fmt.Sprintf("192.168.1.%d/32", i), "reserved", "purelb")
+	}
+
+	// We follow the "next" links to find all of the prefixes
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Prefixes: []netbox.PrefixSelector{{Role: "loadbalancer"}}})
+	capacity, err := nb.Capacity(0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3*254), capacity)
+
+	// and all of the reserved addresses
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token"})
+	for i := 1; i <= 3; i++ {
+		addr, err := nb.Fetch(0, netbox.Owner{Namespace: "default", Name: "echo"})
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("192.168.1.%d/32", i), addr)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	owner := netbox.Owner{Namespace: "default", Name: "echo"}
+	before := conflicts(t)
+
+	// Another allocator claims the first reserved address after we
+	// list it but before we update it, so we take the next one
+	server := fake.NewServer("token")
+	first := server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "reserved", "purelb")
+	server.Hook = func(r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == fmt.Sprintf("/api/ipam/ip-addresses/%d/", first.ID) {
+			first.Status = "active"
+		}
+	}
+	nb := netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token"})
+	addr, err := nb.Fetch(0, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.2/32", addr)
+	server.Close()
+
+	// Another cluster's allocator claims the first reserved address for
+	// a service with the same name at the same time that we do, and its
+	// update wins. The cluster names tell the updates apart.
+	server = fake.NewServer("token")
+	first = server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "reserved", "purelb")
+	server.Hook = func(r *http.Request) {
+		if r.Method == http.MethodPatch && r.URL.Path == fmt.Sprintf("/api/ipam/ip-addresses/%d/", first.ID) {
+			// Let our update happen and then overwrite it
+			server.Hook = func(r *http.Request) {
+				first.Description = "Service default/echo in cluster staging, allocated by PureLB"
+				server.Hook = nil
+			}
+		}
+	}
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Cluster: "prod"})
+	addr, err = nb.Fetch(0, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.2/32", addr)
+	assert.Equal(t, "Service default/echo in cluster staging, allocated by PureLB", server.Address("192.168.1.1/32").Description)
+	server.Close()
+
+	// The other allocator's update lands just after ours, so we only
+	// notice it because we give it time to before we check
+	server = fake.NewServer("token")
+	first = server.AddAddress("192.168.1.1/32", "reserved", "purelb")
+	server.AddAddress("192.168.1.2/32", "reserved", "purelb")
+	server.Hook = func(r *http.Request) {
+		if r.Method == http.MethodPatch && r.URL.Path == fmt.Sprintf("/api/ipam/ip-addresses/%d/", first.ID) {
+			time.Sleep(40 * time.Millisecond)
+			patched := time.Now()
+			server.Hook = func(r *http.Request) {
+				if time.Since(patched) >= 20*time.Millisecond {
+					first.Description = "Service default/echo in cluster staging, allocated by PureLB"
+					server.Hook = nil
+				}
+			}
+		}
+	}
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Cluster: "prod"})
+	addr, err = nb.Fetch(0, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.2/32", addr)
+	server.Close()
+
+	// Another allocator creates the address that we asked for at the
+	// same time that we do, so we delete our record of it
+	server = fake.NewServer("token")
+	defer server.Close()
+	server.AddPrefix("10.0.0.0/24", "", "")
+	var theirs *fake.ServerAddress
+	server.Hook = func(r *http.Request) {
+		if r.Method == http.MethodPost {
+			theirs = server.AddAddress("10.0.0.1/24", "active", "purelb")
+			server.Hook = nil
+		}
+	}
+	nb = netbox.NewNetbox(netbox.Config{URL: server.BaseURL(), Tenant: "purelb", Token: "token", Prefixes: []netbox.PrefixSelector{{Prefix: "10.0.0.0/24"}}})
+	_, err = nb.Claim("10.0.0.1", owner)
+	assert.True(t, errors.Is(err, netbox.ErrConflict), "Claim: %s", err)
+	assert.Equal(t, theirs.ID, server.Address("10.0.0.1/24").ID)
+	found, err := nb.Lookup("10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, theirs.ID, found.ID)
+
+	assert.Equal(t, before+4, conflicts(t))
+}
+
+// networkStrings converts networks into strings in CIDR notation.
+func networkStrings(networks []*net.IPNet) []string {
+	strs := []string{}
+	for _, network := range networks {
+		strs = append(strs, network.String())
+	}
+	return strs
+}
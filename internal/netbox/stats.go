@@ -0,0 +1,53 @@
+// Copyright 2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netbox
+
+import (
+	purelbv1 "purelb.io/pkg/apis/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const subsystem = "netbox"
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of Netbox API requests, by operation and HTTP status code",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op", "code"})
+
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "request_errors_total",
+		Help:      "Number of failed Netbox API requests, by operation and reason",
+	}, []string{"op", "reason"})
+
+	conflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "allocation_conflicts_total",
+		Help:      "Number of addresses that another Netbox client claimed while we were allocating them",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(requestErrors)
+	prometheus.MustRegister(conflicts)
+}
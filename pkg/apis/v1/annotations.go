@@ -29,6 +29,28 @@ const (
 	// allocate this service's IP address.
 	DesiredGroupAnnotation string = "purelb.io/service-group"
 
+	// AddressesAnnotation is the key for the annotation that lists the
+	// addresses that the user would like PureLB to allocate to this
+	// service. It's a comma-separated list with at most one address
+	// per family, e.g., "192.168.1.80,fd53:9ef0:8683::80", so it can
+	// pin both addresses of a dual-stack service. If it's set then
+	// spec.loadBalancerIP is ignored. Families that the service uses
+	// but that aren't in the list are allocated from the same pool as
+	// the listed addresses.
+	AddressesAnnotation string = "purelb.io/addresses"
+
+	// NodeSelectorAnnotation is the key for the annotation that limits
+	// the nodes that can announce this service's local addresses. It's
+	// a label selector, e.g., "topology.kubernetes.io/zone=rack1". If
+	// it's set then it overrides the ServiceGroup's NodeSelector.
+	NodeSelectorAnnotation string = "purelb.io/node-selector"
+
+	// ElectionWeightAnnotation is the key for the Node annotation that
+	// biases elections for local addresses. It's a positive integer
+	// and the default is 1. A node with weight 2 wins roughly twice as
+	// many elections as a node with weight 1.
+	ElectionWeightAnnotation string = "purelb.io/election-weight"
+
 	// Annotations that PureLB sets that might be useful to users.
 
 	// BrandAnnotation is the key for the PureLB "brand" annotation.
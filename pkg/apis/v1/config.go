@@ -15,6 +15,10 @@
 
 package v1
 
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
 // Config is a container for our CRDs.  It's used to notify the app
 // when any configuration changes.  When we're notified that any
 // custom resource has changed, we read all of our resources, load
@@ -29,4 +33,7 @@ type Config struct {
 	Groups []*ServiceGroup
 	// Node agent configurations
 	Agents []*LBNodeAgent
+	// Secrets that the Service Groups reference, e.g., for Netbox
+	// credentials
+	Secrets []*corev1.Secret
 }
@@ -15,8 +15,10 @@
 package v1
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/vishvananda/netlink/nl"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -29,6 +31,7 @@ import (
 // service groups. It contains the usual CRD metadata, and the service
 // group spec and status.
 // +kubebuilder:resource:shortName=sg;sgs
+// +kubebuilder:subresource:status
 type ServiceGroup struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -38,16 +41,19 @@ type ServiceGroup struct {
 	Status ServiceGroupStatus `json:"status"`
 }
 
-// ServiceGroupSpec configures the allocator.  It will have one of
-// either a Local configuration (to allocate service addresses from a
-// local pool) or a Netbox configuration (to get addresses from the
-// Netbox IPAM). For examples, see the "config/" directory in the
-// PureLB source tree.
+// ServiceGroupSpec configures the allocator.  It will have one of a
+// Local configuration (to allocate service addresses from a local
+// pool), a Netbox configuration (to get addresses from the Netbox
+// IPAM), or a Webhook configuration (to get addresses from another
+// IPAM through an HTTP API). For examples, see the "config/"
+// directory in the PureLB source tree.
 type ServiceGroupSpec struct {
 	// +optional
 	Local *ServiceGroupLocalSpec `json:"local,omitempty"`
 	// +optional
 	Netbox *ServiceGroupNetboxSpec `json:"netbox,omitempty"`
+	// +optional
+	Webhook *ServiceGroupWebhookSpec `json:"webhook,omitempty"`
 }
 
 // ServiceGroupLocalSpec configures the allocator to manage pools of
@@ -65,6 +71,13 @@ type ServiceGroupSpec struct {
 // V6Pool fields allow you to configure pools of both IPV4 and IPV6
 // addresses to support dual-stack and you can also use them in a
 // single-stack environment.
+//
+// V4Pools and V6Pools allow you to configure more than one range of
+// addresses per family, e.g., if your address space is fragmented
+// into several small blocks. Each range has its own Subnet and
+// Aggregation. They can be combined with V4Pool and V6Pool, in which
+// case the group allocates from all of the ranges. The ranges in a
+// group can't overlap one another.
 type ServiceGroupLocalSpec struct {
 	// +optional
 	Subnet string `json:"subnet"`
@@ -77,14 +90,123 @@ type ServiceGroupLocalSpec struct {
 	V4Pool *ServiceGroupAddressPool `json:"v4pool,omitempty"`
 	// +optional
 	V6Pool *ServiceGroupAddressPool `json:"v6pool,omitempty"`
+
+	// +optional
+	V4Pools []ServiceGroupAddressPool `json:"v4pools,omitempty"`
+	// +optional
+	V6Pools []ServiceGroupAddressPool `json:"v6pools,omitempty"`
+
+	// Exclude lists addresses within this group's pools that the
+	// allocator will never allocate, e.g., gateways or addresses that
+	// are statically assigned to appliances. Each entry can be a single
+	// address, a CIDR, or a from-to range of addresses. A service that
+	// requests an excluded address using spec.loadBalancerIP won't get
+	// it.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// SkipNetworkBroadcast makes the allocator skip the first (network)
+	// and last (broadcast) addresses of IPV4 pools that are specified
+	// using CIDR notation, e.g., 192.168.1.0 and 192.168.1.255 in
+	// 192.168.1.0/24. It has no effect on /31 and /32 pools, or on pools
+	// specified as from-to ranges.
+	// +optional
+	SkipNetworkBroadcast bool `json:"skipNetworkBroadcast,omitempty"`
+
+	// AllocationStrategy determines how the allocator chooses an
+	// address for a service that doesn't ask for a specific one. It
+	// can be "sequential" (the default) which chooses the lowest
+	// available address, "random" which chooses an available address
+	// at random, or "lru" which chooses an address that has never been
+	// used, or failing that, the address that was released longest
+	// ago.
+	// +kubebuilder:validation:Enum=sequential;random;lru
+	// +optional
+	AllocationStrategy string `json:"allocationStrategy,omitempty"`
+
+	// ReleaseCooldown is how long the allocator holds back a released
+	// address before it will allocate it to another service, e.g.,
+	// "5m". This gives ARP caches and DNS TTLs time to expire so
+	// clients of the old service don't reach the new one. The cooldown
+	// doesn't prevent a service from explicitly requesting the address
+	// using spec.loadBalancerIP. The default is no cooldown.
+	// +optional
+	ReleaseCooldown *metav1.Duration `json:"releaseCooldown,omitempty"`
+
+	// NodeSelector limits the nodes that can announce this group's
+	// local addresses to those whose labels match it. Nodes that don't
+	// match don't take part in the election for the address. A
+	// service's NodeSelectorAnnotation overrides it. The default is
+	// every node.
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+}
+
+const (
+	// AllocationSequential is the ServiceGroupLocalSpec
+	// AllocationStrategy that chooses the lowest available address.
+	AllocationSequential string = "sequential"
+
+	// AllocationRandom is the ServiceGroupLocalSpec AllocationStrategy
+	// that chooses an available address at random.
+	AllocationRandom string = "random"
+
+	// AllocationLRU is the ServiceGroupLocalSpec AllocationStrategy
+	// that chooses the least-recently-used available address.
+	AllocationLRU string = "lru"
+)
+
+// FamilyPools returns this Spec's address pools that correspond to
+// family, i.e., V4Pool followed by V4Pools or V6Pool followed by
+// V6Pools. It doesn't include the legacy top-level Pool.
+func (s *ServiceGroupLocalSpec) FamilyPools(family int) []ServiceGroupAddressPool {
+	pools := []ServiceGroupAddressPool{}
+
+	if family == nl.FAMILY_V4 {
+		if s.V4Pool != nil {
+			pools = append(pools, *s.V4Pool)
+		}
+		pools = append(pools, s.V4Pools...)
+	}
+	if family == nl.FAMILY_V6 {
+		if s.V6Pool != nil {
+			pools = append(pools, *s.V6Pool)
+		}
+		pools = append(pools, s.V6Pools...)
+	}
+
+	return pools
+}
+
+// AddressPool returns this Spec's address pool that contains
+// address. If none of the family-specific pools contains it then
+// AddressPool falls back to the legacy top-level Pool.
+func (s *ServiceGroupLocalSpec) AddressPool(address net.IP) (*ServiceGroupAddressPool, error) {
+	for _, pool := range s.FamilyPools(addrFamily(address)) {
+		if poolContains(pool.Pool, address) {
+			return &pool, nil
+		}
+	}
+
+	// If the legacy pool is the same family we can return that
+	ip, _, err := net.ParseCIDR(s.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("no pool contains address %s", address)
+	}
+	if addrFamily(ip) != addrFamily(address) {
+		return nil, fmt.Errorf("no pool contains address %s", address)
+	}
+	return &ServiceGroupAddressPool{Pool: s.Pool, Subnet: s.Subnet, Aggregation: s.Aggregation}, nil
 }
 
 // FamilyAggregation returns this Spec's aggregation value that
-// corresponds to family.
+// corresponds to family. If the Spec has more than one pool in family
+// then it returns the first pool's aggregation, so use AddressPool
+// instead if you have an address.
 func (s *ServiceGroupLocalSpec) FamilyAggregation(family int) (string, error) {
 	if family == nl.FAMILY_V4 {
-		if s.V4Pool != nil {
-			return s.V4Pool.Aggregation, nil
+		if pools := s.FamilyPools(family); len(pools) > 0 {
+			return pools[0].Aggregation, nil
 		} else {
 			// If the legacy pool is V4 we can return that
 			ip, _, err := net.ParseCIDR(s.Subnet)
@@ -98,8 +220,8 @@ func (s *ServiceGroupLocalSpec) FamilyAggregation(family int) (string, error) {
 		}
 	}
 	if family == nl.FAMILY_V6 {
-		if s.V6Pool != nil {
-			return s.V6Pool.Aggregation, nil
+		if pools := s.FamilyPools(family); len(pools) > 0 {
+			return pools[0].Aggregation, nil
 		} else {
 			// If the legacy pool is V6 we can return that
 			ip, _, err := net.ParseCIDR(s.Subnet)
@@ -115,12 +237,14 @@ func (s *ServiceGroupLocalSpec) FamilyAggregation(family int) (string, error) {
 	return "", fmt.Errorf("unable to find aggregation for family %d", family)
 }
 
-// FamilySubnet returns this Spec's subnet value that
-// corresponds to family.
+// FamilySubnet returns this Spec's subnet value that corresponds to
+// family. If the Spec has more than one pool in family then it
+// returns the first pool's subnet, so use AddressPool instead if you
+// have an address.
 func (s *ServiceGroupLocalSpec) FamilySubnet(family int) (string, error) {
 	if family == nl.FAMILY_V4 {
-		if s.V4Pool != nil {
-			return s.V4Pool.Subnet, nil
+		if pools := s.FamilyPools(family); len(pools) > 0 {
+			return pools[0].Subnet, nil
 		} else {
 			// If the legacy pool is V4 we can return that
 			ip, _, err := net.ParseCIDR(s.Subnet)
@@ -134,8 +258,8 @@ func (s *ServiceGroupLocalSpec) FamilySubnet(family int) (string, error) {
 		}
 	}
 	if family == nl.FAMILY_V6 {
-		if s.V6Pool != nil {
-			return s.V6Pool.Subnet, nil
+		if pools := s.FamilyPools(family); len(pools) > 0 {
+			return pools[0].Subnet, nil
 		} else {
 			// If the legacy pool is V6 we can return that
 			ip, _, err := net.ParseCIDR(s.Subnet)
@@ -151,6 +275,27 @@ func (s *ServiceGroupLocalSpec) FamilySubnet(family int) (string, error) {
 	return "", fmt.Errorf("unable to find subnet for family %d", family)
 }
 
+// poolContains indicates whether address is within pool, which can
+// be a CIDR or a from-to range of addresses. It returns false if pool
+// can't be parsed.
+func poolContains(pool string, address net.IP) bool {
+	if strings.Contains(pool, "-") {
+		fromTo := strings.SplitN(pool, "-", 2)
+		from := net.ParseIP(strings.TrimSpace(fromTo[0]))
+		to := net.ParseIP(strings.TrimSpace(fromTo[1]))
+		if from == nil || to == nil {
+			return false
+		}
+		return bytes.Compare(address.To16(), from.To16()) >= 0 && bytes.Compare(address.To16(), to.To16()) <= 0
+	}
+
+	_, cidr, err := net.ParseCIDR(pool)
+	if err != nil {
+		return false
+	}
+	return cidr.Contains(address)
+}
+
 // addrFamily returns whether lbIP is an IPV4 or IPV6 address.  The
 // return value will be nl.FAMILY_V6 if the address is an IPV6
 // address, nl.FAMILY_V4 if it's IPV4, or 0 if the family can't be
@@ -173,6 +318,128 @@ type ServiceGroupNetboxSpec struct {
 	URL         string `json:"url"`
 	Tenant      string `json:"tenant"`
 	Aggregation string `json:"aggregation"`
+
+	// ReleaseStatus is the Netbox status that the allocator sets on an
+	// address when the service that was using it releases it. If it's
+	// "delete" then the allocator deletes the address from Netbox
+	// instead. The default is "reserved", which lets the allocator use
+	// the address again.
+	// +optional
+	ReleaseStatus string `json:"releaseStatus,omitempty"`
+
+	// Cluster identifies this cluster in the ownership metadata that
+	// the allocator writes into Netbox. Each address's description and
+	// DNS name say which service uses it, and in which cluster. It must
+	// be unique among the clusters that allocate from the same Netbox
+	// tenant, since it's how each allocator tells its addresses from
+	// the others', e.g., when two of them claim the same reserved
+	// address at the same time. Groups without a cluster still work,
+	// with the ownership metadata that allocators wrote before this
+	// field existed, but that's deprecated: the allocator can't tell
+	// its addresses from other clusters' so it doesn't release
+	// orphans.
+	// +optional
+	Cluster string `json:"cluster,omitempty"`
+
+	// CustomFields tells the allocator to also write the ownership
+	// metadata into the Netbox custom fields purelb_cluster,
+	// purelb_service, and purelb_allocated_by. The Netbox
+	// administrator must define them before enabling this.
+	// +optional
+	CustomFields bool `json:"customFields,omitempty"`
+
+	// Prefixes are the Netbox prefixes from which the allocator
+	// allocates addresses. If it's empty then the allocator uses
+	// addresses that the Netbox administrator has created and marked
+	// as "reserved" for the tenant. If it's set then the allocator
+	// asks Netbox for the next available address in each prefix, in
+	// order, until one succeeds.
+	// +optional
+	Prefixes []ServiceGroupNetboxPrefix `json:"prefixes,omitempty"`
+
+	// Credentials tells the allocator where to find the credentials
+	// that it uses to connect to Netbox. If it's not set then the
+	// allocator uses the user token in its NETBOX_USER_TOKEN
+	// environment variable.
+	// +optional
+	Credentials *ServiceGroupCredentials `json:"credentials,omitempty"`
+
+	// ReleaseOrphansAfter tells the allocator to release addresses
+	// that Netbox says it allocated but that no Service uses, e.g.,
+	// because the allocator crashed before it could record the address
+	// in the Service, once they've been orphaned for this long, e.g.,
+	// "15m". The allocator checks for orphans when it starts and
+	// periodically after that. If it's not set then the allocator
+	// reports orphans but doesn't release them.
+	// +optional
+	ReleaseOrphansAfter *metav1.Duration `json:"releaseOrphansAfter,omitempty"`
+}
+
+// ServiceGroupCredentials refers to a Secret that holds the
+// credentials of an external IPAM system. The Secret must be in the
+// ServiceGroup's namespace, and the allocator watches Secrets only in
+// its own namespace, so ServiceGroups that use credentials Secrets
+// should be in PureLB's namespace. When the Secret changes the
+// allocator reconnects to the IPAM system using the new credentials.
+type ServiceGroupCredentials struct {
+	// SecretName is the name of the Secret.
+	SecretName string `json:"secretName"`
+
+	// TokenKey is the key of the token in the Secret, i.e., the Netbox
+	// user token or the webhook's bearer token. The default is
+	// "token".
+	// +optional
+	TokenKey string `json:"tokenKey,omitempty"`
+
+	// CAKey is the key of a PEM-encoded CA bundle in the Secret. If
+	// it's set then the allocator uses the bundle to verify the IPAM
+	// system's TLS certificate instead of the system's CAs.
+	// +optional
+	CAKey string `json:"caKey,omitempty"`
+}
+
+// ServiceGroupNetboxPrefix selects Netbox prefixes. Exactly one of
+// its fields must be set. ID and Prefix select a single prefix, and
+// Role and Tag select all of the prefixes with that role or tag. The
+// prefixes can be IPV4 or IPV6.
+type ServiceGroupNetboxPrefix struct {
+	// ID is the Netbox ID of a prefix.
+	// +optional
+	ID int `json:"id,omitempty"`
+
+	// Prefix is a prefix in CIDR notation, e.g., "192.168.1.0/24".
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// Role is the slug of a Netbox prefix role.
+	// +optional
+	Role string `json:"role,omitempty"`
+
+	// Tag is the slug of a Netbox tag.
+	// +optional
+	Tag string `json:"tag,omitempty"`
+}
+
+// ServiceGroupWebhookSpec configures the allocator to request
+// addresses from an external IPAM system through a JSON HTTP API
+// that the user provides. The documentation of the
+// purelb.io/internal/ipam package describes the API.
+type ServiceGroupWebhookSpec struct {
+	// URL is the base URL of the API, e.g.,
+	// "https://ipam.example.com/purelb/". The allocator appends the
+	// names of the operations to it.
+	URL string `json:"url"`
+
+	// Pool is the name of the pool that the allocator sends in each
+	// request. The default is the ServiceGroup's name.
+	// +optional
+	Pool string `json:"pool,omitempty"`
+
+	// Credentials tells the allocator where to find the bearer token
+	// that it sends in each request. If it's not set then the
+	// allocator doesn't authenticate.
+	// +optional
+	Credentials *ServiceGroupCredentials `json:"credentials,omitempty"`
 }
 
 // ServiceGroupAddressPool specifies a pool of addresses that belong
@@ -190,15 +457,72 @@ type ServiceGroupAddressPool struct {
 	Subnet string `json:"subnet"`
 
 	// Aggregation changes the address mask of the allocated address
-	// from the subnet mask to the specified mask. It can be "default"
-	// or an integer in the range 8-128.
+	// from the subnet mask to the specified mask. It can be "default",
+	// which means the subnet mask and is also what an empty value
+	// means, or a mask length like "/24" between "/1" and "/32" for
+	// IPV4 or "/128" for IPV6.
 	Aggregation string `json:"aggregation"`
 }
 
-// ServiceGroupStatus is currently unused.
+// ServiceGroupStatus is the allocator's report on the state of a
+// ServiceGroup. The allocator rewrites it whenever the group's
+// configuration changes and whenever an address is allocated from or
+// released back to the group.
 type ServiceGroupStatus struct {
+	// V4 describes the utilization of the group's IPV4 addresses. It's
+	// nil if the group has no IPV4 addresses.
+	// +optional
+	V4 *ServiceGroupFamilyStatus `json:"v4,omitempty"`
+
+	// V6 describes the utilization of the group's IPV6 addresses. It's
+	// nil if the group has no IPV6 addresses.
+	// +optional
+	V6 *ServiceGroupFamilyStatus `json:"v6,omitempty"`
+
+	// Allocations lists the addresses that have been allocated from
+	// this group and the services that use each of them.
+	// +optional
+	Allocations []ServiceGroupAllocation `json:"allocations,omitempty"`
+
+	// Conditions reports whether the allocator was able to parse and
+	// validate the group's Spec. If it wasn't then the group won't
+	// appear in the allocator's set of pools.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ServiceGroupFamilyStatus describes the utilization of one IP family
+// of a ServiceGroup's addresses.
+type ServiceGroupFamilyStatus struct {
+	// Capacity is the number of addresses in the pool. Pools that are
+	// managed by a remote system (e.g., Netbox) report 0 unless PureLB
+	// allocates from prefixes whose size it knows.
+	Capacity uint64 `json:"capacity"`
+
+	// InUse is the number of addresses that have been allocated to
+	// services.
+	InUse int `json:"inUse"`
+}
+
+// ServiceGroupAllocation describes one allocated address and the
+// services that use it. More than one service can use an address if
+// they share it using the SharingAnnotation.
+type ServiceGroupAllocation struct {
+	// Address is the allocated IP address.
+	Address string `json:"address"`
+
+	// Services are the namespaced names of the services that use
+	// Address, e.g., "default/echoserver".
+	Services []string `json:"services"`
 }
 
+const (
+	// ServiceGroupParsed is the type of the ServiceGroup condition
+	// that indicates whether the allocator was able to parse and
+	// validate the group's Spec.
+	ServiceGroupParsed string = "Parsed"
+)
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
@@ -206,6 +530,7 @@ type ServiceGroupStatus struct {
 // agents. It contains the usual CRD metadata, and the agent spec and
 // status.
 // +kubebuilder:resource:shortName=lbna;lbnas
+// +kubebuilder:subresource:status
 type LBNodeAgent struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -216,10 +541,17 @@ type LBNodeAgent struct {
 }
 
 // LBNodeAgentSpec configures the node agents.  It will have one Local
-// configuration to announce service addresses locally. For examples,
-// see the "config/" directory in the PureLB source tree.
+// configuration to announce service addresses locally, and can have a
+// BGP configuration to announce non-local addresses to routers. For
+// examples, see the "config/" directory in the PureLB source tree.
 type LBNodeAgentSpec struct {
 	Local *LBNodeAgentLocalSpec `json:"local"`
+
+	// BGP configures the agents to advertise routes for non-local
+	// service addresses to BGP peers, so you don't need to run routing
+	// software on each node.
+	// +optional
+	BGP *LBNodeAgentBGPSpec `json:"bgp,omitempty"`
 }
 
 // LBNodeAgentLocalSpec configures the announcers to announce service
@@ -243,10 +575,233 @@ type LBNodeAgentLocalSpec struct {
 	// +kubebuilder:default="kube-lb0"
 	// +optional
 	ExtLBInterface string `json:"extlbint"`
+
+	// GratuitousCount is the number of gratuitous ARPs (IPv4) or
+	// unsolicited neighbor advertisements (IPv6) that the agent sends
+	// when it takes over a local address, so switches and routers
+	// learn the address's new location without waiting for their
+	// caches to expire. 0 disables them. This field is optional and
+	// the default is 3.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	GratuitousCount *int `json:"gratuitousCount,omitempty"`
+
+	// GratuitousInterval is the time between the announcements in a
+	// burst. This field is optional and the default is "1s".
+	// +optional
+	GratuitousInterval *metav1.Duration `json:"gratuitousInterval,omitempty"`
+
+	// NonPreemptive makes local addresses "sticky". A node that's
+	// announcing a local address keeps it until the node fails or
+	// can't announce it anymore, even if another node would win the
+	// address's election, e.g., because the node that used to own the
+	// address has recovered. This avoids a second disruption when a
+	// failed node comes back. This field is optional and the default
+	// is false, which means that the election winner takes the address
+	// after PreemptionDelay.
+	// +optional
+	NonPreemptive bool `json:"nonPreemptive,omitempty"`
+
+	// PreemptionDelay is how long the winner of a local address's
+	// election waits before it takes the address from another node
+	// that's announcing it, e.g., to give a recovered node time to
+	// settle. It's ignored if NonPreemptive is true. This field is
+	// optional and the default is "0s".
+	// +optional
+	PreemptionDelay *metav1.Duration `json:"preemptionDelay,omitempty"`
+}
+
+// LBNodeAgentBGPSpec configures the agents' BGP speakers. Each agent
+// connects to each of the Peers and advertises a route for each
+// non-local service address that it announces, i.e., each address
+// that's not on the same subnet as one of the node's local
+// interfaces. Routes are host routes (/32 or /128) unless the
+// address's pool has an Aggregation, in which case they use the
+// Aggregation's mask. Agents advertise routes for services whose
+// externalTrafficPolicy is Local only if they have a ready endpoint
+// on their node.
+type LBNodeAgentBGPSpec struct {
+	// ASN is the agents' autonomous system number.
+	// +kubebuilder:validation:Minimum=1
+	ASN uint32 `json:"asn"`
+
+	// RouterID is the BGP identifier, an IPv4 address, that the agents
+	// use. This field is optional and by default each agent uses the
+	// IPv4 address from which it connects to each peer. It's required
+	// if any of the peers have IPv6 addresses.
+	// +optional
+	RouterID string `json:"routerID,omitempty"`
+
+	// HoldTime is the BGP hold time that the agents propose to their
+	// peers. This field is optional and the default is "90s".
+	// +optional
+	HoldTime *metav1.Duration `json:"holdTime,omitempty"`
+
+	// Peers are the routers to which the agents connect. The agents
+	// advertise IPv4 routes to IPv4 peers and IPv6 routes to IPv6
+	// peers, with the agent's end of the connection as the next hop.
+	Peers []LBNodeAgentBGPPeer `json:"peers"`
+
+	// Communities are added to every route, e.g., "65000:100" or
+	// "no-export".
+	// +optional
+	Communities []string `json:"communities,omitempty"`
+
+	// ServiceGroups holds additional attributes for routes to the
+	// addresses in specific ServiceGroups.
+	// +optional
+	ServiceGroups []LBNodeAgentBGPRouteAttributes `json:"serviceGroups,omitempty"`
+}
+
+// LBNodeAgentBGPPeer describes one BGP peer.
+type LBNodeAgentBGPPeer struct {
+	// Address is the peer's IP address.
+	Address string `json:"address"`
+
+	// ASN is the peer's autonomous system number. If it's the same as
+	// the agents' ASN then the session is iBGP.
+	// +kubebuilder:validation:Minimum=1
+	ASN uint32 `json:"asn"`
+
+	// Port is the peer's TCP port. This field is optional and the
+	// default is 179.
+	// +optional
+	Port int `json:"port,omitempty"`
+}
+
+// LBNodeAgentBGPRouteAttributes holds BGP attributes for the routes
+// to addresses in one ServiceGroup.
+type LBNodeAgentBGPRouteAttributes struct {
+	// ServiceGroup is the name of the ServiceGroup.
+	ServiceGroup string `json:"serviceGroup"`
+
+	// Communities are added to the routes, in addition to the
+	// LBNodeAgentBGPSpec Communities.
+	// +optional
+	Communities []string `json:"communities,omitempty"`
+
+	// LocalPref is the routes' LOCAL_PREF. It's sent only to iBGP
+	// peers.
+	// +optional
+	LocalPref *uint32 `json:"localPref,omitempty"`
+
+	// MED is the routes' MULTI_EXIT_DISC.
+	// +optional
+	MED *uint32 `json:"med,omitempty"`
 }
 
-// LBNodeAgentStatus is currently unused.
+// LBNodeAgentStatus reports what each node agent is doing. Each node
+// agent owns one entry in Nodes and updates it using server-side
+// apply, so agents on different nodes don't overwrite one another.
 type LBNodeAgentStatus struct {
+	// +listType=map
+	// +listMapKey=node
+	// +optional
+	Nodes []LBNodeAgentNodeStatus `json:"nodes,omitempty"`
+}
+
+// LBNodeAgentNodeStatus describes the state of one node agent.
+type LBNodeAgentNodeStatus struct {
+	// Node is the name of the node on which the agent runs.
+	Node string `json:"node"`
+
+	// LocalInterfaces are the interfaces that the agent considers for
+	// local announcements, i.e., the interfaces that carry the default
+	// routes or whose names match the LBNodeAgent's localint regex.
+	// +optional
+	LocalInterfaces []string `json:"localInterfaces,omitempty"`
+
+	// DummyInterface describes the interface to which the agent adds
+	// non-local addresses, i.e., kube-lb0 by default.
+	// +optional
+	DummyInterface *LBNodeAgentInterfaceStatus `json:"dummyInterface,omitempty"`
+
+	// Announcements lists the addresses that this node is currently
+	// announcing.
+	// +optional
+	Announcements []LBNodeAgentAnnouncement `json:"announcements,omitempty"`
+
+	// Members are the names of the nodes that this node sees in the
+	// memberlist, i.e., the candidates in local address elections.
+	// +optional
+	Members []string `json:"members,omitempty"`
+
+	// Errors lists the services that this node failed to announce,
+	// and why.
+	// +optional
+	Errors []LBNodeAgentAnnounceError `json:"errors,omitempty"`
+
+	// BGPPeers describes this node's BGP sessions.
+	// +optional
+	BGPPeers []LBNodeAgentBGPPeerStatus `json:"bgpPeers,omitempty"`
+
+	// LastUpdateTime is the time at which the agent last changed this
+	// entry.
+	// +optional
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// LBNodeAgentInterfaceStatus describes one network interface.
+type LBNodeAgentInterfaceStatus struct {
+	Name string `json:"name"`
+
+	// Up is true if the interface exists and is administratively up.
+	Up bool `json:"up"`
+}
+
+const (
+	// AnnouncementLocal is the LBNodeAgentAnnouncement Type of
+	// addresses that are on the same subnet as a node interface. The
+	// node announces them by responding to ARP/ND requests.
+	AnnouncementLocal string = "local"
+
+	// AnnouncementRemote is the LBNodeAgentAnnouncement Type of
+	// addresses that are not on any node subnet. The node adds them to
+	// the dummy interface so routing software can announce them.
+	AnnouncementRemote string = "remote"
+)
+
+// LBNodeAgentAnnouncement describes one address that a node is
+// announcing.
+type LBNodeAgentAnnouncement struct {
+	Address string `json:"address"`
+
+	// Services are the namespaced names of the services that use
+	// Address.
+	Services []string `json:"services"`
+
+	// Interface is the name of the interface to which the agent added
+	// Address.
+	Interface string `json:"interface"`
+
+	// Type is either AnnouncementLocal or AnnouncementRemote.
+	Type string `json:"type"`
+}
+
+// LBNodeAgentBGPPeerStatus describes one BGP session.
+type LBNodeAgentBGPPeerStatus struct {
+	// Address is the peer's address.
+	Address string `json:"address"`
+
+	// State is the session's state, e.g., "Established".
+	State string `json:"state"`
+
+	// Routes is the number of routes that this node is advertising to
+	// the peer.
+	Routes int `json:"routes"`
+
+	// Error describes why the session most recently failed.
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// LBNodeAgentAnnounceError describes a failure to announce a
+// service.
+type LBNodeAgentAnnounceError struct {
+	// Service is the namespaced name of the service.
+	Service string `json:"service"`
+
+	Message string `json:"message"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
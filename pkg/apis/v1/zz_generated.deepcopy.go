@@ -19,6 +19,8 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -47,6 +49,17 @@ func (in *Config) DeepCopyInto(out *Config) {
 			}
 		}
 	}
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = make([]*corev1.Secret, len(*in))
+		for i := range *in {
+			if (*in)[i] != nil {
+				in, out := &(*in)[i], &(*out)[i]
+				*out = new(corev1.Secret)
+				(*in).DeepCopyInto(*out)
+			}
+		}
+	}
 	return
 }
 
@@ -66,10 +79,47 @@ func (in *LBNodeAgent) DeepCopyInto(out *LBNodeAgent) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentAnnounceError) DeepCopyInto(out *LBNodeAgentAnnounceError) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentAnnounceError.
+func (in *LBNodeAgentAnnounceError) DeepCopy() *LBNodeAgentAnnounceError {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentAnnounceError)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentAnnouncement) DeepCopyInto(out *LBNodeAgentAnnouncement) {
+	*out = *in
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentAnnouncement.
+func (in *LBNodeAgentAnnouncement) DeepCopy() *LBNodeAgentAnnouncement {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentAnnouncement)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgent.
 func (in *LBNodeAgent) DeepCopy() *LBNodeAgent {
 	if in == nil {
@@ -88,6 +138,123 @@ func (in *LBNodeAgent) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentBGPPeer) DeepCopyInto(out *LBNodeAgentBGPPeer) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentBGPPeer.
+func (in *LBNodeAgentBGPPeer) DeepCopy() *LBNodeAgentBGPPeer {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentBGPPeer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentBGPPeerStatus) DeepCopyInto(out *LBNodeAgentBGPPeerStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentBGPPeerStatus.
+func (in *LBNodeAgentBGPPeerStatus) DeepCopy() *LBNodeAgentBGPPeerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentBGPPeerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentBGPRouteAttributes) DeepCopyInto(out *LBNodeAgentBGPRouteAttributes) {
+	*out = *in
+	if in.Communities != nil {
+		in, out := &in.Communities, &out.Communities
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LocalPref != nil {
+		in, out := &in.LocalPref, &out.LocalPref
+		*out = new(uint32)
+		**out = **in
+	}
+	if in.MED != nil {
+		in, out := &in.MED, &out.MED
+		*out = new(uint32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentBGPRouteAttributes.
+func (in *LBNodeAgentBGPRouteAttributes) DeepCopy() *LBNodeAgentBGPRouteAttributes {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentBGPRouteAttributes)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentBGPSpec) DeepCopyInto(out *LBNodeAgentBGPSpec) {
+	*out = *in
+	if in.HoldTime != nil {
+		in, out := &in.HoldTime, &out.HoldTime
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.Peers != nil {
+		in, out := &in.Peers, &out.Peers
+		*out = make([]LBNodeAgentBGPPeer, len(*in))
+		copy(*out, *in)
+	}
+	if in.Communities != nil {
+		in, out := &in.Communities, &out.Communities
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ServiceGroups != nil {
+		in, out := &in.ServiceGroups, &out.ServiceGroups
+		*out = make([]LBNodeAgentBGPRouteAttributes, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentBGPSpec.
+func (in *LBNodeAgentBGPSpec) DeepCopy() *LBNodeAgentBGPSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentBGPSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentInterfaceStatus) DeepCopyInto(out *LBNodeAgentInterfaceStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentInterfaceStatus.
+func (in *LBNodeAgentInterfaceStatus) DeepCopy() *LBNodeAgentInterfaceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentInterfaceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LBNodeAgentList) DeepCopyInto(out *LBNodeAgentList) {
 	*out = *in
@@ -124,6 +291,21 @@ func (in *LBNodeAgentList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LBNodeAgentLocalSpec) DeepCopyInto(out *LBNodeAgentLocalSpec) {
 	*out = *in
+	if in.GratuitousCount != nil {
+		in, out := &in.GratuitousCount, &out.GratuitousCount
+		*out = new(int)
+		**out = **in
+	}
+	if in.GratuitousInterval != nil {
+		in, out := &in.GratuitousInterval, &out.GratuitousInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.PreemptionDelay != nil {
+		in, out := &in.PreemptionDelay, &out.PreemptionDelay
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 	return
 }
 
@@ -137,13 +319,67 @@ func (in *LBNodeAgentLocalSpec) DeepCopy() *LBNodeAgentLocalSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LBNodeAgentNodeStatus) DeepCopyInto(out *LBNodeAgentNodeStatus) {
+	*out = *in
+	if in.LocalInterfaces != nil {
+		in, out := &in.LocalInterfaces, &out.LocalInterfaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DummyInterface != nil {
+		in, out := &in.DummyInterface, &out.DummyInterface
+		*out = new(LBNodeAgentInterfaceStatus)
+		**out = **in
+	}
+	if in.Announcements != nil {
+		in, out := &in.Announcements, &out.Announcements
+		*out = make([]LBNodeAgentAnnouncement, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Members != nil {
+		in, out := &in.Members, &out.Members
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Errors != nil {
+		in, out := &in.Errors, &out.Errors
+		*out = make([]LBNodeAgentAnnounceError, len(*in))
+		copy(*out, *in)
+	}
+	if in.BGPPeers != nil {
+		in, out := &in.BGPPeers, &out.BGPPeers
+		*out = make([]LBNodeAgentBGPPeerStatus, len(*in))
+		copy(*out, *in)
+	}
+	in.LastUpdateTime.DeepCopyInto(&out.LastUpdateTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LBNodeAgentNodeStatus.
+func (in *LBNodeAgentNodeStatus) DeepCopy() *LBNodeAgentNodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(LBNodeAgentNodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LBNodeAgentSpec) DeepCopyInto(out *LBNodeAgentSpec) {
 	*out = *in
 	if in.Local != nil {
 		in, out := &in.Local, &out.Local
 		*out = new(LBNodeAgentLocalSpec)
-		**out = **in
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BGP != nil {
+		in, out := &in.BGP, &out.BGP
+		*out = new(LBNodeAgentBGPSpec)
+		(*in).DeepCopyInto(*out)
 	}
 	return
 }
@@ -161,6 +397,13 @@ func (in *LBNodeAgentSpec) DeepCopy() *LBNodeAgentSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LBNodeAgentStatus) DeepCopyInto(out *LBNodeAgentStatus) {
 	*out = *in
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]LBNodeAgentNodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -180,7 +423,7 @@ func (in *ServiceGroup) DeepCopyInto(out *ServiceGroup) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -218,6 +461,59 @@ func (in *ServiceGroupAddressPool) DeepCopy() *ServiceGroupAddressPool {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceGroupAllocation) DeepCopyInto(out *ServiceGroupAllocation) {
+	*out = *in
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceGroupAllocation.
+func (in *ServiceGroupAllocation) DeepCopy() *ServiceGroupAllocation {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceGroupAllocation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceGroupCredentials) DeepCopyInto(out *ServiceGroupCredentials) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceGroupCredentials.
+func (in *ServiceGroupCredentials) DeepCopy() *ServiceGroupCredentials {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceGroupCredentials)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceGroupFamilyStatus) DeepCopyInto(out *ServiceGroupFamilyStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceGroupFamilyStatus.
+func (in *ServiceGroupFamilyStatus) DeepCopy() *ServiceGroupFamilyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceGroupFamilyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceGroupList) DeepCopyInto(out *ServiceGroupList) {
 	*out = *in
@@ -264,6 +560,31 @@ func (in *ServiceGroupLocalSpec) DeepCopyInto(out *ServiceGroupLocalSpec) {
 		*out = new(ServiceGroupAddressPool)
 		**out = **in
 	}
+	if in.V4Pools != nil {
+		in, out := &in.V4Pools, &out.V4Pools
+		*out = make([]ServiceGroupAddressPool, len(*in))
+		copy(*out, *in)
+	}
+	if in.V6Pools != nil {
+		in, out := &in.V6Pools, &out.V6Pools
+		*out = make([]ServiceGroupAddressPool, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ReleaseCooldown != nil {
+		in, out := &in.ReleaseCooldown, &out.ReleaseCooldown
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -277,9 +598,40 @@ func (in *ServiceGroupLocalSpec) DeepCopy() *ServiceGroupLocalSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceGroupNetboxPrefix) DeepCopyInto(out *ServiceGroupNetboxPrefix) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceGroupNetboxPrefix.
+func (in *ServiceGroupNetboxPrefix) DeepCopy() *ServiceGroupNetboxPrefix {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceGroupNetboxPrefix)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceGroupNetboxSpec) DeepCopyInto(out *ServiceGroupNetboxSpec) {
 	*out = *in
+	if in.Prefixes != nil {
+		in, out := &in.Prefixes, &out.Prefixes
+		*out = make([]ServiceGroupNetboxPrefix, len(*in))
+		copy(*out, *in)
+	}
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(ServiceGroupCredentials)
+		**out = **in
+	}
+	if in.ReleaseOrphansAfter != nil {
+		in, out := &in.ReleaseOrphansAfter, &out.ReleaseOrphansAfter
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 	return
 }
 
@@ -304,7 +656,12 @@ func (in *ServiceGroupSpec) DeepCopyInto(out *ServiceGroupSpec) {
 	if in.Netbox != nil {
 		in, out := &in.Netbox, &out.Netbox
 		*out = new(ServiceGroupNetboxSpec)
-		**out = **in
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Webhook != nil {
+		in, out := &in.Webhook, &out.Webhook
+		*out = new(ServiceGroupWebhookSpec)
+		(*in).DeepCopyInto(*out)
 	}
 	return
 }
@@ -322,6 +679,30 @@ func (in *ServiceGroupSpec) DeepCopy() *ServiceGroupSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceGroupStatus) DeepCopyInto(out *ServiceGroupStatus) {
 	*out = *in
+	if in.V4 != nil {
+		in, out := &in.V4, &out.V4
+		*out = new(ServiceGroupFamilyStatus)
+		**out = **in
+	}
+	if in.V6 != nil {
+		in, out := &in.V6, &out.V6
+		*out = new(ServiceGroupFamilyStatus)
+		**out = **in
+	}
+	if in.Allocations != nil {
+		in, out := &in.Allocations, &out.Allocations
+		*out = make([]ServiceGroupAllocation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -334,3 +715,24 @@ func (in *ServiceGroupStatus) DeepCopy() *ServiceGroupStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceGroupWebhookSpec) DeepCopyInto(out *ServiceGroupWebhookSpec) {
+	*out = *in
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(ServiceGroupCredentials)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceGroupWebhookSpec.
+func (in *ServiceGroupWebhookSpec) DeepCopy() *ServiceGroupWebhookSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceGroupWebhookSpec)
+	in.DeepCopyInto(out)
+	return out
+}